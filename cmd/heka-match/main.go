@@ -0,0 +1,227 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+/*
+
+A command-line utility for testing a message_matcher expression against Heka
+protobuf logs or buffer queues, explaining why each message matched or not.
+
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"heka/message"
+	"heka/pipeline"
+)
+
+// Returns the files to read for the path, the queue files in the order they
+// are written when it's a buffer queue directory.
+func inputFiles(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{path}, nil
+	}
+	matches, err := filepath.Glob(filepath.Join(path, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]uint, len(matches))
+	files := matches[:0]
+	for _, f := range matches {
+		name := strings.TrimSuffix(filepath.Base(f), ".log")
+		id, err := strconv.ParseUint(name, 10, 0)
+		if err != nil {
+			continue
+		}
+		ids[f] = uint(id)
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no queue files found in %s", path)
+	}
+	sort.Slice(files, func(i, j int) bool { return ids[files[i]] < ids[files[j]] })
+	return files, nil
+}
+
+// How often a test decided the result of the match.
+type testStats struct {
+	test            string
+	matched, failed int64
+}
+
+type matchStats struct {
+	processed, matched int64
+	tests              []*testStats
+	byTest             map[string]*testStats
+}
+
+func (s *matchStats) add(e message.MatchExplanation) {
+	s.processed++
+	if e.Matched {
+		s.matched++
+	}
+	for _, d := range e.Deciders {
+		ts, ok := s.byTest[d.Test]
+		if !ok {
+			ts = &testStats{test: d.Test}
+			s.byTest[d.Test] = ts
+			s.tests = append(s.tests, ts)
+		}
+		if e.Matched {
+			ts.matched++
+		} else {
+			ts.failed++
+		}
+	}
+}
+
+func (s *matchStats) print(out io.Writer) {
+	var rate float64
+	if s.processed > 0 {
+		rate = float64(s.matched) * 100 / float64(s.processed)
+	}
+	fmt.Fprintf(out, "Processed: %d, matched: %d messages (%.1f%%)\n", s.processed,
+		s.matched, rate)
+	if len(s.tests) == 0 {
+		return
+	}
+	fmt.Fprintf(out, "Deciding tests:\n%10s %10s  %s\n", "matched", "failed", "test")
+	for _, ts := range s.tests {
+		fmt.Fprintf(out, "%10d %10d  %s\n", ts.matched, ts.failed, ts.test)
+	}
+}
+
+func printExplanation(out io.Writer, location string, e message.MatchExplanation) {
+	result := "no match"
+	if e.Matched {
+		result = "match"
+	}
+	fmt.Fprintf(out, "%s: %s\n", location, result)
+	for _, d := range e.Deciders {
+		fmt.Fprintf(out, "    %-5t  %s", d.Result, d.Test)
+		if d.Field != "" {
+			fmt.Fprintf(out, "  [%s = %s]", d.Field, d.Value)
+		}
+		fmt.Fprintln(out)
+	}
+}
+
+func main() {
+	flagMatch := flag.String("match", "", "message_matcher expression to test")
+	flagOffset := flag.Int64("offset", 0, "starting offset for a single input file in bytes")
+	flagMaxMessageSize := flag.Uint64("max-message-size", 4*1024*1024, "maximum message size in bytes")
+	flagSummary := flag.Bool("summary", false, "only output the summary")
+	flagFailed := flag.Bool("failed", false, "only explain the messages that didn't match")
+	flagCount := flag.Int64("count", 0, "maximum number of messages to read, 0 reads them all")
+	flag.Parse()
+
+	if flag.NArg() != 1 || *flagMatch == "" {
+		fmt.Fprintf(os.Stderr, "Usage: %s -match <expression> [options] <file or queue directory>\n",
+			os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if *flagMaxMessageSize < math.MaxUint32 {
+		maxSize := uint32(*flagMaxMessageSize)
+		message.SetMaxMessageSize(maxSize)
+	} else {
+		fmt.Fprintf(os.Stderr, "Message size is too large: %d\n", *flagMaxMessageSize)
+		os.Exit(8)
+	}
+
+	var err error
+	var match *message.MatcherSpecification
+	if match, err = message.CreateMatcherSpecification(*flagMatch); err != nil {
+		fmt.Fprintf(os.Stderr, "Match specification - %s\n", err)
+		os.Exit(2)
+	}
+
+	files, err := inputFiles(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(3)
+	}
+	if *flagOffset != 0 && len(files) > 1 {
+		fmt.Fprintln(os.Stderr, "An offset can only be used with a single input file")
+		os.Exit(1)
+	}
+
+	out := os.Stdout
+	msg := new(message.Message)
+	stats := &matchStats{byTest: make(map[string]*testStats)}
+
+	for _, name := range files {
+		var file *os.File
+		if file, err = os.Open(name); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(3)
+		}
+
+		var offset int64
+		if offset, err = file.Seek(*flagOffset, 0); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(5)
+		}
+
+		// Reads both protobuf streams and queue files, which may be
+		// compressed.
+		records := pipeline.NewQueueFileReader(file, offset)
+		for *flagCount == 0 || stats.processed < *flagCount {
+			record, _, err := records.Next()
+			if err != nil {
+				if err != io.EOF {
+					fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+				}
+				break
+			}
+			offset = records.RecordOffset()
+			headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
+			if err = proto.Unmarshal(record[headerLen:], msg); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: error unmarshalling message at offset: %d error: %s\n",
+					name, offset, err)
+				continue
+			}
+			e := match.Explain(msg)
+			stats.add(e)
+			if !*flagSummary && !(*flagFailed && e.Matched) {
+				printExplanation(out, fmt.Sprintf("%s:%d", name, offset), e)
+			}
+		}
+		if corrupt, size := records.Corrupt(); corrupt > 0 {
+			fmt.Fprintf(os.Stderr, "%s: skipped %d corrupt records, %d bytes\n", name,
+				corrupt, size)
+		}
+		file.Close()
+	}
+
+	if !*flagSummary {
+		fmt.Fprintln(out)
+	}
+	stats.print(out)
+}
@@ -0,0 +1,387 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+/*
+
+A command-line utility for inspecting, dumping and re-driving the buffer
+queues of filters and outputs. Heka should be stopped, or the plugin owning
+the queue disabled, before the queue is modified.
+
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"heka/client"
+	"heka/message"
+	"heka/pipeline"
+)
+
+// Returns the queue directories found at path, path itself when it's a
+// queue or the queues it holds, e.g. for a base_dir/output_queue directory.
+func queueDirs(path string) ([]string, error) {
+	if isQueue(path) {
+		return []string{path}, nil
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var queues []string
+	for _, fi := range entries {
+		dir := filepath.Join(path, fi.Name())
+		if fi.IsDir() && isQueue(dir) {
+			queues = append(queues, dir)
+		}
+	}
+	if len(queues) == 0 {
+		return nil, fmt.Errorf("no queues found in %s", path)
+	}
+	return queues, nil
+}
+
+func isQueue(dir string) bool {
+	if len(pipeline.QueueFileIds(dir)) > 0 {
+		return true
+	}
+	_, _, err := pipeline.ReadQueueCheckpoint(dir)
+	return err == nil
+}
+
+func fileSize(filename string) int64 {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// Prints the files of a queue, its checkpoint and the number of bytes left
+// to read from it.
+func listQueue(out io.Writer, queue string) {
+	ids := pipeline.QueueFileIds(queue)
+	sizes := make([]int64, len(ids))
+	var total int64
+	for i, id := range ids {
+		sizes[i] = fileSize(pipeline.QueueFilename(queue, id))
+		total += sizes[i]
+	}
+	fmt.Fprintf(out, "Queue: %s\n", queue)
+	fmt.Fprintf(out, "  Files: %d, size: %d B\n", len(ids), total)
+	for i, id := range ids {
+		fmt.Fprintf(out, "    %12s %12d\n", filepath.Base(pipeline.QueueFilename(queue, id)),
+			sizes[i])
+	}
+
+	cpId, cpOffset, err := pipeline.ReadQueueCheckpoint(queue)
+	switch {
+	case err == nil:
+		fmt.Fprintf(out, "  Checkpoint: %d %d\n", cpId, cpOffset)
+	case os.IsNotExist(err):
+		fmt.Fprintln(out, "  Checkpoint: none, reading starts at the oldest file")
+		if len(ids) > 0 {
+			cpId = ids[0]
+		}
+	default:
+		fmt.Fprintf(out, "  Checkpoint: %s\n", err)
+		return
+	}
+	var lag int64
+	for i, id := range ids {
+		switch {
+		case id > cpId:
+			lag += sizes[i]
+		case id == cpId && sizes[i] > cpOffset:
+			lag += sizes[i] - cpOffset
+		}
+	}
+	fmt.Fprintf(out, "  Lag: %d B\n", lag)
+}
+
+func printMessage(out io.Writer, format, cursor string, msg *message.Message) {
+	switch format {
+	case "count":
+		// no op
+	case "json":
+		contents, _ := json.Marshal(msg)
+		fmt.Fprintf(out, "%s\n", contents)
+	default:
+		fmt.Fprintf(out, "Cursor: %s\n"+
+			"Timestamp: %s\n"+
+			"Type: %s\n"+
+			"Hostname: %s\n"+
+			"Pid: %d\n"+
+			"UUID: %s\n"+
+			"Logger: %s\n"+
+			"Payload: %s\n"+
+			"EnvVersion: %s\n"+
+			"Severity: %d\n"+
+			"Fields: %+v\n\n",
+			cursor, time.Unix(0, msg.GetTimestamp()), msg.GetType(),
+			msg.GetHostname(), msg.GetPid(), msg.GetUuidString(),
+			msg.GetLogger(), msg.GetPayload(), msg.GetEnvVersion(),
+			msg.GetSeverity(), msg.Fields)
+	}
+}
+
+// Reads the queue from its checkpoint, calling process with every message
+// matching the spec until it returns false, the queue ends or count messages
+// matched. Returns the number of messages read and matched.
+func readQueue(reader *pipeline.BufferReader, match *message.MatcherSpecification,
+	count int64, process func(pack *pipeline.PipelinePack) bool) (processed,
+	matched int64, err error) {
+
+	pack := pipeline.NewPipelinePack(nil)
+	for count == 0 || matched < count {
+		if err = reader.NextRecord(pack); err != nil {
+			if err == pipeline.QueueNoRecord {
+				err = nil
+			}
+			break
+		}
+		processed++
+		if !match.Match(pack.Message) {
+			continue
+		}
+		matched++
+		if !process(pack) {
+			break
+		}
+	}
+	if records, bytes := reader.CorruptCounts(); records > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped %d corrupt records, %d bytes\n", records, bytes)
+	}
+	return processed, matched, err
+}
+
+// Returns the cursor a -cursor setting stands for.
+func seekCursor(queue, setting string) (string, error) {
+	ids := pipeline.QueueFileIds(queue)
+	switch setting {
+	case "start", "end":
+		if len(ids) == 0 {
+			return "", fmt.Errorf("queue %s has no files", queue)
+		}
+		if setting == "start" {
+			return fmt.Sprintf("%d 0", ids[0]), nil
+		}
+		last := ids[len(ids)-1]
+		return fmt.Sprintf("%d %d", last, fileSize(pipeline.QueueFilename(queue, last))), nil
+	}
+	id, offset, err := pipeline.ParseQueueCursor(setting)
+	if err != nil {
+		return "", fmt.Errorf("invalid cursor '%s': %s", setting, err)
+	}
+	fi, err := os.Stat(pipeline.QueueFilename(queue, id))
+	if err != nil {
+		return "", err
+	}
+	if offset < 0 || offset > fi.Size() {
+		return "", fmt.Errorf("offset %d is past the end of queue file %d", offset, id)
+	}
+	return setting, nil
+}
+
+func main() {
+	flagAction := flag.String("action", "list", "queue action: list, dump, seek, truncate, copy or replay")
+	flagMatch := flag.String("match", "TRUE", "message_matcher filter expression (dump, seek, copy and replay)")
+	flagFormat := flag.String("format", "txt", "dump output format [txt|json|count]")
+	flagCount := flag.Int64("count", 0, "maximum number of matching messages to dump, copy or replay, 0 for all")
+	flagCursor := flag.String("cursor", "", "seek: new checkpoint, 'start', 'end' or '<file id> <offset>'")
+	flagSkip := flag.Int64("skip", 0, "seek: number of matching messages to move the checkpoint past")
+	flagDest := flag.String("dest", "", "copy: queue directory the messages are copied to")
+	flagCompression := flag.String("compression", "none", "copy: compression of the copied messages [none|snappy|zstd]")
+	flagAddress := flag.String("address", "", "replay: address of the TcpInput the messages are sent to")
+	flagMaxMessageSize := flag.Uint64("max-message-size", 4*1024*1024, "maximum message size in bytes")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <queue directory>\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	path := flag.Arg(0)
+
+	if *flagMaxMessageSize < math.MaxUint32 {
+		maxSize := uint32(*flagMaxMessageSize)
+		message.SetMaxMessageSize(maxSize)
+	} else {
+		fmt.Fprintf(os.Stderr, "Message size is too large: %d\n", *flagMaxMessageSize)
+		os.Exit(8)
+	}
+
+	var err error
+	var match *message.MatcherSpecification
+	if match, err = message.CreateMatcherSpecification(*flagMatch); err != nil {
+		fmt.Fprintf(os.Stderr, "Match specification - %s\n", err)
+		os.Exit(2)
+	}
+
+	out := os.Stdout
+	if *flagAction == "list" {
+		queues, err := queueDirs(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(3)
+		}
+		for _, queue := range queues {
+			listQueue(out, queue)
+		}
+		return
+	}
+
+	if !isQueue(path) {
+		fmt.Fprintf(os.Stderr, "%s is not a queue directory\n", path)
+		os.Exit(3)
+	}
+
+	switch *flagAction {
+	case "truncate":
+		files, size, err := pipeline.TruncateQueue(path)
+		fmt.Fprintf(out, "Removed %d files, %d B\n", files, size)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(6)
+		}
+		return
+	case "dump", "seek", "copy", "replay":
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid action: %s\n", *flagAction)
+		os.Exit(1)
+	}
+
+	reader, err := pipeline.OpenQueue(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(3)
+	}
+	defer reader.Close()
+
+	var processed, matched int64
+	read := true
+	switch *flagAction {
+	case "dump":
+		processed, matched, err = readQueue(reader, match, *flagCount,
+			func(pack *pipeline.PipelinePack) bool {
+				printMessage(out, *flagFormat, pack.QueueCursor, pack.Message)
+				return true
+			})
+
+	case "seek":
+		var cursor string
+		if *flagCursor != "" {
+			if *flagSkip != 0 {
+				fmt.Fprintln(os.Stderr, "Only one of -cursor and -skip can be used")
+				os.Exit(1)
+			}
+			if cursor, err = seekCursor(path, *flagCursor); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(1)
+			}
+			read = false
+		} else {
+			if *flagSkip <= 0 {
+				fmt.Fprintln(os.Stderr, "The seek action needs -cursor or a positive -skip")
+				os.Exit(1)
+			}
+			processed, matched, err = readQueue(reader, match, *flagSkip,
+				func(pack *pipeline.PipelinePack) bool {
+					cursor = pack.QueueCursor
+					return true
+				})
+		}
+		if err == nil && cursor != "" {
+			if err = reader.WriteCheckpoint(cursor); err == nil {
+				fmt.Fprintf(out, "Checkpoint: %s\n", cursor)
+			}
+		}
+
+	case "copy":
+		if *flagDest == "" {
+			fmt.Fprintln(os.Stderr, "The copy action needs a -dest queue directory")
+			os.Exit(1)
+		}
+		dest, _ := filepath.Abs(*flagDest)
+		if src, _ := filepath.Abs(path); src == dest {
+			fmt.Fprintln(os.Stderr, "Can't copy a queue into itself")
+			os.Exit(1)
+		}
+		config := &pipeline.QueueBufferConfig{
+			MaxFileSize: pipeline.DefaultBufferMaxFileSize,
+			Compression: *flagCompression,
+			SyncPolicy:  "every_n",
+		}
+		var feeder *pipeline.BufferFeeder
+		if feeder, err = pipeline.NewBufferFeeder(dest, config, &pipeline.BufferSize{}); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(4)
+		}
+		processed, matched, err = readQueue(reader, match, *flagCount,
+			func(pack *pipeline.PipelinePack) bool {
+				err = feeder.QueueRecord(pack)
+				return err == nil
+			})
+		if e := feeder.Close(); err == nil {
+			err = e
+		}
+
+	case "replay":
+		// Sends the messages of a dead letter queue, as they were before
+		// being rejected, back to Heka. The checkpoint moves past the
+		// messages sent.
+		if *flagAddress == "" {
+			fmt.Fprintln(os.Stderr, "The replay action needs the -address of a TcpInput")
+			os.Exit(1)
+		}
+		var sender *client.NetworkSender
+		if sender, err = client.NewNetworkSender("tcp", *flagAddress); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(4)
+		}
+		replayer := client.NewClient(sender, client.NewProtobufEncoder(nil))
+		var cursor string
+		processed, matched, err = readQueue(reader, match, *flagCount,
+			func(pack *pipeline.PipelinePack) bool {
+				pipeline.StripDeadLetterFields(pack.Message)
+				if err = replayer.SendMessage(pack.Message); err != nil {
+					return false
+				}
+				cursor = pack.QueueCursor
+				return true
+			})
+		sender.Close()
+		if cursor != "" {
+			if e := reader.WriteCheckpoint(cursor); err == nil {
+				err = e
+			}
+		}
+	}
+
+	if read {
+		fmt.Fprintf(os.Stderr, "Processed: %d, matched: %d messages\n", processed, matched)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(6)
+	}
+}
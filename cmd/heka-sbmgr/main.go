@@ -22,16 +22,19 @@ package main
 import (
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/gogo/protobuf/proto"
+	"github.com/pborman/uuid"
 	"heka/client"
 	"heka/message"
 	"heka/pipeline"
 	"heka/plugins/tcp"
-	"github.com/pborman/uuid"
 )
 
 type SbmgrConfig struct {
@@ -39,14 +42,59 @@ type SbmgrConfig struct {
 	Signer    message.MessageSigningConfig `toml:"signer"`
 	UseTls    bool                         `toml:"use_tls"`
 	Tls       tcp.TlsConfig
+	// Address the manager's responses are delivered to (by a TcpOutput),
+	// required by the list, status, update and rollback actions.
+	ResponseAddress string `toml:"response_address"`
+}
+
+// Waits for the manager's response to the request, the responses are read
+// from the first connection made to the listener.
+func awaitResponse(listener net.Listener, requestId string,
+	timeout time.Duration) (*message.Message, error) {
+
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(timeout))
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, fmt.Errorf("no response within %s", timeout)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	splitter := &pipeline.HekaFramingSplitter{}
+	if err = splitter.Init(splitter.ConfigStruct()); err != nil {
+		return nil, err
+	}
+	sRunner := pipeline.NewSplitterRunner("HekaFramingSplitter", splitter,
+		pipeline.CommonSplitterConfig{})
+	for {
+		_, record, err := sRunner.GetRecordFromStream(conn)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return nil, fmt.Errorf("no response within %s", timeout)
+			}
+			return nil, err
+		}
+		if len(record) == 0 {
+			continue
+		}
+		msg := new(message.Message)
+		headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
+		if err = proto.Unmarshal(record[headerLen:], msg); err != nil {
+			return nil, err
+		}
+		if id, _ := msg.GetFieldValue("request_id"); id == requestId {
+			return msg, nil
+		}
+	}
 }
 
 func main() {
 	configFile := flag.String("config", "sbmgr.toml", "Sandbox manager configuration file")
 	scriptFile := flag.String("script", "xyz.lua", "Sandbox script file")
 	scriptConfig := flag.String("scriptconfig", "xyz.toml", "Sandbox script configuration file")
-	filterName := flag.String("filtername", "filter", "Sandbox filter name (used on unload)")
-	action := flag.String("action", "load", "Sandbox manager action")
+	filterName := flag.String("filtername", "filter", "Sandbox filter name (used on unload, status, update and rollback)")
+	action := flag.String("action", "load", "Sandbox manager action: load, unload, list, status, update or rollback")
+	timeout := flag.Duration("timeout", 10*time.Second, "How long to wait for the manager's response")
 	flag.Parse()
 
 	var config SbmgrConfig
@@ -54,6 +102,24 @@ func main() {
 		client.LogError.Printf("Error decoding config file: %s", err)
 		return
 	}
+
+	var listener net.Listener
+	switch *action {
+	case "load", "unload":
+	case "list", "status", "update", "rollback":
+		if config.ResponseAddress == "" {
+			client.LogError.Fatalf("response_address is required by the %s action\n", *action)
+		}
+		// Listen before sending so the response can't be missed.
+		var err error
+		if listener, err = net.Listen("tcp", config.ResponseAddress); err != nil {
+			client.LogError.Fatalf("Error listening for the response: %s\n", err)
+		}
+		defer listener.Close()
+	default:
+		client.LogError.Fatalf("Invalid action: %s\n", *action)
+	}
+
 	var sender *client.NetworkSender
 	var err error
 	if config.UseTls {
@@ -80,32 +146,55 @@ func main() {
 	msg.SetUuid(uuid.NewRandom())
 	msg.SetHostname(hostname)
 
+	// The configuration is optional on update, the running one is kept if it
+	// isn't given.
+	sendConfig := *action == "load"
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "scriptconfig" {
+			sendConfig = true
+		}
+	})
+
 	switch *action {
-	case "load":
+	case "load", "update":
 		code, err := ioutil.ReadFile(*scriptFile)
 		if err != nil {
 			client.LogError.Printf("Error reading scriptFile: %s\n", err.Error())
 			return
 		}
 		msg.SetPayload(string(code))
-		conf, err := ioutil.ReadFile(*scriptConfig)
-		if err != nil {
-			client.LogError.Printf("Error reading scriptConfig: %s\n", err.Error())
-			return
+		if sendConfig {
+			conf, err := ioutil.ReadFile(*scriptConfig)
+			if err != nil {
+				client.LogError.Printf("Error reading scriptConfig: %s\n", err.Error())
+				return
+			}
+			f, _ := message.NewField("config", string(conf), "toml")
+			msg.AddField(f)
 		}
-		f, _ := message.NewField("config", string(conf), "toml")
-		msg.AddField(f)
-	case "unload":
+	}
+	switch *action {
+	case "unload", "status", "update", "rollback":
 		f, _ := message.NewField("name", *filterName, "")
 		msg.AddField(f)
-	default:
-		client.LogError.Printf("Invalid action: %s", *action)
 	}
 
 	f1, _ := message.NewField("action", *action, "")
 	msg.AddField(f1)
 	err = manager.SendMessage(msg)
 	if err != nil {
-		client.LogError.Printf("Error sending message: %s\n", err.Error())
+		client.LogError.Fatalf("Error sending message: %s\n", err.Error())
+	}
+	if listener == nil {
+		return
+	}
+
+	resp, err := awaitResponse(listener, msg.GetUuidString(), *timeout)
+	if err != nil {
+		client.LogError.Fatalf("Error waiting for the %s response: %s\n", *action, err)
+	}
+	if status, _ := resp.GetFieldValue("status"); status != "ok" {
+		client.LogError.Fatalf("%s failed: %s\n", *action, resp.GetPayload())
 	}
+	fmt.Print(resp.GetPayload())
 }
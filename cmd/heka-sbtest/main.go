@@ -0,0 +1,705 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+/*
+
+Heka Sandbox Test Runner
+
+Runs a SandboxDecoder, SandboxFilter or SandboxEncoder script outside of hekad
+against a file of input messages and prints, or compares against an expected
+fixture, everything the plugin produces.
+
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/gogo/protobuf/proto"
+	"github.com/pborman/uuid"
+	"github.com/rafrombrc/gomock/gomock"
+	"heka/message"
+	"heka/pipeline"
+	pm "heka/pipelinemock"
+	"heka/sandbox"
+	"heka/sandbox/plugins"
+)
+
+const (
+	exitMismatch = 1
+	exitUsage    = 2
+	exitConfig   = 3
+	exitInput    = 4
+	exitOutput   = 5
+	exitPlugin   = 6
+)
+
+// Reports unexpected calls to the runner mocks, they mean the plugin used an
+// API heka-sbtest does not simulate.
+type mockReporter struct{}
+
+func (mockReporter) Errorf(format string, args ...interface{}) {
+	errorf(format, args...)
+}
+
+func (mockReporter) Fatalf(format string, args ...interface{}) {
+	errorf(format, args...)
+	os.Exit(exitPlugin)
+}
+
+// The sandbox plugin under test, process and timerEvent are called in input
+// order, finish after the last message.
+type sandboxPlugin interface {
+	process(msg *message.Message)
+	timerEvent(ns int64)
+	finish()
+}
+
+// Holds the simulated clock and the output of a run. The clock is the
+// timestamp of the current input message; timer events fire every ticker
+// interval starting from the first message.
+type sbTest struct {
+	pConfig  *pipeline.PipelineConfig
+	out      bytes.Buffer
+	ticker   int64
+	nextTick int64
+	now      int64
+	recycle  chan *pipeline.PipelinePack
+}
+
+func newSbTest(globals *pipeline.GlobalConfigStruct) *sbTest {
+	t := &sbTest{
+		pConfig: pipeline.NewPipelineConfig(globals),
+		recycle: make(chan *pipeline.PipelinePack, 1),
+	}
+	go func() {
+		for _ = range t.recycle {
+		}
+	}()
+	return t
+}
+
+// The sandbox clock, messages injected without a Timestamp are stamped with
+// the simulated time so the output is reproducible.
+func (t *sbTest) clock() int64 {
+	return t.now
+}
+
+// Returns a pack for a message injected by the plugin, stamped with the
+// simulated time.
+func (t *sbTest) newPack() *pipeline.PipelinePack {
+	pack := pipeline.NewPipelinePack(t.recycle)
+	pack.Message.SetTimestamp(t.now)
+	pack.Message.SetUuid(uuid.NewRandom())
+	pack.Message.SetHostname(t.pConfig.Globals.Hostname)
+	return pack
+}
+
+// Writes a message in the heka-cat text format, without the Uuid which is
+// random for the injected messages.
+func (t *sbTest) writeMessage(msg *message.Message) {
+	fmt.Fprintf(&t.out, "Timestamp: %s\n"+
+		"Type: %s\n"+
+		"Hostname: %s\n"+
+		"Pid: %d\n"+
+		"Logger: %s\n"+
+		"Payload: %s\n"+
+		"EnvVersion: %s\n"+
+		"Severity: %d\n"+
+		"Fields:\n",
+		time.Unix(0, msg.GetTimestamp()).UTC().Format(time.RFC3339Nano),
+		msg.GetType(), msg.GetHostname(), msg.GetPid(), msg.GetLogger(),
+		msg.GetPayload(), msg.GetEnvVersion(), msg.GetSeverity())
+	for _, f := range msg.Fields {
+		var values interface{}
+		switch f.GetValueType() {
+		case message.Field_STRING:
+			values = f.GetValueString()
+		case message.Field_BYTES:
+			values = f.GetValueBytes()
+		case message.Field_INTEGER:
+			values = f.GetValueInteger()
+		case message.Field_DOUBLE:
+			values = f.GetValueDouble()
+		case message.Field_BOOL:
+			values = f.GetValueBool()
+		}
+		fmt.Fprintf(&t.out, "    %s (%s %q): %v\n", f.GetName(), f.GetValueType(),
+			f.GetRepresentation(), values)
+	}
+	t.out.WriteString("\n")
+}
+
+func (t *sbTest) writeError(err error) {
+	fmt.Fprintf(&t.out, "Error: %s\n\n", err)
+}
+
+// Advances the clock to the message time, firing the timer events that are
+// due first.
+func (t *sbTest) run(sp sandboxPlugin, msg *message.Message) {
+	ts := msg.GetTimestamp()
+	if t.ticker > 0 {
+		if t.nextTick == 0 {
+			t.nextTick = ts + t.ticker
+		}
+		for t.nextTick <= ts {
+			t.now = t.nextTick
+			sp.timerEvent(t.now)
+			t.nextTick += t.ticker
+		}
+	}
+	t.now = ts
+	if msg.Hostname == nil {
+		msg.SetHostname(t.pConfig.Globals.Hostname)
+	}
+	sp.process(msg)
+}
+
+// Fires the pending timer event so the data accumulated since the last one
+// is reported.
+func (t *sbTest) finish(sp sandboxPlugin) {
+	if t.ticker > 0 && t.nextTick > 0 {
+		t.now = t.nextTick
+		sp.timerEvent(t.now)
+	}
+	sp.finish()
+}
+
+type decoderRunner struct {
+	*pm.MockDecoderRunner
+	t   *sbTest
+	err error
+}
+
+func (dr *decoderRunner) NewPack() *pipeline.PipelinePack {
+	return dr.t.newPack()
+}
+
+func (dr *decoderRunner) LogError(err error) {
+	dr.err = err
+}
+
+type sandboxDecoder struct {
+	t       *sbTest
+	decoder *plugins.SandboxDecoder
+}
+
+func newSandboxDecoder(t *sbTest, ctrl *gomock.Controller, name string,
+	section toml.Primitive) (sandboxPlugin, error) {
+
+	decoder := new(plugins.SandboxDecoder)
+	decoder.SetPipelineConfig(t.pConfig)
+	decoder.SetName(name)
+	config := decoder.ConfigStruct()
+	if err := toml.PrimitiveDecode(section, config); err != nil {
+		return nil, err
+	}
+	config.(*sandbox.SandboxConfig).Clock = t.clock
+	if err := decoder.Init(config); err != nil {
+		return nil, err
+	}
+	dr := &decoderRunner{MockDecoderRunner: pm.NewMockDecoderRunner(ctrl), t: t}
+	dr.EXPECT().Name().Return(name).AnyTimes()
+	decoder.SetDecoderRunner(dr)
+	if dr.err != nil {
+		return nil, dr.err
+	}
+	return &sandboxDecoder{t: t, decoder: decoder}, nil
+}
+
+func (d *sandboxDecoder) process(msg *message.Message) {
+	pack := pipeline.NewPipelinePack(d.t.recycle)
+	pack.Message = msg
+	packs, err := d.decoder.Decode(pack)
+	if err != nil {
+		d.t.writeError(err)
+	}
+	for _, p := range packs {
+		d.t.writeMessage(p.Message)
+	}
+}
+
+func (d *sandboxDecoder) timerEvent(ns int64) {}
+
+func (d *sandboxDecoder) finish() {
+	d.decoder.Shutdown()
+}
+
+type pluginHelper struct {
+	*pm.MockPluginHelper
+	t *sbTest
+}
+
+func (h *pluginHelper) PipelinePack(msgLoopCount uint) (*pipeline.PipelinePack, error) {
+	return h.t.newPack(), nil
+}
+
+// Runs the filter like a filter runner would. The clock must not advance
+// while the filter handles a message or a timer event, so every item is
+// waited for: a message is done once its pack is recycled, a timer event once
+// it is counted in the filter's report.
+type sandboxFilter struct {
+	t         *sbTest
+	filter    *plugins.SandboxFilter
+	inChan    chan *pipeline.PipelinePack
+	ticker    chan time.Time
+	processed chan *pipeline.PipelinePack
+	done      chan error
+	err       error
+}
+
+func newSandboxFilter(t *sbTest, ctrl *gomock.Controller, name string,
+	section toml.Primitive) (sandboxPlugin, error) {
+
+	filter := new(plugins.SandboxFilter)
+	filter.SetPipelineConfig(t.pConfig)
+	filter.SetName(name)
+	config := filter.ConfigStruct()
+	if err := toml.PrimitiveDecode(section, config); err != nil {
+		return nil, err
+	}
+	config.(*sandbox.SandboxConfig).Clock = t.clock
+	if err := filter.Init(config); err != nil {
+		return nil, err
+	}
+
+	f := &sandboxFilter{
+		t:         t,
+		filter:    filter,
+		inChan:    make(chan *pipeline.PipelinePack),
+		ticker:    make(chan time.Time),
+		processed: make(chan *pipeline.PipelinePack, 1),
+		done:      make(chan error, 1),
+	}
+	fr := pm.NewMockFilterRunner(ctrl)
+	fr.EXPECT().Name().Return(name).AnyTimes()
+	fr.EXPECT().InChan().Return(f.inChan).AnyTimes()
+	fr.EXPECT().Ticker().Return((<-chan time.Time)(f.ticker)).AnyTimes()
+	fr.EXPECT().UsesBuffering().Return(true).AnyTimes()
+	fr.EXPECT().BackPressured().Return(false).AnyTimes()
+	fr.EXPECT().Inject(gomock.Any()).Do(func(pack *pipeline.PipelinePack) {
+		t.writeMessage(pack.Message)
+	}).Return(true).AnyTimes()
+	fr.EXPECT().LogError(gomock.Any()).Do(func(err error) {
+		t.writeError(err)
+	}).AnyTimes()
+	h := &pluginHelper{MockPluginHelper: pm.NewMockPluginHelper(ctrl), t: t}
+	h.EXPECT().PipelineConfig().Return(t.pConfig).AnyTimes()
+
+	go func() {
+		f.done <- filter.Run(fr, h)
+	}()
+	return f, nil
+}
+
+// Returns false once the filter has exited.
+func (f *sandboxFilter) running() bool {
+	if f.done == nil {
+		return false
+	}
+	select {
+	case f.err = <-f.done:
+		f.done = nil
+		return false
+	default:
+		return true
+	}
+}
+
+func (f *sandboxFilter) timerEventSamples() int64 {
+	msg := new(message.Message)
+	f.filter.ReportMsg(msg)
+	n, _ := msg.GetFieldValue("TimerEventSamples")
+	samples, _ := n.(int64)
+	return samples
+}
+
+func (f *sandboxFilter) process(msg *message.Message) {
+	if !f.running() {
+		return
+	}
+	pack := pipeline.NewPipelinePack(f.processed)
+	pack.Message = msg
+	select {
+	case f.inChan <- pack:
+	case f.err = <-f.done:
+		f.done = nil
+		return
+	}
+	select {
+	case <-f.processed:
+	case f.err = <-f.done:
+		f.done = nil
+	}
+}
+
+func (f *sandboxFilter) timerEvent(ns int64) {
+	if !f.running() {
+		return
+	}
+	samples := f.timerEventSamples()
+	select {
+	case f.ticker <- time.Unix(0, ns):
+	case f.err = <-f.done:
+		f.done = nil
+		return
+	}
+	for f.timerEventSamples() == samples && f.running() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (f *sandboxFilter) finish() {
+	close(f.inChan)
+	if f.done != nil {
+		f.err = <-f.done
+	}
+	if f.err != nil {
+		f.t.writeError(f.err)
+	}
+}
+
+type sandboxEncoder struct {
+	t       *sbTest
+	encoder *plugins.SandboxEncoder
+}
+
+func newSandboxEncoder(t *sbTest, ctrl *gomock.Controller, name string,
+	section toml.Primitive) (sandboxPlugin, error) {
+
+	encoder := new(plugins.SandboxEncoder)
+	encoder.SetPipelineConfig(t.pConfig)
+	encoder.SetName(name)
+	config := encoder.ConfigStruct()
+	if err := toml.PrimitiveDecode(section, config); err != nil {
+		return nil, err
+	}
+	config.(*plugins.SandboxEncoderConfig).Clock = t.clock
+	if err := encoder.Init(config); err != nil {
+		return nil, err
+	}
+	return &sandboxEncoder{t: t, encoder: encoder}, nil
+}
+
+func (e *sandboxEncoder) process(msg *message.Message) {
+	pack := pipeline.NewPipelinePack(e.t.recycle)
+	pack.Message = msg
+	output, err := e.encoder.Encode(pack)
+	if err != nil {
+		e.t.writeError(err)
+	}
+	e.t.out.Write(output)
+}
+
+func (e *sandboxEncoder) timerEvent(ns int64) {}
+
+func (e *sandboxEncoder) finish() {
+	e.encoder.Stop()
+}
+
+type pluginFactory func(t *sbTest, ctrl *gomock.Controller, name string,
+	section toml.Primitive) (sandboxPlugin, error)
+
+var factories = map[string]pluginFactory{
+	"SandboxDecoder": newSandboxDecoder,
+	"SandboxFilter":  newSandboxFilter,
+	"SandboxEncoder": newSandboxEncoder,
+}
+
+// Loads the single plugin section of the configuration file, the plugin type
+// defaults to the section name like in hekad.
+func loadConfig(filename string) (name, typ string, ticker uint,
+	section toml.Primitive, err error) {
+
+	var sections map[string]toml.Primitive
+	if _, err = toml.DecodeFile(filename, &sections); err != nil {
+		return
+	}
+	if len(sections) != 1 {
+		err = fmt.Errorf("%s must contain a single plugin section, found %d",
+			filename, len(sections))
+		return
+	}
+	for name, section = range sections {
+	}
+	var common struct {
+		Type           string `toml:"type"`
+		TickerInterval uint   `toml:"ticker_interval"`
+	}
+	if err = toml.PrimitiveDecode(section, &common); err != nil {
+		return
+	}
+	typ = common.Type
+	if typ == "" {
+		typ = name
+	}
+	ticker = common.TickerInterval
+	return
+}
+
+func makeSplitterRunner() (pipeline.SplitterRunner, error) {
+	splitter := &pipeline.HekaFramingSplitter{}
+	config := splitter.ConfigStruct()
+	err := splitter.Init(config)
+	if err != nil {
+		return nil, fmt.Errorf("Error initializing HekaFramingSplitter: %s", err)
+	}
+	srConfig := pipeline.CommonSplitterConfig{}
+	sRunner := pipeline.NewSplitterRunner("HekaFramingSplitter", splitter, srConfig)
+	return sRunner, nil
+}
+
+// Reads the input messages calling fn for each of them. Text lines become the
+// Payload of a message stamped with the start time, JSON input is a stream of
+// messages as written by heka-cat -format json.
+func readInput(r io.Reader, format string, start int64,
+	fn func(msg *message.Message)) error {
+
+	switch format {
+	case "heka":
+		sRunner, err := makeSplitterRunner()
+		if err != nil {
+			return err
+		}
+		for {
+			n, record, err := sRunner.GetRecordFromStream(r)
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			if n > 0 && n != len(record) {
+				return fmt.Errorf("corruption detected, %d bytes skipped", n-len(record))
+			}
+			if len(record) == 0 {
+				continue
+			}
+			msg := new(message.Message)
+			headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
+			if err = proto.Unmarshal(record[headerLen:], msg); err != nil {
+				return err
+			}
+			fn(msg)
+		}
+	case "text":
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64*1024), int(message.MAX_MESSAGE_SIZE))
+		for scanner.Scan() {
+			msg := new(message.Message)
+			msg.SetUuid(uuid.NewRandom())
+			msg.SetTimestamp(start)
+			msg.SetSeverity(7)
+			msg.SetPayload(scanner.Text())
+			fn(msg)
+		}
+		return scanner.Err()
+	case "json":
+		dec := json.NewDecoder(r)
+		for {
+			msg := new(message.Message)
+			if err := dec.Decode(msg); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			if msg.Timestamp == nil {
+				msg.SetTimestamp(start)
+			}
+			fn(msg)
+		}
+	}
+	return fmt.Errorf("unsupported input format: %s", format)
+}
+
+// Writes the differences between the expected and the actual output lines,
+// returns false if there are none.
+func diff(w io.Writer, expected, actual string) bool {
+	if expected == actual {
+		return false
+	}
+	a := strings.SplitAfter(expected, "\n")
+	b := strings.SplitAfter(actual, "\n")
+	// Longest common subsequence of lines, walked forward to print the edits.
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	line := func(prefix, s string) {
+		fmt.Fprintf(w, "%s%s", prefix, strings.TrimSuffix(s, "\n")+"\n")
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			line(fmt.Sprintf("+%d: ", j+1), b[j])
+			j++
+		default:
+			line(fmt.Sprintf("-%d: ", i+1), a[i])
+			i++
+		}
+	}
+	return true
+}
+
+// Runs the plugin of the configuration file against the input, the output is
+// written to t.out. The ticker defaults to the plugin's ticker_interval.
+// Returns the exit code for the error of a failed run.
+func runPlugin(t *sbTest, configFile string, in io.Reader, format string,
+	start int64) (int, error) {
+
+	name, typ, tickerInterval, section, err := loadConfig(configFile)
+	if err != nil {
+		return exitConfig, fmt.Errorf("Error decoding config file: %s", err)
+	}
+	factory, ok := factories[typ]
+	if !ok {
+		return exitConfig, fmt.Errorf("Unsupported plugin type: %s", typ)
+	}
+	if t.ticker == 0 {
+		t.ticker = int64(tickerInterval) * int64(time.Second)
+	}
+
+	ctrl := gomock.NewController(mockReporter{})
+	sp, err := factory(t, ctrl, name, section)
+	if err != nil {
+		return exitPlugin, fmt.Errorf("Error initializing %s: %s", name, err)
+	}
+	err = readInput(in, format, start, func(msg *message.Message) {
+		t.run(sp, msg)
+	})
+	t.finish(sp)
+	if err != nil {
+		return exitInput, fmt.Errorf("Error reading the input: %s", err)
+	}
+	return 0, nil
+}
+
+func main() {
+	os.Exit(run())
+}
+
+func errorf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
+
+// Returns the exit code, deferred cleanups run before main exits.
+func run() int {
+	flagConfig := flag.String("config", "sbtest.toml",
+		"TOML file with a single SandboxDecoder, SandboxFilter or SandboxEncoder section")
+	flagInput := flag.String("input", "", "input filename, defaults to stdin")
+	flagFormat := flag.String("format", "heka", "input format [heka|text|json]")
+	flagStart := flag.String("start", "1970-01-01T00:00:00Z",
+		"RFC3339 timestamp of the text and json messages without one")
+	flagTicker := flag.Duration("ticker", 0,
+		"simulated timer_event interval, defaults to the filter's ticker_interval")
+	flagExpected := flag.String("expected", "", "expected output fixture to diff against")
+	flagOutput := flag.String("output", "", "output filename, defaults to stdout")
+	flagShareDir := flag.String("share_dir", ".", "directory the relative script paths are resolved in")
+	flagHostname := flag.String("hostname", "localhost", "hostname of the injected messages")
+	flagMaxMessageSize := flag.Uint64("max-message-size", 4*1024*1024, "maximum message size in bytes")
+	flag.Parse()
+
+	if flag.NArg() != 0 {
+		flag.PrintDefaults()
+		return exitUsage
+	}
+	if *flagMaxMessageSize >= math.MaxUint32 {
+		errorf("Message size is too large: %d", *flagMaxMessageSize)
+		return exitUsage
+	}
+	message.SetMaxMessageSize(uint32(*flagMaxMessageSize))
+
+	start, err := time.Parse(time.RFC3339Nano, *flagStart)
+	if err != nil {
+		errorf("Invalid start time: %s", err)
+		return exitUsage
+	}
+
+	in := os.Stdin
+	if *flagInput != "" {
+		if in, err = os.Open(*flagInput); err != nil {
+			errorf("%s", err)
+			return exitInput
+		}
+		defer in.Close()
+	}
+
+	// preserved data and profiles are written to a scratch base directory
+	baseDir, err := ioutil.TempDir("", "heka-sbtest")
+	if err != nil {
+		errorf("%s", err)
+		return exitPlugin
+	}
+	defer os.RemoveAll(baseDir)
+
+	globals := pipeline.DefaultGlobals()
+	globals.ShareDir = *flagShareDir
+	globals.BaseDir = baseDir
+	globals.Hostname = *flagHostname
+	t := newSbTest(globals)
+	t.ticker = int64(*flagTicker)
+	if code, err := runPlugin(t, *flagConfig, in, *flagFormat, start.UnixNano()); err != nil {
+		errorf("%s", err)
+		return code
+	}
+
+	code := 0
+	if *flagExpected != "" {
+		expected, err := ioutil.ReadFile(*flagExpected)
+		if err != nil {
+			errorf("%s", err)
+			return exitInput
+		}
+		if diff(os.Stderr, string(expected), t.out.String()) {
+			code = exitMismatch
+		}
+	}
+	if *flagOutput != "" {
+		err = ioutil.WriteFile(*flagOutput, t.out.Bytes(), 0644)
+	} else if *flagExpected == "" {
+		_, err = os.Stdout.Write(t.out.Bytes())
+	}
+	if err != nil {
+		errorf("%s", err)
+		return exitOutput
+	}
+	return code
+}
@@ -0,0 +1,93 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"heka/pipeline"
+)
+
+// Runs every plugin against its input and compares the output with its
+// fixture, the messages injected without a Timestamp are stamped with the
+// simulated clock.
+func TestFixtures(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		input  string
+		start  string
+	}{
+		{"decoder", "text", "decoder.txt", "2015-01-01T00:00:00Z"},
+		{"filter", "json", "filter.json", "1970-01-01T00:00:00Z"},
+		{"encoder", "json", "encoder.json", "1970-01-01T00:00:00Z"},
+	}
+
+	baseDir, err := ioutil.TempDir("", "heka-sbtest")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(baseDir)
+	dir := "testsupport"
+
+	for _, test := range tests {
+		expected, err := ioutil.ReadFile(filepath.Join(dir, test.name+".out"))
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		start, err := time.Parse(time.RFC3339Nano, test.start)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		in, err := os.Open(filepath.Join(dir, test.input))
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		globals := pipeline.DefaultGlobals()
+		globals.ShareDir = dir
+		globals.BaseDir = baseDir
+		globals.Hostname = "localhost"
+		sbt := newSbTest(globals)
+		code, err := runPlugin(sbt, filepath.Join(dir, test.name+".toml"), in,
+			test.format, start.UnixNano())
+		in.Close()
+		if err != nil {
+			t.Fatalf("%s: exit code %d: %s", test.name, code, err)
+		}
+		var d bytes.Buffer
+		if diff(&d, string(expected), sbt.out.String()) {
+			t.Errorf("%s: output differs from the fixture:\n%s", test.name, d.String())
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	var d bytes.Buffer
+	if diff(&d, "a\nb\nc\n", "a\nb\nc\n") {
+		t.Errorf("identical outputs reported as different: %s", d.String())
+	}
+	if !diff(&d, "a\nb\nc\n", "a\nx\nc\n") {
+		t.Fatalf("different outputs reported as identical")
+	}
+	expected := "+2: x\n-2: b\n"
+	if d.String() != expected {
+		t.Errorf("expected:\n%s\nreceived:\n%s", expected, d.String())
+	}
+}
@@ -0,0 +1,20 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+-- Decodes "key=value" pairs into message fields, the decoded message has no
+-- Timestamp of its own.
+function process_message ()
+    local payload = read_message("Payload")
+    local fields = {}
+    local n = 0
+    for k, v in string.gmatch(payload, "(%w+)=(%w+)") do
+        fields[k] = v
+        n = n + 1
+    end
+    if n == 0 then
+        return -1, "no key=value pair"
+    end
+    inject_message({Type = "kv", Payload = payload, Fields = fields})
+    return 0
+end
@@ -0,0 +1,11 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+-- Writes one "<timestamp> <type>: <payload>" line per message.
+function process_message ()
+    inject_payload("txt", "", string.format("%d %s: %s\n",
+        read_message("Timestamp"), read_message("Type"),
+        read_message("Payload")))
+    return 0
+end
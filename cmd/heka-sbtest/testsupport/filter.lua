@@ -0,0 +1,18 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+-- Counts the messages, every timer event reports the count as a payload and
+-- as a message without a Timestamp of its own.
+local count = 0
+
+function process_message ()
+    count = count + 1
+    return 0
+end
+
+function timer_event(ns)
+    inject_payload("txt", "count", string.format("%d at %d", count, ns))
+    inject_message({Type = "count", Payload = tostring(count)})
+    count = 0
+end
@@ -48,6 +48,8 @@ type HekadConfig struct {
 	MaxMessageSize        uint32 `toml:"max_message_size"`        // 发送的消息最大大小，默认 64k
 	LogFlags              int    `toml:"log_flags"`               // log格式
 	FullBufferMaxRetries  uint32 `toml:"full_buffer_max_retries"` // 缓冲区过大时，为减轻背压清空缓冲区，hekad等待缓存区小于90%的最大间隔数
+	MaxBatchSize          int    `toml:"max_batch_size"`          // 路由器每批传递的最大消息数，0或1表示不分批
+	MaxBatchLinger        string `toml:"max_batch_linger"`        // 路由器等待一批消息填满的最长时间，默认0即不等待
 }
 
 // 配置文件和环境变量处理
@@ -75,6 +77,7 @@ func LoadHekadConfig(configPath string) (config *HekadConfig, err error) {
 		Hostname:              hostname,
 		LogFlags:              log.LstdFlags,
 		FullBufferMaxRetries:  10,
+		MaxBatchLinger:        "0",
 	}
 
 	var configFile map[string]toml.Primitive
@@ -70,6 +70,7 @@ func setGlobalConfigs(config *HekadConfig) (*pipeline.GlobalConfigStruct, string
 	maxMsgProcessDuration := config.MaxMsgProcessDuration
 	maxMsgTimerInject := config.MaxMsgTimerInject
 	maxPackIdle, _ := time.ParseDuration(config.MaxPackIdle)
+	maxBatchLinger, _ := time.ParseDuration(config.MaxBatchLinger)
 
 	runtime.GOMAXPROCS(maxprocs)
 
@@ -84,6 +85,8 @@ func setGlobalConfigs(config *HekadConfig) (*pipeline.GlobalConfigStruct, string
 	globals.MaxMsgProcessDuration = maxMsgProcessDuration
 	globals.MaxMsgTimerInject = maxMsgTimerInject
 	globals.MaxPackIdle = maxPackIdle
+	globals.MaxBatchSize = config.MaxBatchSize
+	globals.MaxBatchLinger = maxBatchLinger
 	globals.BaseDir = config.BaseDir
 	globals.ShareDir = config.ShareDir
 	globals.SampleDenominator = config.SampleDenominator
@@ -140,6 +143,13 @@ func main() {
 		return
 	}
 
+	if _, err = time.ParseDuration(config.MaxBatchLinger); err != nil {
+		pipeline.LogError.Printf("Can't parse `max_batch_linger` time duration: %s\n",
+			config.MaxBatchLinger)
+		exitCode = 1
+		return
+	}
+
 	globals, cpuProfName, memProfName := setGlobalConfigs(config)
 
 	if err = os.MkdirAll(globals.BaseDir, 0755); err != nil {
@@ -238,10 +248,22 @@ func main() {
 }
 
 func loadFullConfig(pipeconf *pipeline.PipelineConfig, configPath *string) (err error) {
+	if err = preloadConfig(pipeconf, configPath); err == nil {
+		err = pipeconf.LoadConfig()
+	}
+	// A reload reads the same file or directory again.
+	pipeconf.SetConfigLoader(func(next *pipeline.PipelineConfig) error {
+		return preloadConfig(next, configPath)
+	})
+	return err
+}
+
+func preloadConfig(pipeconf *pipeline.PipelineConfig, configPath *string) (err error) {
 	p, err := os.Open(*configPath)
 	if err != nil {
 		return fmt.Errorf("error opening file: %s", err.Error())
 	}
+	defer p.Close()
 	fi, err := p.Stat()
 	if err != nil {
 		return fmt.Errorf("can't stat file: %s", err.Error())
@@ -263,8 +285,5 @@ func loadFullConfig(pipeconf *pipeline.PipelineConfig, configPath *string) (err
 	} else {
 		err = pipeconf.PreloadFromConfigFile(*configPath)
 	}
-	if err == nil {
-		err = pipeconf.LoadConfig()
-	}
 	return err
 }
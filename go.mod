@@ -8,8 +8,11 @@ require (
 	github.com/abh/geoip v0.0.0-20160510155516-07cea4480daa
 	github.com/cactus/gostrftime v1.0.1
 	github.com/crankycoder/xmlpath v0.0.0-20130917154930-670b185b686f
+	github.com/d5/tengo/v2 v2.17.0
 	github.com/fsouza/go-dockerclient v1.7.4
 	github.com/gogo/protobuf v1.3.2
+	github.com/golang/snappy v0.0.3
+	github.com/klauspost/compress v1.12.2
 	github.com/layeh/gopher-json v0.0.0-20201124131017-552bb3c4c3bf
 	github.com/orfjackal/nanospec.go v0.0.0-20120727230329-de4694c1d701 // indirect
 	github.com/pborman/uuid v1.2.1
@@ -23,5 +26,4 @@ require (
 	github.com/yuin/gopher-lua v0.0.0-20210529063254-f4c35e4016d9
 	launchpad.net/gocheck v0.0.0-20140225173054-000000000087 // indirect
 	launchpad.net/xmlpath v0.0.0-20130614043138-000000000004 // indirect
-
 )
@@ -30,6 +30,9 @@ func TestAllSpecs(t *testing.T) {
 	r.AddSpec(MessageFieldsSpec)
 	r.AddSpec(MessageEqualsSpec)
 	r.AddSpec(MatcherSpecificationSpec)
+	r.AddSpec(MatcherIndexSpec)
+	r.AddSpec(CompiledMatcherSpec)
+	r.AddSpec(MatcherExplainSpec)
 	gospec.MainGoTest(r, t)
 }
 
@@ -0,0 +1,430 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Compiled form of a matcher (sub)expression.
+type matchFunc func(msg *Message) bool
+
+// Relative cost of evaluating an expression, the operands of && and || are
+// evaluated cheapest first.
+const (
+	costConstant = 0
+	costNumeric  = 1
+	costString   = 2
+	costScan     = 3 // prefix, suffix, substring and set tests
+	costCIDR     = 8
+	costUuid     = 8 // formatted for every test
+	costField    = 6 // looking up the field
+	costRegexp   = 20
+)
+
+type compiled struct {
+	fn       matchFunc
+	cost     int
+	constant bool
+	value    bool // result of a constant expression
+}
+
+func constantExpr(value bool) compiled {
+	return compiled{constant: true, value: value, cost: costConstant}
+}
+
+func (c compiled) matchFunc() matchFunc {
+	if c.constant {
+		value := c.value
+		return func(msg *Message) bool { return value }
+	}
+	return c.fn
+}
+
+// Compiles the parse tree into a tree of closures with the field accessors
+// and comparisons resolved, constant subexpressions folded and the operands
+// of chained && and || reordered by cost. It evaluates exactly like
+// evalMatcherSpecification.
+func compileMatcher(t *tree) matchFunc {
+	if t == nil {
+		return constantExpr(false).matchFunc()
+	}
+	return compileTree(t).matchFunc()
+}
+
+func compileTree(t *tree) compiled {
+	if t.left == nil {
+		return compileLeaf(t.stmt)
+	}
+	switch t.stmt.op.tokenId {
+	case OP_NOT:
+		c := compileTree(t.left)
+		if c.constant {
+			return constantExpr(!c.value)
+		}
+		fn := c.fn
+		return compiled{fn: func(msg *Message) bool { return !fn(msg) }, cost: c.cost}
+	case OP_AND, OP_OR:
+		return compileChain(t)
+	}
+	return constantExpr(false)
+}
+
+// Collects the operands of a chain of the same logical operator.
+func chainOperands(t *tree, op int, operands []*tree) []*tree {
+	if t.left != nil && t.stmt.op.tokenId == op {
+		operands = chainOperands(t.left, op, operands)
+		return chainOperands(t.right, op, operands)
+	}
+	return append(operands, t)
+}
+
+// Compiles the operands of a chain of the same logical operator, ordered
+// the way they're evaluated: cheapest first, in the order of the spec
+// otherwise. Explain evaluates them in the same order.
+func orderedOperands(t *tree) ([]*tree, []compiled) {
+	trees := chainOperands(t, t.stmt.op.tokenId, nil)
+	operands := make([]compiled, len(trees))
+	for i, operand := range trees {
+		operands[i] = compileTree(operand)
+	}
+	order := make([]int, len(trees))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return operands[order[i]].cost < operands[order[j]].cost
+	})
+	sortedTrees := make([]*tree, len(trees))
+	sorted := make([]compiled, len(trees))
+	for i, j := range order {
+		sortedTrees[i], sorted[i] = trees[j], operands[j]
+	}
+	return sortedTrees, sorted
+}
+
+func compileChain(t *tree) compiled {
+	// The result of the chain as soon as one operand has this value.
+	decisive := t.stmt.op.tokenId == OP_OR
+
+	var operands []compiled
+	cost := 0
+	_, ordered := orderedOperands(t)
+	for _, c := range ordered {
+		if c.constant {
+			if c.value == decisive {
+				return constantExpr(decisive)
+			}
+			continue // no effect on the result
+		}
+		operands = append(operands, c)
+		cost += c.cost
+	}
+	switch len(operands) {
+	case 0:
+		return constantExpr(!decisive)
+	case 1:
+		return operands[0]
+	}
+
+	fns := make([]matchFunc, len(operands))
+	for i, c := range operands {
+		fns[i] = c.fn
+	}
+	var fn matchFunc
+	if len(fns) == 2 {
+		a, b := fns[0], fns[1]
+		if decisive {
+			fn = func(msg *Message) bool { return a(msg) || b(msg) }
+		} else {
+			fn = func(msg *Message) bool { return a(msg) && b(msg) }
+		}
+	} else {
+		fn = func(msg *Message) bool {
+			for _, f := range fns {
+				if f(msg) == decisive {
+					return decisive
+				}
+			}
+			return !decisive
+		}
+	}
+	return compiled{fn: fn, cost: cost}
+}
+
+func compileLeaf(stmt *Statement) compiled {
+	switch stmt.op.tokenId {
+	case TRUE:
+		return constantExpr(true)
+	case FALSE:
+		return constantExpr(false)
+	}
+
+	switch stmt.field.tokenId {
+	case VAR_UUID, VAR_TYPE, VAR_LOGGER, VAR_PAYLOAD, VAR_ENVVERSION,
+		VAR_HOSTNAME:
+		test, cost := compileStringTest(stmt)
+		var get func(msg *Message) string
+		switch stmt.field.tokenId {
+		case VAR_UUID:
+			get = (*Message).GetUuidString
+			cost += costUuid
+		case VAR_TYPE:
+			get = (*Message).GetType
+		case VAR_LOGGER:
+			get = (*Message).GetLogger
+		case VAR_PAYLOAD:
+			get = (*Message).GetPayload
+		case VAR_ENVVERSION:
+			get = (*Message).GetEnvVersion
+		case VAR_HOSTNAME:
+			get = (*Message).GetHostname
+		}
+		return compiled{fn: func(msg *Message) bool { return test(get(msg)) }, cost: cost}
+
+	case VAR_TIMESTAMP, VAR_SEVERITY, VAR_PID:
+		test := compileNumericTest(stmt)
+		var fn matchFunc
+		switch stmt.field.tokenId {
+		case VAR_TIMESTAMP:
+			fn = func(msg *Message) bool { return test(float64(msg.GetTimestamp())) }
+		case VAR_SEVERITY:
+			fn = func(msg *Message) bool { return test(float64(msg.GetSeverity())) }
+		case VAR_PID:
+			fn = func(msg *Message) bool { return test(float64(msg.GetPid())) }
+		}
+		return compiled{fn: fn, cost: costNumeric}
+
+	case VAR_FIELDS:
+		return compileFieldTest(stmt)
+	}
+	return constantExpr(false)
+}
+
+func compileFieldTest(stmt *Statement) compiled {
+	name := stmt.field.token
+	fi := stmt.field.fieldIndex
+	ai := stmt.field.arrayIndex
+	missing := testNonExistence(stmt)
+	stringTest, cost := compileStringTest(stmt)
+	numericTest := compileNumericTest(stmt)
+	if stmt.field.function == FN_LEN {
+		numericTest = func(f float64) bool { return false }
+	}
+	boolTest := compileBoolTest(stmt)
+
+	fn := func(msg *Message) bool {
+		field := findField(msg, name, fi)
+		if field == nil {
+			return missing
+		}
+		switch field.GetValueType() {
+		case Field_STRING:
+			if ai >= len(field.ValueString) {
+				return missing
+			}
+			return stringTest(field.ValueString[ai])
+		case Field_BYTES:
+			if ai >= len(field.ValueBytes) {
+				return missing
+			}
+			return stringTest(string(field.ValueBytes[ai]))
+		case Field_INTEGER:
+			if ai >= len(field.ValueInteger) {
+				return missing
+			}
+			return numericTest(float64(field.ValueInteger[ai]))
+		case Field_DOUBLE:
+			if ai >= len(field.ValueDouble) {
+				return missing
+			}
+			return numericTest(field.ValueDouble[ai])
+		case Field_BOOL:
+			if ai >= len(field.ValueBool) {
+				return missing
+			}
+			return boolTest(field.ValueBool[ai])
+		}
+		return false
+	}
+	return compiled{fn: fn, cost: costField + cost}
+}
+
+// Returns the fi-th field with the name, without collecting them all.
+func findField(msg *Message, name string, fi int) *Field {
+	if msg == nil {
+		return nil
+	}
+	for _, field := range msg.Fields {
+		if field != nil && field.GetName() == name {
+			if fi == 0 {
+				return field
+			}
+			fi--
+		}
+	}
+	return nil
+}
+
+// Compiles the comparison of a string value, returns it with its cost.
+func compileStringTest(stmt *Statement) (func(s string) bool, int) {
+	if stmt.field.function == FN_LEN {
+		test := compileNumericTest(stmt)
+		return func(s string) bool {
+			return test(float64(utf8.RuneCountInString(s)))
+		}, costString
+	}
+	never := func(s string) bool { return false }
+	if stmt.value.tokenId == NUMERIC_VALUE {
+		return never, costConstant
+	}
+
+	v := stmt.value.token
+	isNil := stmt.value.tokenId == NIL_VALUE
+	switch stmt.op.tokenId {
+	case OP_EQ:
+		if isNil {
+			return never, costConstant
+		}
+		return func(s string) bool { return s == v }, costString
+	case OP_NE:
+		if isNil {
+			return func(s string) bool { return true }, costConstant
+		}
+		return func(s string) bool { return s != v }, costString
+	case OP_LT:
+		return func(s string) bool { return s < v }, costString
+	case OP_LTE:
+		return func(s string) bool { return s <= v }, costString
+	case OP_GT:
+		return func(s string) bool { return s > v }, costString
+	case OP_GTE:
+		return func(s string) bool { return s >= v }, costString
+	case OP_RE, OP_NRE:
+		test, cost := compileRegexpTest(stmt)
+		if stmt.op.tokenId == OP_NRE {
+			return func(s string) bool { return !test(s) }, cost
+		}
+		return test, cost
+	case OP_IN:
+		set := stmt.value.set.strings
+		return func(s string) bool { return set[s] }, costScan
+	case OP_NOT_IN:
+		set := stmt.value.set.strings
+		return func(s string) bool { return !set[s] }, costScan
+	case FN_STARTSWITH:
+		return func(s string) bool { return strings.HasPrefix(s, v) }, costScan
+	case FN_ENDSWITH:
+		return func(s string) bool { return strings.HasSuffix(s, v) }, costScan
+	case FN_CONTAINS:
+		return func(s string) bool { return strings.Contains(s, v) }, costScan
+	case OP_CIDR:
+		ipnet := stmt.value.ipnet
+		return func(s string) bool {
+			ip := net.ParseIP(s)
+			return ip != nil && ipnet.Contains(ip)
+		}, costCIDR
+	}
+	return never, costConstant
+}
+
+// Compiles a regular expression match, using plain string tests for the
+// expressions that are literals.
+func compileRegexpTest(stmt *Statement) (func(s string) bool, int) {
+	v := stmt.value.token
+	re := stmt.value.regexp
+	if re == nil {
+		switch stmt.value.fieldIndex {
+		case STARTS_WITH:
+			return func(s string) bool { return strings.HasPrefix(s, v) }, costScan
+		case ENDS_WITH:
+			return func(s string) bool { return strings.HasSuffix(s, v) }, costScan
+		}
+		return func(s string) bool { return false }, costConstant
+	}
+	prefix, complete := re.LiteralPrefix()
+	if complete {
+		return func(s string) bool { return strings.Contains(s, prefix) }, costScan
+	}
+	if prefix != "" && anchoredAtStart(re) {
+		// Most values are rejected without running the regexp.
+		return func(s string) bool {
+			return strings.HasPrefix(s, prefix) && re.MatchString(s)
+		}, costRegexp
+	}
+	return re.MatchString, costRegexp
+}
+
+// Returns true if matches have to start at the beginning of the text, flags
+// like multi-line mode make ^ match elsewhere.
+func anchoredAtStart(re *regexp.Regexp) bool {
+	expr := re.String()
+	return strings.HasPrefix(expr, "^") || strings.HasPrefix(expr, `\A`)
+}
+
+// Compiles the comparison of a numeric value.
+func compileNumericTest(stmt *Statement) func(f float64) bool {
+	never := func(f float64) bool { return false }
+	if !(stmt.value.tokenId == NUMERIC_VALUE || stmt.value.tokenId == NIL_VALUE) {
+		return never
+	}
+	v := stmt.value.double
+	isNil := stmt.value.tokenId == NIL_VALUE
+	switch stmt.op.tokenId {
+	case OP_EQ:
+		if isNil {
+			return never
+		}
+		return func(f float64) bool { return f == v }
+	case OP_NE:
+		if isNil {
+			return func(f float64) bool { return true }
+		}
+		return func(f float64) bool { return f != v }
+	case OP_LT:
+		return func(f float64) bool { return f < v }
+	case OP_LTE:
+		return func(f float64) bool { return f <= v }
+	case OP_GT:
+		return func(f float64) bool { return f > v }
+	case OP_GTE:
+		return func(f float64) bool { return f >= v }
+	case OP_IN:
+		set := stmt.value.set.numbers
+		return func(f float64) bool { return set[f] }
+	case OP_NOT_IN:
+		set := stmt.value.set.numbers
+		return func(f float64) bool { return !set[f] }
+	}
+	return never
+}
+
+// Compiles the comparison of a boolean field value.
+func compileBoolTest(stmt *Statement) func(b bool) bool {
+	switch stmt.value.tokenId {
+	case NIL_VALUE:
+		exists := stmt.op.tokenId != OP_EQ
+		return func(b bool) bool { return exists }
+	case TRUE:
+		return func(b bool) bool { return b }
+	case FALSE:
+		return func(b bool) bool { return !b }
+	}
+	return func(b bool) bool { return false }
+}
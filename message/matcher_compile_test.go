@@ -0,0 +1,115 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"testing"
+
+	"github.com/rafrombrc/gospec/src/gospec"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func CompiledMatcherSpec(c gospec.Context) {
+	msg := getTestMessage()
+
+	compile := func(spec string) compiled {
+		ms, err := CreateMatcherSpecification(spec)
+		c.Assume(err, gs.IsNil)
+		return compileTree(ms.vm)
+	}
+
+	c.Specify("A compiled matcher", func() {
+		c.Specify("folds constant subexpressions", func() {
+			constants := map[string]bool{
+				"TRUE":                               true,
+				"!TRUE":                              false,
+				"FALSE && Type == 'TEST'":            false,
+				"Type == 'TEST' || (TRUE && !FALSE)": true,
+				"!(Severity == 6 && FALSE)":          true,
+				"(Type == 'a' || TRUE) && !(FALSE || FALSE)": true,
+			}
+			for spec, value := range constants {
+				cm := compile(spec)
+				c.Expect(cm.constant, gs.IsTrue)
+				c.Expect(cm.value, gs.Equals, value)
+			}
+
+			cm := compile("TRUE && Type == 'TEST' && !FALSE")
+			c.Expect(cm.constant, gs.IsFalse)
+			c.Expect(cm.cost, gs.Equals, costString)
+		})
+
+		c.Specify("evaluates the cheapest operands first", func() {
+			cm := compile("Type =~ /T.ST/ && Fields[foo] == 'bar' && Severity == 6")
+			c.Expect(cm.cost, gs.Equals, costRegexp+costField+costString+costNumeric)
+
+			ops := []compiled{
+				compileTree(parseTree(c, "Type =~ /T.ST/")),
+				compileTree(parseTree(c, "Fields[foo] == 'bar'")),
+				compileTree(parseTree(c, "Severity == 6")),
+			}
+			c.Expect(ops[2].cost < ops[1].cost, gs.IsTrue)
+			c.Expect(ops[1].cost < ops[0].cost, gs.IsTrue)
+		})
+
+		c.Specify("reduces literal regexps to string tests", func() {
+			ms, err := CreateMatcherSpecification("Type =~ /ES/")
+			c.Assume(err, gs.IsNil)
+			c.Expect(compileTree(ms.vm).cost, gs.Equals, costScan)
+			c.Expect(ms.Match(msg), gs.IsTrue)
+
+			ms, err = CreateMatcherSpecification("Type =~ /^TE.T/ && Type !~ /(?m)^X.S/")
+			c.Assume(err, gs.IsNil)
+			c.Expect(ms.Match(msg), gs.IsTrue)
+		})
+
+		c.Specify("counts the evaluations and matches", func() {
+			ms, err := CreateMatcherSpecification("Type == 'TEST'")
+			c.Assume(err, gs.IsNil)
+			ms.Match(msg)
+			ms.Match(msg)
+			ms.Match(new(Message))
+			evaluations, matches := ms.Stats()
+			c.Expect(evaluations, gs.Equals, int64(3))
+			c.Expect(matches, gs.Equals, int64(2))
+		})
+	})
+}
+
+func parseTree(c gospec.Context, spec string) *tree {
+	ms, err := CreateMatcherSpecification(spec)
+	c.Assume(err, gs.IsNil)
+	return ms.vm
+}
+
+func BenchmarkMatcherInterpreted(b *testing.B) {
+	s := "Fields[foo] == 'bar' && Payload =~ /[Pp]ayload/ && Type == 'other'"
+	ms, _ := CreateMatcherSpecification(s)
+	msg := getTestMessage()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		evalMatcherSpecification(ms.vm, msg)
+	}
+}
+
+func BenchmarkMatcherCompiled(b *testing.B) {
+	s := "Fields[foo] == 'bar' && Payload =~ /[Pp]ayload/ && Type == 'other'"
+	ms, _ := CreateMatcherSpecification(s)
+	msg := getTestMessage()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ms.Match(msg)
+	}
+}
@@ -0,0 +1,139 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MatchTest is one test of a matcher specification evaluated against a
+// message.
+type MatchTest struct {
+	Test   string // spec text of the test, e.g. "Fields[status] >= 500"
+	Field  string // message variable tested, empty for TRUE and FALSE
+	Value  string // value of the variable in the message
+	Result bool
+}
+
+// MatchExplanation tells why a message did or didn't match a specification.
+type MatchExplanation struct {
+	Matched bool
+	// Tests deciding the result: the operand failing an && or satisfying an
+	// ||, or every operand when all of them had to be evaluated.
+	Deciders []MatchTest
+}
+
+// Explain evaluates the parse tree against the message the way Match does,
+// evaluating the operands of && and || in the same cost order and short
+// circuiting at the same operand, and reports the tests that decided the
+// result. It doesn't update the match statistics.
+func (m *MatcherSpecification) Explain(msg *Message) (e MatchExplanation) {
+	e.Matched, e.Deciders = m.explainTree(m.vm, msg)
+	return
+}
+
+func (m *MatcherSpecification) explainTree(t *tree, msg *Message) (bool, []MatchTest) {
+	if t == nil {
+		return false, nil
+	}
+	if t.stmt.op.tokenId == OP_NOT {
+		b, deciders := m.explainTree(t.left, msg)
+		return !b, deciders
+	}
+	if t.left == nil {
+		b := testExpr(msg, t.stmt)
+		field, value := explainValue(msg, t.stmt)
+		test := MatchTest{
+			Test:   strings.TrimSpace(m.spec[t.start:t.end]),
+			Field:  field,
+			Value:  value,
+			Result: b,
+		}
+		return b, []MatchTest{test}
+	}
+
+	// The result of the chain as soon as one operand has this value.
+	decisive := t.stmt.op.tokenId == OP_OR
+	operands, _ := orderedOperands(t)
+	var all []MatchTest
+	for _, operand := range operands {
+		b, deciders := m.explainTree(operand, msg)
+		if b == decisive {
+			return b, deciders // short circuit
+		}
+		all = append(all, deciders...)
+	}
+	// Every operand was needed to get the result.
+	return !decisive, all
+}
+
+// Returns the name of the variable tested by stmt and its value in the
+// message.
+func explainValue(msg *Message, stmt *Statement) (field, value string) {
+	switch stmt.op.tokenId {
+	case TRUE, FALSE:
+		return
+	}
+	field = stmt.field.token
+	switch stmt.field.tokenId {
+	case VAR_UUID, VAR_TYPE, VAR_LOGGER, VAR_PAYLOAD, VAR_ENVVERSION,
+		VAR_HOSTNAME:
+		value = strconv.Quote(getStringValue(msg, stmt))
+	case VAR_TIMESTAMP, VAR_SEVERITY, VAR_PID:
+		value = strconv.FormatFloat(getNumericValue(msg, stmt), 'f', -1, 64)
+	case VAR_FIELDS:
+		fi := stmt.field.fieldIndex
+		ai := stmt.field.arrayIndex
+		if fi != 0 || ai != 0 {
+			field = fmt.Sprintf("Fields[%s][%d][%d]", field, fi, ai)
+		} else {
+			field = fmt.Sprintf("Fields[%s]", field)
+		}
+		value = explainField(findField(msg, stmt.field.token, fi), ai)
+	}
+	return
+}
+
+func explainField(field *Field, ai int) string {
+	const missing = "<missing>"
+	if field == nil {
+		return missing
+	}
+	switch field.GetValueType() {
+	case Field_STRING:
+		if ai < len(field.ValueString) {
+			return strconv.Quote(field.ValueString[ai])
+		}
+	case Field_BYTES:
+		if ai < len(field.ValueBytes) {
+			return strconv.Quote(string(field.ValueBytes[ai]))
+		}
+	case Field_INTEGER:
+		if ai < len(field.ValueInteger) {
+			return strconv.FormatInt(field.ValueInteger[ai], 10)
+		}
+	case Field_DOUBLE:
+		if ai < len(field.ValueDouble) {
+			return strconv.FormatFloat(field.ValueDouble[ai], 'g', -1, 64)
+		}
+	case Field_BOOL:
+		if ai < len(field.ValueBool) {
+			return strconv.FormatBool(field.ValueBool[ai])
+		}
+	}
+	return missing
+}
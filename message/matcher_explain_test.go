@@ -0,0 +1,91 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"github.com/rafrombrc/gospec/src/gospec"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func MatcherExplainSpec(c gospec.Context) {
+	msg := getTestMessage()
+
+	explain := func(spec string) MatchExplanation {
+		ms, err := CreateMatcherSpecification(spec)
+		c.Assume(err, gs.IsNil)
+		return ms.Explain(msg)
+	}
+
+	c.Specify("An explanation", func() {
+		c.Specify("names the failing operand of an &&", func() {
+			e := explain("Type == 'TEST' && Fields[number] > 100 && Severity < 7")
+			c.Expect(e.Matched, gs.IsFalse)
+			c.Assume(len(e.Deciders), gs.Equals, 1)
+			c.Expect(e.Deciders[0], gs.Equals, MatchTest{
+				Test:   "Fields[number] > 100",
+				Field:  "Fields[number]",
+				Value:  "64",
+				Result: false,
+			})
+		})
+
+		c.Specify("names the satisfied operand of an ||", func() {
+			e := explain("(Logger == 'x' || startswith(Type, 'TE')) && TRUE")
+			c.Expect(e.Matched, gs.IsTrue)
+			c.Assume(len(e.Deciders), gs.Equals, 2)
+			// The constant is the cheapest operand, it's evaluated first.
+			c.Expect(e.Deciders[0].Test, gs.Equals, "TRUE")
+			c.Expect(e.Deciders[0].Field, gs.Equals, "")
+			c.Expect(e.Deciders[1].Test, gs.Equals, "startswith(Type, 'TE')")
+			c.Expect(e.Deciders[1].Field, gs.Equals, "Type")
+			c.Expect(e.Deciders[1].Value, gs.Equals, `"TEST"`)
+		})
+
+		c.Specify("evaluates the operands in the order Match does", func() {
+			// The field lookup costs more than the Type test, which
+			// decides the result first.
+			e := explain("Fields[number] > 100 && Type == 'x'")
+			c.Expect(e.Matched, gs.IsFalse)
+			c.Assume(len(e.Deciders), gs.Equals, 1)
+			c.Expect(e.Deciders[0].Test, gs.Equals, "Type == 'x'")
+		})
+
+		c.Specify("lists every operand when all were needed", func() {
+			e := explain("Type IN ('a', 'b') || Fields[missing][1][0] != NIL")
+			c.Expect(e.Matched, gs.IsFalse)
+			c.Assume(len(e.Deciders), gs.Equals, 2)
+			c.Expect(e.Deciders[0].Test, gs.Equals, "Type IN ('a', 'b')")
+			c.Expect(e.Deciders[1].Test, gs.Equals, "Fields[missing][1][0] != NIL")
+			c.Expect(e.Deciders[1].Value, gs.Equals, "<missing>")
+		})
+
+		c.Specify("looks through negations", func() {
+			e := explain("!(Severity == 6)")
+			c.Expect(e.Matched, gs.IsFalse)
+			c.Assume(len(e.Deciders), gs.Equals, 1)
+			c.Expect(e.Deciders[0].Test, gs.Equals, "Severity == 6")
+			c.Expect(e.Deciders[0].Value, gs.Equals, "6")
+			c.Expect(e.Deciders[0].Result, gs.IsTrue)
+		})
+
+		c.Specify("doesn't count as a match", func() {
+			ms, err := CreateMatcherSpecification("TRUE")
+			c.Assume(err, gs.IsNil)
+			c.Expect(ms.Explain(msg).Matched, gs.IsTrue)
+			evaluations, _ := ms.Stats()
+			c.Expect(evaluations, gs.Equals, int64(0))
+		})
+	})
+}
@@ -0,0 +1,189 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+// Header fields the matchers are indexed on, in order of preference.
+var indexedVariables = []int{VAR_TYPE, VAR_LOGGER, VAR_HOSTNAME}
+
+// MatcherIndex narrows down the matchers a message has to be tested against.
+// A matcher that can only match messages with one of a set of Type, Logger
+// or Hostname values (e.g. "Type == 'a' && Severity < 4", "Logger == 'a' ||
+// Logger == 'b'" or "Hostname IN ('a', 'b')") is indexed on those values, any other matcher is a
+// candidate for every message. The index doesn't evaluate the matchers, the
+// candidates still have to be tested with Match.
+type MatcherIndex struct {
+	byValue   map[int]map[string][]int
+	unindexed []int
+	keys      map[int]indexKey
+}
+
+type indexKey struct {
+	variable int
+	values   []string
+}
+
+func NewMatcherIndex() *MatcherIndex {
+	idx := &MatcherIndex{
+		byValue: make(map[int]map[string][]int, len(indexedVariables)),
+		keys:    make(map[int]indexKey),
+	}
+	for _, v := range indexedVariables {
+		idx.byValue[v] = make(map[string][]int)
+	}
+	return idx
+}
+
+// Add indexes the matcher under the id, replacing any matcher previously
+// added with the same id. A nil matcher is a candidate for every message.
+func (idx *MatcherIndex) Add(id int, spec *MatcherSpecification) {
+	idx.Remove(id)
+	var key indexKey
+	ok := false
+	if spec != nil {
+		key, ok = treeIndexKey(spec.vm)
+	}
+	if !ok {
+		idx.unindexed = append(idx.unindexed, id)
+		key.variable = 0
+	}
+	idx.keys[id] = key
+	for _, value := range key.values {
+		idx.byValue[key.variable][value] = append(idx.byValue[key.variable][value], id)
+	}
+}
+
+// Remove drops the matcher indexed under the id.
+func (idx *MatcherIndex) Remove(id int) {
+	key, ok := idx.keys[id]
+	if !ok {
+		return
+	}
+	delete(idx.keys, id)
+	if key.variable == 0 {
+		idx.unindexed = removeId(idx.unindexed, id)
+		return
+	}
+	values := idx.byValue[key.variable]
+	for _, value := range key.values {
+		if ids := removeId(values[value], id); len(ids) > 0 {
+			values[value] = ids
+		} else {
+			delete(values, value)
+		}
+	}
+}
+
+// Indexed reports whether the matcher added under the id is indexed, as
+// opposed to being a candidate for every message.
+func (idx *MatcherIndex) Indexed(id int) bool {
+	key, ok := idx.keys[id]
+	return ok && key.variable != 0
+}
+
+// Candidates appends the ids of the matchers that may match the message to
+// ids and returns the extended slice. Every id is appended at most once.
+func (idx *MatcherIndex) Candidates(msg *Message, ids []int) []int {
+	ids = append(ids, idx.unindexed...)
+	if values := idx.byValue[VAR_TYPE]; len(values) > 0 {
+		ids = append(ids, values[msg.GetType()]...)
+	}
+	if values := idx.byValue[VAR_LOGGER]; len(values) > 0 {
+		ids = append(ids, values[msg.GetLogger()]...)
+	}
+	if values := idx.byValue[VAR_HOSTNAME]; len(values) > 0 {
+		ids = append(ids, values[msg.GetHostname()]...)
+	}
+	return ids
+}
+
+func removeId(ids []int, id int) []int {
+	for i, v := range ids {
+		if v == id {
+			return append(ids[:i], ids[i+1:]...)
+		}
+	}
+	return ids
+}
+
+func variablePreference(variable int) int {
+	for i, v := range indexedVariables {
+		if v == variable {
+			return i
+		}
+	}
+	return len(indexedVariables)
+}
+
+// Works out the header field values a message must have for the tree to
+// match it. For an AND either side's values will do, the preferred variable
+// or smallest set wins; for an OR both sides must constrain the same
+// variable and their values are combined. Anything else can't be indexed.
+func treeIndexKey(t *tree) (key indexKey, ok bool) {
+	if t == nil {
+		return
+	}
+	if t.left == nil {
+		stmt := t.stmt
+		if stmt.value.tokenId != STRING_VALUE || stmt.field.function != 0 ||
+			variablePreference(stmt.field.tokenId) == len(indexedVariables) {
+			return
+		}
+		switch stmt.op.tokenId {
+		case OP_EQ:
+			return indexKey{stmt.field.tokenId, []string{stmt.value.token}}, true
+		case OP_IN:
+			return indexKey{stmt.field.tokenId, stmt.value.set.sortedStrings()}, true
+		}
+		return
+	}
+
+	left, lok := treeIndexKey(t.left)
+	right, rok := treeIndexKey(t.right)
+	switch t.stmt.op.tokenId {
+	case OP_AND:
+		switch {
+		case lok && rok:
+			lp, rp := variablePreference(left.variable), variablePreference(right.variable)
+			if rp < lp || rp == lp && len(right.values) < len(left.values) {
+				return right, true
+			}
+			return left, true
+		case lok:
+			return left, true
+		case rok:
+			return right, true
+		}
+	case OP_OR:
+		if lok && rok && left.variable == right.variable {
+			values := left.values
+			for _, v := range right.values {
+				if !containsString(values, v) {
+					values = append(values, v)
+				}
+			}
+			return indexKey{left.variable, values}, true
+		}
+	}
+	return
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
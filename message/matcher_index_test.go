@@ -0,0 +1,153 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/rafrombrc/gospec/src/gospec"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func MatcherIndexSpec(c gospec.Context) {
+	msg := getTestMessage()
+	msg.SetHostname("example.com")
+
+	c.Specify("A MatcherIndex", func() {
+		idx := NewMatcherIndex()
+		add := func(id int, spec string) {
+			ms, err := CreateMatcherSpecification(spec)
+			c.Assume(err, gs.IsNil)
+			idx.Add(id, ms)
+		}
+		candidates := func() []int {
+			ids := idx.Candidates(msg, nil)
+			sort.Ints(ids)
+			return ids
+		}
+
+		c.Specify("indexes header equality tests", func() {
+			indexed := []string{
+				"Type == 'TEST'",
+				"Type == 'TEST' && Severity == 6",
+				"Severity == 6 && Logger == 'GoSpec'",
+				"Type == 'other' || Type == 'TEST'",
+				"(Type == 'a' || Type == 'b') && Fields[foo] == 'bar'",
+				"Hostname == 'example.com' && Type == 'TEST'",
+				"Logger == 'GoSpec' && Type == 'TEST'",
+				"Type IN ('a', 'TEST') && !(Severity > 6)",
+				"Hostname IN ('a', 'b') || Hostname == 'c'",
+			}
+			for i, spec := range indexed {
+				add(i, spec)
+				c.Expect(idx.Indexed(i), gs.IsTrue)
+			}
+			c.Expect(fmt.Sprint(candidates()), gs.Equals, "[0 1 2 3 5 6 7]")
+		})
+
+		c.Specify("leaves other matchers unindexed", func() {
+			unindexed := []string{
+				"TRUE",
+				"Type != 'TEST'",
+				"Type =~ /TEST/",
+				"Type == 'TEST' || Logger == 'GoSpec'",
+				"Type == 'TEST' || Severity == 6",
+				"Fields[foo] == 'bar'",
+				"Payload == 'Test Payload'",
+				"Type NOT IN ('a', 'b')",
+				"!(Type == 'TEST')",
+				"startswith(Type, 'TE')",
+				"len(Logger) == 6",
+			}
+			for i, spec := range unindexed {
+				add(i, spec)
+				c.Expect(idx.Indexed(i), gs.IsFalse)
+			}
+			c.Expect(fmt.Sprint(candidates()), gs.Equals, "[0 1 2 3 4 5 6 7 8 9 10]")
+		})
+
+		c.Specify("only returns matchers that may match", func() {
+			add(0, "Type == 'other'")
+			add(1, "Logger == 'other' && TRUE")
+			add(2, "Hostname == 'example.com'")
+			c.Expect(fmt.Sprint(candidates()), gs.Equals, "[2]")
+		})
+
+		c.Specify("removes and replaces matchers", func() {
+			add(0, "Type == 'TEST'")
+			add(1, "TRUE")
+			add(2, "Type == 'TEST' || Type == 'other'")
+			idx.Remove(0)
+			idx.Remove(1)
+			c.Expect(fmt.Sprint(candidates()), gs.Equals, "[2]")
+			add(2, "Type == 'other'")
+			c.Expect(len(candidates()), gs.Equals, 0)
+			add(2, "FALSE")
+			c.Expect(fmt.Sprint(candidates()), gs.Equals, "[2]")
+		})
+	})
+}
+
+// Matchers typical of a large configuration, most of them test the Type.
+func benchmarkMatchers(n int) []*MatcherSpecification {
+	specs := make([]*MatcherSpecification, n)
+	for i := range specs {
+		var s string
+		switch i % 10 {
+		case 0:
+			s = fmt.Sprintf("Logger == 'logger%d'", i)
+		case 1:
+			s = fmt.Sprintf("Fields[name] == 'field%d'", i)
+		default:
+			s = fmt.Sprintf("Type == 'type%d' && Severity <= 6", i)
+		}
+		specs[i], _ = CreateMatcherSpecification(s)
+	}
+	return specs
+}
+
+// The router sends every message to every matcher, which evaluates it.
+func BenchmarkRouteFanOut150(b *testing.B) {
+	specs := benchmarkMatchers(150)
+	msg := getTestMessage()
+	msg.SetType("type42")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, ms := range specs {
+			ms.Match(msg)
+		}
+	}
+}
+
+// The router only sends the message to the candidate matchers.
+func BenchmarkRouteIndexed150(b *testing.B) {
+	specs := benchmarkMatchers(150)
+	idx := NewMatcherIndex()
+	for i, ms := range specs {
+		idx.Add(i, ms)
+	}
+	msg := getTestMessage()
+	msg.SetType("type42")
+	var ids []int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ids = idx.Candidates(msg, ids[:0])
+		for _, id := range ids {
+			specs[id].Match(msg)
+		}
+	}
+}
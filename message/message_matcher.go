@@ -14,12 +14,20 @@
 
 package message
 
-import "strings"
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
 
 // MatcherSpecification used by the message router to distribute messages
 type MatcherSpecification struct {
-	vm   *tree
-	spec string
+	evaluations int64
+	matches     int64
+	vm          *tree
+	match       matchFunc
+	spec        string
 }
 
 // CreateMatcherSpecification compiles the spec string into a simple
@@ -31,13 +39,25 @@ func CreateMatcherSpecification(spec string) (*MatcherSpecification, error) {
 	if err != nil {
 		return nil, err
 	}
+	ms.match = compileMatcher(ms.vm)
 	return ms, nil
 }
 
 // Match compares the message against the matcher spec and return the match
 // result
 func (m *MatcherSpecification) Match(message *Message) bool {
-	return evalMatcherSpecification(m.vm, message)
+	atomic.AddInt64(&m.evaluations, 1)
+	if m.match == nil || !m.match(message) {
+		return false
+	}
+	atomic.AddInt64(&m.matches, 1)
+	return true
+}
+
+// Stats returns the number of messages the spec has been matched against and
+// how many of them matched.
+func (m *MatcherSpecification) Stats() (evaluations, matches int64) {
+	return atomic.LoadInt64(&m.evaluations), atomic.LoadInt64(&m.matches)
 }
 
 // String outputs the spec as text
@@ -45,11 +65,15 @@ func (m *MatcherSpecification) String() string {
 	return m.spec
 }
 
+// Interprets the parse tree, the compiled matcher must give the same results.
 func evalMatcherSpecification(t *tree, msg *Message) (b bool) {
 	if t == nil {
 		return false
 	}
 
+	if t.stmt.op.tokenId == OP_NOT {
+		return !evalMatcherSpecification(t.left, msg)
+	}
 	if t.left != nil {
 		b = evalMatcherSpecification(t.left, msg)
 	} else {
@@ -99,6 +123,9 @@ func getNumericValue(msg *Message, stmt *Statement) float64 {
 }
 
 func stringTest(s string, stmt *Statement) bool {
+	if stmt.field.function == FN_LEN {
+		return numericTest(float64(utf8.RuneCountInString(s)), stmt)
+	}
 	if stmt.value.tokenId == NUMERIC_VALUE {
 		return false
 	}
@@ -137,6 +164,19 @@ func stringTest(s string, stmt *Statement) bool {
 		} else if stmt.value.fieldIndex == ENDS_WITH {
 			return !strings.HasSuffix(s, stmt.value.token)
 		}
+	case OP_IN:
+		return stmt.value.set.strings[s]
+	case OP_NOT_IN:
+		return !stmt.value.set.strings[s]
+	case FN_STARTSWITH:
+		return strings.HasPrefix(s, stmt.value.token)
+	case FN_ENDSWITH:
+		return strings.HasSuffix(s, stmt.value.token)
+	case FN_CONTAINS:
+		return strings.Contains(s, stmt.value.token)
+	case OP_CIDR:
+		ip := net.ParseIP(s)
+		return ip != nil && stmt.value.ipnet.Contains(ip)
 	}
 	return false
 }
@@ -164,6 +204,10 @@ func numericTest(f float64, stmt *Statement) bool {
 		return (f > stmt.value.double)
 	case OP_GTE:
 		return (f >= stmt.value.double)
+	case OP_IN:
+		return stmt.value.set.numbers[f]
+	case OP_NOT_IN:
+		return !stmt.value.set.numbers[f]
 	}
 	return false
 }
@@ -216,11 +260,17 @@ func testExpr(msg *Message, stmt *Statement) bool {
 				if ai >= len(field.ValueInteger) {
 					return testNonExistence(stmt)
 				}
+				if stmt.field.function == FN_LEN {
+					return false
+				}
 				return numericTest(float64(field.ValueInteger[ai]), stmt)
 			case Field_DOUBLE:
 				if ai >= len(field.ValueDouble) {
 					return testNonExistence(stmt)
 				}
+				if stmt.field.function == FN_LEN {
+					return false
+				}
 				return numericTest(field.ValueDouble[ai], stmt)
 			case Field_BOOL:
 				if ai >= len(field.ValueBool) {
@@ -233,9 +283,10 @@ func testExpr(msg *Message, stmt *Statement) bool {
 					return true
 				}
 				b := field.ValueBool[ai]
-				if stmt.value.tokenId == TRUE {
+				switch stmt.value.tokenId {
+				case TRUE:
 					return (b == true)
-				} else {
+				case FALSE:
 					return (b == false)
 				}
 			}
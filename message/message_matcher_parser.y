@@ -3,9 +3,11 @@ package message
 
 import (
 	"fmt"
-	"log"
+	"net"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"unicode/utf8"
 )
@@ -28,7 +30,16 @@ var variables = map[string]int{
 	"Fields":     VAR_FIELDS,
 	"TRUE":       TRUE,
 	"FALSE":      FALSE,
-	"NIL":        NIL_VALUE}
+	"NIL":        NIL_VALUE,
+	"IN":         OP_IN}
+
+var functions = map[string]int{
+	"startswith": FN_STARTSWITH,
+	"endswith":   FN_ENDSWITH,
+	"contains":   FN_CONTAINS,
+	"len":        FN_LEN,
+	"has":        FN_HAS,
+	"in_cidr":    OP_CIDR}
 
 var parseLock sync.Mutex
 
@@ -37,9 +48,15 @@ type Statement struct {
 }
 
 type tree struct {
-	left  *tree
-	stmt  *Statement
-	right *tree
+	left       *tree
+	stmt       *Statement
+	right      *tree
+	start, end int // span of a test in the spec text
+}
+
+// Returns the node of a test spanning the spec text from first to last.
+func leaf(first, last yySymType, stmt *Statement) *tree {
+	return &tree{stmt: stmt, start: first.pos, end: last.end}
 }
 
 type stack struct {
@@ -66,8 +83,35 @@ func (s *stack) pop() (node *tree) {
 	return nil
 }
 
+// Set of values tested by the IN and NOT IN operators.
+type valueSet struct {
+	strings map[string]bool
+	numbers map[float64]bool
+}
+
+func newValueSet() *valueSet {
+	return &valueSet{
+		strings: make(map[string]bool),
+		numbers: make(map[float64]bool),
+	}
+}
+
+// Returns the set's strings in sorted order.
+func (vs *valueSet) sortedStrings() []string {
+	values := make([]string, 0, len(vs.strings))
+	for s := range vs.strings {
+		values = append(values, s)
+	}
+	sort.Strings(values)
+	return values
+}
+
 var nodes []*tree
 
+func init() {
+	yyErrorVerbose = true
+}
+
 %}
 
 %union {
@@ -77,6 +121,11 @@ var nodes []*tree
    fieldIndex  int
    arrayIndex  int
    regexp      *regexp.Regexp
+   set         *valueSet
+   ipnet       *net.IPNet
+   function    int
+   pos         int
+   end         int
 }
 
 %token OP_EQ OP_NE OP_GT OP_GTE OP_LT OP_LTE OP_RE OP_NRE
@@ -86,10 +135,14 @@ var nodes []*tree
 %token VAR_FIELDS
 %token STRING_VALUE NUMERIC_VALUE REGEXP_VALUE NIL_VALUE
 %token TRUE FALSE
+%token OP_IN OP_NOT_IN OP_CIDR OP_NOT
+%token FN_STARTSWITH FN_ENDSWITH FN_CONTAINS FN_LEN FN_HAS
+%token LEX_ERROR
 
 %start spec
 %left OP_OR
 %left OP_AND
+%right OP_NOT
 
 %%
 
@@ -120,47 +173,127 @@ numeric_vars : VAR_TIMESTAMP
    | VAR_SEVERITY
    | VAR_PID
 ;
+set_op : OP_IN
+   | OP_NOT_IN
+;
+string_fn : FN_STARTSWITH
+   | FN_ENDSWITH
+   | FN_CONTAINS
+;
+string_list : STRING_VALUE
+      {
+      $$ = $1
+      $$.set = newValueSet()
+      $$.set.strings[$1.token] = true
+      }
+   | string_list ',' STRING_VALUE
+      {
+      $$ = $1
+      $$.set.strings[$3.token] = true
+      }
+;
+numeric_list : NUMERIC_VALUE
+      {
+      $$ = $1
+      $$.set = newValueSet()
+      $$.set.numbers[$1.double] = true
+      }
+   | numeric_list ',' NUMERIC_VALUE
+      {
+      $$ = $1
+      $$.set.numbers[$3.double] = true
+      }
+;
 string_test : string_vars relational STRING_VALUE
        {
        //fmt.Println("string_test", $1, $2, $3)
-       nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+       nodes = append(nodes, leaf($1, $3, &Statement{$1, $2, $3}))
        }
    |   string_vars regexp REGEXP_VALUE
        {
        //fmt.Println("string_test regexp", $1, $2, $3)
-       nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+       nodes = append(nodes, leaf($1, $3, &Statement{$1, $2, $3}))
+       }
+   |   string_vars set_op '(' string_list ')'
+       {
+       nodes = append(nodes, leaf($1, $5, &Statement{$1, $2, $4}))
+       }
+   |   string_vars OP_CIDR STRING_VALUE
+       {
+       nodes = append(nodes, leaf($1, $3, &Statement{$1, $2, $3}))
+       }
+   |   string_fn '(' string_vars ',' STRING_VALUE ')'
+       {
+       nodes = append(nodes, leaf($1, $6, &Statement{$3, $1, $5}))
+       }
+   |   FN_LEN '(' string_vars ')' relational NUMERIC_VALUE
+       {
+       $3.function = FN_LEN
+       nodes = append(nodes, leaf($1, $6, &Statement{$3, $5, $6}))
        }
 ;
 numeric_test : numeric_vars relational NUMERIC_VALUE
    {
    //fmt.Println("numeric_test", $1, $2, $3)
-   nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+   nodes = append(nodes, leaf($1, $3, &Statement{$1, $2, $3}))
+   }
+   | numeric_vars set_op '(' numeric_list ')'
+   {
+   nodes = append(nodes, leaf($1, $5, &Statement{$1, $2, $4}))
    }
 ;
 field_test : VAR_FIELDS relational NUMERIC_VALUE
       {
       //fmt.Println("field_test numeric", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      nodes = append(nodes, leaf($1, $3, &Statement{$1, $2, $3}))
       }
    | VAR_FIELDS relational STRING_VALUE
       {
       //fmt.Println("field_test string", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      nodes = append(nodes, leaf($1, $3, &Statement{$1, $2, $3}))
       }
    | VAR_FIELDS OP_EQ boolean
       {
       //fmt.Println("field_test boolean", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      nodes = append(nodes, leaf($1, $3, &Statement{$1, $2, $3}))
       }
    | VAR_FIELDS regexp REGEXP_VALUE
       {
       //fmt.Println("field_test regexp", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      nodes = append(nodes, leaf($1, $3, &Statement{$1, $2, $3}))
       }
    | VAR_FIELDS eqneq NIL_VALUE
       {
       //fmt.Println("field_test existence", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      nodes = append(nodes, leaf($1, $3, &Statement{$1, $2, $3}))
+      }
+   | VAR_FIELDS set_op '(' string_list ')'
+      {
+      nodes = append(nodes, leaf($1, $5, &Statement{$1, $2, $4}))
+      }
+   | VAR_FIELDS set_op '(' numeric_list ')'
+      {
+      nodes = append(nodes, leaf($1, $5, &Statement{$1, $2, $4}))
+      }
+   | VAR_FIELDS OP_CIDR STRING_VALUE
+      {
+      nodes = append(nodes, leaf($1, $3, &Statement{$1, $2, $3}))
+      }
+   | string_fn '(' VAR_FIELDS ',' STRING_VALUE ')'
+      {
+      nodes = append(nodes, leaf($1, $6, &Statement{$3, $1, $5}))
+      }
+   | FN_LEN '(' VAR_FIELDS ')' relational NUMERIC_VALUE
+      {
+      $3.function = FN_LEN
+      nodes = append(nodes, leaf($1, $6, &Statement{$3, $5, $6}))
+      }
+   | FN_HAS '(' VAR_FIELDS ')'
+      {
+      // has(Fields[x]) is the same test as Fields[x] != NIL
+      nodes = append(nodes, leaf($1, $4, &Statement{$3,
+         yySymType{tokenId: OP_NE, token: "!="},
+         yySymType{tokenId: NIL_VALUE, token: "NIL"}}))
       }
 ;
 boolean : TRUE | FALSE
@@ -178,23 +311,32 @@ expr : '(' expr ')'
       //fmt.Println("or", $1, $2, $3)
       nodes = append(nodes, &tree{stmt:&Statement{op:$2}})
       }
+   | OP_NOT expr
+      {
+      nodes = append(nodes, &tree{stmt:&Statement{op:$1}})
+      }
    | string_test
    | numeric_test
    | field_test
    | boolean
       {
          //fmt.Println("boolean", $1)
-         nodes = append(nodes, &tree{stmt:&Statement{op:$1}})
+         nodes = append(nodes, leaf($1, $1, &Statement{op:$1}))
       }
 ;
 
 %%
 
 type MatcherSpecificationParser struct {
-	spec     string
-	sym      string
-	peekrune rune
-	lexPos   int
+	spec      string
+	sym       string
+	peekrune  rune
+	lexPos    int
+	runePos   int // start of the last rune read
+	tokenPos  int // start of the last token
+	tokenEnd  int
+	lastToken int
+	err       string
     reToken *regexp.Regexp
 }
 
@@ -209,7 +351,10 @@ func parseMatcherSpecification(ms *MatcherSpecification) error {
 	if yyParse(&msp) == 0 {
 		s := new(stack)
 		for _, node := range nodes {
-			if node.stmt.op.tokenId != OP_OR &&
+			if node.stmt.op.tokenId == OP_NOT {
+				node.left = s.pop()
+				s.push(node)
+			} else if node.stmt.op.tokenId != OP_OR &&
 				node.stmt.op.tokenId != OP_AND {
 				s.push(node)
 			} else {
@@ -221,14 +366,41 @@ func parseMatcherSpecification(ms *MatcherSpecification) error {
 		ms.vm = s.pop()
 		return nil
 	}
-	return fmt.Errorf("syntax error: last token: %s pos: %d", msp.sym, msp.lexPos)
+	near := "end of input"
+	if msp.tokenPos < len(msp.spec) && msp.tokenPos < msp.tokenEnd {
+		near = strconv.Quote(strings.TrimSpace(msp.spec[msp.tokenPos:msp.tokenEnd]))
+	}
+	return fmt.Errorf("syntax error at position %d near %s: %s", msp.tokenPos, near,
+		msp.err)
 }
 
+// Error records the first error reported by the parser or the lexer.
 func (m *MatcherSpecificationParser) Error(s string) {
-	fmt.Errorf("syntax error: %s last token: %s pos: %d", m.sym, m.lexPos)
+	if m.err == "" {
+		m.err = strings.TrimPrefix(s, "syntax error: ")
+	}
+}
+
+// Records a lexing error, the returned token makes the parse fail.
+func (m *MatcherSpecificationParser) lexError(format string, args ...interface{}) int {
+	m.Error(fmt.Sprintf(format, args...))
+	return LEX_ERROR
 }
 
 func (m *MatcherSpecificationParser) Lex(yylval *yySymType) int {
+	tokenId := m.lex(yylval)
+	if m.peekrune == ' ' {
+		m.tokenEnd = m.lexPos
+	} else {
+		m.tokenEnd = m.runePos
+	}
+	yylval.pos = m.tokenPos
+	yylval.end = m.tokenEnd
+	m.lastToken = tokenId
+	return tokenId
+}
+
+func (m *MatcherSpecificationParser) lex(yylval *yySymType) int {
 	var err error
 	var c, tmp rune
 	var i int
@@ -239,14 +411,21 @@ func (m *MatcherSpecificationParser) Lex(yylval *yySymType) int {
 	yylval.fieldIndex = 0
 	yylval.arrayIndex = 0
 	yylval.regexp = nil
+	yylval.set = nil
+	yylval.ipnet = nil
+	yylval.function = 0
 
 	c = m.peekrune
 	m.peekrune = ' '
 
 loop:
+	m.tokenPos = m.runePos
 	if c >= 'A' && c <= 'Z' {
 		goto variable
 	}
+	if c >= 'a' && c <= 'z' {
+		goto function
+	}
 	if (c >= '0' && c <= '9') || c == '.' {
 		goto number
 	}
@@ -263,7 +442,7 @@ loop:
 			yylval.token = "=~"
 			yylval.tokenId = OP_RE
 		} else {
-			break
+			return m.lexError("unexpected '='")
 		}
 		return yylval.tokenId
 	case '!':
@@ -275,7 +454,9 @@ loop:
 			yylval.token = "!~"
 			yylval.tokenId = OP_NRE
 		} else {
-			break
+			m.peekrune = c
+			yylval.token = "!"
+			yylval.tokenId = OP_NOT
 		}
 		return yylval.tokenId
 	case '>':
@@ -303,7 +484,7 @@ loop:
 	case '|':
 		c = m.getrune()
 		if c != '|' {
-			break
+			return m.lexError("unexpected '|'")
 		}
 		yylval.token = "||"
 		yylval.tokenId = OP_OR
@@ -311,7 +492,7 @@ loop:
 	case '&':
 		c = m.getrune()
 		if c != '&' {
-			break
+			return m.lexError("unexpected '&'")
 		}
 		yylval.token = "&&"
 		yylval.tokenId = OP_AND
@@ -332,21 +513,41 @@ variable:
 			break
 		}
 	}
+	if m.sym == "NOT" {
+		for c == ' ' || c == '\t' {
+			c = m.getrune()
+		}
+		m.sym = ""
+		for rvariable(c) {
+			m.sym += string(c)
+			c = m.getrune()
+		}
+		if m.sym != "IN" {
+			return m.lexError("expected IN after NOT")
+		}
+		m.peekrune = c
+		yylval.token = "NOT IN"
+		yylval.tokenId = OP_NOT_IN
+		return yylval.tokenId
+	}
 	yylval.tokenId = variables[m.sym]
+	if yylval.tokenId == 0 {
+		return m.lexError("unknown variable %s", m.sym)
+	}
 	if yylval.tokenId == VAR_FIELDS {
 		if c != '[' {
-			return 0
+			return m.lexError("expected [ after Fields")
 		}
 		var bracketCount int
 		var idx [3]string
 		for {
 			c = m.getrune()
 			if c == 0 {
-				return 0
+				return m.lexError("unterminated field reference")
 			}
 			if c == ']' { // a closing bracket in the variable name will fail validation
 				if len(idx[bracketCount]) == 0 {
-					return 0
+					return m.lexError("empty field reference")
 				}
 				bracketCount++
 				m.peekrune = m.getrune()
@@ -363,7 +564,7 @@ variable:
 					if ddigit(c) {
 						idx[bracketCount] += string(c)
 					} else {
-						return 0
+						return m.lexError("invalid field index")
 					}
 				}
 			}
@@ -378,11 +579,11 @@ variable:
 		yylval.token = idx[0]
 		yylval.fieldIndex, err = strconv.Atoi(idx[1])
 		if err != nil {
-			return 0
+			return m.lexError("invalid field index")
 		}
 		yylval.arrayIndex, err = strconv.Atoi(idx[2])
 		if err != nil {
-			return 0
+			return m.lexError("invalid array index")
 		}
 	} else {
 		yylval.token = m.sym
@@ -402,8 +603,7 @@ number:
 	m.peekrune = c
 	yylval.double, err = strconv.ParseFloat(m.sym, 64)
 	if err != nil {
-		log.Printf("error converting %v\n", m.sym)
-		yylval.double = 0
+		return m.lexError("invalid number %s", m.sym)
 	}
 	yylval.token = m.sym
 	yylval.tokenId = NUMERIC_VALUE
@@ -415,7 +615,7 @@ quotestring:
 	for {
 		c = m.getrune()
 		if c == 0 {
-			return 0
+			return m.lexError("unterminated string")
 		}
 		if c == '\\' {
 			m.peekrune = m.getrune()
@@ -433,16 +633,35 @@ quotestring:
 		}
 		m.sym += string(c)
 	}
+	if m.lastToken == OP_CIDR {
+		if yylval.ipnet = parseCIDR(m.sym); yylval.ipnet == nil {
+			return m.lexError("invalid CIDR %q", m.sym)
+		}
+	}
 	yylval.token = m.sym
 	yylval.tokenId = STRING_VALUE
 	return yylval.tokenId
 
+function:
+	m.sym = ""
+	for rfunction(c) {
+		m.sym += string(c)
+		c = m.getrune()
+	}
+	m.peekrune = c
+	yylval.tokenId = functions[m.sym]
+	if yylval.tokenId == 0 {
+		return m.lexError("unknown function %s", m.sym)
+	}
+	yylval.token = m.sym
+	return yylval.tokenId
+
 regexpstring:
 	m.sym = ""
 	for {
 		c = m.getrune()
 		if c == 0 {
-			return 0
+			return m.lexError("unterminated regexp")
 		}
 		if c == '\\' {
 			m.peekrune = m.getrune()
@@ -460,6 +679,24 @@ regexpstring:
 		}
 		m.sym += string(c)
 	}
+	// Flags following the closing slash, e.g. /error/i
+	var flags string
+	for c = m.getrune(); c >= 'a' && c <= 'z'; c = m.getrune() {
+		if !strings.ContainsRune("ims", c) {
+			return m.lexError("invalid regexp flag %q", c)
+		}
+		flags += string(c)
+	}
+	m.peekrune = c
+	if flags != "" {
+		yylval.regexp, err = regexp.Compile("(?" + flags + ")" + m.sym)
+		if err != nil {
+			return m.lexError("invalid regexp /%s/%s: %s", m.sym, flags, err)
+		}
+		yylval.token = m.sym
+		yylval.tokenId = REGEXP_VALUE
+		return yylval.tokenId
+	}
 	rlen := len(m.sym)
 	if rlen > 0 && m.sym[0] == '^' {
 		if re, err := regexp.Compile(m.sym[1:]); err == nil {
@@ -483,14 +720,28 @@ regexpstring:
 	}
 	yylval.regexp, err = regexp.Compile(m.sym)
 	if err != nil {
-		log.Printf("invalid regexp %v\n", m.sym)
-		return 0
+		return m.lexError("invalid regexp /%s/: %s", m.sym, err)
 	}
 	yylval.token = m.sym
 	yylval.tokenId = REGEXP_VALUE
 	return yylval.tokenId
 }
 
+// Parses a CIDR block, a plain address is treated as a single host block.
+func parseCIDR(s string) *net.IPNet {
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		return ipnet
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
 func rvariable(c rune) bool {
 	if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') {
 		return true
@@ -498,6 +749,10 @@ func rvariable(c rune) bool {
 	return false
 }
 
+func rfunction(c rune) bool {
+	return (c >= 'a' && c <= 'z') || c == '_'
+}
+
 func rdigit(c rune) bool {
 	switch c {
 	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9',
@@ -520,8 +775,10 @@ func (m *MatcherSpecificationParser) getrune() rune {
 	var n int
 
 	if m.lexPos >= len(m.spec) {
+		m.runePos = m.lexPos
 		return 0
 	}
+	m.runePos = m.lexPos
 	c, n = utf8.DecodeRuneInString(m.spec[m.lexPos:len(m.spec)])
 	m.lexPos += n
 	if c == '\n' {
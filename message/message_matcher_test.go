@@ -43,6 +43,7 @@ func MatcherSpecificationSpec(c gospec.Context) {
 	field7, _ := NewField("Timestamp", date, "date-time")
 	field8, _ := NewField("zero", int64(0), "")
 	field9, _ := NewField("string", "43", "")
+	field10, _ := NewField("ip", "10.1.2.3", "ipv4")
 	msg.AddField(field1)
 	msg.AddField(field2)
 	msg.AddField(field3)
@@ -52,6 +53,7 @@ func MatcherSpecificationSpec(c gospec.Context) {
 	msg.AddField(field7)
 	msg.AddField(field8)
 	msg.AddField(field9)
+	msg.AddField(field10)
 
 	c.Specify("A MatcherSpecification", func() {
 		malformed := []string{
@@ -79,6 +81,19 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			"NIL",                                                         // invalid use of constant
 			"Type == NIL",                                                 // existence check only works on fields
 			"Fields[test] > NIL",                                          // existence check only works with equals and not equals
+			"Type IN ()",                                                  // empty set
+			"Type IN ('a', 1)",                                            // mixed set
+			"Severity IN ('a')",                                           // Severity is not a string
+			"Type NOT ('a')",                                              // missing IN
+			"Type =~ /test/x",                                             // unknown regexp flag
+			"startswith(Severity, '6')",                                   // Severity is not a string
+			"contains(Type)",                                              // missing argument
+			"len(Type) == 'a'",                                            // length is a number
+			"has(Type)",                                                   // existence check only works on fields
+			"bogus(Type)",                                                 // unknown function
+			"Fields[ip] in_cidr '10.0.0.0/33'",                            // invalid CIDR
+			"Severity in_cidr '10.0.0.0/8'",                               // Severity is not a string
+			"!",                                                           // nothing to negate
 		}
 
 		negative := []string{
@@ -116,6 +131,33 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			"Type !~ /^TE/",
 			"Type !~ /ST$/",
 			"Logger =~ /./ && Type =~ /^anything/",
+			"Type IN ('test', 'foo')",
+			"Type NOT IN ('TEST', 'foo')",
+			"Severity IN (1, 2, 7)",
+			"Severity NOT IN (6)",
+			"Fields[foo] IN ('alternate')",
+			"Fields[int] NOT IN (999, 1)",
+			"Fields[int] IN ('999')",
+			"Type =~ /^te$/i",
+			"Type !~ /test/i",
+			"startswith(Type, 'te')",
+			"endswith(Payload, 'payload')",
+			"contains(Logger, 'spec')",
+			"startswith(Fields[foo], 'baz')",
+			"len(Type) != 4",
+			"len(Fields[foo]) > 3",
+			"len(Fields[int]) == 3",
+			"has(Fields[missing])",
+			"has(Fields[int][0][2])",
+			"!TRUE",
+			"!(Type == 'TEST')",
+			"!has(Fields[foo]) || Severity != 6",
+			"!Type == 'TEST' || FALSE",
+			"!!FALSE",
+			"Fields[ip] in_cidr '192.168.0.0/16'",
+			"Fields[ip] in_cidr '10.1.2.4'",
+			"Fields[foo] in_cidr '0.0.0.0/0'",
+			"Fields[int] in_cidr '0.0.0.0/0'",
 		}
 
 		positive := []string{
@@ -169,6 +211,38 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			"Type =~ /ST$/",
 			"Type !~ /^te/",
 			"Type !~ /st$/",
+			"Type IN ('TEST')",
+			"Type IN ('foo', \"TEST\", 'bar')",
+			"Type NOT IN ('test', 'foo')",
+			"Severity IN (1, 6)",
+			"Pid NOT IN (0)",
+			"Fields[foo] IN ('bar', 'baz')",
+			"Fields[foo][1] NOT IN ('bar')",
+			"Fields[int] IN (999, 1024)",
+			"Fields[double] IN (99.9)",
+			"Type =~ /^test$/i",
+			"Type !~ /^test$/",
+			"Payload =~ /PAYLOAD$/i",
+			"Fields[Payload] =~ /TYPE=WEB/i",
+			"startswith(Type, 'TE')",
+			"endswith(Payload, 'Payload')",
+			"contains(Payload, 't Pay')",
+			"startswith(Fields[foo], 'ba')",
+			"endswith(Fields[bytes], 'ta')",
+			"contains(Fields[foo][1], 'tern')",
+			"len(Type) == 4",
+			"len(Payload) > 5 && len(Payload) <= 12",
+			"len(Fields[foo][1]) == 9",
+			"has(Fields[foo])",
+			"has(Fields[int][0][1])",
+			"!FALSE",
+			"!(Type == 'test')",
+			"!has(Fields[missing]) && Type == 'TEST'",
+			"!(Severity < 6 || Type != 'TEST')",
+			"!!TRUE",
+			"Fields[ip] in_cidr '10.0.0.0/8'",
+			"Fields[ip] in_cidr '10.1.2.3'",
+			"Fields[ip] in_cidr '::ffff:10.0.0.0/104'",
 		}
 
 		c.Specify("malformed matcher tests", func() {
@@ -178,12 +252,30 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			}
 		})
 
+		c.Specify("reports the position of syntax errors", func() {
+			errors := map[string]string{
+				"Type == 'test' && Severity = 6": "syntax error at position 27 near \"=\": unexpected '='",
+				"Type == 'test' && Bogus == 6":   "syntax error at position 18 near \"Bogus\": unknown variable Bogus",
+				"Type =~ /(test/":                "syntax error at position 8 near \"/(test/\": invalid regexp /(test/: error parsing regexp: missing closing ): `(test`",
+				"Type == 'test' &&":              "syntax error at position 17 near end of input: unexpected $end",
+				"Severity == 'high'":             "syntax error at position 12 near \"'high'\": unexpected STRING_VALUE, expecting NUMERIC_VALUE",
+				"Fields[ip] in_cidr 'x'":         "syntax error at position 19 near \"'x'\": invalid CIDR \"x\"",
+			}
+			for spec, expected := range errors {
+				_, err := CreateMatcherSpecification(spec)
+				c.Assume(err, gs.Not(gs.IsNil))
+				c.Expect(err.Error(), gs.Equals, expected)
+			}
+		})
+
 		c.Specify("negative matcher tests", func() {
 			for _, v := range negative {
 				ms, err := CreateMatcherSpecification(v)
 				c.Expect(err, gs.IsNil)
 				match := ms.Match(msg)
 				c.Expect(match, gs.IsFalse)
+				c.Expect(evalMatcherSpecification(ms.vm, msg), gs.IsFalse)
+				c.Expect(ms.Explain(msg).Matched, gs.IsFalse)
 			}
 		})
 
@@ -193,6 +285,8 @@ func MatcherSpecificationSpec(c gospec.Context) {
 				c.Expect(err, gs.IsNil)
 				match := ms.Match(msg)
 				c.Expect(match, gs.IsTrue)
+				c.Expect(evalMatcherSpecification(ms.vm, msg), gs.IsTrue)
+				c.Expect(ms.Explain(msg).Matched, gs.IsTrue)
 			}
 		})
 	})
@@ -9,9 +9,11 @@ import __yyfmt__ "fmt"
 
 import (
 	"fmt"
-	"log"
+	"net"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"unicode/utf8"
 )
@@ -34,7 +36,16 @@ var variables = map[string]int{
 	"Fields":     VAR_FIELDS,
 	"TRUE":       TRUE,
 	"FALSE":      FALSE,
-	"NIL":        NIL_VALUE}
+	"NIL":        NIL_VALUE,
+	"IN":         OP_IN}
+
+var functions = map[string]int{
+	"startswith": FN_STARTSWITH,
+	"endswith":   FN_ENDSWITH,
+	"contains":   FN_CONTAINS,
+	"len":        FN_LEN,
+	"has":        FN_HAS,
+	"in_cidr":    OP_CIDR}
 
 var parseLock sync.Mutex
 
@@ -43,9 +54,15 @@ type Statement struct {
 }
 
 type tree struct {
-	left  *tree
-	stmt  *Statement
-	right *tree
+	left       *tree
+	stmt       *Statement
+	right      *tree
+	start, end int // span of a test in the spec text
+}
+
+// Returns the node of a test spanning the spec text from first to last.
+func leaf(first, last yySymType, stmt *Statement) *tree {
+	return &tree{stmt: stmt, start: first.pos, end: last.end}
 }
 
 type stack struct {
@@ -72,9 +89,36 @@ func (s *stack) pop() (node *tree) {
 	return nil
 }
 
+// Set of values tested by the IN and NOT IN operators.
+type valueSet struct {
+	strings map[string]bool
+	numbers map[float64]bool
+}
+
+func newValueSet() *valueSet {
+	return &valueSet{
+		strings: make(map[string]bool),
+		numbers: make(map[float64]bool),
+	}
+}
+
+// Returns the set's strings in sorted order.
+func (vs *valueSet) sortedStrings() []string {
+	values := make([]string, 0, len(vs.strings))
+	for s := range vs.strings {
+		values = append(values, s)
+	}
+	sort.Strings(values)
+	return values
+}
+
 var nodes []*tree
 
-//line message_matcher_parser.y:73
+func init() {
+	yyErrorVerbose = true
+}
+
+//line message_matcher_parser.y:117
 type yySymType struct {
 	yys        int
 	tokenId    int
@@ -83,6 +127,11 @@ type yySymType struct {
 	fieldIndex int
 	arrayIndex int
 	regexp     *regexp.Regexp
+	set        *valueSet
+	ipnet      *net.IPNet
+	function   int
+	pos        int
+	end        int
 }
 
 const OP_EQ = 57346
@@ -111,6 +160,16 @@ const REGEXP_VALUE = 57368
 const NIL_VALUE = 57369
 const TRUE = 57370
 const FALSE = 57371
+const OP_IN = 57372
+const OP_NOT_IN = 57373
+const OP_CIDR = 57374
+const OP_NOT = 57375
+const FN_STARTSWITH = 57376
+const FN_ENDSWITH = 57377
+const FN_CONTAINS = 57378
+const FN_LEN = 57379
+const FN_HAS = 57380
+const LEX_ERROR = 57381
 
 var yyToknames = [...]string{
 	"$end",
@@ -142,6 +201,17 @@ var yyToknames = [...]string{
 	"NIL_VALUE",
 	"TRUE",
 	"FALSE",
+	"OP_IN",
+	"OP_NOT_IN",
+	"OP_CIDR",
+	"OP_NOT",
+	"FN_STARTSWITH",
+	"FN_ENDSWITH",
+	"FN_CONTAINS",
+	"FN_LEN",
+	"FN_HAS",
+	"LEX_ERROR",
+	"','",
 	"'('",
 	"')'",
 }
@@ -152,14 +222,19 @@ const yyEofCode = 1
 const yyErrCode = 2
 const yyInitialStackSize = 16
 
-//line message_matcher_parser.y:191
+//line message_matcher_parser.y:328
 
 type MatcherSpecificationParser struct {
-	spec     string
-	sym      string
-	peekrune rune
-	lexPos   int
-	reToken  *regexp.Regexp
+	spec      string
+	sym       string
+	peekrune  rune
+	lexPos    int
+	runePos   int // start of the last rune read
+	tokenPos  int // start of the last token
+	tokenEnd  int
+	lastToken int
+	err       string
+	reToken   *regexp.Regexp
 }
 
 func parseMatcherSpecification(ms *MatcherSpecification) error {
@@ -173,7 +248,10 @@ func parseMatcherSpecification(ms *MatcherSpecification) error {
 	if yyParse(&msp) == 0 {
 		s := new(stack)
 		for _, node := range nodes {
-			if node.stmt.op.tokenId != OP_OR &&
+			if node.stmt.op.tokenId == OP_NOT {
+				node.left = s.pop()
+				s.push(node)
+			} else if node.stmt.op.tokenId != OP_OR &&
 				node.stmt.op.tokenId != OP_AND {
 				s.push(node)
 			} else {
@@ -185,14 +263,41 @@ func parseMatcherSpecification(ms *MatcherSpecification) error {
 		ms.vm = s.pop()
 		return nil
 	}
-	return fmt.Errorf("syntax error: last token: %s pos: %d", msp.sym, msp.lexPos)
+	near := "end of input"
+	if msp.tokenPos < len(msp.spec) && msp.tokenPos < msp.tokenEnd {
+		near = strconv.Quote(strings.TrimSpace(msp.spec[msp.tokenPos:msp.tokenEnd]))
+	}
+	return fmt.Errorf("syntax error at position %d near %s: %s", msp.tokenPos, near,
+		msp.err)
 }
 
+// Error records the first error reported by the parser or the lexer.
 func (m *MatcherSpecificationParser) Error(s string) {
-	fmt.Errorf("syntax error: %s last token: %s pos: %d", m.sym, m.lexPos)
+	if m.err == "" {
+		m.err = strings.TrimPrefix(s, "syntax error: ")
+	}
+}
+
+// Records a lexing error, the returned token makes the parse fail.
+func (m *MatcherSpecificationParser) lexError(format string, args ...interface{}) int {
+	m.Error(fmt.Sprintf(format, args...))
+	return LEX_ERROR
 }
 
 func (m *MatcherSpecificationParser) Lex(yylval *yySymType) int {
+	tokenId := m.lex(yylval)
+	if m.peekrune == ' ' {
+		m.tokenEnd = m.lexPos
+	} else {
+		m.tokenEnd = m.runePos
+	}
+	yylval.pos = m.tokenPos
+	yylval.end = m.tokenEnd
+	m.lastToken = tokenId
+	return tokenId
+}
+
+func (m *MatcherSpecificationParser) lex(yylval *yySymType) int {
 	var err error
 	var c, tmp rune
 	var i int
@@ -203,14 +308,21 @@ func (m *MatcherSpecificationParser) Lex(yylval *yySymType) int {
 	yylval.fieldIndex = 0
 	yylval.arrayIndex = 0
 	yylval.regexp = nil
+	yylval.set = nil
+	yylval.ipnet = nil
+	yylval.function = 0
 
 	c = m.peekrune
 	m.peekrune = ' '
 
 loop:
+	m.tokenPos = m.runePos
 	if c >= 'A' && c <= 'Z' {
 		goto variable
 	}
+	if c >= 'a' && c <= 'z' {
+		goto function
+	}
 	if (c >= '0' && c <= '9') || c == '.' {
 		goto number
 	}
@@ -227,7 +339,7 @@ loop:
 			yylval.token = "=~"
 			yylval.tokenId = OP_RE
 		} else {
-			break
+			return m.lexError("unexpected '='")
 		}
 		return yylval.tokenId
 	case '!':
@@ -239,7 +351,9 @@ loop:
 			yylval.token = "!~"
 			yylval.tokenId = OP_NRE
 		} else {
-			break
+			m.peekrune = c
+			yylval.token = "!"
+			yylval.tokenId = OP_NOT
 		}
 		return yylval.tokenId
 	case '>':
@@ -267,7 +381,7 @@ loop:
 	case '|':
 		c = m.getrune()
 		if c != '|' {
-			break
+			return m.lexError("unexpected '|'")
 		}
 		yylval.token = "||"
 		yylval.tokenId = OP_OR
@@ -275,7 +389,7 @@ loop:
 	case '&':
 		c = m.getrune()
 		if c != '&' {
-			break
+			return m.lexError("unexpected '&'")
 		}
 		yylval.token = "&&"
 		yylval.tokenId = OP_AND
@@ -296,21 +410,41 @@ variable:
 			break
 		}
 	}
+	if m.sym == "NOT" {
+		for c == ' ' || c == '\t' {
+			c = m.getrune()
+		}
+		m.sym = ""
+		for rvariable(c) {
+			m.sym += string(c)
+			c = m.getrune()
+		}
+		if m.sym != "IN" {
+			return m.lexError("expected IN after NOT")
+		}
+		m.peekrune = c
+		yylval.token = "NOT IN"
+		yylval.tokenId = OP_NOT_IN
+		return yylval.tokenId
+	}
 	yylval.tokenId = variables[m.sym]
+	if yylval.tokenId == 0 {
+		return m.lexError("unknown variable %s", m.sym)
+	}
 	if yylval.tokenId == VAR_FIELDS {
 		if c != '[' {
-			return 0
+			return m.lexError("expected [ after Fields")
 		}
 		var bracketCount int
 		var idx [3]string
 		for {
 			c = m.getrune()
 			if c == 0 {
-				return 0
+				return m.lexError("unterminated field reference")
 			}
 			if c == ']' { // a closing bracket in the variable name will fail validation
 				if len(idx[bracketCount]) == 0 {
-					return 0
+					return m.lexError("empty field reference")
 				}
 				bracketCount++
 				m.peekrune = m.getrune()
@@ -327,7 +461,7 @@ variable:
 					if ddigit(c) {
 						idx[bracketCount] += string(c)
 					} else {
-						return 0
+						return m.lexError("invalid field index")
 					}
 				}
 			}
@@ -342,11 +476,11 @@ variable:
 		yylval.token = idx[0]
 		yylval.fieldIndex, err = strconv.Atoi(idx[1])
 		if err != nil {
-			return 0
+			return m.lexError("invalid field index")
 		}
 		yylval.arrayIndex, err = strconv.Atoi(idx[2])
 		if err != nil {
-			return 0
+			return m.lexError("invalid array index")
 		}
 	} else {
 		yylval.token = m.sym
@@ -366,8 +500,7 @@ number:
 	m.peekrune = c
 	yylval.double, err = strconv.ParseFloat(m.sym, 64)
 	if err != nil {
-		log.Printf("error converting %v\n", m.sym)
-		yylval.double = 0
+		return m.lexError("invalid number %s", m.sym)
 	}
 	yylval.token = m.sym
 	yylval.tokenId = NUMERIC_VALUE
@@ -379,7 +512,7 @@ quotestring:
 	for {
 		c = m.getrune()
 		if c == 0 {
-			return 0
+			return m.lexError("unterminated string")
 		}
 		if c == '\\' {
 			m.peekrune = m.getrune()
@@ -397,16 +530,35 @@ quotestring:
 		}
 		m.sym += string(c)
 	}
+	if m.lastToken == OP_CIDR {
+		if yylval.ipnet = parseCIDR(m.sym); yylval.ipnet == nil {
+			return m.lexError("invalid CIDR %q", m.sym)
+		}
+	}
 	yylval.token = m.sym
 	yylval.tokenId = STRING_VALUE
 	return yylval.tokenId
 
+function:
+	m.sym = ""
+	for rfunction(c) {
+		m.sym += string(c)
+		c = m.getrune()
+	}
+	m.peekrune = c
+	yylval.tokenId = functions[m.sym]
+	if yylval.tokenId == 0 {
+		return m.lexError("unknown function %s", m.sym)
+	}
+	yylval.token = m.sym
+	return yylval.tokenId
+
 regexpstring:
 	m.sym = ""
 	for {
 		c = m.getrune()
 		if c == 0 {
-			return 0
+			return m.lexError("unterminated regexp")
 		}
 		if c == '\\' {
 			m.peekrune = m.getrune()
@@ -424,6 +576,24 @@ regexpstring:
 		}
 		m.sym += string(c)
 	}
+	// Flags following the closing slash, e.g. /error/i
+	var flags string
+	for c = m.getrune(); c >= 'a' && c <= 'z'; c = m.getrune() {
+		if !strings.ContainsRune("ims", c) {
+			return m.lexError("invalid regexp flag %q", c)
+		}
+		flags += string(c)
+	}
+	m.peekrune = c
+	if flags != "" {
+		yylval.regexp, err = regexp.Compile("(?" + flags + ")" + m.sym)
+		if err != nil {
+			return m.lexError("invalid regexp /%s/%s: %s", m.sym, flags, err)
+		}
+		yylval.token = m.sym
+		yylval.tokenId = REGEXP_VALUE
+		return yylval.tokenId
+	}
 	rlen := len(m.sym)
 	if rlen > 0 && m.sym[0] == '^' {
 		if re, err := regexp.Compile(m.sym[1:]); err == nil {
@@ -447,14 +617,28 @@ regexpstring:
 	}
 	yylval.regexp, err = regexp.Compile(m.sym)
 	if err != nil {
-		log.Printf("invalid regexp %v\n", m.sym)
-		return 0
+		return m.lexError("invalid regexp /%s/: %s", m.sym, err)
 	}
 	yylval.token = m.sym
 	yylval.tokenId = REGEXP_VALUE
 	return yylval.tokenId
 }
 
+// Parses a CIDR block, a plain address is treated as a single host block.
+func parseCIDR(s string) *net.IPNet {
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		return ipnet
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
 func rvariable(c rune) bool {
 	if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') {
 		return true
@@ -462,6 +646,10 @@ func rvariable(c rune) bool {
 	return false
 }
 
+func rfunction(c rune) bool {
+	return (c >= 'a' && c <= 'z') || c == '_'
+}
+
 func rdigit(c rune) bool {
 	switch c {
 	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9',
@@ -484,8 +672,10 @@ func (m *MatcherSpecificationParser) getrune() rune {
 	var n int
 
 	if m.lexPos >= len(m.spec) {
+		m.runePos = m.lexPos
 		return 0
 	}
+	m.runePos = m.lexPos
 	c, n = utf8.DecodeRuneInString(m.spec[m.lexPos:len(m.spec)])
 	m.lexPos += n
 	if c == '\n' {
@@ -495,94 +685,121 @@ func (m *MatcherSpecificationParser) getrune() rune {
 }
 
 //line yacctab:1
-var yyExca = [...]int{
+var yyExca = [...]int8{
 	-1, 1,
 	1, -1,
 	-2, 0,
-	-1, 38,
+	-1, 53,
 	27, 9,
 	-2, 3,
-	-1, 41,
+	-1, 58,
 	27, 10,
 	-2, 4,
 }
 
 const yyPrivate = 57344
 
-const yyLast = 77
-
-var yyAct = [...]int{
-	13, 14, 15, 16, 17, 18, 19, 20, 21, 10,
-	7, 24, 23, 51, 11, 12, 3, 11, 12, 2,
-	52, 22, 46, 25, 49, 48, 47, 45, 24, 23,
-	44, 38, 41, 30, 31, 32, 33, 34, 35, 23,
-	6, 5, 4, 42, 43, 9, 8, 40, 1, 50,
-	28, 29, 30, 31, 32, 33, 34, 35, 28, 29,
-	30, 31, 32, 33, 26, 27, 0, 0, 0, 0,
-	0, 0, 0, 0, 36, 37, 39,
+const yyLast = 150
+
+var yyAct = [...]int8{
+	34, 87, 81, 17, 18, 19, 20, 21, 22, 26,
+	27, 28, 13, 50, 52, 8, 9, 15, 16, 31,
+	30, 104, 4, 23, 24, 25, 11, 14, 103, 91,
+	3, 98, 92, 101, 100, 98, 92, 99, 93, 86,
+	85, 78, 72, 65, 59, 49, 48, 77, 84, 62,
+	53, 58, 40, 41, 42, 43, 44, 45, 83, 15,
+	16, 82, 88, 102, 76, 67, 69, 74, 73, 75,
+	38, 39, 40, 41, 42, 43, 46, 47, 57, 64,
+	90, 89, 107, 106, 105, 88, 96, 97, 38, 39,
+	40, 41, 42, 43, 44, 45, 46, 47, 2, 71,
+	29, 95, 32, 33, 17, 18, 19, 20, 21, 22,
+	94, 82, 79, 70, 46, 47, 37, 17, 18, 19,
+	20, 21, 22, 66, 63, 80, 68, 36, 35, 60,
+	61, 38, 39, 40, 41, 42, 43, 31, 30, 30,
+	51, 56, 54, 7, 6, 5, 10, 12, 55, 1,
 }
 
-var yyPact = [...]int{
-	-14, -14, 16, -14, -1000, -1000, -1000, -1000, 46, 54,
-	27, -1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
-	-1000, -1000, 16, -14, -14, -1, 3, -4, -1000, -1000,
-	-1000, -1000, -1000, -1000, -1000, -1000, 1, 0, -11, -13,
-	-7, -1000, -1000, 26, -1000, -1000, -1000, -1000, -1000, -1000,
-	-1000, -1000, -1000,
+var yyPact = [...]int16{
+	-11, -11, 125, -11, -11, -32768, -32768, -32768, -32768, 84,
+	5, 4, 66, 46, 3, -32768, -32768, -32768, -32768, -32768,
+	-32768, -32768, -32768, -32768, -32768, -32768, -32768, -32768, -32768, 125,
+	-11, -11, 7, -32768, 100, 53, 2, 99, -32768, -32768,
+	-32768, -32768, -32768, -32768, -32768, -32768, -32768, -32768, 103, 90,
+	74, 1, 43, 31, 38, 20, 0, 88, -32768, 102,
+	-32768, 126, -32768, -32768, -32768, 87, -32768, 18, 8, -2,
+	-3, -32768, 60, -32768, -32768, -32768, -32768, -32768, 37, -32768,
+	-13, -4, -32768, 86, 77, 127, 127, -5, -32768, -8,
+	-9, -32768, 39, -32768, -14, -21, 59, 58, 57, -32768,
+	-32768, -32768, -32768, -32768, -32768, -32768, -32768, -32768,
 }
 
-var yyPgo = [...]int{
-	0, 48, 19, 64, 47, 65, 46, 45, 42, 41,
-	40, 10,
+var yyPgo = [...]uint8{
+	0, 149, 98, 0, 148, 128, 16, 147, 127, 146,
+	2, 1, 145, 144, 143, 15,
 }
 
-var yyR1 = [...]int{
+var yyR1 = [...]int8{
 	0, 1, 1, 3, 3, 3, 3, 3, 3, 4,
 	4, 5, 5, 6, 6, 6, 6, 6, 6, 7,
-	7, 7, 8, 8, 9, 10, 10, 10, 10, 10,
-	11, 11, 2, 2, 2, 2, 2, 2, 2,
+	7, 7, 8, 8, 9, 9, 9, 10, 10, 11,
+	11, 12, 12, 12, 12, 12, 12, 13, 13, 14,
+	14, 14, 14, 14, 14, 14, 14, 14, 14, 14,
+	15, 15, 2, 2, 2, 2, 2, 2, 2, 2,
 }
 
-var yyR2 = [...]int{
+var yyR2 = [...]int8{
 	0, 1, 2, 1, 1, 1, 1, 1, 1, 1,
 	1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
-	1, 1, 3, 3, 3, 3, 3, 3, 3, 3,
-	1, 1, 3, 3, 3, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1, 3, 1,
+	3, 3, 3, 5, 3, 6, 6, 3, 5, 3,
+	3, 3, 3, 3, 5, 5, 3, 6, 6, 4,
+	1, 1, 3, 3, 3, 2, 1, 1, 1, 1,
 }
 
-var yyChk = [...]int{
-	-1000, -1, -2, 30, -8, -9, -10, -11, -6, -7,
-	23, 28, 29, 14, 15, 16, 17, 18, 19, 20,
-	21, 22, -2, 13, 12, -2, -3, -5, 4, 5,
-	6, 7, 8, 9, 10, 11, -3, -3, 4, -5,
-	-4, 5, -2, -2, 31, 24, 26, 25, 25, 24,
-	-11, 26, 27,
+var yyChk = [...]int16{
+	-32768, -1, -2, 41, 33, -12, -13, -14, -15, -6,
+	-9, 37, -7, 23, 38, 28, 29, 14, 15, 16,
+	17, 18, 19, 34, 35, 36, 20, 21, 22, -2,
+	13, 12, -2, -2, -3, -5, -8, 32, 4, 5,
+	6, 7, 8, 9, 10, 11, 30, 31, 41, 41,
+	-3, -8, -3, 4, -5, -4, -8, 32, 5, 41,
+	-2, -2, 42, 24, 26, 41, 24, -6, 23, -6,
+	23, 25, 41, 25, 24, -15, 26, 27, 41, 24,
+	23, -10, 24, 40, 40, 42, 42, -11, 25, -10,
+	-11, 42, 40, 42, 24, 24, -3, -3, 40, 42,
+	42, 42, 24, 42, 42, 25, 25, 25,
 }
 
-var yyDef = [...]int{
-	0, -2, 1, 0, 35, 36, 37, 38, 0, 0,
-	0, 30, 31, 13, 14, 15, 16, 17, 18, 19,
-	20, 21, 2, 0, 0, 0, 0, 0, 3, 4,
-	5, 6, 7, 8, 11, 12, 0, 0, -2, 0,
-	0, -2, 33, 34, 32, 22, 23, 24, 25, 26,
-	27, 28, 29,
+var yyDef = [...]int8{
+	0, -2, 1, 0, 0, 56, 57, 58, 59, 0,
+	0, 0, 0, 0, 0, 50, 51, 13, 14, 15,
+	16, 17, 18, 24, 25, 26, 19, 20, 21, 2,
+	0, 0, 0, 55, 0, 0, 0, 0, 3, 4,
+	5, 6, 7, 8, 11, 12, 22, 23, 0, 0,
+	0, 0, 0, -2, 0, 0, 0, 0, -2, 0,
+	53, 54, 52, 31, 32, 0, 34, 0, 0, 0,
+	0, 37, 0, 39, 40, 41, 42, 43, 0, 46,
+	0, 0, 27, 0, 0, 0, 0, 0, 29, 0,
+	0, 49, 0, 33, 0, 0, 0, 0, 0, 38,
+	44, 45, 28, 35, 47, 36, 48, 30,
 }
 
-var yyTok1 = [...]int{
+var yyTok1 = [...]int8{
 	1, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
-	30, 31,
+	41, 42, 3, 3, 40,
 }
 
-var yyTok2 = [...]int{
+var yyTok2 = [...]int8{
 	2, 3, 4, 5, 6, 7, 8, 9, 10, 11,
 	12, 13, 14, 15, 16, 17, 18, 19, 20, 21,
-	22, 23, 24, 25, 26, 27, 28, 29,
+	22, 23, 24, 25, 26, 27, 28, 29, 30, 31,
+	32, 33, 34, 35, 36, 37, 38, 39,
 }
 
-var yyTok3 = [...]int{
+var yyTok3 = [...]int8{
 	0,
 }
 
@@ -625,7 +842,7 @@ func yyNewParser() yyParser {
 	return &yyParserImpl{}
 }
 
-const yyFlag = -1000
+const yyFlag = -32768
 
 func yyTokname(c int) string {
 	if c >= 1 && c-1 < len(yyToknames) {
@@ -664,9 +881,9 @@ func yyErrorMessage(state, lookAhead int) string {
 	expected := make([]int, 0, 4)
 
 	// Look for shiftable tokens.
-	base := yyPact[state]
+	base := int(yyPact[state])
 	for tok := TOKSTART; tok-1 < len(yyToknames); tok++ {
-		if n := base + tok; n >= 0 && n < yyLast && yyChk[yyAct[n]] == tok {
+		if n := base + tok; n >= 0 && n < yyLast && int(yyChk[int(yyAct[n])]) == tok {
 			if len(expected) == cap(expected) {
 				return res
 			}
@@ -676,13 +893,13 @@ func yyErrorMessage(state, lookAhead int) string {
 
 	if yyDef[state] == -2 {
 		i := 0
-		for yyExca[i] != -1 || yyExca[i+1] != state {
+		for yyExca[i] != -1 || int(yyExca[i+1]) != state {
 			i += 2
 		}
 
 		// Look for tokens that we accept or reduce.
 		for i += 2; yyExca[i] >= 0; i += 2 {
-			tok := yyExca[i]
+			tok := int(yyExca[i])
 			if tok < TOKSTART || yyExca[i+1] == 0 {
 				continue
 			}
@@ -713,30 +930,30 @@ func yylex1(lex yyLexer, lval *yySymType) (char, token int) {
 	token = 0
 	char = lex.Lex(lval)
 	if char <= 0 {
-		token = yyTok1[0]
+		token = int(yyTok1[0])
 		goto out
 	}
 	if char < len(yyTok1) {
-		token = yyTok1[char]
+		token = int(yyTok1[char])
 		goto out
 	}
 	if char >= yyPrivate {
 		if char < yyPrivate+len(yyTok2) {
-			token = yyTok2[char-yyPrivate]
+			token = int(yyTok2[char-yyPrivate])
 			goto out
 		}
 	}
 	for i := 0; i < len(yyTok3); i += 2 {
-		token = yyTok3[i+0]
+		token = int(yyTok3[i+0])
 		if token == char {
-			token = yyTok3[i+1]
+			token = int(yyTok3[i+1])
 			goto out
 		}
 	}
 
 out:
 	if token == 0 {
-		token = yyTok2[1] /* unknown char */
+		token = int(yyTok2[1]) /* unknown char */
 	}
 	if yyDebug >= 3 {
 		__yyfmt__.Printf("lex %s(%d)\n", yyTokname(token), uint(char))
@@ -791,7 +1008,7 @@ yystack:
 	yyS[yyp].yys = yystate
 
 yynewstate:
-	yyn = yyPact[yystate]
+	yyn = int(yyPact[yystate])
 	if yyn <= yyFlag {
 		goto yydefault /* simple state */
 	}
@@ -802,8 +1019,8 @@ yynewstate:
 	if yyn < 0 || yyn >= yyLast {
 		goto yydefault
 	}
-	yyn = yyAct[yyn]
-	if yyChk[yyn] == yytoken { /* valid shift */
+	yyn = int(yyAct[yyn])
+	if int(yyChk[yyn]) == yytoken { /* valid shift */
 		yyrcvr.char = -1
 		yytoken = -1
 		yyVAL = yyrcvr.lval
@@ -816,7 +1033,7 @@ yynewstate:
 
 yydefault:
 	/* default state action */
-	yyn = yyDef[yystate]
+	yyn = int(yyDef[yystate])
 	if yyn == -2 {
 		if yyrcvr.char < 0 {
 			yyrcvr.char, yytoken = yylex1(yylex, &yyrcvr.lval)
@@ -825,18 +1042,18 @@ yydefault:
 		/* look through exception table */
 		xi := 0
 		for {
-			if yyExca[xi+0] == -1 && yyExca[xi+1] == yystate {
+			if yyExca[xi+0] == -1 && int(yyExca[xi+1]) == yystate {
 				break
 			}
 			xi += 2
 		}
 		for xi += 2; ; xi += 2 {
-			yyn = yyExca[xi+0]
+			yyn = int(yyExca[xi+0])
 			if yyn < 0 || yyn == yytoken {
 				break
 			}
 		}
-		yyn = yyExca[xi+1]
+		yyn = int(yyExca[xi+1])
 		if yyn < 0 {
 			goto ret0
 		}
@@ -858,10 +1075,10 @@ yydefault:
 
 			/* find a state where "error" is a legal shift action */
 			for yyp >= 0 {
-				yyn = yyPact[yyS[yyp].yys] + yyErrCode
+				yyn = int(yyPact[yyS[yyp].yys]) + yyErrCode
 				if yyn >= 0 && yyn < yyLast {
-					yystate = yyAct[yyn] /* simulate a shift of "error" */
-					if yyChk[yystate] == yyErrCode {
+					yystate = int(yyAct[yyn]) /* simulate a shift of "error" */
+					if int(yyChk[yystate]) == yyErrCode {
 						goto yystack
 					}
 				}
@@ -897,7 +1114,7 @@ yydefault:
 	yypt := yyp
 	_ = yypt // guard against "declared and not used"
 
-	yyp -= yyR2[yyn]
+	yyp -= int(yyR2[yyn])
 	// yyp is now the index of $0. Perform the default action. Iff the
 	// reduced production is ε, $1 is possibly out of range.
 	if yyp+1 >= len(yyS) {
@@ -908,103 +1125,210 @@ yydefault:
 	yyVAL = yyS[yyp+1]
 
 	/* consult goto table to find next state */
-	yyn = yyR1[yyn]
-	yyg := yyPgo[yyn]
+	yyn = int(yyR1[yyn])
+	yyg := int(yyPgo[yyn])
 	yyj := yyg + yyS[yyp].yys + 1
 
 	if yyj >= yyLast {
-		yystate = yyAct[yyg]
+		yystate = int(yyAct[yyg])
 	} else {
-		yystate = yyAct[yyj]
-		if yyChk[yystate] != -yyn {
-			yystate = yyAct[yyg]
+		yystate = int(yyAct[yyj])
+		if int(yyChk[yystate]) != -yyn {
+			yystate = int(yyAct[yyg])
 		}
 	}
 	// dummy call; replaced with literal code
 	switch yynt {
 
-	case 22:
+	case 27:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line message_matcher_parser.y:184
+		{
+			yyVAL = yyDollar[1]
+			yyVAL.set = newValueSet()
+			yyVAL.set.strings[yyDollar[1].token] = true
+		}
+	case 28:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:190
+		{
+			yyVAL = yyDollar[1]
+			yyVAL.set.strings[yyDollar[3].token] = true
+		}
+	case 29:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line message_matcher_parser.y:196
+		{
+			yyVAL = yyDollar[1]
+			yyVAL.set = newValueSet()
+			yyVAL.set.numbers[yyDollar[1].double] = true
+		}
+	case 30:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:202
+		{
+			yyVAL = yyDollar[1]
+			yyVAL.set.numbers[yyDollar[3].double] = true
+		}
+	case 31:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line message_matcher_parser.y:124
+//line message_matcher_parser.y:208
 		{
 			//fmt.Println("string_test", $1, $2, $3)
-			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+			nodes = append(nodes, leaf(yyDollar[1], yyDollar[3], &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}))
 		}
-	case 23:
+	case 32:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line message_matcher_parser.y:129
+//line message_matcher_parser.y:213
 		{
 			//fmt.Println("string_test regexp", $1, $2, $3)
-			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+			nodes = append(nodes, leaf(yyDollar[1], yyDollar[3], &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}))
+		}
+	case 33:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line message_matcher_parser.y:218
+		{
+			nodes = append(nodes, leaf(yyDollar[1], yyDollar[5], &Statement{yyDollar[1], yyDollar[2], yyDollar[4]}))
+		}
+	case 34:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:222
+		{
+			nodes = append(nodes, leaf(yyDollar[1], yyDollar[3], &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}))
+		}
+	case 35:
+		yyDollar = yyS[yypt-6 : yypt+1]
+//line message_matcher_parser.y:226
+		{
+			nodes = append(nodes, leaf(yyDollar[1], yyDollar[6], &Statement{yyDollar[3], yyDollar[1], yyDollar[5]}))
+		}
+	case 36:
+		yyDollar = yyS[yypt-6 : yypt+1]
+//line message_matcher_parser.y:230
+		{
+			yyDollar[3].function = FN_LEN
+			nodes = append(nodes, leaf(yyDollar[1], yyDollar[6], &Statement{yyDollar[3], yyDollar[5], yyDollar[6]}))
 		}
-	case 24:
+	case 37:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line message_matcher_parser.y:135
+//line message_matcher_parser.y:236
 		{
 			//fmt.Println("numeric_test", $1, $2, $3)
-			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+			nodes = append(nodes, leaf(yyDollar[1], yyDollar[3], &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}))
+		}
+	case 38:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line message_matcher_parser.y:241
+		{
+			nodes = append(nodes, leaf(yyDollar[1], yyDollar[5], &Statement{yyDollar[1], yyDollar[2], yyDollar[4]}))
 		}
-	case 25:
+	case 39:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line message_matcher_parser.y:141
+//line message_matcher_parser.y:246
 		{
 			//fmt.Println("field_test numeric", $1, $2, $3)
-			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+			nodes = append(nodes, leaf(yyDollar[1], yyDollar[3], &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}))
 		}
-	case 26:
+	case 40:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line message_matcher_parser.y:146
+//line message_matcher_parser.y:251
 		{
 			//fmt.Println("field_test string", $1, $2, $3)
-			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+			nodes = append(nodes, leaf(yyDollar[1], yyDollar[3], &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}))
 		}
-	case 27:
+	case 41:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line message_matcher_parser.y:151
+//line message_matcher_parser.y:256
 		{
 			//fmt.Println("field_test boolean", $1, $2, $3)
-			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+			nodes = append(nodes, leaf(yyDollar[1], yyDollar[3], &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}))
 		}
-	case 28:
+	case 42:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line message_matcher_parser.y:156
+//line message_matcher_parser.y:261
 		{
 			//fmt.Println("field_test regexp", $1, $2, $3)
-			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+			nodes = append(nodes, leaf(yyDollar[1], yyDollar[3], &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}))
 		}
-	case 29:
+	case 43:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line message_matcher_parser.y:161
+//line message_matcher_parser.y:266
 		{
 			//fmt.Println("field_test existence", $1, $2, $3)
-			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+			nodes = append(nodes, leaf(yyDollar[1], yyDollar[3], &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}))
 		}
-	case 32:
+	case 44:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line message_matcher_parser.y:271
+		{
+			nodes = append(nodes, leaf(yyDollar[1], yyDollar[5], &Statement{yyDollar[1], yyDollar[2], yyDollar[4]}))
+		}
+	case 45:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line message_matcher_parser.y:275
+		{
+			nodes = append(nodes, leaf(yyDollar[1], yyDollar[5], &Statement{yyDollar[1], yyDollar[2], yyDollar[4]}))
+		}
+	case 46:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:279
+		{
+			nodes = append(nodes, leaf(yyDollar[1], yyDollar[3], &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}))
+		}
+	case 47:
+		yyDollar = yyS[yypt-6 : yypt+1]
+//line message_matcher_parser.y:283
+		{
+			nodes = append(nodes, leaf(yyDollar[1], yyDollar[6], &Statement{yyDollar[3], yyDollar[1], yyDollar[5]}))
+		}
+	case 48:
+		yyDollar = yyS[yypt-6 : yypt+1]
+//line message_matcher_parser.y:287
+		{
+			yyDollar[3].function = FN_LEN
+			nodes = append(nodes, leaf(yyDollar[1], yyDollar[6], &Statement{yyDollar[3], yyDollar[5], yyDollar[6]}))
+		}
+	case 49:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line message_matcher_parser.y:292
+		{
+			// has(Fields[x]) is the same test as Fields[x] != NIL
+			nodes = append(nodes, leaf(yyDollar[1], yyDollar[4], &Statement{yyDollar[3],
+				yySymType{tokenId: OP_NE, token: "!="},
+				yySymType{tokenId: NIL_VALUE, token: "NIL"}}))
+		}
+	case 52:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line message_matcher_parser.y:168
+//line message_matcher_parser.y:301
 		{
 			yyVAL = yyDollar[2]
 		}
-	case 33:
+	case 53:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line message_matcher_parser.y:172
+//line message_matcher_parser.y:305
 		{
 			//fmt.Println("and", $1, $2, $3)
 			nodes = append(nodes, &tree{stmt: &Statement{op: yyDollar[2]}})
 		}
-	case 34:
+	case 54:
 		yyDollar = yyS[yypt-3 : yypt+1]
-//line message_matcher_parser.y:177
+//line message_matcher_parser.y:310
 		{
 			//fmt.Println("or", $1, $2, $3)
 			nodes = append(nodes, &tree{stmt: &Statement{op: yyDollar[2]}})
 		}
-	case 38:
+	case 55:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line message_matcher_parser.y:315
+		{
+			nodes = append(nodes, &tree{stmt: &Statement{op: yyDollar[1]}})
+		}
+	case 59:
 		yyDollar = yyS[yypt-1 : yypt+1]
-//line message_matcher_parser.y:185
+//line message_matcher_parser.y:322
 		{
 			//fmt.Println("boolean", $1)
-			nodes = append(nodes, &tree{stmt: &Statement{op: yyDollar[1]}})
+			nodes = append(nodes, leaf(yyDollar[1], yyDollar[1], &Statement{op: yyDollar[1]}))
 		}
 	}
 	goto yystack /* stack new state and value */
@@ -37,6 +37,8 @@ func TestAllSpecs(t *testing.T) {
 	r := gospec.NewRunner()
 	r.Parallel = false
 
+	r.AddSpec(ConfigReloadFilterSpec)
+	r.AddSpec(DeadLetterSpec)
 	r.AddSpec(HekaFramingSpec)
 	r.AddSpec(InputRunnerSpec)
 	r.AddSpec(MessageTemplateSpec)
@@ -45,7 +47,9 @@ func TestAllSpecs(t *testing.T) {
 	r.AddSpec(QueueBufferSpec)
 	r.AddSpec(PatternGroupingSpec)
 	r.AddSpec(RegexSpec)
+	r.AddSpec(ReloadSpec)
 	r.AddSpec(ReportSpec)
+	r.AddSpec(RouterSpec)
 	r.AddSpec(SplitterRunnerSpec)
 	r.AddSpec(StatAccumInputSpec)
 	r.AddSpec(TokenSpec)
@@ -199,8 +199,14 @@ type PipelineConfig struct {
 	// Lock protecting access to running outputs so they can be removed
 	// safely.
 	outputsLock sync.RWMutex
+	// Is freed when all Output runners have stopped.
+	outputsWg sync.WaitGroup
 	// Internal reporting channel.
 	reportRecycleChan chan *PipelinePack
+	// Preloads the configuration files again on a reload.
+	configLoader func(*PipelineConfig) error
+	// Serializes configuration reloads.
+	reloadLock sync.Mutex
 
 	// The next few values are used only during the initial configuration
 	// loading process.
@@ -236,6 +242,8 @@ func NewPipelineConfig(globals *GlobalConfigStruct) (config *PipelineConfig) {
 
 	config.allEncoders = make(map[string]Encoder)
 	config.router = NewMessageRouter(globals.PluginChanSize, globals.abortChan)
+	config.router.batchSize = globals.MaxBatchSize
+	config.router.batchLinger = globals.MaxBatchLinger
 	config.inputRecycleChan = make(chan *PipelinePack, globals.PoolSize)
 	config.injectRecycleChan = make(chan *PipelinePack, globals.PoolSize)
 	config.LogMsgs = make([]string, 0, 4)
@@ -427,6 +435,7 @@ func (self *PipelineConfig) AddFilterRunner(fRunner FilterRunner) error {
 	self.filtersWg.Add(1)
 	if err := fRunner.Start(self, &self.filtersWg); err != nil {
 		self.filtersWg.Done()
+		delete(self.FilterRunners, fRunner.Name())
 		return fmt.Errorf("AddFilterRunner '%s' failed to start: %s",
 			fRunner.Name(), err)
 	} else {
@@ -462,6 +471,7 @@ func (self *PipelineConfig) AddInputRunner(iRunner InputRunner) error {
 	self.inputsWg.Add(1)
 	if err := iRunner.Start(self, &self.inputsWg); err != nil {
 		self.inputsWg.Done()
+		delete(self.InputRunners, iRunner.Name())
 		return fmt.Errorf("AddInputRunner '%s' failed to start: %s", iRunner.Name(), err)
 	}
 	return nil
@@ -484,6 +494,22 @@ func (self *PipelineConfig) RemoveInputRunner(iRunner InputRunner) {
 	iRunner.Input().Stop()
 }
 
+// AddOutputRunner starts the provided OutputRunner and adds it to the set of
+// running Outputs.
+func (self *PipelineConfig) AddOutputRunner(oRunner OutputRunner) error {
+	self.outputsLock.Lock()
+	defer self.outputsLock.Unlock()
+	self.OutputRunners[oRunner.Name()] = oRunner
+	self.outputsWg.Add(1)
+	if err := oRunner.Start(self, &self.outputsWg); err != nil {
+		self.outputsWg.Done()
+		delete(self.OutputRunners, oRunner.Name())
+		return fmt.Errorf("AddOutputRunner '%s' failed to start: %s", oRunner.Name(), err)
+	}
+	self.router.AddOutputMatcher() <- oRunner.MatchRunner()
+	return nil
+}
+
 // RemoveOutputRunner unregisters the provided OutputRunner from heka, and
 // removes it's message matcher from the heka router.
 func (self *PipelineConfig) RemoveOutputRunner(oRunner OutputRunner) {
@@ -601,6 +627,7 @@ type CommonFOConfig struct {
 	UseFraming   *bool              `toml:"use_framing"` // Output only.
 	UseBuffering *bool              `toml:"use_buffering"`
 	Buffering    *QueueBufferConfig `toml:"buffering"`
+	DeadLetter   *DeadLetterConfig  `toml:"dead_letter"` // Output only.
 }
 
 type CommonSplitterConfig struct {
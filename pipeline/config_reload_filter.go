@@ -0,0 +1,84 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"syscall"
+	"time"
+)
+
+// Filter that reloads the Heka configuration when it receives a signed
+// control message, the same as sending hekad a SIGHUP.
+type ConfigReloadFilter struct {
+	globals *GlobalConfigStruct
+}
+
+// ConfigReloadFilter config struct, used for specifying the default message
+// matcher and checking a message signer is set.
+type ConfigReloadFilterConfig struct {
+	// Defaults to the reload control messages.
+	MessageMatcher string `toml:"message_matcher"`
+	// Required, otherwise anyone able to deliver a message could reload the
+	// configuration.
+	MessageSigner string `toml:"message_signer"`
+}
+
+func (this *ConfigReloadFilter) SetPipelineConfig(pConfig *PipelineConfig) {
+	this.globals = pConfig.Globals
+}
+
+func (this *ConfigReloadFilter) ConfigStruct() interface{} {
+	return &ConfigReloadFilterConfig{
+		MessageMatcher: "Type == 'heka.control.reload'",
+	}
+}
+
+func (this *ConfigReloadFilter) Init(config interface{}) error {
+	conf := config.(*ConfigReloadFilterConfig)
+	if conf.MessageSigner == "" {
+		return errors.New("message_signer must be set")
+	}
+	return nil
+}
+
+func (this *ConfigReloadFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
+	for pack := range fr.InChan() {
+		fr.UpdateCursor(pack.QueueCursor)
+		// Stale control messages, e.g. replayed from a queue, are ignored.
+		delta := time.Now().UnixNano() - pack.Message.GetTimestamp()
+		if math.Abs(float64(delta)) >= 5e9 {
+			pack.Recycle(fmt.Errorf("Discarded control message: %d seconds skew",
+				delta/1e9))
+			continue
+		}
+		select {
+		case this.globals.SigChan() <- syscall.SIGHUP:
+			fr.LogMessage("reload requested")
+		default:
+			fr.LogMessage("reload already pending")
+		}
+		pack.Recycle(nil)
+	}
+	return
+}
+
+func init() {
+	RegisterPlugin("ConfigReloadFilter", func() interface{} {
+		return new(ConfigReloadFilter)
+	})
+}
@@ -0,0 +1,136 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+
+	"heka/message"
+)
+
+// DeadLetterConfig holds the `dead_letter` settings of an output. The
+// messages the output rejects are written to a dead letter queue instead of
+// being dropped, they can be replayed with heka-queue.
+type DeadLetterConfig struct {
+	// Queue directory, relative to the base_dir. Defaults to
+	// "dead_letter/<output name>".
+	Path string `toml:"path"`
+	// Attempts made at delivering a message failing with a RetryMessageError
+	// before it's rejected, 0 retries it for as long as it takes.
+	MaxAttempts int `toml:"max_attempts"`
+	// Maximum disk space used by the queue, the messages rejected once it's
+	// full are dropped. Defaults to 0, no limit.
+	MaxBufferSize uint64 `toml:"max_buffer_size"`
+}
+
+// Fields attached to the messages written to a dead letter queue.
+const (
+	DeadLetterErrorField    = "DeadLetterError"
+	DeadLetterOutputField   = "DeadLetterOutput"
+	DeadLetterAttemptsField = "DeadLetterAttempts"
+)
+
+func (foRunner *foRunner) openDeadLetter() error {
+	config := foRunner.config.DeadLetter
+	if config == nil || foRunner.kind != foOutput {
+		return nil
+	}
+	queue := config.Path
+	if queue == "" {
+		queue = filepath.Join("dead_letter", _wordre.ReplaceAllString(foRunner.name, "_"))
+	}
+	queue = foRunner.pConfig.Globals.PrependBaseDir(queue)
+	qConfig := defaultQueueBufferConfig()
+	qConfig.MaxBufferSize = config.MaxBufferSize
+	// Rejected messages are rare, each one is kept safe.
+	qConfig.SyncPolicy = "always"
+	feeder, err := NewBufferFeeder(queue, qConfig,
+		&BufferSize{size: getQueueBufferSize(queue)})
+	if err != nil {
+		return err
+	}
+	foRunner.deadLetterFeeder = feeder
+	return nil
+}
+
+func (foRunner *foRunner) closeDeadLetter() {
+	if foRunner.deadLetterFeeder == nil {
+		return
+	}
+	if err := foRunner.deadLetterFeeder.Close(); err != nil {
+		foRunner.LogError(fmt.Errorf("can't close dead letter queue: %s", err))
+	}
+	foRunner.deadLetterFeeder = nil
+}
+
+// Returns true if a message failing with a RetryMessageError has been
+// attempted as many times as it can be before it's rejected, or if the plugin
+// gave up retrying it on its own with ErrMaxRetriesExceeded.
+func (foRunner *foRunner) attemptsExhausted(err error, attempts int) bool {
+	if errors.Is(err, ErrMaxRetriesExceeded) {
+		return true
+	}
+	config := foRunner.config.DeadLetter
+	return config != nil && config.MaxAttempts > 0 && attempts >= config.MaxAttempts
+}
+
+// Writes a copy of a pack the plugin rejected to the dead letter queue, with
+// the error, the plugin name and the number of delivery attempts attached.
+// The pack isn't recycled.
+func (foRunner *foRunner) deadLetter(pack *PipelinePack, reason error, attempts int) {
+	feeder := foRunner.deadLetterFeeder
+	if feeder == nil {
+		return
+	}
+	dead := &PipelinePack{Message: message.CopyMessage(pack.Message)}
+	f, _ := message.NewField(DeadLetterErrorField, reason.Error(), "")
+	dead.Message.AddField(f)
+	f, _ = message.NewField(DeadLetterOutputField, foRunner.name, "")
+	dead.Message.AddField(f)
+	f, _ = message.NewField(DeadLetterAttemptsField, attempts, "count")
+	dead.Message.AddField(f)
+
+	err := dead.EncodeMsgBytes()
+	if err == nil {
+		err = feeder.QueueRecord(dead)
+	}
+	if err != nil {
+		foRunner.LogError(fmt.Errorf("can't write rejected message to the dead letter queue: %s",
+			err))
+		return
+	}
+	atomic.AddInt64(&foRunner.deadLetterCount, 1)
+}
+
+// StripDeadLetterFields removes the fields added to a message written to a
+// dead letter queue, restoring the message as it was when it was rejected.
+func StripDeadLetterFields(msg *message.Message) {
+	for _, name := range []string{DeadLetterErrorField, DeadLetterOutputField,
+		DeadLetterAttemptsField} {
+
+		for f := msg.FindFirstField(name); f != nil; f = msg.FindFirstField(name) {
+			msg.DeleteField(f)
+		}
+	}
+}
+
+// DeadLetterCount returns the number of messages written to the plugin's
+// dead letter queue.
+func (foRunner *foRunner) DeadLetterCount() int64 {
+	return atomic.LoadInt64(&foRunner.deadLetterCount)
+}
@@ -0,0 +1,144 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	ts "heka/pipeline/testsupport"
+)
+
+// Output rejecting every message with its error.
+type RejectingOutput struct {
+	err      error
+	attempts int
+}
+
+func (o *RejectingOutput) Init(config interface{}) error {
+	return nil
+}
+
+func (o *RejectingOutput) Prepare(or OutputRunner, h PluginHelper) error {
+	return nil
+}
+
+func (o *RejectingOutput) ProcessMessage(pack *PipelinePack) error {
+	o.attempts++
+	return o.err
+}
+
+func (o *RejectingOutput) CleanUp() {}
+
+func DeadLetterSpec(c gs.Context) {
+	tmpDir, tmpErr := ioutil.TempDir("", "deadletter-tests")
+	defer func() {
+		tmpErr = os.RemoveAll(tmpDir)
+		c.Expect(tmpErr, gs.Equals, nil)
+	}()
+
+	pConfig := NewPipelineConfig(nil)
+	pConfig.Globals.BaseDir = tmpDir
+	output := new(RejectingOutput)
+	config := CommonFOConfig{
+		Matcher:    "TRUE",
+		DeadLetter: &DeadLetterConfig{MaxAttempts: 3},
+	}
+	runner, err := NewFORunner("Rejecting Output", output, config, "RejectingOutput", 1)
+	c.Assume(err, gs.IsNil)
+	runner.pConfig = pConfig
+	c.Assume(runner.openDeadLetter(), gs.IsNil)
+
+	recycleChan := make(chan *PipelinePack, 1)
+	reject := func() {
+		pack := NewPipelinePack(recycleChan)
+		pack.Message = ts.GetTestMessage()
+		pack.Message.SetPayload("rejected")
+		runner.inChan <- pack
+		close(runner.inChan)
+		c.Expect(runner.channelLoop(output, nil, nil), gs.IsNil)
+		runner.closeDeadLetter()
+		<-recycleChan
+	}
+	// Returns the message written to the dead letter queue.
+	deadLetter := func() *PipelinePack {
+		queue := filepath.Join(tmpDir, "dead_letter", "Rejecting_Output")
+		reader, err := OpenQueue(queue)
+		c.Assume(err, gs.IsNil)
+		defer reader.Close()
+		pack := NewPipelinePack(nil)
+		c.Assume(reader.NextRecord(pack), gs.IsNil)
+		c.Expect(reader.NextRecord(NewPipelinePack(nil)), gs.Equals, QueueNoRecord)
+		return pack
+	}
+
+	c.Specify("A dead letter queue", func() {
+		c.Specify("keeps the messages an output rejects", func() {
+			output.err = errors.New("mapping error")
+			reject()
+			c.Expect(output.attempts, gs.Equals, 1)
+			c.Expect(runner.DeadLetterCount(), gs.Equals, int64(1))
+
+			msg := deadLetter().Message
+			c.Expect(msg.GetPayload(), gs.Equals, "rejected")
+			reason, _ := msg.GetFieldValue(DeadLetterErrorField)
+			c.Expect(reason, gs.Equals, "mapping error")
+			name, _ := msg.GetFieldValue(DeadLetterOutputField)
+			c.Expect(name, gs.Equals, "Rejecting Output")
+			attempts, _ := msg.GetFieldValue(DeadLetterAttemptsField)
+			c.Expect(attempts, gs.Equals, int64(1))
+
+			// The message can be replayed as it was.
+			fields := len(msg.Fields)
+			StripDeadLetterFields(msg)
+			c.Expect(len(msg.Fields), gs.Equals, fields-3)
+			c.Expect(msg.FindFirstField(DeadLetterErrorField), gs.IsNil)
+		})
+
+		c.Specify("keeps the messages still failing after max_attempts", func() {
+			output.err = NewRetryMessageError("connection refused")
+			reject()
+			c.Expect(output.attempts, gs.Equals, 3)
+			c.Expect(runner.DeadLetterCount(), gs.Equals, int64(1))
+
+			msg := deadLetter().Message
+			attempts, _ := msg.GetFieldValue(DeadLetterAttemptsField)
+			c.Expect(attempts, gs.Equals, int64(3))
+		})
+
+		c.Specify("keeps the messages the output gave up retrying", func() {
+			output.err = NewRetryMessageError("sending: %w", ErrMaxRetriesExceeded)
+			reject()
+			c.Expect(output.attempts, gs.Equals, 1)
+			c.Expect(runner.DeadLetterCount(), gs.Equals, int64(1))
+
+			msg := deadLetter().Message
+			reason, _ := msg.GetFieldValue(DeadLetterErrorField)
+			c.Expect(reason, gs.Equals, "sending: Max retries exceeded")
+			attempts, _ := msg.GetFieldValue(DeadLetterAttemptsField)
+			c.Expect(attempts, gs.Equals, int64(1))
+		})
+
+		c.Specify("keeps the messages failing with ErrMaxRetriesExceeded", func() {
+			output.err = ErrMaxRetriesExceeded
+			reject()
+			c.Expect(output.attempts, gs.Equals, 1)
+			c.Expect(runner.DeadLetterCount(), gs.Equals, int64(1))
+		})
+	})
+}
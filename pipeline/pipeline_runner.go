@@ -49,6 +49,8 @@ type GlobalConfigStruct struct {
 	MaxMsgProcessInject   uint
 	MaxMsgTimerInject     uint
 	MaxPackIdle           time.Duration
+	MaxBatchSize          int           // packs routed per batch, 0 or 1 disables batching
+	MaxBatchLinger        time.Duration // how long the router waits for a batch to fill up
 	stopping              bool
 	stoppingMutex         sync.RWMutex
 	shutdownOnce          sync.Once
@@ -264,16 +266,15 @@ func (p *PipelinePack) EncodeMsgBytes() error {
 func Run(config *PipelineConfig) (exitCode int) {
 	LogInfo.Println("Starting hekad...")
 
-	var outputsWg sync.WaitGroup
 	var err error
 
 	globals := config.Globals
 
 	for name, output := range config.OutputRunners {
-		outputsWg.Add(1)
-		if err = output.Start(config, &outputsWg); err != nil {
+		config.outputsWg.Add(1)
+		if err = output.Start(config, &config.outputsWg); err != nil {
 			LogError.Printf("Output '%s' failed to start: %s", name, err)
-			outputsWg.Done()
+			config.outputsWg.Done()
 			if !output.IsStoppable() {
 				globals.ShutDown(1)
 			}
@@ -333,6 +334,23 @@ func Run(config *PipelineConfig) (exitCode int) {
 		LogInfo.Println("Input started:", name)
 	}
 
+	// Reloads run one at a time on their own goroutine, a SIGHUP received
+	// while one is pending is folded into it. Shutdown waits for a running
+	// reload to finish and skips the pending one.
+	reloads := make(chan struct{}, 1)
+	reloadsDone := make(chan struct{})
+	go func() {
+		defer close(reloadsDone)
+		for range reloads {
+			if globals.IsShuttingDown() {
+				continue
+			}
+			if err := config.Reload(); err != nil {
+				LogError.Println("Reload failed, keeping the running configuration: ", err)
+			}
+		}
+	}()
+
 	// wait for sigint
 	signal.Notify(globals.sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP,
 		SIGUSR1, SIGUSR2)
@@ -346,6 +364,11 @@ func Run(config *PipelineConfig) (exitCode int) {
 				if err := notify.Post(RELOAD, nil); err != nil {
 					LogError.Println("Error sending reload event: ", err)
 				}
+				select {
+				case reloads <- struct{}{}:
+				default:
+					LogInfo.Println("Reload already pending.")
+				}
 			case syscall.SIGINT, syscall.SIGTERM:
 				LogInfo.Println("Shutdown initiated.")
 				globals.stop()
@@ -359,6 +382,9 @@ func Run(config *PipelineConfig) (exitCode int) {
 		}
 	}
 
+	close(reloads)
+	<-reloadsDone
+
 	config.inputsLock.Lock()
 	for _, input := range config.InputRunners {
 		input.Input().Stop()
@@ -391,11 +417,13 @@ func Run(config *PipelineConfig) (exitCode int) {
 	config.filtersLock.Unlock()
 	config.filtersWg.Wait()
 
+	config.outputsLock.Lock()
 	for _, output := range config.OutputRunners {
 		config.router.RemoveOutputMatcher() <- output.MatchRunner()
 		LogInfo.Printf("Stop message sent to output '%s'", output.Name())
 	}
-	outputsWg.Wait()
+	config.outputsLock.Unlock()
+	config.outputsWg.Wait()
 
 	for name, encoder := range config.allEncoders {
 		if stopper, ok := encoder.(NeedsStopping); ok {
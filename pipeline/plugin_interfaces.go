@@ -73,6 +73,23 @@ type MessageProcessor interface {
 	ProcessMessage(pack *PipelinePack) (err error)
 }
 
+// Can be implemented by Filters and Outputs to be handed the matched messages
+// in batches when the router batches its deliveries (see the hekad
+// max_batch_size setting), instead of one at a time through ProcessMessage.
+// The packs are recycled once ProcessMessages returns. A RetryMessageError
+// makes the whole batch be retried, any other error applies to every pack in
+// the batch.
+type BatchMessageProcessor interface {
+	ProcessMessages(packs []*PipelinePack) (err error)
+}
+
+// Can be implemented by the config struct of a plugin that saves its data when
+// it's destroyed and restores it in Init. A reload only initializes the new
+// instance of such a plugin once the previous one has exited.
+type PreservesData interface {
+	PreservesData() bool
+}
+
 type Filter interface {
 	Prepare(r FilterRunner, h PluginHelper) (err error)
 	CleanUp()
@@ -214,6 +214,8 @@ type iRunner struct {
 	canExit            bool
 	shutdownWanters    []WantsDecoderRunnerShutdown
 	shutdownLock       sync.Mutex
+	// Closed once the input has stopped running.
+	done chan struct{}
 }
 
 func (ir *iRunner) Ticker() (ticker <-chan time.Time) {
@@ -302,12 +304,14 @@ func (ir *iRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error) {
 			return fmt.Errorf("no registered '%s' decoder", ir.config.Decoder)
 		}
 	}
+	ir.done = make(chan struct{})
 	go ir.Starter(h, wg)
 	return
 }
 
 func (ir *iRunner) Starter(h PluginHelper, wg *sync.WaitGroup) {
 	defer wg.Done()
+	defer close(ir.done)
 
 	globals := ir.pConfig.Globals
 	rh, err := NewRetryHelper(ir.config.Retries)
@@ -505,12 +509,35 @@ func (ir *iRunner) getDeliverFunc(token string) (DeliverFunc, DecoderRunner, Dec
 			if !trustMsgBytes {
 				p.TrustMsgBytes = false
 			}
+		}
+		if len(packs) > 1 && ir.pConfig.router.batchSize > 1 {
+			ir.injectBatch(packs)
+			return
+		}
+		for _, p := range packs {
 			ir.Inject(p)
 		}
 	}
 	return deliver, nil, decoder
 }
 
+// Injects the packs decoded from a single pack as one batch.
+func (ir *iRunner) injectBatch(packs []*PipelinePack) error {
+	batch := make([]*PipelinePack, 0, len(packs))
+	for _, pack := range packs {
+		if err := pack.EncodeMsgBytes(); err != nil {
+			ir.LogError(fmt.Errorf("encoding message: %s", err.Error()))
+			pack.recycle()
+			continue
+		}
+		batch = append(batch, pack)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return ir.pConfig.router.injectBatch(batch)
+}
+
 func (ir *iRunner) NewDeliverer(token string) Deliverer {
 	deliver, dRunner, decoder := ir.getDeliverFunc(token)
 	d := &deliverer{
@@ -628,33 +655,24 @@ func (dr *dRunner) Start(h PluginHelper, wg *sync.WaitGroup) {
 }
 
 func (dr *dRunner) start(h PluginHelper, wg *sync.WaitGroup) {
-	var (
-		pack  *PipelinePack
-		packs []*PipelinePack
-		err   error
-	)
-	for pack = range dr.inChan {
-		if packs, err = dr.decoder.Decode(pack); packs != nil {
-			for _, p := range packs {
-				dr.deliver(p)
-			}
-		} else {
-			if err != nil {
-				if dr.printFailure {
-					dr.LogError(err)
-				}
-				if dr.sendFailure {
-					if err = AddDecodeFailureFields(pack.Message, err.Error()); err != nil {
-						dr.LogError(err)
-					}
-					pack.TrustMsgBytes = false
-					dr.deliver(pack)
-					continue
-				}
+	workers, preserveOrder := 1, true
+	if concurrent, ok := dr.decoder.(ConcurrentDecoder); ok {
+		workers, preserveOrder = concurrent.Concurrency()
+	}
+	switch {
+	case workers <= 1:
+		batch := dr.newBatch()
+		for pack := range dr.inChan {
+			packs, err := dr.decoder.Decode(pack)
+			dr.handleDecoded(batch, pack, packs, err)
+			if len(dr.inChan) == 0 {
+				batch.flush()
 			}
-			pack.recycle()
-			continue
 		}
+	case preserveOrder:
+		dr.decodeOrdered(workers)
+	default:
+		dr.decodeUnordered(workers)
 	}
 	if wanter, ok := dr.decoder.(WantsDecoderRunnerShutdown); ok {
 		wanter.Shutdown()
@@ -663,7 +681,138 @@ func (dr *dRunner) start(h PluginHelper, wg *sync.WaitGroup) {
 	wg.Done()
 }
 
-func (dr *dRunner) deliver(pack *PipelinePack) {
+// Decodes with a number of goroutines, delivering the results as soon as they
+// are available.
+func (dr *dRunner) decodeUnordered(workers int) {
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			batch := dr.newBatch()
+			for pack := range dr.inChan {
+				packs, err := dr.decoder.Decode(pack)
+				dr.handleDecoded(batch, pack, packs, err)
+				if len(dr.inChan) == 0 {
+					batch.flush()
+				}
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
+type decodeResult struct {
+	pack  *PipelinePack
+	packs []*PipelinePack
+	err   error
+}
+
+type decodeJob struct {
+	pack   *PipelinePack
+	result chan decodeResult
+}
+
+// Decodes with a number of goroutines, delivering the results in the order the
+// packs were received.
+func (dr *dRunner) decodeOrdered(workers int) {
+	// Every pack gets a result channel, queued in arrival order so the results
+	// are waited for in that order.
+	pending := make(chan chan decodeResult, workers)
+	jobs := make(chan decodeJob)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range jobs {
+				packs, err := dr.decoder.Decode(job.pack)
+				job.result <- decodeResult{job.pack, packs, err}
+			}
+		}()
+	}
+	go func() {
+		for pack := range dr.inChan {
+			result := make(chan decodeResult, 1)
+			pending <- result
+			jobs <- decodeJob{pack, result}
+		}
+		close(jobs)
+		close(pending)
+	}()
+	batch := dr.newBatch()
+	for result := range pending {
+		r := <-result
+		dr.handleDecoded(batch, r.pack, r.packs, r.err)
+		if len(pending) == 0 {
+			batch.flush()
+		}
+	}
+}
+
+// Collects the packs a decoder delivers to hand them over to the router in
+// batches, when the router batches its deliveries. Owned by a single
+// goroutine.
+type routerBatch struct {
+	router *messageRouter
+	size   int
+	packs  []*PipelinePack
+}
+
+func (dr *dRunner) newBatch() *routerBatch {
+	return &routerBatch{
+		router: dr.router,
+		size:   dr.router.batchSize,
+	}
+}
+
+// Injects the pack right away if the router doesn't batch, otherwise adds it
+// to the batch, which is handed over once it's full.
+func (b *routerBatch) add(pack *PipelinePack) error {
+	if b.size <= 1 {
+		return b.router.Inject(pack)
+	}
+	b.packs = append(b.packs, pack)
+	if len(b.packs) >= b.size {
+		return b.flush()
+	}
+	return nil
+}
+
+// Hands the collected packs over to the router.
+func (b *routerBatch) flush() error {
+	if len(b.packs) == 0 {
+		return nil
+	}
+	packs := b.packs
+	b.packs = make([]*PipelinePack, 0, b.size)
+	return b.router.injectBatch(packs)
+}
+
+// Delivers the packs decoded from a pack, or handles the decoding failure.
+func (dr *dRunner) handleDecoded(batch *routerBatch, pack *PipelinePack,
+	packs []*PipelinePack, err error) {
+
+	if packs != nil {
+		for _, p := range packs {
+			dr.deliver(batch, p)
+		}
+		return
+	}
+	if err != nil {
+		if dr.printFailure {
+			dr.LogError(err)
+		}
+		if dr.sendFailure {
+			if err = AddDecodeFailureFields(pack.Message, err.Error()); err != nil {
+				dr.LogError(err)
+			}
+			pack.TrustMsgBytes = false
+			dr.deliver(batch, pack)
+			return
+		}
+	}
+	pack.recycle()
+}
+
+func (dr *dRunner) deliver(batch *routerBatch, pack *PipelinePack) {
 	if !dr.encodes || !pack.TrustMsgBytes {
 		err := pack.EncodeMsgBytes()
 		if err != nil {
@@ -673,7 +822,7 @@ func (dr *dRunner) deliver(pack *PipelinePack) {
 			return
 		}
 	}
-	dr.router.Inject(pack)
+	batch.add(pack)
 }
 
 func (dr *dRunner) InChan() chan *PipelinePack {
@@ -712,6 +861,14 @@ type WantsDecoderRunner interface {
 	SetDecoderRunner(dr DecoderRunner)
 }
 
+// Any decoder whose Decode method is safe to call from several goroutines at
+// once can implement this interface to have its DecoderRunner decode with the
+// returned number of goroutines. If preserveOrder is true the decoded packs
+// are still delivered in the order the packs were received.
+type ConcurrentDecoder interface {
+	Concurrency() (workers int, preserveOrder bool)
+}
+
 // Any decoder that needs to know when the DecoderRunner is exiting can
 // implement this interface and it will be called on DecoderRunner exit.
 type WantsDecoderRunnerShutdown interface {
@@ -839,6 +996,7 @@ func (kind foRunnerKind) String() string {
 type foRunner struct {
 	processMessageCount int64
 	dropMessageCount    int64
+	deadLetterCount     int64
 	capacity            int
 	pRunnerBase
 	pluginType   string
@@ -846,6 +1004,7 @@ type foRunner struct {
 	matcher      *MatchRunner
 	ticker       <-chan time.Time
 	inChan       chan *PipelinePack
+	batchChan    chan []*PipelinePack // batch-aware plugins only
 	backChan     chan *PipelinePack
 	h            PluginHelper
 	retainPack   *PipelinePack
@@ -859,6 +1018,13 @@ type foRunner struct {
 	lastErr      error
 	bufReader    *BufferReader
 	stopChan     chan bool
+	// Queue of the messages the plugin rejected, see DeadLetterConfig.
+	deadLetterFeeder *BufferFeeder
+	// Set when the plugin is being removed by a configuration reload, so it
+	// exits without being treated as a failure.
+	retired int32
+	// Closed once the plugin has stopped running.
+	done chan struct{}
 }
 
 const pluginPoolSize = 2
@@ -902,11 +1068,22 @@ func NewFORunner(name string, plugin Plugin, config CommonFOConfig,
 			config.Buffering.FullAction = "shutdown"
 		}
 		switch config.Buffering.FullAction {
-		case "shutdown", "drop", "block":
+		case "shutdown", "drop", "drop_oldest", "block":
 		default:
-			msg := "buffer full_action must be 'shutdown', 'drop', or 'block', got '%s'"
+			msg := "buffer full_action must be 'shutdown', 'drop', 'drop_oldest', or 'block', got '%s'"
 			return nil, fmt.Errorf(msg, config.Buffering.FullAction)
 		}
+		if _, err := queueCodec(config.Buffering.Compression); err != nil {
+			return nil, fmt.Errorf("buffer %s", err)
+		}
+		if config.Buffering.MaxAge != "" {
+			if _, err := time.ParseDuration(config.Buffering.MaxAge); err != nil {
+				return nil, fmt.Errorf("buffer can't parse max_age: %s", err)
+			}
+		}
+		if err := checkSyncPolicy(config.Buffering.SyncPolicy); err != nil {
+			return nil, fmt.Errorf("buffer %s", err)
+		}
 		runner.capacity = int(config.Buffering.MaxBufferSize) * 90 / 100
 	}
 
@@ -1040,8 +1217,12 @@ func (foRunner *foRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error)
 			return fmt.Errorf("can't initialize buffer: %s", err)
 		}
 	}
+	if err = foRunner.openDeadLetter(); err != nil {
+		return fmt.Errorf("can't initialize dead letter queue: %s", err)
+	}
 
 	foRunner.stopChan = make(chan bool)
+	foRunner.done = make(chan struct{})
 
 	if foRunner.matcher != nil {
 		foRunner.matcher.bufFeeder = bufFeeder
@@ -1067,6 +1248,19 @@ func (foRunner *foRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error)
 		}
 	}
 
+	// With batching turned on the matcher gets batches from the router and
+	// passes them on as they are to plugins that can process them.
+	batchSize := foRunner.pConfig.Globals.MaxBatchSize
+	if batchSize > 1 && foRunner.matcher != nil {
+		foRunner.matcher.enableBatching(batchSize)
+		_, batchAware := foRunner.plugin.(BatchMessageProcessor)
+		if newStyleAPI && batchAware && !foRunner.useBuffering {
+			foRunner.batchChan = make(chan []*PipelinePack,
+				cap(foRunner.matcher.batchChan))
+			foRunner.matcher.batchOut = foRunner.batchChan
+		}
+	}
+
 	if newStyleAPI {
 		plugin, ok := foRunner.plugin.(MessageProcessor)
 		if !ok {
@@ -1123,9 +1317,11 @@ func (foRunner *foRunner) channelLoop(plugin MessageProcessor, h PluginHelper,
 			if !ok {
 				break
 			}
+			attempts := 0
 		RetryLoop:
 			for !foRunner.pConfig.Globals.IsShuttingDown() {
 				err := plugin.ProcessMessage(pack)
+				attempts++
 				if err == nil {
 					pack.recycle()
 					break RetryLoop // Bumps us back to the outer loop.
@@ -1136,11 +1332,17 @@ func (foRunner *foRunner) channelLoop(plugin MessageProcessor, h PluginHelper,
 					return err
 				case RetryMessageError:
 					foRunner.LogError(err)
+					if foRunner.attemptsExhausted(err, attempts) {
+						foRunner.deadLetter(pack, err, attempts)
+						pack.recycle()
+						break RetryLoop
+					}
 					rh.Wait()
 					resetNeeded = true
 					continue // Try the same one again.
 				default:
 					foRunner.LogError(err)
+					foRunner.deadLetter(pack, err, attempts)
 					pack.recycle()
 					break RetryLoop
 				}
@@ -1164,12 +1366,103 @@ func (foRunner *foRunner) channelLoop(plugin MessageProcessor, h PluginHelper,
 	return nil
 }
 
+// batchLoop is invoked instead of channelLoop for plugins that process the
+// messages in batches.
+func (foRunner *foRunner) batchLoop(plugin BatchMessageProcessor, h PluginHelper,
+	tickReceiver TickerPlugin) error {
+
+	rh, _ := NewRetryHelper(RetryOptions{
+		MaxDelay:   "1s",
+		Delay:      "10ms",
+		MaxRetries: -1,
+	})
+
+	recycle := func(packs []*PipelinePack) {
+		for _, pack := range packs {
+			pack.recycle()
+		}
+	}
+
+	resetNeeded := false
+	ok := true
+	var packs []*PipelinePack
+	for ok {
+		if resetNeeded {
+			rh.Reset()
+		}
+		select {
+		case packs, ok = <-foRunner.batchChan:
+			if !ok {
+				break
+			}
+			attempts := 0
+			// The error applies to every pack of the batch.
+			deadLetter := func(err error) {
+				for _, pack := range packs {
+					foRunner.deadLetter(pack, err, attempts)
+				}
+			}
+		RetryLoop:
+			for {
+				if foRunner.pConfig.Globals.IsShuttingDown() {
+					// The batch won't be retried, it's dropped.
+					recycle(packs)
+					break RetryLoop
+				}
+				err := plugin.ProcessMessages(packs)
+				attempts++
+				if err == nil {
+					recycle(packs)
+					break RetryLoop
+				}
+				switch err.(type) {
+				case PluginExitError:
+					recycle(packs)
+					return err
+				case RetryMessageError:
+					foRunner.LogError(err)
+					if foRunner.attemptsExhausted(err, attempts) {
+						deadLetter(err)
+						recycle(packs)
+						break RetryLoop
+					}
+					rh.Wait()
+					resetNeeded = true
+					continue // Try the same batch again.
+				default:
+					foRunner.LogError(err)
+					deadLetter(err)
+					recycle(packs)
+					break RetryLoop
+				}
+			}
+		case <-foRunner.ticker:
+			if tickReceiver == nil {
+				// Again, this shouldn't happen.
+				panic(fmt.Sprintf("Not a TickerPlugin: %s", foRunner.name))
+			}
+			err := tickReceiver.TimerEvent()
+			if err != nil {
+				err = fmt.Errorf("Error running TimerEvent for %s: %s",
+					foRunner.name, err.Error())
+				if _, isFatal := err.(PluginExitError); isFatal {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
 // Starter is the main goroutine launched for plugins that support the newer
 // API.
 func (foRunner *foRunner) Starter(plugin MessageProcessor, h PluginHelper,
 	wg *sync.WaitGroup) {
 
 	defer wg.Done()
+	defer close(foRunner.done)
+	defer foRunner.closeDeadLetter()
 
 	globals := foRunner.pConfig.Globals
 	if foRunner.matcher != nil {
@@ -1242,6 +1535,8 @@ func (foRunner *foRunner) Starter(plugin MessageProcessor, h PluginHelper,
 	for !globals.IsShuttingDown() {
 		if foRunner.useBuffering {
 			err = foRunner.bufferLoop(plugin, h, tickReceiver)
+		} else if foRunner.batchChan != nil {
+			err = foRunner.batchLoop(plugin.(BatchMessageProcessor), h, tickReceiver)
 		} else {
 			err = foRunner.channelLoop(plugin, h, tickReceiver)
 		}
@@ -1265,8 +1560,9 @@ func (foRunner *foRunner) Starter(plugin MessageProcessor, h PluginHelper,
 
 		foRunner.LogMessage("stopped")
 
-		// Are we shutting down? Save ourselves some time by exiting now.
-		if globals.IsShuttingDown() {
+		// Are we shutting down or being removed? Save ourselves some time by
+		// exiting now.
+		if globals.IsShuttingDown() || foRunner.isRetired() {
 			break
 		}
 
@@ -1325,6 +1621,16 @@ func (foRunner *foRunner) Starter(plugin MessageProcessor, h PluginHelper,
 	}
 }
 
+// Marks the plugin as deliberately removed, it has to be called before its
+// matcher is removed from the router.
+func (foRunner *foRunner) retire() {
+	atomic.StoreInt32(&foRunner.retired, 1)
+}
+
+func (foRunner *foRunner) isRetired() bool {
+	return atomic.LoadInt32(&foRunner.retired) == 1
+}
+
 func (foRunner *foRunner) IsStoppable() bool {
 	return foRunner.canExit
 }
@@ -1348,6 +1654,14 @@ func (foRunner *foRunner) exit() {
 				orphaned++
 				pack.recycle()
 			}
+			if foRunner.batchChan != nil {
+				for packs := range foRunner.batchChan {
+					for _, pack := range packs {
+						orphaned++
+						pack.recycle()
+					}
+				}
+			}
 			if orphaned == 1 {
 				foRunner.LogError(fmt.Errorf("Lost/Dropped 1 message"))
 			} else if orphaned > 1 {
@@ -1355,8 +1669,8 @@ func (foRunner *foRunner) exit() {
 			}
 		}()
 	}
-	// Just exit if we're stopping.
-	if foRunner.pConfig.Globals.IsShuttingDown() {
+	// Just exit if we're stopping, or if a reload removed us.
+	if foRunner.pConfig.Globals.IsShuttingDown() || foRunner.isRetired() {
 		return
 	}
 
@@ -1471,6 +1785,8 @@ func (foRunner *foRunner) runBoth(h PluginHelper) error {
 // OldStarter is the main goroutine driving plugins that support the older API.
 func (foRunner *foRunner) OldStarter(helper PluginHelper, wg *sync.WaitGroup) {
 	defer wg.Done()
+	defer close(foRunner.done)
+	defer foRunner.closeDeadLetter()
 
 	var err error
 	globals := foRunner.pConfig.Globals
@@ -1518,7 +1834,7 @@ func (foRunner *foRunner) OldStarter(helper PluginHelper, wg *sync.WaitGroup) {
 		foRunner.LogMessage("stopped")
 
 		// Are we supposed to stop? Save ourselves some time by exiting now.
-		if globals.IsShuttingDown() {
+		if globals.IsShuttingDown() || foRunner.isRetired() {
 			break
 		}
 
@@ -1565,7 +1881,7 @@ func (foRunner *foRunner) OldStarter(helper PluginHelper, wg *sync.WaitGroup) {
 }
 
 // Message sending function for buffered plugins using the old-style API.
-func (foRunner foRunner) SendRecord(pack *PipelinePack) error {
+func (foRunner *foRunner) SendRecord(pack *PipelinePack) error {
 	select {
 	case foRunner.inChan <- pack:
 		// Wait until pack is delivered.
@@ -1578,6 +1894,7 @@ func (foRunner foRunner) SendRecord(pack *PipelinePack) error {
 				if _, ok := err.(RetryMessageError); !ok {
 					foRunner.LogError(fmt.Errorf("can't send record: %s", err))
 					atomic.AddInt64(&foRunner.dropMessageCount, 1)
+					foRunner.deadLetter(pack, err, foRunner.bufReader.sendAttempts)
 					pack.recycle()
 					err = nil // Swallow the error so there's no retry.
 				}
@@ -1738,15 +2055,23 @@ func (err PluginExitError) Error() string {
 
 type RetryMessageError struct {
 	msg string
+	err error
 }
 
+// The error wrapped with %w, if any, is returned by Unwrap.
 func NewRetryMessageError(msg string, subs ...interface{}) RetryMessageError {
+	var err error
 	if len(subs) > 0 {
-		msg = fmt.Sprintf(msg, subs...)
+		e := fmt.Errorf(msg, subs...)
+		msg, err = e.Error(), errors.Unwrap(e)
 	}
-	return RetryMessageError{msg}
+	return RetryMessageError{msg, err}
 }
 
 func (err RetryMessageError) Error() string {
 	return err.msg
 }
+
+func (err RetryMessageError) Unwrap() error {
+	return err.err
+}
@@ -25,6 +25,7 @@ import (
 	"regexp"
 	"sort"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -43,6 +44,8 @@ var ErrStopping = errors.New("Stopping")
 
 var _wordre = regexp.MustCompile("\\W")
 
+const queueCheckpointFilename = "checkpoint.txt"
+
 type BufferSize struct {
 	size uint64
 }
@@ -64,9 +67,59 @@ type QueueBufferConfig struct {
 	MaxBufferSize     uint64 `toml:"max_buffer_size"`
 	FullAction        string `toml:"full_action"`
 	CursorUpdateCount uint   `toml:"cursor_update_count"`
+	// Compression of the queued records, "none", "snappy" or "zstd".
+	Compression string `toml:"compression"`
+	// Uncompressed size of the records gathered in a compressed block.
+	BlockSize uint64 `toml:"block_size"`
+	// How long a compressed block waits for more records before it's
+	// written.
+	BlockLinger string `toml:"block_linger"`
+	// Age after which queue files that are no longer written are removed,
+	// empty to keep them until they're read.
+	MaxAge string `toml:"max_age"`
+	// When the queued records are synced to disk, "none", "interval",
+	// "every_n" or "always".
+	SyncPolicy string `toml:"sync_policy"`
+	// Longest time written records wait to be synced with the "interval"
+	// policy.
+	SyncInterval string `toml:"sync_interval"`
+	// Number of records written between syncs with the "every_n" policy.
+	SyncCount uint `toml:"sync_count"`
 }
 
-const DefaultBufferMaxFileSize uint64 = uint64(512 * 1024 * 1024)
+const (
+	DefaultBufferMaxFileSize  uint64 = uint64(512 * 1024 * 1024)
+	DefaultBufferBlockSize    uint64 = uint64(64 * 1024)
+	DefaultBufferBlockLinger         = "100ms"
+	DefaultBufferSyncInterval        = "1s"
+	DefaultBufferSyncCount           = uint(100)
+)
+
+// How often the age of the queue files is checked when `max_age` is set.
+const queueExpireInterval = time.Second
+
+// Checks a `sync_policy` setting.
+func checkSyncPolicy(policy string) error {
+	switch policy {
+	case "", "none", "interval", "every_n", "always":
+		return nil
+	}
+	return fmt.Errorf("sync_policy must be 'none', 'interval', 'every_n' or 'always', got '%s'",
+		policy)
+}
+
+// Syncs a directory, making the files created or renamed in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if e := d.Close(); err == nil {
+		err = e
+	}
+	return err
+}
 
 func defaultQueueBufferConfig() *QueueBufferConfig {
 	return &QueueBufferConfig{
@@ -74,6 +127,12 @@ func defaultQueueBufferConfig() *QueueBufferConfig {
 		MaxBufferSize:     uint64(0),
 		FullAction:        "shutdown",
 		CursorUpdateCount: uint(1),
+		Compression:       "none",
+		BlockSize:         DefaultBufferBlockSize,
+		BlockLinger:       DefaultBufferBlockLinger,
+		SyncPolicy:        "none",
+		SyncInterval:      DefaultBufferSyncInterval,
+		SyncCount:         DefaultBufferSyncCount,
 	}
 }
 
@@ -106,6 +165,10 @@ func NewBufferSet(queueDir, queueName string, config *QueueBufferConfig,
 			message.MAX_RECORD_SIZE)
 		return nil, nil, err
 	}
+	if config.BlockSize > MaxBufferBlockSize {
+		err := fmt.Errorf("`block_size` must not be greater than %d", MaxBufferBlockSize)
+		return nil, nil, err
+	}
 
 	bf, err := NewBufferFeeder(queue, config, queueSize)
 	if err != nil {
@@ -116,6 +179,8 @@ func NewBufferSet(queueDir, queueName string, config *QueueBufferConfig,
 	if err != nil {
 		return nil, nil, fmt.Errorf("can't create BufferReader: %s", err)
 	}
+	bf.reader = br
+	bf.startExpiry()
 
 	return bf, br, nil
 }
@@ -127,18 +192,81 @@ type BufferFeeder struct {
 	queue         string
 	queueSize     *BufferSize
 	Config        *QueueBufferConfig
+	codec         byte
+	blockSize     int
+	linger        time.Duration
+	// Framed records waiting to be compressed into a block, written by
+	// QueueRecord or by the linger timer.
+	block      []byte
+	blockLock  sync.Mutex
+	blockTimer *time.Timer
+	out        []byte
+	maxAge         time.Duration
+	expireInterval time.Duration
+	expireTimer    *time.Timer
+	// Records written since the last sync of the write file. A sync covers
+	// all of them, records are grouped by the block they're compressed in,
+	// by Commit, by sync_count or by sync_interval.
+	syncPolicy   string
+	syncInterval time.Duration
+	syncCount    uint
+	syncTimer    *time.Timer
+	unsynced     uint
+	blockRecords uint
+	committing   bool
+	// Reader of the queue, its unread files are removed by the `drop_oldest`
+	// full action and by `max_age`.
+	reader *BufferReader
 }
 
 func NewBufferFeeder(queue string, config *QueueBufferConfig, queueSize *BufferSize) (
 	*BufferFeeder, error) {
 
 	bf := &BufferFeeder{
-		queue:     queue,
-		queueSize: queueSize,
-		Config:    config,
+		queue:          queue,
+		queueSize:      queueSize,
+		Config:         config,
+		expireInterval: queueExpireInterval,
 	}
 
 	var err error
+	if bf.codec, err = queueCodec(config.Compression); err != nil {
+		return nil, err
+	}
+	bf.blockSize = int(config.BlockSize)
+	if bf.blockSize == 0 {
+		bf.blockSize = int(DefaultBufferBlockSize)
+	}
+	linger := config.BlockLinger
+	if linger == "" {
+		linger = DefaultBufferBlockLinger
+	}
+	if bf.linger, err = time.ParseDuration(linger); err != nil {
+		return nil, fmt.Errorf("can't parse `block_linger`: %s", err)
+	}
+	if config.MaxAge != "" {
+		if bf.maxAge, err = time.ParseDuration(config.MaxAge); err != nil {
+			return nil, fmt.Errorf("can't parse `max_age`: %s", err)
+		}
+	}
+	if err = checkSyncPolicy(config.SyncPolicy); err != nil {
+		return nil, err
+	}
+	bf.syncPolicy = config.SyncPolicy
+	if bf.syncPolicy == "" {
+		bf.syncPolicy = "none"
+	}
+	interval := config.SyncInterval
+	if interval == "" {
+		interval = DefaultBufferSyncInterval
+	}
+	if bf.syncInterval, err = time.ParseDuration(interval); err != nil {
+		return nil, fmt.Errorf("can't parse `sync_interval`: %s", err)
+	}
+	bf.syncCount = config.SyncCount
+	if bf.syncCount == 0 {
+		bf.syncCount = DefaultBufferSyncCount
+	}
 	if !fileExists(bf.queue) {
 		if err = os.MkdirAll(bf.queue, 0766); err != nil {
 			return nil, fmt.Errorf("can't make queue directory: %s", err)
@@ -164,6 +292,9 @@ func NewBufferFeeder(queue string, config *QueueBufferConfig, queueSize *BufferS
 
 func (bf *BufferFeeder) RollQueue() (err error) {
 	if bf.writeFile != nil {
+		if err = bf.sync(); err != nil {
+			return err
+		}
 		bf.writeFile.Close()
 		bf.writeFile = nil
 	}
@@ -171,23 +302,28 @@ func (bf *BufferFeeder) RollQueue() (err error) {
 	bf.writeFile, err = os.OpenFile(getQueueFilename(bf.queue, bf.writeId),
 		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	bf.writeFileSize = 0
+	if err == nil && bf.syncPolicy != "none" {
+		err = syncDir(bf.queue)
+	}
 	return err
 }
 
 // QueueRecord adds a new record to the end of the current queue buffer. Note
 // that QueueRecord is *not* thread safe, it should only ever be called by one
-// goroutine at a time.
+// goroutine at a time. With compression the record is written along with the
+// ones following it, once they fill a block or the block linger expires,
+// unless the "always" sync policy requires it to be written right away or at
+// the end of the commit group.
 func (bf *BufferFeeder) QueueRecord(pack *PipelinePack) error {
+	bf.blockLock.Lock()
+	defer bf.blockLock.Unlock()
+
 	maxQueueSize := bf.Config.MaxBufferSize
-	if maxQueueSize > 0 && (bf.queueSize.Get()+uint64(len(pack.MsgBytes)) > maxQueueSize) {
+	pending := uint64(len(bf.block))
+	if maxQueueSize > 0 &&
+		(bf.queueSize.Get()+pending+uint64(len(pack.MsgBytes)) > maxQueueSize) {
 		return QueueIsFull
 	}
-	maxQueueFileSize := bf.Config.MaxFileSize
-	if bf.writeFileSize+uint64(len(pack.MsgBytes)) > maxQueueFileSize {
-		if err := bf.RollQueue(); err != nil {
-			return fmt.Errorf("queue file rotation error: %s", err)
-		}
-	}
 
 	var outBytes []byte
 	err := client.CreateHekaStream(pack.MsgBytes, &outBytes, nil)
@@ -195,6 +331,263 @@ func (bf *BufferFeeder) QueueRecord(pack *PipelinePack) error {
 		return fmt.Errorf("message framing error: %s", err)
 	}
 
+	if bf.codec == queueCodecNone {
+		return bf.writeBlock(outBytes, 1)
+	}
+	if len(bf.block) > 0 && len(bf.block)+len(outBytes) > bf.blockSize {
+		if err = bf.flush(); err != nil {
+			return err
+		}
+	}
+	bf.block = append(bf.block, outBytes...)
+	bf.blockRecords++
+	if len(bf.block) >= bf.blockSize || bf.syncPolicy == "always" && !bf.committing {
+		// A full block, or a record that must be synced before returning.
+		return bf.flush()
+	}
+	if len(bf.block) == len(outBytes) {
+		// First record of the block.
+		if bf.blockTimer == nil {
+			bf.blockTimer = time.AfterFunc(bf.linger, bf.lingerExpired)
+		} else {
+			bf.blockTimer.Reset(bf.linger)
+		}
+	}
+	return nil
+}
+
+// DropOldest makes room in a full queue for a record of the given size by
+// removing whole queue files, oldest first. The messages they hold that
+// haven't been read yet are counted as dropped. QueueIsFull is returned if
+// the record still doesn't fit.
+func (bf *BufferFeeder) DropOldest(size uint64) error {
+	bf.blockLock.Lock()
+	defer bf.blockLock.Unlock()
+
+	maxQueueSize := bf.Config.MaxBufferSize
+	full := func(os.FileInfo) bool {
+		return bf.queueSize.Get()+uint64(len(bf.block))+size > maxQueueSize
+	}
+	if bf.reader == nil || maxQueueSize == 0 {
+		return QueueIsFull
+	}
+	if err := bf.dropFiles(full); err != nil {
+		return err
+	}
+	if full(nil) && bf.writeFileSize > 0 {
+		// Only the file being written is left, start a new one so it can
+		// be dropped too.
+		if err := bf.RollQueue(); err != nil {
+			return fmt.Errorf("queue file rotation error: %s", err)
+		}
+		if err := bf.dropFiles(full); err != nil {
+			return err
+		}
+	}
+	if full(nil) {
+		return QueueIsFull
+	}
+	return nil
+}
+
+// Starts checking the age of the queue files when `max_age` is set. They're
+// checked on a timer so they expire even when no new records are queued,
+// until the feeder is closed.
+func (bf *BufferFeeder) startExpiry() {
+	if bf.maxAge > 0 && bf.reader != nil {
+		bf.expireTimer = time.AfterFunc(bf.expireInterval, bf.expireFiles)
+	}
+}
+
+func (bf *BufferFeeder) expireFiles() {
+	bf.blockLock.Lock()
+	defer bf.blockLock.Unlock()
+	if bf.writeFile == nil {
+		// Closed.
+		return
+	}
+	if err := bf.expire(time.Now()); err != nil {
+		bf.reader.logError(fmt.Errorf("can't expire queue files: %s", err))
+	}
+	bf.expireTimer.Reset(bf.expireInterval)
+}
+
+// Removes the queue files last written more than `max_age` ago.
+func (bf *BufferFeeder) expire(now time.Time) error {
+	return bf.dropFiles(func(fi os.FileInfo) bool {
+		return now.Sub(fi.ModTime()) > bf.maxAge
+	})
+}
+
+// Removes the queue files older than the write file, oldest first, for as
+// long as drop returns true.
+func (bf *BufferFeeder) dropFiles(drop func(fi os.FileInfo) bool) error {
+	br := bf.reader
+	br.lock.Lock()
+	defer br.lock.Unlock()
+
+	for _, id := range sortedBufferIds(bf.queue) {
+		if id >= bf.writeId {
+			break
+		}
+		fi, err := os.Stat(getQueueFilename(bf.queue, id))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed by the reader since we listed it.
+				continue
+			}
+			return fmt.Errorf("can't stat queue file: %s", err)
+		}
+		if !drop(fi) {
+			break
+		}
+		if err = br.dropFile(id, fi.Size()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close writes the records waiting to be compressed and closes the write
+// file, the feeder can't be used anymore.
+func (bf *BufferFeeder) Close() error {
+	bf.blockLock.Lock()
+	defer bf.blockLock.Unlock()
+	if bf.expireTimer != nil {
+		bf.expireTimer.Stop()
+	}
+	err := bf.flush()
+	if err == nil {
+		err = bf.sync()
+	}
+	if bf.writeFile != nil {
+		if e := bf.writeFile.Close(); err == nil {
+			err = e
+		}
+		bf.writeFile = nil
+	}
+	return err
+}
+
+// Flush writes the records waiting to be compressed, and syncs the write
+// file unless `sync_policy` is "none".
+func (bf *BufferFeeder) Flush() error {
+	bf.blockLock.Lock()
+	defer bf.blockLock.Unlock()
+	if err := bf.flush(); err != nil {
+		return err
+	}
+	return bf.sync()
+}
+
+// BeginCommit starts a group of records queued with a single sync under the
+// "always" sync policy, the group ends with Commit.
+func (bf *BufferFeeder) BeginCommit() {
+	bf.blockLock.Lock()
+	bf.committing = true
+	bf.blockLock.Unlock()
+}
+
+// Commit writes and syncs the records queued since BeginCommit under the
+// "always" sync policy, including the ones waiting to be compressed.
+func (bf *BufferFeeder) Commit() error {
+	bf.blockLock.Lock()
+	defer bf.blockLock.Unlock()
+	bf.committing = false
+	if bf.syncPolicy == "always" {
+		if err := bf.flush(); err != nil {
+			return err
+		}
+		return bf.sync()
+	}
+	return nil
+}
+
+// Called after records are written, syncs them as the policy requires.
+func (bf *BufferFeeder) written(records uint) error {
+	if bf.syncPolicy == "none" {
+		return nil
+	}
+	bf.unsynced += records
+	switch bf.syncPolicy {
+	case "always":
+		if !bf.committing {
+			return bf.sync()
+		}
+	case "every_n":
+		if bf.unsynced >= bf.syncCount {
+			return bf.sync()
+		}
+	case "interval":
+		if bf.unsynced == records {
+			// First record since the last sync.
+			if bf.syncTimer == nil {
+				bf.syncTimer = time.AfterFunc(bf.syncInterval, bf.syncExpired)
+			} else {
+				bf.syncTimer.Reset(bf.syncInterval)
+			}
+		}
+	}
+	return nil
+}
+
+func (bf *BufferFeeder) syncExpired() {
+	bf.blockLock.Lock()
+	defer bf.blockLock.Unlock()
+	if err := bf.sync(); err != nil && bf.reader != nil {
+		bf.reader.logError(fmt.Errorf("can't sync queue file: %s", err))
+	}
+}
+
+func (bf *BufferFeeder) sync() error {
+	if bf.unsynced == 0 || bf.writeFile == nil {
+		return nil
+	}
+	if err := bf.writeFile.Sync(); err != nil {
+		return fmt.Errorf("can't sync queue file: %s", err)
+	}
+	bf.unsynced = 0
+	if bf.syncTimer != nil {
+		bf.syncTimer.Stop()
+	}
+	return nil
+}
+
+func (bf *BufferFeeder) lingerExpired() {
+	bf.blockLock.Lock()
+	defer bf.blockLock.Unlock()
+	if bf.flush() != nil {
+		// The records are kept, try again later.
+		bf.blockTimer.Reset(bf.linger)
+	}
+}
+
+func (bf *BufferFeeder) flush() error {
+	if len(bf.block) == 0 {
+		return nil
+	}
+	if err := bf.writeBlock(bf.block, bf.blockRecords); err != nil {
+		return err
+	}
+	bf.block = bf.block[:0]
+	bf.blockRecords = 0
+	if bf.blockTimer != nil {
+		bf.blockTimer.Stop()
+	}
+	return nil
+}
+
+// Writes the framed records as a single block, rolling the queue file first
+// if it would get too large.
+func (bf *BufferFeeder) writeBlock(records []byte, count uint) error {
+	bf.out = appendQueueBlock(bf.out[:0], bf.codec, records)
+	outBytes := bf.out
+	if bf.writeFileSize+uint64(len(outBytes)) > bf.Config.MaxFileSize {
+		if err := bf.RollQueue(); err != nil {
+			return fmt.Errorf("queue file rotation error: %s", err)
+		}
+	}
+
 	n, err := bf.writeFile.Write(outBytes)
 	if err != nil {
 		if n > 0 {
@@ -213,22 +606,31 @@ func (bf *BufferFeeder) QueueRecord(pack *PipelinePack) error {
 	}
 	bf.queueSize.Add(uint64(n))
 	bf.writeFileSize += uint64(n)
-	return nil
+	return bf.written(count)
 }
 
 type BufferReader struct {
 	readOffset         int64
 	cursorOffset       int64
+	corruptRecordCount int64
+	corruptByteCount   int64
+	droppedCount       int64
+	droppedByteCount   int64
+	// Guards the read and cursor state, queue files are dropped by the
+	// feeder while they're being read.
+	lock               sync.Mutex
+	droppedId          uint // cursors in files below it were dropped
+	sendAttempts       int  // attempts made at the record being sent
 	config             *QueueBufferConfig
 	runner             *foRunner
-	sRunner            SplitterRunner
-	splitter           *HekaFramingSplitter
+	records            *QueueFileReader
+	countedRecords     int64 // corruption of the read file already counted
+	countedBytes       int64
 	readFile           *os.File
 	readId             uint
 	cursorId           uint
 	cursorCount        uint
 	checkpointFilename string
-	checkpointFile     *os.File
 	queue              string
 	queueSize          *BufferSize
 }
@@ -247,24 +649,9 @@ func NewBufferReader(queue string, config *QueueBufferConfig, queueSize *BufferS
 		runner:    runner,
 	}
 
-	pConfig.makersLock.RLock()
-	splitterMakers := pConfig.makers["Splitter"]
-	maker, ok := splitterMakers["HekaFramingSplitter"]
-	if !ok {
-		pConfig.makersLock.RUnlock()
-		return nil, errors.New("no registered `HekaFramingSplitter`.")
-	}
-	splitterName := fmt.Sprintf("%s-buffer-splitter", runner.Name())
-	sRunner, err := maker.MakeRunner(splitterName)
-	pConfig.makersLock.RUnlock()
-	if err != nil {
-		return nil, fmt.Errorf("can't make SplitterRunner: %s", err.Error())
-	}
-	br.sRunner = sRunner.(SplitterRunner)
-
-	br.checkpointFilename = filepath.Join(queue, "checkpoint.txt")
+	br.checkpointFilename = filepath.Join(queue, queueCheckpointFilename)
 
-	if err = br.initReadFile(); err != nil {
+	if err := br.initReadFile(); err != nil {
 		return nil, fmt.Errorf("can't access read location: %s", err)
 	}
 
@@ -296,6 +683,9 @@ func (br *BufferReader) initReadFile() error {
 			br.readFile = nil
 			br.readId = 0
 		}
+		if br.readFile != nil {
+			br.setRecords(0)
+		}
 		return err
 	}
 	if br.readFile, err = os.Open(filename); err != nil {
@@ -304,8 +694,16 @@ func (br *BufferReader) initReadFile() error {
 	if _, err = br.readFile.Seek(br.readOffset, 0); err != nil {
 		br.readFile.Close()
 		br.readFile = nil
+		return err
 	}
-	return err
+	br.setRecords(br.readOffset)
+	return nil
+}
+
+// Starts reading the records of the read file from offset.
+func (br *BufferReader) setRecords(offset int64) {
+	br.records = NewQueueFileReader(br.readFile, offset)
+	br.countedRecords, br.countedBytes = 0, 0
 }
 
 func (br *BufferReader) getFileFromId(id uint) (file *os.File, foundId uint,
@@ -347,6 +745,12 @@ func (br *BufferReader) updateCursor(queueCursor string) error {
 	if err != nil {
 		return fmt.Errorf("can't parse queue cursor '%s': %s", queueCursor, err)
 	}
+	br.lock.Lock()
+	defer br.lock.Unlock()
+	if id < br.droppedId {
+		// The message was read before its file was dropped.
+		return nil
+	}
 	if id < br.cursorId {
 		// TODO: Handle id wrapping?
 		return QueueCursorPast
@@ -399,20 +803,76 @@ func (br *BufferReader) updateCursor(queueCursor string) error {
 	return nil
 }
 
-func (br *BufferReader) writeCheckpoint(queueCursor string) error {
-	var err error
-	if br.checkpointFile == nil {
-		if br.checkpointFile, err = os.OpenFile(br.checkpointFilename,
-			os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
-			return err
+// Removes queue file id, of the given size, on behalf of the feeder. The
+// messages the reader hadn't processed yet are counted as dropped, reading
+// them first, and the cursor moves past the file.
+func (br *BufferReader) dropFile(id uint, size int64) error {
+	filename := getQueueFilename(br.queue, id)
+	var messages, dropped int64
+	if id >= br.cursorId {
+		var offset int64
+		if id == br.cursorId {
+			offset = br.cursorOffset
+		}
+		var err error
+		if messages, err = countQueueRecords(filename, offset); err != nil {
+			return fmt.Errorf("can't read queue file %s: %s", filename, err)
+		}
+		dropped = size - offset
+	}
+	if err := os.Remove(filename); err != nil {
+		return fmt.Errorf("can't remove queue file %s: %s", filename, err)
+	}
+	br.queueSize.Add(^uint64(size - 1)) // Subtracts file size.
+	br.droppedId = id + 1
+	if br.readFile != nil && id >= br.readId {
+		// The next read starts from the checkpoint.
+		br.readFile.Close()
+		br.readFile = nil
+	}
+	if id >= br.cursorId {
+		br.cursorId, br.cursorOffset = id+1, 0
+		br.cursorCount = 0
+		if err := br.writeCheckpoint(fmt.Sprintf("%d %d", br.cursorId,
+			br.cursorOffset)); err != nil {
+			return fmt.Errorf("can't write checkpoint file: %s", err)
 		}
 	}
-	br.checkpointFile.Seek(0, 0)
-	n, err := br.checkpointFile.WriteString(queueCursor)
+	atomic.AddInt64(&br.droppedCount, messages)
+	atomic.AddInt64(&br.droppedByteCount, dropped)
+	br.logError(fmt.Errorf("dropped queue file %d: %d messages, %d bytes", id,
+		messages, dropped))
+	return nil
+}
+
+// Replaces the checkpoint file with a new one holding the cursor, so a crash
+// leaves either of them in place. Unless `sync_policy` is "none" the new
+// checkpoint is synced to disk.
+func (br *BufferReader) writeCheckpoint(queueCursor string) error {
+	durable := br.config.SyncPolicy != "" && br.config.SyncPolicy != "none"
+	tmpFilename := br.checkpointFilename + ".tmp"
+	file, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(queueCursor)
+	if err == nil && durable {
+		err = file.Sync()
+	}
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmpFilename, br.checkpointFilename)
+	}
 	if err != nil {
+		os.Remove(tmpFilename)
 		return err
 	}
-	return br.checkpointFile.Truncate(int64(n))
+	if durable {
+		return syncDir(filepath.Dir(br.checkpointFilename))
+	}
+	return nil
 }
 
 func (br *BufferReader) runTimerEvent(tickerPlugin TickerPlugin) error {
@@ -434,14 +894,12 @@ func (br *BufferReader) NewStreamOutput(sender MessageProcessor, packSupply chan
 	}
 
 	defer func() {
+		br.lock.Lock()
+		defer br.lock.Unlock()
 		err := br.writeCheckpoint(fmt.Sprintf("%d %d", br.cursorId, br.cursorOffset))
 		if err != nil {
 			br.runner.LogError(fmt.Errorf("can't write buffer checkpoint: %s", err))
 		}
-		if br.checkpointFile != nil {
-			br.checkpointFile.Close()
-			br.checkpointFile = nil
-		}
 		if br.readFile != nil {
 			br.readFile.Close()
 			br.readFile = nil
@@ -461,8 +919,8 @@ func (br *BufferReader) NewStreamOutput(sender MessageProcessor, packSupply chan
 	)
 
 	for {
-		if err = br.initReadFile(); err != nil {
-			return fmt.Errorf("can't initialize read file", err)
+		if err = br.openReadFile(); err != nil {
+			return fmt.Errorf("can't initialize read file: %s", err)
 		}
 		if br.readFile != nil {
 			if resetNeeded {
@@ -517,9 +975,11 @@ func (br *BufferReader) NewStreamOutput(sender MessageProcessor, packSupply chan
 			resetNeeded = false
 		}
 
+		attempts := 0
 	sendLoop:
 		for {
 			err = sender.ProcessMessage(pack)
+			attempts++
 			if err != nil {
 				switch err.(type) {
 				case PluginExitError:
@@ -528,9 +988,16 @@ func (br *BufferReader) NewStreamOutput(sender MessageProcessor, packSupply chan
 					return err
 				case RetryMessageError:
 					br.runner.LogError(fmt.Errorf("can't send record: %s", err))
+					if br.runner.attemptsExhausted(err, attempts) {
+						atomic.AddInt64(&br.runner.dropMessageCount, 1)
+						br.runner.deadLetter(pack, err, attempts)
+						pack.recycle()
+						break sendLoop
+					}
 					// Falls through to a retry wait below.
 				default:
 					atomic.AddInt64(&br.runner.dropMessageCount, 1)
+					br.runner.deadLetter(pack, err, attempts)
 					pack.recycle()
 					break sendLoop
 				}
@@ -569,14 +1036,12 @@ func (br *BufferReader) StreamOutput(sender BufferSender,
 	packSupply chan *PipelinePack, stopChan chan bool) error {
 
 	defer func() {
+		br.lock.Lock()
+		defer br.lock.Unlock()
 		err := br.writeCheckpoint(fmt.Sprintf("%d %d", br.cursorId, br.cursorOffset))
 		if err != nil {
 			br.runner.LogError(fmt.Errorf("can't write buffer checkpoint: %s", err))
 		}
-		if br.checkpointFile != nil {
-			br.checkpointFile.Close()
-			br.checkpointFile = nil
-		}
 		if br.readFile != nil {
 			br.readFile.Close()
 			br.readFile = nil
@@ -596,8 +1061,8 @@ func (br *BufferReader) StreamOutput(sender BufferSender,
 	)
 
 	for {
-		if err := br.initReadFile(); err != nil {
-			return fmt.Errorf("can't initialize read file", err)
+		if err := br.openReadFile(); err != nil {
+			return fmt.Errorf("can't initialize read file: %s", err)
 		}
 		if br.readFile != nil {
 			if resetNeeded {
@@ -643,7 +1108,8 @@ func (br *BufferReader) StreamOutput(sender BufferSender,
 			rh.Reset()
 			resetNeeded = false
 		}
-		for {
+		for attempts := 1; ; attempts++ {
+			br.sendAttempts = attempts
 			if err = sender.SendRecord(pack); err == nil {
 				if resetNeeded {
 					rh.Reset()
@@ -651,6 +1117,12 @@ func (br *BufferReader) StreamOutput(sender BufferSender,
 				}
 				break
 			}
+			if _, ok := err.(RetryMessageError); ok && br.runner.attemptsExhausted(err, attempts) {
+				atomic.AddInt64(&br.runner.dropMessageCount, 1)
+				br.runner.deadLetter(pack, err, attempts)
+				pack.recycle()
+				break
+			}
 			select {
 			case <-stopChan:
 				pack.recycle()
@@ -664,7 +1136,19 @@ func (br *BufferReader) StreamOutput(sender BufferSender,
 	}
 }
 
+// Opens the read file if there's any data to read.
+func (br *BufferReader) openReadFile() error {
+	br.lock.Lock()
+	defer br.lock.Unlock()
+	if br.readFile != nil {
+		return nil
+	}
+	return br.initReadFile()
+}
+
 func (br *BufferReader) NextRecord(pack *PipelinePack) error {
+	br.lock.Lock()
+	defer br.lock.Unlock()
 	if br.readFile == nil {
 		err := br.initReadFile()
 		if err != nil {
@@ -675,8 +1159,10 @@ func (br *BufferReader) NextRecord(pack *PipelinePack) error {
 		}
 	}
 
-	n, record, err := br.sRunner.GetRecordFromStream(br.readFile)
-	if err != nil {
+	var reread bool
+	for {
+		record, resume, err := br.records.Next()
+		br.countCorruption()
 		if err == io.EOF {
 			// Look to see if there's a newer file, advance to it if so.
 			nextReadFile, nextFileId, err := br.getFileFromId(br.readId + 1)
@@ -686,48 +1172,168 @@ func (br *BufferReader) NextRecord(pack *PipelinePack) error {
 				// No next file, current file might still grow.
 				return QueueNoRecord
 			}
-			// Newer file exists, bump the id and file and recurse.
+			if !reread && br.records.Pending() > 0 {
+				// The end of the current file may have been written since
+				// we last read it, read it again before giving up on it.
+				nextReadFile.Close()
+				reread = true
+				continue
+			}
+			// Whatever is left of the current file was torn by a crash.
+			br.records.SkipPending()
+			br.countCorruption()
+			// Newer file exists, bump the id and file and keep reading.
 			oldReadFile := br.readFile
 			br.readFile = nextReadFile
 			br.readId = nextFileId
 			br.readOffset = 0
+			br.setRecords(0)
+			reread = false
 			if err = oldReadFile.Close(); err != nil {
 				return fmt.Errorf("can't close readfile: %s", err)
 			}
-			return br.NextRecord(pack)
-		} else {
+			continue
+		} else if err != nil {
 			return fmt.Errorf("can't extract record: %s", err)
 		}
+
+		br.readOffset = resume
+		headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
+		msgLen := len(record) - headerLen
+		if cap(pack.MsgBytes) < msgLen {
+			pack.MsgBytes = make([]byte, msgLen)
+		} else {
+			pack.MsgBytes = pack.MsgBytes[:msgLen]
+		}
+		copy(pack.MsgBytes, record[headerLen:])
+		pack.TrustMsgBytes = true
+		if err = proto.Unmarshal(pack.MsgBytes, pack.Message); err != nil {
+			// A record with a valid checksum, or an unchecked one written by
+			// an older version, can't be decoded: skip it.
+			atomic.AddInt64(&br.corruptRecordCount, 1)
+			atomic.AddInt64(&br.corruptByteCount, int64(len(record)))
+			br.logError(fmt.Errorf("skipped undecodable record in queue file %d: %s",
+				br.readId, err))
+			continue
+		}
+		pack.QueueCursor = fmt.Sprintf("%d %d", br.readId, br.readOffset)
+		return nil
 	}
+}
 
-	br.readOffset += int64(n)
-	recordLen := len(record)
-	if recordLen == 0 {
-		return QueueNeedData
+// Adds the corrupt data skipped by the file reader since the last call to
+// the reader's counts.
+func (br *BufferReader) countCorruption() {
+	records, bytes := br.records.Corrupt()
+	if records == br.countedRecords {
+		return
 	}
-	if recordLen < 1 {
-		return QueueInvalidRecord
+	records, bytes = records-br.countedRecords, bytes-br.countedBytes
+	br.countedRecords += records
+	br.countedBytes += bytes
+	atomic.AddInt64(&br.corruptRecordCount, records)
+	atomic.AddInt64(&br.corruptByteCount, bytes)
+	br.logError(fmt.Errorf("skipped %d bytes of corrupt data in queue file %d",
+		bytes, br.readId))
+}
+
+func (br *BufferReader) logError(err error) {
+	if br.runner != nil {
+		br.runner.LogError(err)
 	}
-	headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
-	if recordLen < headerLen {
-		return QueueInvalidRecord
+}
+
+// DroppedCounts returns the number of messages dropped from the queue by the
+// `drop_oldest` full action or by `max_age`, and their total size in bytes.
+func (br *BufferReader) DroppedCounts() (messages, bytes int64) {
+	return atomic.LoadInt64(&br.droppedCount), atomic.LoadInt64(&br.droppedByteCount)
+}
+
+// CorruptCounts returns the number of corrupt records skipped by the reader
+// and their total size in bytes.
+func (br *BufferReader) CorruptCounts() (records, bytes int64) {
+	return atomic.LoadInt64(&br.corruptRecordCount), atomic.LoadInt64(&br.corruptByteCount)
+}
+
+// OpenQueue returns a reader for the queue directory of an output that isn't
+// running, reading from the queue's checkpoint. It's meant for the tools
+// inspecting and editing queues.
+func OpenQueue(queue string) (*BufferReader, error) {
+	if !fileExists(queue) {
+		return nil, fmt.Errorf("no queue directory %s", queue)
 	}
-	msgLen := len(record) - headerLen
-	if cap(pack.MsgBytes) < msgLen {
-		pack.MsgBytes = make([]byte, msgLen)
-	} else {
-		pack.MsgBytes = pack.MsgBytes[:msgLen]
+	queueSize := &BufferSize{size: getQueueBufferSize(queue)}
+	return NewBufferReader(queue, defaultQueueBufferConfig(), queueSize, nil, nil)
+}
+
+// Close closes the file being read.
+func (br *BufferReader) Close() {
+	br.lock.Lock()
+	defer br.lock.Unlock()
+	if br.readFile != nil {
+		br.readFile.Close()
+		br.readFile = nil
 	}
-	copy(pack.MsgBytes, record[headerLen:])
-	pack.TrustMsgBytes = true
-	err = proto.Unmarshal(pack.MsgBytes, pack.Message)
+}
+
+// WriteCheckpoint moves the queue's checkpoint to the cursor, next time the
+// queue is read it starts from there.
+func (br *BufferReader) WriteCheckpoint(queueCursor string) error {
+	id, offset, err := parseQueueCursor([]byte(queueCursor))
 	if err != nil {
-		return fmt.Errorf("can't unmarshal record: %s", err)
+		return fmt.Errorf("can't parse queue cursor '%s': %s", queueCursor, err)
+	}
+	br.lock.Lock()
+	defer br.lock.Unlock()
+	if err = br.writeCheckpoint(queueCursor); err != nil {
+		return err
 	}
-	pack.QueueCursor = fmt.Sprintf("%d %d", br.readId, br.readOffset)
+	br.cursorId, br.cursorOffset = id, offset
 	return nil
 }
 
+// ParseQueueCursor returns the queue file id and offset of a queue cursor,
+// as found in PipelinePack.QueueCursor and in queue checkpoints.
+func ParseQueueCursor(queueCursor string) (id uint, offset int64, err error) {
+	return parseQueueCursor([]byte(queueCursor))
+}
+
+// ReadQueueCheckpoint returns the position recorded in the checkpoint of a
+// queue directory. The error satisfies os.IsNotExist if the queue doesn't
+// have any.
+func ReadQueueCheckpoint(queue string) (id uint, offset int64, err error) {
+	return readCheckpoint(filepath.Join(queue, queueCheckpointFilename))
+}
+
+// QueueFileIds returns the ids of the files of a queue directory, in the
+// order they were written.
+func QueueFileIds(queue string) []uint {
+	return sortedBufferIds(queue)
+}
+
+// QueueFilename returns the path of a queue file.
+func QueueFilename(queue string, id uint) string {
+	return getQueueFilename(queue, id)
+}
+
+// TruncateQueue removes the files and the checkpoint of a queue directory,
+// leaving an empty queue. It returns the number of files removed and their
+// total size.
+func TruncateQueue(queue string) (files int, size uint64, err error) {
+	size = getQueueBufferSize(queue)
+	for _, id := range sortedBufferIds(queue) {
+		if err = os.Remove(getQueueFilename(queue, id)); err != nil {
+			return files, size, err
+		}
+		files++
+	}
+	err = os.Remove(filepath.Join(queue, queueCheckpointFilename))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return files, size, err
+}
+
 func parseQueueCursor(queueCursor []byte) (id uint, offset int64, err error) {
 	idx := bytes.IndexByte(queueCursor, ' ')
 	if idx == -1 {
@@ -750,6 +1356,28 @@ func parseQueueCursor(queueCursor []byte) (id uint, offset int64, err error) {
 	return id, offset, nil
 }
 
+// Counts the records of a queue file from offset.
+func countQueueRecords(filename string, offset int64) (count int64, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if _, err = file.Seek(offset, 0); err != nil {
+		return 0, err
+	}
+	records := NewQueueFileReader(file, offset)
+	for {
+		if _, _, err = records.Next(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return count, err
+		}
+		count++
+	}
+}
+
 func readCheckpoint(filename string) (id uint, offset int64, err error) {
 	file, err := os.Open(filename)
 	if err != nil {
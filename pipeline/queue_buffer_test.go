@@ -17,9 +17,13 @@ package pipeline
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
+	"testing"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/gogo/protobuf/proto"
@@ -138,7 +142,6 @@ func QueueBufferSpec(c gs.Context) {
 			c.Expect(err, gs.IsNil)
 			c.Expect(id, gs.Equals, uint(43))
 			c.Expect(offset, gs.Equals, int64(1))
-			reader.checkpointFile.Close()
 		})
 
 		c.Specify("readCheckpoint", func() {
@@ -184,7 +187,6 @@ func QueueBufferSpec(c gs.Context) {
 			reader.checkpointFilename = filepath.Join(tmpDir, "cp.txt")
 			reader.queue = tmpDir
 			reader.writeCheckpoint(fmt.Sprintf("%d 10", feeder.writeId))
-			reader.checkpointFile.Close()
 			err = reader.initReadFile()
 			c.Assume(err, gs.IsNil)
 			buf := make([]byte, 4)
@@ -205,7 +207,7 @@ func QueueBufferSpec(c gs.Context) {
 			encoder := client.NewProtobufEncoder(nil)
 			protoBytes, err := encoder.EncodeMessage(newpack.Message)
 			newpack.MsgBytes = protoBytes
-			expectedLen := 115
+			expectedLen := 125
 
 			c.Specify("adds framing", func() {
 				err = feeder.RollQueue()
@@ -219,9 +221,11 @@ func QueueBufferSpec(c gs.Context) {
 				f, err := os.Open(fName)
 				c.Expect(err, gs.IsNil)
 
-				n, record, err := reader.sRunner.GetRecordFromStream(f)
+				records := NewQueueFileReader(f, 0)
+				record, resume, err := records.Next()
 				f.Close()
-				c.Expect(n, gs.Equals, expectedLen)
+				c.Expect(resume, gs.Equals, int64(expectedLen))
+				c.Expect(len(record), gs.Equals, expectedLen-queueBlockHeaderSize)
 				c.Expect(err, gs.IsNil)
 				headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
 				record = record[headerLen:]
@@ -319,5 +323,458 @@ func QueueBufferSpec(c gs.Context) {
 
 			c.Expect(getQueueBufferSize(tmpDir), gs.Equals, uint64(20))
 		})
+
+		c.Specify("queue files", func() {
+			encoder := client.NewProtobufEncoder(nil)
+			packWithPayload := func(payload string) *PipelinePack {
+				pack := NewPipelinePack(nil)
+				pack.Message = ts.GetTestMessage()
+				pack.Message.SetPayload(payload)
+				pack.MsgBytes, err = encoder.EncodeMessage(pack.Message)
+				c.Assume(err, gs.IsNil)
+				return pack
+			}
+			readPayloads := func(fName string) (payloads []string,
+				resumes []int64, records *QueueFileReader) {
+
+				f, err := os.Open(fName)
+				c.Assume(err, gs.IsNil)
+				defer f.Close()
+				records = NewQueueFileReader(f, 0)
+				for {
+					record, resume, err := records.Next()
+					if err != nil {
+						c.Expect(err, gs.Equals, io.EOF)
+						return
+					}
+					headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
+					outMsg := new(message.Message)
+					c.Expect(proto.Unmarshal(record[headerLen:], outMsg), gs.IsNil)
+					payloads = append(payloads, outMsg.GetPayload())
+					resumes = append(resumes, resume)
+				}
+			}
+			fName := getQueueFilename(feeder.queue, feeder.writeId)
+			// Size of the "record N" records framed and in a block.
+			var framed []byte
+			err = client.CreateHekaStream(packWithPayload("record 0").MsgBytes, &framed, nil)
+			c.Assume(err, gs.IsNil)
+			recordLen := len(framed)
+			blockLen := recordLen + queueBlockHeaderSize
+
+			for _, compression := range []string{"snappy", "zstd"} {
+				c.Specify("compresses blocks of records with "+compression, func() {
+					feeder.codec, err = queueCodec(compression)
+					c.Assume(err, gs.IsNil)
+					for i := 0; i < 10; i++ {
+						err = feeder.QueueRecord(packWithPayload(fmt.Sprintf("record %d", i)))
+						c.Expect(err, gs.IsNil)
+					}
+					c.Expect(feeder.writeFileSize, gs.Equals, uint64(0))
+					c.Expect(feeder.Flush(), gs.IsNil)
+					size := int64(feeder.writeFileSize)
+					c.Expect(size < int64(10*recordLen/2), gs.IsTrue)
+					c.Expect(feeder.queueSize.Get(), gs.Equals, uint64(size))
+
+					payloads, resumes, records := readPayloads(fName)
+					c.Assume(len(payloads), gs.Equals, 10)
+					for i, payload := range payloads {
+						c.Expect(payload, gs.Equals, fmt.Sprintf("record %d", i))
+					}
+					// Resuming in the middle of a block reads it again.
+					c.Expect(resumes[0], gs.Equals, int64(0))
+					c.Expect(resumes[8], gs.Equals, int64(0))
+					c.Expect(resumes[9], gs.Equals, size)
+					corruptRecords, _ := records.Corrupt()
+					c.Expect(corruptRecords, gs.Equals, int64(0))
+				})
+			}
+
+			c.Specify("writes a compressed block once its linger expires", func() {
+				feeder.codec = queueCodecSnappy
+				feeder.linger = time.Millisecond
+				err = feeder.QueueRecord(packWithPayload("lingering"))
+				c.Expect(err, gs.IsNil)
+				for i := 0; i < 100 && feeder.queueSize.Get() == 0; i++ {
+					time.Sleep(10 * time.Millisecond)
+				}
+				payloads, _, _ := readPayloads(fName)
+				c.Expect(len(payloads), gs.Equals, 1)
+			})
+
+			c.Specify("skips corrupt blocks", func() {
+				for i := 0; i < 3; i++ {
+					err = feeder.QueueRecord(packWithPayload(fmt.Sprintf("record %d", i)))
+					c.Assume(err, gs.IsNil)
+				}
+				data, err := ioutil.ReadFile(fName)
+				c.Assume(err, gs.IsNil)
+				c.Assume(len(data), gs.Equals, 3*blockLen)
+				data[blockLen+blockLen/2] ^= 0xff
+				c.Assume(ioutil.WriteFile(fName, data, 0644), gs.IsNil)
+
+				payloads, _, records := readPayloads(fName)
+				c.Expect(len(payloads), gs.Equals, 2)
+				c.Expect(payloads[0], gs.Equals, "record 0")
+				c.Expect(payloads[1], gs.Equals, "record 2")
+				corruptRecords, corruptBytes := records.Corrupt()
+				c.Expect(corruptRecords, gs.Equals, int64(1))
+				c.Expect(corruptBytes, gs.Equals, int64(blockLen))
+			})
+
+			c.Specify("reads the records written by older versions", func() {
+				var data []byte
+				for i := 0; i < 2; i++ {
+					var framed []byte
+					pack := packWithPayload(fmt.Sprintf("record %d", i))
+					c.Assume(client.CreateHekaStream(pack.MsgBytes, &framed, nil), gs.IsNil)
+					data = append(data, framed...)
+					data = append(data, "garbage"...)
+				}
+				c.Assume(ioutil.WriteFile(fName, data, 0644), gs.IsNil)
+
+				payloads, _, records := readPayloads(fName)
+				c.Expect(len(payloads), gs.Equals, 2)
+				c.Expect(payloads[1], gs.Equals, "record 1")
+				corruptRecords, corruptBytes := records.Corrupt()
+				c.Expect(corruptRecords, gs.Equals, int64(2))
+				c.Expect(corruptBytes, gs.Equals, int64(14))
+			})
+
+			c.Specify("NextRecord moves past a torn end of file", func() {
+				c.Assume(feeder.QueueRecord(packWithPayload("first")), gs.IsNil)
+				firstEnd := feeder.writeFileSize
+				block := appendQueueBlock(nil, queueCodecNone, []byte("torn record"))
+				_, err = feeder.writeFile.Write(block[:15])
+				c.Assume(err, gs.IsNil)
+				c.Assume(feeder.RollQueue(), gs.IsNil)
+				c.Assume(feeder.QueueRecord(packWithPayload("second")), gs.IsNil)
+
+				pack := NewPipelinePack(nil)
+				c.Expect(reader.NextRecord(pack), gs.IsNil)
+				c.Expect(pack.Message.GetPayload(), gs.Equals, "first")
+				c.Expect(pack.QueueCursor, gs.Equals, fmt.Sprintf("%d %d", feeder.writeId-1, firstEnd))
+				c.Expect(reader.NextRecord(pack), gs.IsNil)
+				c.Expect(pack.Message.GetPayload(), gs.Equals, "second")
+				c.Expect(reader.NextRecord(pack), gs.Equals, QueueNoRecord)
+				corruptRecords, corruptBytes := reader.CorruptCounts()
+				c.Expect(corruptRecords, gs.Equals, int64(1))
+				c.Expect(corruptBytes, gs.Equals, int64(15))
+				reader.readFile.Close()
+			})
+
+			c.Specify("drop_oldest removes the oldest queue files", func() {
+				feeder.Config.MaxFileSize = uint64(2 * blockLen)
+				feeder.Config.MaxBufferSize = uint64(6 * blockLen)
+				firstId := feeder.writeId
+				for i := 0; i < 6; i++ {
+					err = feeder.QueueRecord(packWithPayload(fmt.Sprintf("record %d", i)))
+					c.Assume(err, gs.IsNil)
+				}
+				c.Expect(feeder.writeId, gs.Equals, firstId+2)
+				pack := NewPipelinePack(nil)
+				c.Assume(reader.NextRecord(pack), gs.IsNil)
+				c.Expect(pack.Message.GetPayload(), gs.Equals, "record 0")
+				cursor := pack.QueueCursor
+				c.Expect(reader.updateCursor(cursor), gs.IsNil)
+
+				err = feeder.QueueRecord(packWithPayload("record 6"))
+				c.Expect(err, gs.Equals, QueueIsFull)
+				c.Expect(feeder.DropOldest(uint64(len(pack.MsgBytes))), gs.IsNil)
+				c.Expect(fileExists(getQueueFilename(feeder.queue, firstId)), gs.IsFalse)
+				c.Expect(feeder.queueSize.Get(), gs.Equals, uint64(4*blockLen))
+				err = feeder.QueueRecord(packWithPayload("record 6"))
+				c.Expect(err, gs.IsNil)
+
+				// Only the unread message of the dropped file is counted.
+				dropped, droppedBytes := reader.DroppedCounts()
+				c.Expect(dropped, gs.Equals, int64(1))
+				c.Expect(droppedBytes, gs.Equals, int64(blockLen))
+				id, offset, err := readCheckpoint(reader.checkpointFilename)
+				c.Expect(err, gs.IsNil)
+				c.Expect(id, gs.Equals, firstId+1)
+				c.Expect(offset, gs.Equals, int64(0))
+
+				// The reader moves on to the next file, acknowledging the
+				// message read from the dropped one is harmless.
+				c.Expect(reader.NextRecord(pack), gs.IsNil)
+				c.Expect(pack.Message.GetPayload(), gs.Equals, "record 2")
+				c.Expect(reader.updateCursor(cursor), gs.IsNil)
+				c.Expect(reader.updateCursor(pack.QueueCursor), gs.IsNil)
+				reader.readFile.Close()
+			})
+
+			c.Specify("syncs the queued records", func() {
+				c.Specify("every n records", func() {
+					feeder.syncPolicy = "every_n"
+					feeder.syncCount = 3
+					for i := 0; i < 4; i++ {
+						err = feeder.QueueRecord(packWithPayload(fmt.Sprintf("record %d", i)))
+						c.Expect(err, gs.IsNil)
+					}
+					c.Expect(feeder.unsynced, gs.Equals, uint(1))
+					c.Expect(feeder.Flush(), gs.IsNil)
+					c.Expect(feeder.unsynced, gs.Equals, uint(0))
+				})
+
+				c.Specify("once the interval expires", func() {
+					feeder.syncPolicy = "interval"
+					feeder.syncInterval = time.Millisecond
+					err = feeder.QueueRecord(packWithPayload("record 0"))
+					c.Expect(err, gs.IsNil)
+					synced := func() bool {
+						feeder.blockLock.Lock()
+						defer feeder.blockLock.Unlock()
+						return feeder.unsynced == 0
+					}
+					for i := 0; i < 100 && !synced(); i++ {
+						time.Sleep(10 * time.Millisecond)
+					}
+					c.Expect(synced(), gs.IsTrue)
+				})
+
+				c.Specify("always, once per commit", func() {
+					feeder.syncPolicy = "always"
+					err = feeder.QueueRecord(packWithPayload("record 0"))
+					c.Expect(err, gs.IsNil)
+					c.Expect(feeder.unsynced, gs.Equals, uint(0))
+
+					feeder.BeginCommit()
+					for i := 1; i < 4; i++ {
+						err = feeder.QueueRecord(packWithPayload(fmt.Sprintf("record %d", i)))
+						c.Expect(err, gs.IsNil)
+					}
+					c.Expect(feeder.unsynced, gs.Equals, uint(3))
+					c.Expect(feeder.Commit(), gs.IsNil)
+					c.Expect(feeder.unsynced, gs.Equals, uint(0))
+				})
+
+				c.Specify("always, writing the compressed records first", func() {
+					feeder.syncPolicy = "always"
+					feeder.codec = queueCodecSnappy
+					feeder.linger = time.Hour
+					err = feeder.QueueRecord(packWithPayload("record 0"))
+					c.Expect(err, gs.IsNil)
+
+					feeder.BeginCommit()
+					for i := 1; i < 4; i++ {
+						err = feeder.QueueRecord(packWithPayload(fmt.Sprintf("record %d", i)))
+						c.Expect(err, gs.IsNil)
+					}
+					c.Expect(feeder.Commit(), gs.IsNil)
+					c.Expect(feeder.unsynced, gs.Equals, uint(0))
+
+					// Read without closing the feeder, as after a crash.
+					payloads, _, _ := readPayloads(fName)
+					c.Expect(len(payloads), gs.Equals, 4)
+				})
+
+				c.Specify("and replaces the checkpoint atomically", func() {
+					reader.config.SyncPolicy = "always"
+					c.Expect(reader.writeCheckpoint("3 125"), gs.IsNil)
+					c.Expect(reader.writeCheckpoint("4 250"), gs.IsNil)
+					c.Expect(fileExists(reader.checkpointFilename+".tmp"), gs.IsFalse)
+					id, offset, err := readCheckpoint(reader.checkpointFilename)
+					c.Expect(err, gs.IsNil)
+					c.Expect(id, gs.Equals, uint(4))
+					c.Expect(offset, gs.Equals, int64(250))
+				})
+			})
+
+			c.Specify("can be inspected and edited by tools", func() {
+				for i := 0; i < 3; i++ {
+					err = feeder.QueueRecord(packWithPayload(fmt.Sprintf("record %d", i)))
+					c.Assume(err, gs.IsNil)
+				}
+				ids := QueueFileIds(feeder.queue)
+				c.Expect(len(ids), gs.Equals, 1)
+				c.Expect(ids[0], gs.Equals, feeder.writeId)
+				_, _, err = ReadQueueCheckpoint(feeder.queue)
+				c.Expect(os.IsNotExist(err), gs.IsTrue)
+
+				tool, err := OpenQueue(feeder.queue)
+				c.Assume(err, gs.IsNil)
+				pack := NewPipelinePack(nil)
+				c.Expect(tool.NextRecord(pack), gs.IsNil)
+				c.Expect(tool.WriteCheckpoint(pack.QueueCursor), gs.IsNil)
+				tool.Close()
+				id, offset, err := ReadQueueCheckpoint(feeder.queue)
+				c.Expect(err, gs.IsNil)
+				cursorId, cursorOffset, err := ParseQueueCursor(pack.QueueCursor)
+				c.Expect(err, gs.IsNil)
+				c.Expect(id, gs.Equals, cursorId)
+				c.Expect(offset, gs.Equals, cursorOffset)
+
+				// Reading resumes at the checkpoint.
+				tool, err = OpenQueue(feeder.queue)
+				c.Assume(err, gs.IsNil)
+				c.Expect(tool.NextRecord(pack), gs.IsNil)
+				c.Expect(pack.Message.GetPayload(), gs.Equals, "record 1")
+				tool.Close()
+
+				feeder.writeFile.Close()
+				files, size, err := TruncateQueue(feeder.queue)
+				c.Expect(err, gs.IsNil)
+				c.Expect(files, gs.Equals, 1)
+				c.Expect(size, gs.Equals, uint64(3*blockLen))
+				c.Expect(len(QueueFileIds(feeder.queue)), gs.Equals, 0)
+				_, _, err = ReadQueueCheckpoint(feeder.queue)
+				c.Expect(os.IsNotExist(err), gs.IsTrue)
+			})
+
+			c.Specify("max_age expires the queue files written before it", func() {
+				feeder.Config.MaxFileSize = uint64(2 * blockLen)
+				firstId := feeder.writeId
+				for i := 0; i < 4; i++ {
+					err = feeder.QueueRecord(packWithPayload(fmt.Sprintf("record %d", i)))
+					c.Assume(err, gs.IsNil)
+				}
+				c.Assume(feeder.RollQueue(), gs.IsNil)
+				old := time.Now().Add(-2 * time.Hour)
+				err = os.Chtimes(getQueueFilename(feeder.queue, firstId), old, old)
+				c.Assume(err, gs.IsNil)
+
+				// Expired without queuing any more records.
+				feeder.maxAge = time.Hour
+				feeder.expireInterval = 10 * time.Millisecond
+				feeder.startExpiry()
+				first := getQueueFilename(feeder.queue, firstId)
+				for deadline := time.Now().Add(5 * time.Second); fileExists(first) &&
+					time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				}
+				c.Expect(fileExists(first), gs.IsFalse)
+				c.Expect(fileExists(getQueueFilename(feeder.queue, firstId+1)), gs.IsTrue)
+				c.Expect(feeder.queueSize.Get(), gs.Equals, uint64(2*blockLen))
+				dropped, droppedBytes := reader.DroppedCounts()
+				c.Expect(dropped, gs.Equals, int64(2))
+				c.Expect(droppedBytes, gs.Equals, int64(2*blockLen))
+
+				pack := NewPipelinePack(nil)
+				c.Expect(reader.NextRecord(pack), gs.IsNil)
+				c.Expect(pack.Message.GetPayload(), gs.Equals, "record 2")
+				reader.readFile.Close()
+
+				// Closing the feeder stops the timer.
+				c.Expect(feeder.Close(), gs.IsNil)
+				c.Expect(feeder.expireTimer.Stop(), gs.IsFalse)
+			})
+			if feeder.writeFile != nil {
+				feeder.writeFile.Close()
+			}
+		})
 	})
 }
+
+func benchmarkQueueRecordSync(b *testing.B, policy string) {
+	tmpDir, err := ioutil.TempDir("", "queuebuffer-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := defaultQueueBufferConfig()
+	config.SyncPolicy = policy
+	feeder, err := NewBufferFeeder(tmpDir, config, &BufferSize{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer feeder.writeFile.Close()
+
+	pack := NewPipelinePack(nil)
+	pack.Message = ts.GetTestMessage()
+	encoder := client.NewProtobufEncoder(nil)
+	if pack.MsgBytes, err = encoder.EncodeMessage(pack.Message); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(pack.MsgBytes)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err = feeder.QueueRecord(pack); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err = feeder.Flush(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkQueueRecordSyncNone(b *testing.B) {
+	benchmarkQueueRecordSync(b, "none")
+}
+
+func BenchmarkQueueRecordSyncInterval(b *testing.B) {
+	benchmarkQueueRecordSync(b, "interval")
+}
+
+func BenchmarkQueueRecordSyncEveryN(b *testing.B) {
+	benchmarkQueueRecordSync(b, "every_n")
+}
+
+func BenchmarkQueueRecordSyncAlways(b *testing.B) {
+	benchmarkQueueRecordSync(b, "always")
+}
+
+// Queues b.N records through a matcher fed by several producers, the records
+// waiting on the matcher's channel are synced at once.
+func benchmarkMatcherQueueSync(b *testing.B, policy string) {
+	tmpDir, err := ioutil.TempDir("", "queuebuffer-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := defaultQueueBufferConfig()
+	config.SyncPolicy = policy
+	feeder, err := NewBufferFeeder(tmpDir, config, &BufferSize{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer feeder.writeFile.Close()
+
+	mr, err := NewMatchRunner("TRUE", "", nil, 30, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	mr.bufFeeder = feeder
+	mr.stopChan = make(chan bool)
+
+	msg := ts.GetTestMessage()
+	encoder := client.NewProtobufEncoder(nil)
+	msgBytes, err := encoder.EncodeMessage(msg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	recycleChan := make(chan *PipelinePack, 100)
+	for i := 0; i < cap(recycleChan); i++ {
+		recycleChan <- NewPipelinePack(recycleChan)
+	}
+
+	const producers = 8
+	var wg sync.WaitGroup
+	wg.Add(producers)
+	b.SetBytes(int64(len(msgBytes)))
+	b.ResetTimer()
+	mr.Start(1)
+	for p := 0; p < producers; p++ {
+		go func(n int) {
+			for i := 0; i < n; i++ {
+				pack := <-recycleChan
+				pack.Message = msg
+				pack.MsgBytes = msgBytes
+				mr.inChan <- pack
+			}
+			wg.Done()
+		}((b.N + p) / producers)
+	}
+	wg.Wait()
+	mr.Close()
+	<-mr.stopChan
+}
+
+func BenchmarkMatcherQueueSyncNone(b *testing.B) {
+	benchmarkMatcherQueueSync(b, "none")
+}
+
+func BenchmarkMatcherQueueSyncAlways(b *testing.B) {
+	benchmarkMatcherQueueSync(b, "always")
+}
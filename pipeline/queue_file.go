@@ -0,0 +1,374 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"heka/message"
+)
+
+// Queue files hold a sequence of blocks, each one made of a header followed
+// by its payload:
+//
+//	magic    1 byte   0x1d
+//	codec    1 byte   payload compression, see the queueCodec constants
+//	length   4 bytes  payload length, big endian
+//	checksum 4 bytes  CRC-32C of the codec, the length and the payload
+//
+// The uncompressed payload is a sequence of Heka framed records. Queue files
+// written by older versions hold the framed records without any block, they
+// are still read.
+const (
+	queueBlockMagic      = byte(0x1d)
+	queueBlockHeaderSize = 10
+
+	queueCodecNone   = byte(0)
+	queueCodecSnappy = byte(1)
+	queueCodecZstd   = byte(2)
+)
+
+// Largest uncompressed size of the records gathered in a compressed block.
+const MaxBufferBlockSize = 4 * 1024 * 1024
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// The zstd encoder and decoder are safe for concurrent use, all queues
+// share them.
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	})
+}
+
+// Returns the codec of a `compression` setting.
+func queueCodec(compression string) (byte, error) {
+	switch compression {
+	case "", "none":
+		return queueCodecNone, nil
+	case "snappy":
+		return queueCodecSnappy, nil
+	case "zstd":
+		initZstd()
+		return queueCodecZstd, nil
+	}
+	return 0, fmt.Errorf("compression must be 'none', 'snappy' or 'zstd', got '%s'",
+		compression)
+}
+
+// Appends a block holding the records in payload to dst. The payload is
+// stored uncompressed when compressing it doesn't make it any smaller.
+func appendQueueBlock(dst []byte, codec byte, payload []byte) []byte {
+	start := len(dst)
+	dst = append(dst, queueBlockMagic, codec, 0, 0, 0, 0, 0, 0, 0, 0)
+	switch codec {
+	case queueCodecSnappy:
+		n := snappy.MaxEncodedLen(len(payload))
+		if cap(dst)-len(dst) < n {
+			grown := make([]byte, len(dst), len(dst)+n)
+			copy(grown, dst)
+			dst = grown
+		}
+		dst = dst[:len(dst)+len(snappy.Encode(dst[len(dst):len(dst)+n], payload))]
+	case queueCodecZstd:
+		dst = zstdEncoder.EncodeAll(payload, dst)
+	}
+	if codec == queueCodecNone || len(dst)-start-queueBlockHeaderSize >= len(payload) {
+		dst = append(dst[:start+queueBlockHeaderSize], payload...)
+		dst[start+1] = queueCodecNone
+	}
+	header := dst[start : start+queueBlockHeaderSize]
+	binary.BigEndian.PutUint32(header[2:6], uint32(len(dst)-start-queueBlockHeaderSize))
+	crc := crc32.Update(0, crcTable, header[1:6])
+	crc = crc32.Update(crc, crcTable, dst[start+queueBlockHeaderSize:])
+	binary.BigEndian.PutUint32(header[6:10], crc)
+	return dst
+}
+
+// Returns the records of a block, decompressing them into buf if needed.
+func decodeQueueBlock(block, buf []byte) ([]byte, error) {
+	payload := block[queueBlockHeaderSize:]
+	switch block[1] {
+	case queueCodecSnappy:
+		n, err := snappy.DecodedLen(payload)
+		if err != nil {
+			return nil, err
+		}
+		if cap(buf) < n {
+			buf = make([]byte, n)
+		}
+		return snappy.Decode(buf[:n], payload)
+	case queueCodecZstd:
+		initZstd()
+		return zstdDecoder.DecodeAll(payload, buf[:0])
+	}
+	return payload, nil
+}
+
+func maxQueueBlockLength() int {
+	return MaxBufferBlockSize + int(message.MAX_RECORD_SIZE)
+}
+
+// Kinds of frame found in queue file data.
+const (
+	frameNeedData = iota // no complete frame, more data is needed
+	frameRecord          // a Heka framed record
+	frameBlock           // a block of records
+)
+
+// Finds the next frame in buf, returning the number of unparsable bytes
+// skipped before it, its length and its kind. Bare records are skipped
+// unless records is true.
+func findQueueFrame(buf []byte, header *message.Header, records bool) (skipped, n,
+	kind int) {
+
+	for skipped < len(buf) {
+		b := buf[skipped:]
+		switch b[0] {
+		case queueBlockMagic:
+			if len(b) < queueBlockHeaderSize {
+				return skipped, 0, frameNeedData
+			}
+			length := int(binary.BigEndian.Uint32(b[2:6]))
+			if b[1] > queueCodecZstd || length > maxQueueBlockLength() {
+				break
+			}
+			n = queueBlockHeaderSize + length
+			if len(b) < n {
+				return skipped, 0, frameNeedData
+			}
+			crc := crc32.Update(0, crcTable, b[1:6])
+			crc = crc32.Update(crc, crcTable, b[queueBlockHeaderSize:n])
+			if crc == binary.BigEndian.Uint32(b[6:10]) {
+				return skipped, n, frameBlock
+			}
+		case message.RECORD_SEPARATOR:
+			if !records {
+				break
+			}
+			if len(b) < message.HEADER_DELIMITER_SIZE {
+				return skipped, 0, frameNeedData
+			}
+			headerEnd := int(b[1]) + message.HEADER_FRAMING_SIZE
+			if len(b) < headerEnd {
+				return skipped, 0, frameNeedData
+			}
+			header.Reset()
+			decoded, _ := message.DecodeHeader(b[message.HEADER_DELIMITER_SIZE:headerEnd],
+				header)
+			if !decoded || header.MessageLength == nil {
+				break
+			}
+			n = headerEnd + int(header.GetMessageLength())
+			if len(b) < n {
+				return skipped, 0, frameNeedData
+			}
+			return skipped, n, frameRecord
+		}
+		// Not a valid frame, look again from the next possible frame start.
+		next := bytes.IndexAny(b[1:], "\x1d\x1e")
+		if next == -1 {
+			return len(buf), 0, frameNeedData
+		}
+		skipped += next + 1
+	}
+	return skipped, 0, frameNeedData
+}
+
+// QueueFileReader reads the records of a queue file, which may still be
+// growing. Blocks are checked and decompressed, corrupt data is skipped and
+// counted.
+type QueueFileReader struct {
+	file       *os.File
+	buf        []byte
+	start, end int   // data read but not consumed yet
+	offset     int64 // file offset of buf[start]
+	header     message.Header
+	blocks     bool   // the file holds blocks rather than bare records
+	block      []byte // records of the current block
+	blockPos   int
+	blockStart int64 // file offset of the current block
+	frameStart int64 // file offset of the frame of the last record
+	blockBuf   []byte
+	// Counts of the skipped corrupt data.
+	corruptRecords int64
+	corruptBytes   int64
+}
+
+// NewQueueFileReader returns a reader for the records of file starting at
+// the given file offset, where the file must have been positioned.
+func NewQueueFileReader(file *os.File, offset int64) *QueueFileReader {
+	return &QueueFileReader{
+		file:   file,
+		buf:    make([]byte, 8*1024),
+		offset: offset,
+	}
+}
+
+// Next returns the next Heka framed record and the offset to resume reading
+// from once it has been processed. The offset of the records of a block but
+// the last is the start of the block, so a block is read again in full when
+// resuming in the middle of it. io.EOF is returned at the end of the data
+// written so far, Next can be called again once the file has grown.
+func (qr *QueueFileReader) Next() (record []byte, resume int64, err error) {
+	for {
+		if qr.blockPos < len(qr.block) {
+			skipped, n, kind := findQueueFrame(qr.block[qr.blockPos:], &qr.header, true)
+			if kind != frameRecord {
+				// The rest of the block can't be read.
+				skipped, n = len(qr.block)-qr.blockPos, 0
+			}
+			if skipped > 0 {
+				qr.skip(skipped)
+			}
+			record = qr.block[qr.blockPos+skipped : qr.blockPos+skipped+n]
+			qr.blockPos += skipped + n
+			if n == 0 {
+				continue
+			}
+			qr.frameStart = qr.blockStart
+			if qr.blockPos < len(qr.block) {
+				return record, qr.blockStart, nil
+			}
+			return record, qr.offset, nil
+		}
+
+		if qr.start < qr.end && qr.buf[qr.start] == queueBlockMagic {
+			// Once a file is known to hold blocks, the records found when
+			// looking for the block following a corrupt one are part of
+			// it and can't be trusted.
+			qr.blocks = true
+		}
+		skipped, n, kind := findQueueFrame(qr.buf[qr.start:qr.end], &qr.header, !qr.blocks)
+		if skipped > 0 {
+			qr.skip(skipped)
+			qr.consume(skipped)
+		}
+		switch kind {
+		case frameRecord:
+			record = qr.buf[qr.start : qr.start+n]
+			qr.frameStart = qr.offset
+			qr.consume(n)
+			return record, qr.offset, nil
+		case frameBlock:
+			blockStart := qr.offset
+			block := qr.buf[qr.start : qr.start+n]
+			qr.consume(n)
+			if qr.block, err = decodeQueueBlock(block, qr.blockBuf); err != nil {
+				qr.skip(n)
+				qr.block = nil
+				continue
+			}
+			if block[1] != queueCodecNone {
+				qr.blockBuf = qr.block
+			}
+			qr.blockPos = 0
+			qr.blockStart = blockStart
+			continue
+		}
+		if err = qr.fill(); err != nil {
+			return nil, qr.offset, err
+		}
+	}
+}
+
+// Pending returns the size of the incomplete frame at the end of the data
+// read so far.
+func (qr *QueueFileReader) Pending() int {
+	return qr.end - qr.start
+}
+
+// SkipPending drops the incomplete frame at the end of a file that won't
+// grow anymore, it's counted as corrupt.
+func (qr *QueueFileReader) SkipPending() {
+	if n := qr.Pending(); n > 0 {
+		qr.skip(n)
+		qr.consume(n)
+	}
+}
+
+// Corrupt returns the number of corrupt records skipped and their total size
+// in bytes.
+func (qr *QueueFileReader) Corrupt() (records, bytes int64) {
+	return qr.corruptRecords, qr.corruptBytes
+}
+
+// Offset returns the file offset of the data not consumed yet.
+func (qr *QueueFileReader) Offset() int64 {
+	return qr.offset
+}
+
+// RecordOffset returns the file offset of the frame holding the last record
+// returned, where reading must start to get it again.
+func (qr *QueueFileReader) RecordOffset() int64 {
+	return qr.frameStart
+}
+
+func (qr *QueueFileReader) skip(n int) {
+	qr.corruptRecords++
+	qr.corruptBytes += int64(n)
+}
+
+func (qr *QueueFileReader) consume(n int) {
+	qr.start += n
+	qr.offset += int64(n)
+}
+
+// Reads more data from the file, making room for a whole frame.
+func (qr *QueueFileReader) fill() error {
+	if qr.start > 0 {
+		copy(qr.buf, qr.buf[qr.start:qr.end])
+		qr.end -= qr.start
+		qr.start = 0
+	}
+	if qr.end == len(qr.buf) {
+		size := 2 * len(qr.buf)
+		if max := queueBlockHeaderSize + maxQueueBlockLength(); size > max {
+			size = max
+		}
+		if size <= len(qr.buf) {
+			// Can't happen, frames are never larger than the buffer.
+			return fmt.Errorf("queue frame larger than %d bytes", len(qr.buf))
+		}
+		grown := make([]byte, size)
+		copy(grown, qr.buf[:qr.end])
+		qr.buf = grown
+	}
+	n, err := qr.file.Read(qr.buf[qr.end:])
+	qr.end += n
+	if n > 0 {
+		return nil
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	return err
+}
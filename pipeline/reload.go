@@ -0,0 +1,563 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+	"heka/message"
+)
+
+// Order in which the plugin categories are swapped in by a reload, the
+// runners are stopped in the reverse order of the last three.
+var reloadOrder = []string{"Decoder", "Encoder", "Splitter", "Output", "Filter", "Input"}
+
+// SetConfigLoader sets the function used to read the configuration again when
+// it is reloaded. The loader is expected to call PreloadFromConfigFile on the
+// provided PipelineConfig for every configuration file, the same way the
+// configuration was loaded at startup.
+func (self *PipelineConfig) SetConfigLoader(loader func(*PipelineConfig) error) {
+	self.configLoader = loader
+}
+
+// The changes a reload makes to the running configuration, by category.
+type reloadPlan struct {
+	makers  map[string]map[string]PluginMaker
+	added   map[string][]string
+	changed map[string][]string
+	removed map[string][]string
+}
+
+// Reload reads the configuration again and applies the differences to the
+// running pipeline. Plugins that were added are started, the ones that were
+// removed are stopped and the ones whose section changed, or that use a
+// decoder, splitter or encoder whose section changed, are restarted. Stopped
+// plugins process the messages already delivered to them before they exit.
+// An invalid configuration, or a plugin failing to initialize or start, is
+// rejected leaving the running pipeline as it was. Plugins started by a
+// SandboxManagerFilter are left alone.
+func (self *PipelineConfig) Reload() error {
+	self.reloadLock.Lock()
+	defer self.reloadLock.Unlock()
+
+	if self.configLoader == nil {
+		return errors.New("no configuration loader set")
+	}
+	next := NewPipelineConfig(self.Globals)
+	if err := self.configLoader(next); err != nil {
+		return err
+	}
+	if next.errcnt != 0 {
+		return fmt.Errorf("%d errors loading plugins", next.errcnt)
+	}
+	if len(next.makersByCategory) == 0 {
+		return errors.New("empty configuration")
+	}
+
+	plan, err := self.planReload(next)
+	if err != nil {
+		return err
+	}
+	return self.applyReload(plan)
+}
+
+// Returns true if both sections hold the same settings.
+func sameSection(a, b toml.Primitive) bool {
+	var am, bm map[string]interface{}
+	if toml.PrimitiveDecode(a, &am) != nil || toml.PrimitiveDecode(b, &bm) != nil {
+		return false
+	}
+	return reflect.DeepEqual(am, bm)
+}
+
+// Returns the decoder and splitter an input's runner will use.
+func inputDependencies(maker PluginMaker, config interface{}) (decoder, splitter string) {
+	common, _ := maker.(*pluginMaker).prepCommonTypedConfig()
+	commonInput, _ := common.(CommonInputConfig)
+	decoder, splitter = commonInput.Decoder, commonInput.Splitter
+	if decoder == "" {
+		decoder = getAttr(config, "Decoder", "").(string)
+	}
+	if splitter == "" {
+		splitter = getAttr(config, "Splitter", "").(string)
+	}
+	if splitter == "" {
+		splitter = "NullSplitter"
+	}
+	return
+}
+
+// Returns the message matcher and encoder a filter's or output's runner will
+// use.
+func foDependencies(maker PluginMaker, config interface{}) (matcher, encoder string) {
+	common, _ := maker.(*pluginMaker).prepCommonTypedConfig()
+	commonFO, _ := common.(CommonFOConfig)
+	matcher, encoder = commonFO.Matcher, commonFO.Encoder
+	if matcher == "" {
+		matcher = getAttr(config, "MessageMatcher", "").(string)
+	}
+	if encoder == "" {
+		encoder = getAttr(config, "Encoder", "").(string)
+	}
+	return
+}
+
+// Creates the makers for the new configuration bound to the running one,
+// validates them and works out what has to change.
+func (self *PipelineConfig) planReload(next *PipelineConfig) (*reloadPlan, error) {
+	plan := &reloadPlan{
+		makers:  make(map[string]map[string]PluginMaker),
+		added:   make(map[string][]string),
+		changed: make(map[string][]string),
+		removed: make(map[string][]string),
+	}
+	for _, category := range reloadOrder {
+		plan.makers[category] = make(map[string]PluginMaker)
+	}
+
+	var errcnt int
+	fail := func(msg string, args ...interface{}) {
+		LogError.Printf("Reload: "+msg, args...)
+		errcnt++
+	}
+
+	configs := make(map[string]interface{})
+	for _, makers := range next.makersByCategory {
+		for _, m := range makers {
+			pm := m.(*pluginMaker)
+			maker, err := NewPluginMaker(pm.name, self, pm.tomlSection)
+			if err != nil {
+				fail("%s", err)
+				continue
+			}
+			config, err := maker.PrepConfig()
+			if err != nil {
+				fail("%s", err)
+				continue
+			}
+			plan.makers[maker.Category()][maker.Name()] = maker
+			configs[maker.Name()] = config
+		}
+	}
+
+	self.makersLock.RLock()
+	defer self.makersLock.RUnlock()
+
+	// The default plugins are registered whether they're configured or not.
+	for name := range makeDefaultConfigs() {
+		for _, category := range reloadOrder {
+			if maker, ok := self.makers[category][name]; ok {
+				if _, ok = plan.makers[category][name]; !ok {
+					plan.makers[category][name] = maker
+				}
+			}
+		}
+	}
+
+	changed := make(map[string]map[string]bool)
+	for _, category := range reloadOrder {
+		changed[category] = make(map[string]bool)
+		for name, maker := range plan.makers[category] {
+			running, ok := self.makers[category][name]
+			if !ok {
+				plan.added[category] = append(plan.added[category], name)
+			} else if running != maker && !sameSection(running.(*pluginMaker).tomlSection,
+				maker.(*pluginMaker).tomlSection) {
+				changed[category][name] = true
+			}
+		}
+		for name := range self.makers[category] {
+			if _, ok := plan.makers[category][name]; !ok {
+				plan.removed[category] = append(plan.removed[category], name)
+				changed[category][name] = true
+			}
+		}
+	}
+
+	// A MultiDecoder changes with any of its subdecoders.
+	for again := true; again; {
+		again = false
+		for name, maker := range plan.makers["Decoder"] {
+			if changed["Decoder"][name] || maker.Type() != "MultiDecoder" {
+				continue
+			}
+			for _, sub := range subsFromSection(maker.(*pluginMaker).tomlSection) {
+				if changed["Decoder"][sub] {
+					changed["Decoder"][name] = true
+					again = true
+					break
+				}
+			}
+		}
+	}
+
+	for name, maker := range plan.makers["Input"] {
+		decoder, splitter := inputDependencies(maker, configs[name])
+		if decoder != "" {
+			if _, ok := plan.makers["Decoder"][decoder]; !ok {
+				fail("%s specifies undefined decoder %s", name, decoder)
+			}
+		}
+		if _, ok := plan.makers["Splitter"][splitter]; !ok {
+			fail("%s specifies undefined splitter %s", name, splitter)
+		}
+		if changed["Decoder"][decoder] || changed["Splitter"][splitter] {
+			changed["Input"][name] = true
+		}
+	}
+	for _, category := range []string{"Filter", "Output"} {
+		for name, maker := range plan.makers[category] {
+			matcher, encoder := foDependencies(maker, configs[name])
+			if matcher == "" {
+				fail("'%s' missing message matcher", name)
+			} else if _, err := message.CreateMatcherSpecification(matcher); err != nil {
+				fail("'%s' invalid message matcher: %s", name, err)
+			}
+			if encoder != "" {
+				if _, ok := plan.makers["Encoder"][encoder]; !ok {
+					fail("%s specifies undefined encoder %s", name, encoder)
+				}
+			}
+			if changed["Encoder"][encoder] {
+				changed[category][name] = true
+			}
+		}
+	}
+	if errcnt != 0 {
+		return nil, fmt.Errorf("%d errors in the new configuration", errcnt)
+	}
+
+	for _, category := range reloadOrder {
+		for name := range changed[category] {
+			if _, ok := plan.makers[category][name]; ok {
+				if _, ok = self.makers[category][name]; ok {
+					plan.changed[category] = append(plan.changed[category], name)
+				}
+			}
+		}
+		sort.Strings(plan.added[category])
+		sort.Strings(plan.changed[category])
+		sort.Strings(plan.removed[category])
+	}
+	return plan, nil
+}
+
+// A runner of the new configuration, built before anything is stopped unless
+// it's deferred.
+type reloadRunner struct {
+	category string
+	name     string
+	maker    PluginMaker
+	runner   PluginRunner
+	// Built and started once the previous runner has exited.
+	deferred bool
+}
+
+// True if the maker's plugin restores the data its previous instance saves
+// on exit.
+func preservesData(maker PluginMaker) bool {
+	config, err := maker.PrepConfig()
+	if err != nil {
+		return false
+	}
+	p, ok := config.(PreservesData)
+	return ok && p.PreservesData()
+}
+
+// Builds and initializes the runners of the added and changed plugins, then
+// stops the removed and changed runners, swaps the makers and starts the new
+// runners. A changed plugin that can't be initialized while its previous
+// runner is running, e.g. an input listening on the same address, is
+// initialized again once that runner has stopped. A changed plugin that
+// preserves its data is only initialized, and started, once its previous
+// runner has exited and saved the data. The router is held while
+// the filters and outputs are swapped so each message goes to either the
+// previous or the new runner, the previous runners process the messages
+// already delivered to them before they exit. Any failure aborts the reload,
+// leaving the running configuration as it was.
+func (self *PipelineConfig) applyReload(plan *reloadPlan) error {
+	var runners []*reloadRunner
+	for _, category := range reloadOrder {
+		if !hasRunner(category) {
+			continue
+		}
+		for _, name := range plan.added[category] {
+			maker := plan.makers[category][name]
+			runner, err := maker.MakeRunner("")
+			if err != nil {
+				return fmt.Errorf("[%s] failed to start: %s", name, err)
+			}
+			runners = append(runners, &reloadRunner{category, name, maker, runner, false})
+		}
+		for _, name := range plan.changed[category] {
+			maker := plan.makers[category][name]
+			if preservesData(maker) {
+				runners = append(runners, &reloadRunner{category, name, maker, nil, true})
+				continue
+			}
+			runner, _ := maker.MakeRunner("")
+			runners = append(runners, &reloadRunner{category, name, maker, runner, false})
+		}
+	}
+
+	previous := make(map[string]map[string]PluginMaker)
+	self.makersLock.RLock()
+	for _, category := range reloadOrder {
+		previous[category] = make(map[string]PluginMaker)
+		for name, maker := range self.makers[category] {
+			previous[category][name] = maker
+		}
+	}
+	self.makersLock.RUnlock()
+
+	// The inputs are stopped first so the filters and outputs get their last
+	// messages.
+	for _, names := range [][]string{plan.removed["Input"], plan.changed["Input"]} {
+		for _, name := range names {
+			self.waitRunner(name, self.removeRunner("Input", name))
+		}
+	}
+
+	release := self.router.hold()
+	retired := make(map[string]chan struct{})
+	for _, category := range []string{"Filter", "Output"} {
+		for _, names := range [][]string{plan.removed[category], plan.changed[category]} {
+			for _, name := range names {
+				retired[name] = self.removeRunner(category, name)
+			}
+		}
+	}
+
+	self.makersLock.Lock()
+	for _, category := range reloadOrder {
+		makers := self.makers[category] // DecoderMakers shares this map
+		for _, name := range plan.removed[category] {
+			delete(makers, name)
+		}
+		for _, names := range [][]string{plan.added[category], plan.changed[category]} {
+			for _, name := range names {
+				makers[name] = plan.makers[category][name]
+			}
+		}
+	}
+	self.makersLock.Unlock()
+
+	// The filters and outputs are started under the hold, the inputs and the
+	// deferred runners once the previous filters and outputs have exited.
+	started, err := self.startReloadRunners(runners, false)
+	if err != nil {
+		self.abortReload(plan, previous, started, release)
+	} else {
+		release()
+	}
+	for name, done := range retired {
+		self.waitRunner(name, done)
+	}
+	if err != nil {
+		return err
+	}
+	inputs, err := self.startReloadRunners(runners, true)
+	if err != nil {
+		self.abortReload(plan, previous, append(started, inputs...), nil)
+		return err
+	}
+
+	for _, category := range reloadOrder {
+		for _, name := range plan.removed[category] {
+			LogInfo.Printf("Reload: removed [%s]\n", name)
+		}
+		for _, name := range plan.changed[category] {
+			LogInfo.Printf("Reload: restarted [%s]\n", name)
+		}
+		for _, name := range plan.added[category] {
+			LogInfo.Printf("Reload: started [%s]\n", name)
+		}
+	}
+	return nil
+}
+
+// Starts the input and deferred runners built for a reload if late is set,
+// or the other filter and output ones, initializing those that failed while
+// their previous runner was running. Returns the runners started until one
+// fails.
+func (self *PipelineConfig) startReloadRunners(runners []*reloadRunner,
+	late bool) (started []*reloadRunner, err error) {
+
+	for _, r := range runners {
+		if (r.category == "Input" || r.deferred) != late {
+			continue
+		}
+		if r.runner == nil {
+			if r.runner, err = r.maker.MakeRunner(""); err != nil {
+				return started, fmt.Errorf("[%s] failed to start: %s", r.name, err)
+			}
+		}
+		if err = self.addRunner(r.category, r.runner); err != nil {
+			return started, fmt.Errorf("[%s] failed to start: %s", r.name, err)
+		}
+		started = append(started, r)
+	}
+	return started, nil
+}
+
+// Undoes a reload that failed to start one of the new runners: the runners
+// it started are stopped, the previous makers restored and the runners it
+// stopped started again. The filters and outputs are swapped back under the
+// router hold, release is set if the reload still holds the router.
+func (self *PipelineConfig) abortReload(plan *reloadPlan,
+	previous map[string]map[string]PluginMaker, started []*reloadRunner,
+	release func()) {
+
+	if release == nil {
+		for _, r := range started {
+			if r.category == "Input" {
+				self.waitRunner(r.name, self.removeRunner(r.category, r.name))
+			}
+		}
+		release = self.router.hold()
+	}
+	retired := make(map[string]chan struct{})
+	for _, r := range started {
+		if r.category != "Input" {
+			retired[r.name] = self.removeRunner(r.category, r.name)
+		}
+	}
+
+	self.makersLock.Lock()
+	for _, category := range reloadOrder {
+		makers := self.makers[category] // DecoderMakers shares this map
+		for name := range makers {
+			delete(makers, name)
+		}
+		for name, maker := range previous[category] {
+			makers[name] = maker
+		}
+	}
+	self.makersLock.Unlock()
+
+	// The plugins preserving their data are restarted once the runners
+	// replacing them have exited.
+	restart := func(category string, late bool) {
+		for _, names := range [][]string{plan.removed[category], plan.changed[category]} {
+			for _, name := range names {
+				maker := previous[category][name]
+				if preservesData(maker) != late {
+					continue
+				}
+				if err := self.startRunner(category, maker); err != nil {
+					LogError.Printf("Reload: [%s] failed to restart: %s", name, err)
+				}
+			}
+		}
+	}
+	restart("Output", false)
+	restart("Filter", false)
+	release()
+	for name, done := range retired {
+		self.waitRunner(name, done)
+	}
+	restart("Output", true)
+	restart("Filter", true)
+	restart("Input", false)
+	restart("Input", true)
+}
+
+// Removes a running input, filter or output. Returns a channel closed once
+// the runner has exited, nil if it isn't running.
+func (self *PipelineConfig) removeRunner(category, name string) (done chan struct{}) {
+	switch category {
+	case "Input":
+		self.inputsLock.RLock()
+		runner, ok := self.InputRunners[name]
+		self.inputsLock.RUnlock()
+		if !ok {
+			return nil
+		}
+		if ir, ok := runner.(*iRunner); ok {
+			done = ir.done
+		}
+		self.RemoveInputRunner(runner)
+	case "Filter":
+		runner, ok := self.Filter(name)
+		if !ok {
+			return nil
+		}
+		if fo, ok := runner.(*foRunner); ok {
+			fo.retire()
+			done = fo.done
+		}
+		self.RemoveFilterRunner(name)
+	case "Output":
+		self.outputsLock.RLock()
+		runner, ok := self.OutputRunners[name]
+		self.outputsLock.RUnlock()
+		if !ok {
+			return nil
+		}
+		if fo, ok := runner.(*foRunner); ok {
+			fo.retire()
+			done = fo.done
+		}
+		self.RemoveOutputRunner(runner)
+	}
+	return done
+}
+
+// Waits until a removed runner has exited.
+func (self *PipelineConfig) waitRunner(name string, done chan struct{}) {
+	if done != nil {
+		<-done
+		LogInfo.Printf("Reload: stopped [%s]\n", name)
+	}
+}
+
+// True for the categories whose plugins have a runner of their own. Decoders,
+// encoders and splitters have nothing to start, their makers are used when
+// the runners that need them start.
+func hasRunner(category string) bool {
+	switch category {
+	case "Input", "Filter", "Output":
+		return true
+	}
+	return false
+}
+
+// Creates and starts the runner of an input, filter or output maker.
+func (self *PipelineConfig) startRunner(category string, maker PluginMaker) error {
+	if !hasRunner(category) {
+		return nil
+	}
+	runner, err := maker.MakeRunner("")
+	if err != nil {
+		return err
+	}
+	return self.addRunner(category, runner)
+}
+
+// Starts a runner of an input, filter or output.
+func (self *PipelineConfig) addRunner(category string, runner PluginRunner) error {
+	switch category {
+	case "Input":
+		return self.AddInputRunner(runner.(InputRunner))
+	case "Filter":
+		return self.AddFilterRunner(runner.(FilterRunner))
+	default:
+		return self.AddOutputRunner(runner.(OutputRunner))
+	}
+}
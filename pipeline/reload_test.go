@@ -0,0 +1,635 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+// State shared by the plugins of a reload test pipeline.
+type reloadTest struct {
+	payloads chan string // delivered by the running ReloadTestInput
+	records  chan string // written by the filters and outputs
+}
+
+var (
+	reloadTests     = make(map[*PipelineConfig]*reloadTest)
+	reloadTestsLock sync.Mutex
+)
+
+func getReloadTest(pConfig *PipelineConfig) *reloadTest {
+	reloadTestsLock.Lock()
+	defer reloadTestsLock.Unlock()
+	return reloadTests[pConfig]
+}
+
+type reloadTestConfig struct {
+	Tag  string
+	Fail bool
+}
+
+// Base of the reload test plugins, they fail to initialize when configured
+// with fail = true.
+type reloadTestPlugin struct {
+	test   *reloadTest
+	config *reloadTestConfig
+}
+
+func (p *reloadTestPlugin) SetPipelineConfig(pConfig *PipelineConfig) {
+	p.test = getReloadTest(pConfig)
+}
+
+func (p *reloadTestPlugin) ConfigStruct() interface{} {
+	return new(reloadTestConfig)
+}
+
+func (p *reloadTestPlugin) Init(config interface{}) error {
+	p.config = config.(*reloadTestConfig)
+	if p.config.Fail {
+		return errors.New("configured to fail")
+	}
+	return nil
+}
+
+type ReloadTestInput struct {
+	reloadTestPlugin
+	stop chan struct{}
+}
+
+func (i *ReloadTestInput) Run(ir InputRunner, h PluginHelper) error {
+	i.stop = make(chan struct{})
+	for {
+		select {
+		case payload := <-i.test.payloads:
+			pack := <-ir.InChan()
+			pack.Message.SetType("reload.test")
+			pack.Message.SetPayload(payload)
+			ir.Deliver(pack)
+		case <-i.stop:
+			return nil
+		}
+	}
+}
+
+func (i *ReloadTestInput) Stop() {
+	close(i.stop)
+}
+
+// Tags the messages with its tag.
+type ReloadTestDecoder struct {
+	reloadTestPlugin
+}
+
+func (d *ReloadTestDecoder) Decode(pack *PipelinePack) ([]*PipelinePack, error) {
+	pack.Message.SetLogger(d.config.Tag)
+	return []*PipelinePack{pack}, nil
+}
+
+type ReloadTestEncoder struct {
+	reloadTestPlugin
+}
+
+func (e *ReloadTestEncoder) Encode(pack *PipelinePack) ([]byte, error) {
+	return []byte(e.config.Tag + ":" + pack.Message.GetPayload()), nil
+}
+
+// Records the messages it's sent as "<tag> <decoder tag> <payload>".
+type ReloadTestFilter struct {
+	reloadTestPlugin
+}
+
+func (f *ReloadTestFilter) Prepare(fr FilterRunner, h PluginHelper) error {
+	return nil
+}
+
+func (f *ReloadTestFilter) ProcessMessage(pack *PipelinePack) error {
+	f.test.records <- fmt.Sprintf("%s %s %s", f.config.Tag, pack.Message.GetLogger(),
+		pack.Message.GetPayload())
+	return nil
+}
+
+func (f *ReloadTestFilter) CleanUp() {}
+
+// Records the messages it's sent as "<tag> <decoder tag> <encoded payload>".
+type ReloadTestOutput struct {
+	reloadTestPlugin
+	or OutputRunner
+}
+
+func (o *ReloadTestOutput) Prepare(or OutputRunner, h PluginHelper) error {
+	o.or = or
+	return nil
+}
+
+func (o *ReloadTestOutput) ProcessMessage(pack *PipelinePack) error {
+	payload := pack.Message.GetPayload()
+	if o.or.Encoder() != nil {
+		b, err := o.or.Encode(pack)
+		if err != nil {
+			return err
+		}
+		payload = string(b)
+	}
+	o.test.records <- fmt.Sprintf("%s %s %s", o.config.Tag, pack.Message.GetLogger(),
+		payload)
+	return nil
+}
+
+func (o *ReloadTestOutput) CleanUp() {}
+
+type reloadTestCounterConfig struct {
+	Tag          string
+	DataFile     string `toml:"data_file"`
+	PreserveData bool   `toml:"preserve_data"`
+}
+
+func (c *reloadTestCounterConfig) PreservesData() bool {
+	return c.PreserveData
+}
+
+// Counts the messages it's sent, recording "<tag> count <count>" for each of
+// them. With preserve_data the count is saved to the data file on exit and
+// restored from it in Init.
+type ReloadTestCounterFilter struct {
+	test   *reloadTest
+	config *reloadTestCounterConfig
+	count  int
+}
+
+func (f *ReloadTestCounterFilter) SetPipelineConfig(pConfig *PipelineConfig) {
+	f.test = getReloadTest(pConfig)
+}
+
+func (f *ReloadTestCounterFilter) ConfigStruct() interface{} {
+	return new(reloadTestCounterConfig)
+}
+
+func (f *ReloadTestCounterFilter) Init(config interface{}) error {
+	f.config = config.(*reloadTestCounterConfig)
+	if !f.config.PreserveData {
+		return nil
+	}
+	data, err := ioutil.ReadFile(f.config.DataFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f.count, err = strconv.Atoi(string(data))
+	return err
+}
+
+func (f *ReloadTestCounterFilter) Prepare(fr FilterRunner, h PluginHelper) error {
+	return nil
+}
+
+func (f *ReloadTestCounterFilter) ProcessMessage(pack *PipelinePack) error {
+	f.count++
+	f.test.records <- fmt.Sprintf("%s count %d", f.config.Tag, f.count)
+	return nil
+}
+
+func (f *ReloadTestCounterFilter) CleanUp() {
+	if f.config.PreserveData {
+		ioutil.WriteFile(f.config.DataFile, []byte(strconv.Itoa(f.count)), 0644)
+	}
+}
+
+func init() {
+	RegisterPlugin("ReloadTestInput", func() interface{} {
+		return new(ReloadTestInput)
+	})
+	RegisterPlugin("ReloadTestDecoder", func() interface{} {
+		return new(ReloadTestDecoder)
+	})
+	RegisterPlugin("ReloadTestEncoder", func() interface{} {
+		return new(ReloadTestEncoder)
+	})
+	RegisterPlugin("ReloadTestFilter", func() interface{} {
+		return new(ReloadTestFilter)
+	})
+	RegisterPlugin("ReloadTestOutput", func() interface{} {
+		return new(ReloadTestOutput)
+	})
+	RegisterPlugin("ReloadTestCounterFilter", func() interface{} {
+		return new(ReloadTestCounterFilter)
+	})
+}
+
+// Starts the runners of a loaded configuration the way Run does.
+func startTestPipeline(pConfig *PipelineConfig) error {
+	for name, output := range pConfig.OutputRunners {
+		pConfig.outputsWg.Add(1)
+		if err := output.Start(pConfig, &pConfig.outputsWg); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	for name, filter := range pConfig.FilterRunners {
+		pConfig.filtersWg.Add(1)
+		if err := filter.Start(pConfig, &pConfig.filtersWg); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	pConfig.router.initMatchSlices()
+	for i := 0; i < pConfig.Globals.PoolSize; i++ {
+		pConfig.inputRecycleChan <- NewPipelinePack(pConfig.inputRecycleChan)
+		pConfig.injectRecycleChan <- NewPipelinePack(pConfig.injectRecycleChan)
+	}
+	pConfig.router.Start()
+	for name, input := range pConfig.InputRunners {
+		pConfig.inputsWg.Add(1)
+		if err := input.Start(pConfig, &pConfig.inputsWg); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// Stops the runners the way Run does on shutdown.
+func stopTestPipeline(pConfig *PipelineConfig) {
+	pConfig.Globals.stop()
+	pConfig.inputsLock.Lock()
+	for _, input := range pConfig.InputRunners {
+		input.Input().Stop()
+	}
+	pConfig.inputsLock.Unlock()
+	pConfig.inputsWg.Wait()
+
+	pConfig.allDecodersLock.Lock()
+	for _, decoder := range pConfig.allDecoders {
+		close(decoder.InChan())
+	}
+	pConfig.allDecoders = pConfig.allDecoders[:0]
+	pConfig.allDecodersLock.Unlock()
+	pConfig.decodersWg.Wait()
+
+	pConfig.filtersLock.Lock()
+	for _, filter := range pConfig.FilterRunners {
+		pConfig.router.RemoveFilterMatcher() <- filter.MatchRunner()
+	}
+	pConfig.filtersLock.Unlock()
+	pConfig.filtersWg.Wait()
+
+	pConfig.outputsLock.Lock()
+	for _, output := range pConfig.OutputRunners {
+		pConfig.router.RemoveOutputMatcher() <- output.MatchRunner()
+	}
+	pConfig.outputsLock.Unlock()
+	pConfig.outputsWg.Wait()
+}
+
+func ReloadSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "reload-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	pConfig := NewPipelineConfig(nil)
+	test := &reloadTest{
+		payloads: make(chan string),
+		records:  make(chan string, 1000),
+	}
+	reloadTestsLock.Lock()
+	reloadTests[pConfig] = test
+	reloadTestsLock.Unlock()
+	defer func() {
+		reloadTestsLock.Lock()
+		delete(reloadTests, pConfig)
+		reloadTestsLock.Unlock()
+	}()
+
+	sections := map[string]string{
+		"in": `type = "ReloadTestInput"
+decoder = "dec"`,
+		"dec": `type = "ReloadTestDecoder"
+tag = "dec1"`,
+		"enc": `type = "ReloadTestEncoder"
+tag = "enc1"`,
+		"filter": `type = "ReloadTestFilter"
+message_matcher = "Type == 'reload.test'"
+tag = "filter1"`,
+		"out": `type = "ReloadTestOutput"
+message_matcher = "Type == 'reload.test'"
+encoder = "enc"
+tag = "out1"`,
+	}
+	configFile := filepath.Join(tmpDir, "config.toml")
+	writeConfig := func() {
+		var names []string
+		for name := range sections {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var config string
+		for _, name := range names {
+			config += fmt.Sprintf("[%s]\n%s\n\n", name, sections[name])
+		}
+		c.Assume(ioutil.WriteFile(configFile, []byte(config), 0644), gs.IsNil)
+	}
+	writeConfig()
+	pConfig.SetConfigLoader(func(next *PipelineConfig) error {
+		reloadTestsLock.Lock()
+		reloadTests[next] = test
+		reloadTestsLock.Unlock()
+		return next.PreloadFromConfigFile(configFile)
+	})
+
+	c.Assume(pConfig.PreloadFromConfigFile(configFile), gs.IsNil)
+	c.Assume(pConfig.LoadConfig(), gs.IsNil)
+	c.Assume(startTestPipeline(pConfig), gs.IsNil)
+	defer stopTestPipeline(pConfig)
+
+	// Sends the payloads through the input and returns the sorted records
+	// the filters and outputs write for them.
+	send := func(records int, payloads ...string) []string {
+		go func() {
+			for _, payload := range payloads {
+				test.payloads <- payload
+			}
+		}()
+		var received []string
+		timeout := time.After(5 * time.Second)
+		for len(received) < records {
+			select {
+			case record := <-test.records:
+				received = append(received, record)
+			case <-timeout:
+				c.Expect(len(received), gs.Equals, records)
+				return received
+			}
+		}
+		sort.Strings(received)
+		return received
+	}
+	// Returns the running runners by name.
+	running := func() map[string]PluginRunner {
+		runners := make(map[string]PluginRunner)
+		pConfig.inputsLock.RLock()
+		for name, runner := range pConfig.InputRunners {
+			runners[name] = runner
+		}
+		pConfig.inputsLock.RUnlock()
+		pConfig.filtersLock.RLock()
+		for name, runner := range pConfig.FilterRunners {
+			runners[name] = runner
+		}
+		pConfig.filtersLock.RUnlock()
+		pConfig.outputsLock.RLock()
+		for name, runner := range pConfig.OutputRunners {
+			runners[name] = runner
+		}
+		pConfig.outputsLock.RUnlock()
+		return runners
+	}
+
+	c.Expect(strings.Join(send(2, "a"), "|"), gs.Equals,
+		"filter1 dec1 a|out1 dec1 enc1:a")
+	before := running()
+	// True if the same runners are still running.
+	unchanged := func() bool {
+		after := running()
+		if len(after) != len(before) {
+			return false
+		}
+		for name, runner := range before {
+			if after[name] != runner {
+				return false
+			}
+		}
+		return true
+	}
+
+	c.Specify("A configuration reload", func() {
+		c.Specify("starts the added plugins", func() {
+			sections["out2"] = `type = "ReloadTestOutput"
+message_matcher = "Type == 'reload.test'"
+tag = "out2"`
+			writeConfig()
+			c.Expect(pConfig.Reload(), gs.IsNil)
+			c.Expect(strings.Join(send(3, "b"), "|"), gs.Equals,
+				"filter1 dec1 b|out1 dec1 enc1:b|out2 dec1 b")
+			after := running()
+			c.Expect(len(after), gs.Equals, 4)
+			for name, runner := range before {
+				c.Expect(after[name], gs.Equals, runner)
+			}
+		})
+
+		c.Specify("stops the removed plugins", func() {
+			delete(sections, "filter")
+			writeConfig()
+			c.Expect(pConfig.Reload(), gs.IsNil)
+			c.Expect(strings.Join(send(1, "b"), "|"), gs.Equals, "out1 dec1 enc1:b")
+			_, ok := pConfig.Filter("filter")
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(running()["out"], gs.Equals, before["out"])
+		})
+
+		c.Specify("restarts the changed plugins", func() {
+			sections["filter"] = strings.Replace(sections["filter"], "filter1", "filter2", 1)
+			writeConfig()
+			c.Expect(pConfig.Reload(), gs.IsNil)
+			c.Expect(strings.Join(send(2, "b"), "|"), gs.Equals,
+				"filter2 dec1 b|out1 dec1 enc1:b")
+			after := running()
+			c.Expect(after["filter"] != before["filter"], gs.IsTrue)
+			c.Expect(after["in"], gs.Equals, before["in"])
+			c.Expect(after["out"], gs.Equals, before["out"])
+		})
+
+		c.Specify("restores the data a restarted plugin preserves", func() {
+			sections["counter"] = fmt.Sprintf(`type = "ReloadTestCounterFilter"
+message_matcher = "Type == 'reload.test'"
+preserve_data = true
+data_file = %q
+tag = "counter1"`, filepath.Join(tmpDir, "counter.data"))
+			writeConfig()
+			c.Expect(pConfig.Reload(), gs.IsNil)
+			c.Expect(strings.Join(send(3, "b"), "|"), gs.Equals,
+				"counter1 count 1|filter1 dec1 b|out1 dec1 enc1:b")
+			for i, tag := range []string{"counter2", "counter3"} {
+				sections["counter"] = strings.Replace(sections["counter"],
+					fmt.Sprintf("counter%d", i+1), tag, 1)
+				writeConfig()
+				c.Expect(pConfig.Reload(), gs.IsNil)
+				c.Expect(send(3, "c")[0], gs.Equals, fmt.Sprintf("%s count %d", tag, i+2))
+			}
+		})
+
+		c.Specify("restarts the input using a changed decoder", func() {
+			sections["dec"] = strings.Replace(sections["dec"], "dec1", "dec2", 1)
+			writeConfig()
+			c.Expect(pConfig.Reload(), gs.IsNil)
+			c.Expect(strings.Join(send(2, "b"), "|"), gs.Equals,
+				"filter1 dec2 b|out1 dec2 enc1:b")
+			after := running()
+			c.Expect(after["in"] != before["in"], gs.IsTrue)
+			c.Expect(after["filter"], gs.Equals, before["filter"])
+			c.Expect(after["out"], gs.Equals, before["out"])
+		})
+
+		c.Specify("restarts the output using a changed encoder", func() {
+			sections["enc"] = strings.Replace(sections["enc"], "enc1", "enc2", 1)
+			writeConfig()
+			c.Expect(pConfig.Reload(), gs.IsNil)
+			c.Expect(strings.Join(send(2, "b"), "|"), gs.Equals,
+				"filter1 dec1 b|out1 dec1 enc2:b")
+			after := running()
+			c.Expect(after["out"] != before["out"], gs.IsTrue)
+			c.Expect(after["in"], gs.Equals, before["in"])
+			c.Expect(after["filter"], gs.Equals, before["filter"])
+		})
+
+		c.Specify("rejects an invalid configuration", func() {
+			sections["out"] = strings.Replace(sections["out"], `"enc"`, `"missing"`, 1)
+			writeConfig()
+			c.Expect(pConfig.Reload(), gs.Not(gs.IsNil))
+			c.Expect(unchanged(), gs.IsTrue)
+			c.Expect(strings.Join(send(2, "b"), "|"), gs.Equals,
+				"filter1 dec1 b|out1 dec1 enc1:b")
+		})
+
+		c.Specify("leaves everything running when an added plugin fails to initialize", func() {
+			sections["out"] = strings.Replace(sections["out"], "out1", "out2", 1)
+			sections["filter2"] = `type = "ReloadTestFilter"
+message_matcher = "TRUE"
+fail = true`
+			writeConfig()
+			c.Expect(pConfig.Reload(), gs.Not(gs.IsNil))
+			c.Expect(unchanged(), gs.IsTrue)
+			c.Expect(strings.Join(send(2, "b"), "|"), gs.Equals,
+				"filter1 dec1 b|out1 dec1 enc1:b")
+		})
+
+		c.Specify("restores the previous configuration when a changed plugin fails to start", func() {
+			sections["out2"] = `type = "ReloadTestOutput"
+message_matcher = "Type == 'reload.test'"
+tag = "out2"`
+			sections["out"] += "\nfail = true"
+			writeConfig()
+			c.Expect(pConfig.Reload(), gs.Not(gs.IsNil))
+			after := running()
+			c.Expect(len(after), gs.Equals, 3)
+			c.Expect(after["in"], gs.Equals, before["in"])
+			c.Expect(after["filter"], gs.Equals, before["filter"])
+			c.Expect(strings.Join(send(2, "b"), "|"), gs.Equals,
+				"filter1 dec1 b|out1 dec1 enc1:b")
+			pConfig.makersLock.RLock()
+			_, ok := pConfig.makers["Output"]["out2"]
+			pConfig.makersLock.RUnlock()
+			c.Expect(ok, gs.IsFalse)
+		})
+
+		c.Specify("delivers every message to a restarted plugin", func() {
+			payloads := make([]string, 200)
+			for i := range payloads {
+				payloads[i] = fmt.Sprint(i)
+			}
+			sections["out"] = strings.Replace(sections["out"], "out1", "out2", 1)
+			writeConfig()
+			errs := make(chan error)
+			go func() {
+				time.Sleep(time.Millisecond)
+				errs <- pConfig.Reload()
+			}()
+			received := send(400, payloads...)
+			c.Expect(<-errs, gs.IsNil)
+			outputs := make(map[string]bool)
+			for _, record := range received {
+				if !strings.HasPrefix(record, "filter1 ") {
+					fields := strings.Fields(record)
+					outputs[strings.SplitN(fields[2], ":", 2)[1]] = true
+				}
+			}
+			c.Expect(len(outputs), gs.Equals, 200)
+		})
+	})
+}
+
+func ConfigReloadFilterSpec(c gs.Context) {
+	pConfig := NewPipelineConfig(nil)
+	filter := new(ConfigReloadFilter)
+	filter.SetPipelineConfig(pConfig)
+	config := filter.ConfigStruct().(*ConfigReloadFilterConfig)
+	config.MessageSigner = "ops"
+	c.Assume(filter.Init(config), gs.IsNil)
+	runner, err := NewFORunner("reload", filter, CommonFOConfig{Matcher: config.MessageMatcher,
+		Signer: config.MessageSigner}, "ConfigReloadFilter", 10)
+	c.Assume(err, gs.IsNil)
+	recycleChan := make(chan *PipelinePack, 10)
+
+	// Runs the filter on control messages with the given timestamps.
+	run := func(timestamps ...int64) {
+		for _, ts := range timestamps {
+			pack := NewPipelinePack(recycleChan)
+			pack.Message.SetType("heka.control.reload")
+			pack.Message.SetTimestamp(ts)
+			runner.inChan <- pack
+		}
+		close(runner.inChan)
+		c.Expect(filter.Run(runner, nil), gs.IsNil)
+		c.Expect(len(recycleChan), gs.Equals, len(timestamps))
+	}
+	sighups := func() (n int) {
+		for {
+			select {
+			case sig := <-pConfig.Globals.SigChan():
+				c.Expect(sig, gs.Equals, syscall.SIGHUP)
+				n++
+			default:
+				return
+			}
+		}
+	}
+
+	c.Specify("A ConfigReloadFilter", func() {
+		c.Specify("matches the reload control messages", func() {
+			c.Expect(config.MessageMatcher, gs.Equals, "Type == 'heka.control.reload'")
+		})
+
+		c.Specify("requires a message signer", func() {
+			config := filter.ConfigStruct().(*ConfigReloadFilterConfig)
+			c.Expect(filter.Init(config).Error(), gs.Equals, "message_signer must be set")
+		})
+
+		c.Specify("requests a reload", func() {
+			run(time.Now().UnixNano())
+			c.Expect(sighups(), gs.Equals, 1)
+		})
+
+		c.Specify("requests a single reload for messages received before it started", func() {
+			now := time.Now().UnixNano()
+			run(now, now)
+			c.Expect(sighups(), gs.Equals, 1)
+		})
+
+		c.Specify("ignores stale messages", func() {
+			run(time.Now().Add(-time.Minute).UnixNano(), time.Now().Add(time.Minute).UnixNano())
+			c.Expect(sighups(), gs.Equals, 0)
+		})
+	})
+}
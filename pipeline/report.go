@@ -66,6 +66,22 @@ func PopulateReportMsg(pr PluginRunner, msg *message.Message) (err error) {
 		}
 		fRunner.MatchRunner().reportLock.Unlock()
 		message.NewInt64Field(msg, "MatchAvgDuration", tmp, "ns")
+		evaluations, matches := fRunner.MatchRunner().MatcherSpecification().Stats()
+		message.NewInt64Field(msg, "MatchCount", evaluations, "count")
+		message.NewInt64Field(msg, "MatchHits", matches, "count")
+		if foRunner, ok := fRunner.(*foRunner); ok && foRunner.config.DeadLetter != nil {
+			message.NewInt64Field(msg, "DeadLetterCount", foRunner.DeadLetterCount(), "count")
+		}
+		if foRunner, ok := fRunner.(*foRunner); ok && foRunner.bufReader != nil {
+			reader := foRunner.bufReader
+			message.NewInt64Field(msg, "BufferSize", int64(reader.queueSize.Get()), "B")
+			records, bytes := reader.CorruptCounts()
+			message.NewInt64Field(msg, "BufferCorruptRecordCount", records, "count")
+			message.NewInt64Field(msg, "BufferCorruptByteCount", bytes, "B")
+			dropped, droppedBytes := reader.DroppedCounts()
+			message.NewInt64Field(msg, "BufferDropMessageCount", dropped, "count")
+			message.NewInt64Field(msg, "BufferDropByteCount", droppedBytes, "B")
+		}
 	} else if dRunner, ok := pr.(DecoderRunner); ok {
 		message.NewIntField(msg, "InChanCapacity", cap(dRunner.InChan()), "count")
 		message.NewIntField(msg, "InChanLength", len(dRunner.InChan()), "count")
@@ -43,6 +43,9 @@ type MessageRouter interface {
 	// Channel to facilitate adding a matcher to the router which starts the
 	// message flow to the associated filter.
 	AddFilterMatcher() chan *MatchRunner
+	// Channel to facilitate adding a matcher to the router which starts the
+	// message flow to the associated output.
+	AddOutputMatcher() chan *MatchRunner
 	// Channel to facilitate removing a Filter.  If the matcher exists it will
 	// be removed from the router, the matcher channel closed and drained, the
 	// filter channel closed and drained, and the filter exited.
@@ -56,11 +59,25 @@ type MessageRouter interface {
 type messageRouter struct {
 	processMessageCount int64
 	inChan              chan *PipelinePack
+	batchInChan         chan []*PipelinePack
 	addFilterMatcher    chan *MatchRunner
+	addOutputMatcher    chan *MatchRunner
 	removeFilterMatcher chan *MatchRunner
 	removeOutputMatcher chan *MatchRunner
+	holdChan            chan chan struct{}
 	fMatchers           []*MatchRunner
 	oMatchers           []*MatchRunner
+	// Indexes of the matchers by their position in the slices above, only
+	// the candidates the index returns for a message are sent the pack.
+	fIndex *message.MatcherIndex
+	oIndex *message.MatcherIndex
+	// Packs are routed in batches of up to batchSize when it's greater than
+	// one, waiting at most batchLinger for a batch to fill up.
+	batchSize   int
+	batchLinger time.Duration
+	candidates  []int
+	fPending    [][]*PipelinePack
+	oPending    [][]*PipelinePack
 	// These are used during initialization time only to prevent false
 	// duplicate matchers, they will *not* be kept up to date as matchers are
 	// added to / removed from the router. The slices defined above contain
@@ -74,11 +91,16 @@ type messageRouter struct {
 func NewMessageRouter(chanSize int, abortChan chan struct{}) (router *messageRouter) {
 	router = new(messageRouter)
 	router.inChan = make(chan *PipelinePack, chanSize)
+	router.batchInChan = make(chan []*PipelinePack, chanSize)
 	router.addFilterMatcher = make(chan *MatchRunner, 0)
+	router.addOutputMatcher = make(chan *MatchRunner, 0)
 	router.removeFilterMatcher = make(chan *MatchRunner, 0)
 	router.removeOutputMatcher = make(chan *MatchRunner, 0)
+	router.holdChan = make(chan chan struct{})
 	router.fMatcherMap = make(map[string]*MatchRunner)
 	router.oMatcherMap = make(map[string]*MatchRunner)
+	router.fIndex = message.NewMatcherIndex()
+	router.oIndex = message.NewMatcherIndex()
 	return router
 }
 
@@ -90,6 +112,10 @@ func (self *messageRouter) AddFilterMatcher() chan *MatchRunner {
 	return self.addFilterMatcher
 }
 
+func (self *messageRouter) AddOutputMatcher() chan *MatchRunner {
+	return self.addOutputMatcher
+}
+
 func (self *messageRouter) RemoveFilterMatcher() chan *MatchRunner {
 	return self.removeFilterMatcher
 }
@@ -98,6 +124,15 @@ func (self *messageRouter) RemoveOutputMatcher() chan *MatchRunner {
 	return self.removeOutputMatcher
 }
 
+// Stops routing messages until the returned function is called, matchers can
+// still be added and removed in the meantime. A reload holds the router while
+// it swaps plugins so every message is sent to either the old or the new one.
+func (self *messageRouter) hold() (release func()) {
+	c := make(chan struct{})
+	self.holdChan <- c
+	return func() { close(c) }
+}
+
 func (self *messageRouter) Inject(pack *PipelinePack) error {
 	select {
 	case self.inChan <- pack:
@@ -107,6 +142,18 @@ func (self *messageRouter) Inject(pack *PipelinePack) error {
 	}
 }
 
+// Hands a slice of packs over to the router with a single channel operation,
+// the slice belongs to the router afterwards. Only used when the router
+// batches its deliveries.
+func (self *messageRouter) injectBatch(packs []*PipelinePack) error {
+	select {
+	case self.batchInChan <- packs:
+		return nil
+	case <-self.abortChan:
+		return AbortError
+	}
+}
+
 // initMatchSlices creates the `fMatchers` and `oMatchers` MatchRunner slices
 // and populates them with the matchers that are in the respective matcher
 // maps. Should be called exactly once after all of the config has been loaded
@@ -115,9 +162,11 @@ func (self *messageRouter) initMatchSlices() {
 	self.fMatchers = make([]*MatchRunner, 0, len(self.fMatcherMap))
 	self.oMatchers = make([]*MatchRunner, 0, len(self.oMatcherMap))
 	for _, matcher := range self.fMatcherMap {
+		self.fIndex.Add(len(self.fMatchers), matcher.spec)
 		self.fMatchers = append(self.fMatchers, matcher)
 	}
 	for _, matcher := range self.oMatcherMap {
+		self.oIndex.Add(len(self.oMatchers), matcher.spec)
 		self.oMatchers = append(self.oMatchers, matcher)
 	}
 }
@@ -131,69 +180,42 @@ func (self *messageRouter) Start() {
 		var matcher *MatchRunner
 		var ok = true
 		var pack *PipelinePack
+		var packs, batch []*PipelinePack
+		batching := self.batchSize > 1
 		for ok {
-			runtime.Gosched()
+			if !batching {
+				runtime.Gosched()
+			}
 			select {
 			case matcher = <-self.addFilterMatcher:
-				if matcher != nil {
-					exists := false
-					available := -1
-					for i, m := range self.fMatchers {
-						if m == nil {
-							available = i
-						}
-						if matcher == m {
-							exists = true
-							break
-						}
-					}
-					if !exists {
-						if available != -1 {
-							self.fMatchers[available] = matcher
-						} else {
-							self.fMatchers = append(self.fMatchers, matcher)
-						}
-					}
-				}
+				self.fMatchers = addMatcher(self.fMatchers, self.fIndex, matcher)
+			case matcher = <-self.addOutputMatcher:
+				self.oMatchers = addMatcher(self.oMatchers, self.oIndex, matcher)
 			case matcher = <-self.removeFilterMatcher:
-				if matcher != nil {
-					for i, m := range self.fMatchers {
-						if matcher == m {
-							m.Close()
-							self.fMatchers[i] = nil
-							break
-						}
-					}
-				}
+				removeMatcher(self.fMatchers, self.fIndex, matcher)
 			case matcher = <-self.removeOutputMatcher:
-				if matcher != nil {
-					for i, m := range self.oMatchers {
-						if matcher == m {
-							m.Close()
-							self.oMatchers[i] = nil
-							break
-						}
-					}
-				}
+				removeMatcher(self.oMatchers, self.oIndex, matcher)
+			case release := <-self.holdChan:
+				self.held(release)
 			case pack, ok = <-self.inChan:
 				if !ok {
 					break
 				}
-				pack.diagnostics.Reset() //todo xx 监控
-				atomic.AddInt64(&self.processMessageCount, 1)
-				for _, matcher = range self.fMatchers {
-					if matcher != nil {
-						atomic.AddInt32(&pack.RefCount, 1)
-						matcher.inChan <- pack
-					}
+				if batching {
+					batch, ok = self.collectBatch(append(batch[:0], pack))
+					self.routeBatch(batch)
+					break
 				}
-				for _, matcher = range self.oMatchers {
-					if matcher != nil {
-						atomic.AddInt32(&pack.RefCount, 1)
-						matcher.inChan <- pack
-					}
+				self.routePack(pack)
+			case packs = <-self.batchInChan:
+				if batching {
+					batch, ok = self.collectBatch(append(batch[:0], packs...))
+					self.routeBatch(batch)
+					break
+				}
+				for _, pack = range packs {
+					self.routePack(pack)
 				}
-				pack.recycle()
 			}
 		}
 		for _, matcher = range self.fMatchers {
@@ -202,19 +224,200 @@ func (self *messageRouter) Start() {
 			}
 		}
 		for _, matcher = range self.oMatchers {
-			matcher.Close()
+			if matcher != nil {
+				matcher.Close()
+			}
 		}
 		LogInfo.Println("MessageRouter stopped.")
 	}()
 	LogInfo.Println("MessageRouter started.")
 }
 
+// Sends the pack to each of its candidate matchers.
+func (self *messageRouter) routePack(pack *PipelinePack) {
+	pack.diagnostics.Reset() //todo xx 监控
+	atomic.AddInt64(&self.processMessageCount, 1)
+	self.candidates = self.fIndex.Candidates(pack.Message, self.candidates[:0])
+	for _, i := range self.candidates {
+		atomic.AddInt32(&pack.RefCount, 1)
+		self.fMatchers[i].inChan <- pack
+	}
+	self.candidates = self.oIndex.Candidates(pack.Message, self.candidates[:0])
+	for _, i := range self.candidates {
+		atomic.AddInt32(&pack.RefCount, 1)
+		self.oMatchers[i].inChan <- pack
+	}
+	pack.recycle()
+}
+
+// Only adds and removes matchers until release is closed.
+func (self *messageRouter) held(release chan struct{}) {
+	for {
+		select {
+		case matcher := <-self.addFilterMatcher:
+			self.fMatchers = addMatcher(self.fMatchers, self.fIndex, matcher)
+		case matcher := <-self.addOutputMatcher:
+			self.oMatchers = addMatcher(self.oMatchers, self.oIndex, matcher)
+		case matcher := <-self.removeFilterMatcher:
+			removeMatcher(self.fMatchers, self.fIndex, matcher)
+		case matcher := <-self.removeOutputMatcher:
+			removeMatcher(self.oMatchers, self.oIndex, matcher)
+		case <-release:
+			return
+		}
+	}
+}
+
+// Adds the packs waiting on the input channels to the batch of packs already
+// received, waiting up to batchLinger for more of them. The slices of packs
+// injected by the decoders are added whole, so a batch can go over batchSize
+// by less than one of them. Returns false if the input channel has been
+// closed.
+func (self *messageRouter) collectBatch(batch []*PipelinePack) ([]*PipelinePack, bool) {
+	var linger <-chan time.Time
+	if self.batchLinger > 0 {
+		timer := time.NewTimer(self.batchLinger)
+		defer timer.Stop()
+		linger = timer.C
+	}
+	var (
+		pack  *PipelinePack
+		packs []*PipelinePack
+		ok    bool
+	)
+	for len(batch) < self.batchSize {
+		if linger == nil {
+			select {
+			case pack, ok = <-self.inChan:
+				if !ok {
+					return batch, false
+				}
+				batch = append(batch, pack)
+			case packs = <-self.batchInChan:
+				batch = append(batch, packs...)
+			default:
+				return batch, true
+			}
+		} else {
+			select {
+			case pack, ok = <-self.inChan:
+				if !ok {
+					return batch, false
+				}
+				batch = append(batch, pack)
+			case packs = <-self.batchInChan:
+				batch = append(batch, packs...)
+			case <-linger:
+				return batch, true
+			}
+		}
+	}
+	return batch, true
+}
+
+// Sends each matcher the packs of the batch it's a candidate for in a single
+// slice, which is handed over to the matcher. The router's reference to the
+// packs is released once they have all been delivered.
+func (self *messageRouter) routeBatch(batch []*PipelinePack) {
+	atomic.AddInt64(&self.processMessageCount, int64(len(batch)))
+	self.fPending = growPending(self.fPending, len(self.fMatchers))
+	self.oPending = growPending(self.oPending, len(self.oMatchers))
+	for _, pack := range batch {
+		pack.diagnostics.Reset()
+		self.candidates = self.fIndex.Candidates(pack.Message, self.candidates[:0])
+		for _, i := range self.candidates {
+			atomic.AddInt32(&pack.RefCount, 1)
+			self.fPending[i] = appendPending(self.fPending[i], pack, len(batch))
+		}
+		self.candidates = self.oIndex.Candidates(pack.Message, self.candidates[:0])
+		for _, i := range self.candidates {
+			atomic.AddInt32(&pack.RefCount, 1)
+			self.oPending[i] = appendPending(self.oPending[i], pack, len(batch))
+		}
+	}
+	sendPending(self.fMatchers, self.fPending)
+	sendPending(self.oMatchers, self.oPending)
+	for _, pack := range batch {
+		pack.recycle()
+	}
+}
+
+func growPending(pending [][]*PipelinePack, n int) [][]*PipelinePack {
+	for len(pending) < n {
+		pending = append(pending, nil)
+	}
+	return pending
+}
+
+func appendPending(packs []*PipelinePack, pack *PipelinePack,
+	batchLen int) []*PipelinePack {
+
+	if packs == nil {
+		packs = make([]*PipelinePack, 0, batchLen)
+	}
+	return append(packs, pack)
+}
+
+// Hands the pending packs over to their matchers.
+func sendPending(matchers []*MatchRunner, pending [][]*PipelinePack) {
+	for i, packs := range pending {
+		if len(packs) != 0 {
+			matchers[i].sendBatch(packs)
+			pending[i] = nil
+		}
+	}
+}
+
+// Adds the matcher to the slot of a removed one, or to the end of the
+// matchers, unless it's already there, and indexes it by its position.
+func addMatcher(matchers []*MatchRunner, index *message.MatcherIndex,
+	matcher *MatchRunner) []*MatchRunner {
+
+	if matcher == nil {
+		return matchers
+	}
+	available := -1
+	for i, m := range matchers {
+		if m == nil {
+			available = i
+		}
+		if matcher == m {
+			return matchers
+		}
+	}
+	if available == -1 {
+		available = len(matchers)
+		matchers = append(matchers, nil)
+	}
+	matchers[available] = matcher
+	index.Add(available, matcher.spec)
+	return matchers
+}
+
+// Closes the matcher and frees its slot, if it's one of the matchers.
+func removeMatcher(matchers []*MatchRunner, index *message.MatcherIndex,
+	matcher *MatchRunner) {
+
+	if matcher == nil {
+		return
+	}
+	for i, m := range matchers {
+		if matcher == m {
+			m.Close()
+			matchers[i] = nil
+			index.Remove(i)
+			return
+		}
+	}
+}
+
 // Encapsulates the mechanics of testing messages against a specific plugin's
 // message_matcher value.
 type MatchRunner struct {
 	closing       int32
 	matchSamples  int64
 	matchDuration int64
+	batched       int64
 	spec          *message.MatcherSpecification
 	signer        string
 	inChan        chan *PipelinePack
@@ -225,6 +428,10 @@ type MatchRunner struct {
 	bufFeeder     *BufferFeeder
 	globals       *GlobalConfigStruct
 	retry         *RetryHelper
+	// Used instead of inChan when the router delivers batches, the matched
+	// packs are sent on batchOut if the plugin processes batches.
+	batchChan chan []*PipelinePack
+	batchOut  chan []*PipelinePack
 }
 
 // Creates and returns a new MatchRunner if possible, or a relevant error if
@@ -260,12 +467,34 @@ func (mr *MatchRunner) MatcherSpecification() *message.MatcherSpecification {
 
 // Returns the Matcher InChan length for backpresure detection and reporting
 func (mr *MatchRunner) InChanLen() int {
-	return len(mr.inChan)
+	return len(mr.inChan) + int(atomic.LoadInt64(&mr.batched))
 }
 
 func (mr *MatchRunner) Close() {
 	atomic.StoreInt32(&mr.closing, 1)
 	close(mr.inChan)
+	if mr.batchChan != nil {
+		close(mr.batchChan)
+	}
+}
+
+// Switches the runner over to receiving batches of packs from the router,
+// queueing about as many packs as its input channel would. Has to be called
+// before the runner is started.
+func (mr *MatchRunner) enableBatching(batchSize int) {
+	if mr.batchChan != nil {
+		return
+	}
+	size := (cap(mr.inChan) + batchSize - 1) / batchSize
+	if size < 1 {
+		size = 1
+	}
+	mr.batchChan = make(chan []*PipelinePack, size)
+}
+
+func (mr *MatchRunner) sendBatch(packs []*PipelinePack) {
+	atomic.AddInt64(&mr.batched, int64(len(packs)))
+	mr.batchChan <- packs
 }
 
 // Returns the runner's average match duration in nanoseconds
@@ -305,10 +534,9 @@ func (mr *MatchRunner) run(sampleDenom int) {
 	)
 
 	var capacity int64 = int64(cap(mr.inChan))
-	for pack := range mr.inChan {
+	matches := func(pack *PipelinePack) bool {
 		if len(mr.signer) != 0 && mr.signer != pack.Signer {
-			pack.recycle()
-			continue
+			return false
 		}
 		// We may want to keep separate samples for match/nomatch conditions.
 		// In most cases the random sampling will capture the most common
@@ -333,21 +561,86 @@ func (mr *MatchRunner) run(sampleDenom int) {
 			match = mr.spec.Match(pack.Message)
 			counter++
 		}
+		return match
+	}
+	deliver := func(pack *PipelinePack) {
+		if err := mr.deliver(pack); err != nil {
+			mr.pluginRunner.LogError(fmt.Errorf("can't deliver matched message: %s",
+				err))
+		}
+	}
 
-		if match {
-			pack.diagnostics.AddStamp(mr.pluginRunner)
-			err := mr.deliver(pack)
-			if err != nil {
-				mr.pluginRunner.LogError(fmt.Errorf("can't deliver matched message: %s",
-					err))
+	if mr.batchChan != nil {
+		for packs := range mr.batchChan {
+			atomic.AddInt64(&mr.batched, -int64(len(packs)))
+			// The matched packs are moved to the front of the batch we own.
+			matched := packs[:0]
+			for _, pack := range packs {
+				if matches(pack) {
+					pack.diagnostics.AddStamp(mr.pluginRunner)
+					matched = append(matched, pack)
+				} else {
+					pack.recycle()
+				}
+			}
+			if len(matched) == 0 {
+				continue
+			}
+			if mr.batchOut != nil {
+				mr.batchOut <- matched
+				continue
+			}
+			if mr.bufFeeder != nil {
+				// The whole batch is synced at once.
+				mr.bufFeeder.BeginCommit()
 			}
+			for _, pack := range matched {
+				deliver(pack)
+			}
+			if mr.bufFeeder != nil {
+				if err := mr.bufFeeder.Commit(); err != nil {
+					mr.pluginRunner.LogError(fmt.Errorf("can't sync queued messages: %s", err))
+				}
+			}
+		}
+	}
+	handle := func(pack *PipelinePack) {
+		if matches(pack) {
+			pack.diagnostics.AddStamp(mr.pluginRunner)
+			deliver(pack)
 		} else {
 			pack.recycle()
 		}
 	}
+	for pack := range mr.inChan {
+		if mr.bufFeeder == nil {
+			handle(pack)
+			continue
+		}
+		// The packs already waiting are queued along with this one and synced
+		// at once.
+		mr.bufFeeder.BeginCommit()
+		handle(pack)
+		for n := len(mr.inChan); n > 0; n-- {
+			if pack, ok := <-mr.inChan; ok {
+				handle(pack)
+			}
+		}
+		if err := mr.bufFeeder.Commit(); err != nil {
+			mr.pluginRunner.LogError(fmt.Errorf("can't sync queued messages: %s", err))
+		}
+	}
+	if mr.bufFeeder != nil {
+		if err := mr.bufFeeder.Close(); err != nil {
+			mr.pluginRunner.LogError(fmt.Errorf("can't write queued messages: %s", err))
+		}
+	}
 	if mr.matchChan != nil {
 		close(mr.matchChan)
 	}
+	if mr.batchOut != nil {
+		close(mr.batchOut)
+	}
 	if mr.stopChan != nil {
 		close(mr.stopChan)
 	}
@@ -381,6 +674,11 @@ func (mr *MatchRunner) deliver(pack *PipelinePack) error {
 				}
 				mr.retry.Reset()
 			case "drop":
+			case "drop_oldest":
+				err = mr.bufFeeder.DropOldest(uint64(len(pack.MsgBytes)))
+				if err == nil {
+					err = mr.bufFeeder.QueueRecord(pack)
+				}
 			}
 		}
 		pack.recycle()
@@ -0,0 +1,306 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"heka/message"
+	ts "heka/pipeline/testsupport"
+)
+
+// Output processing the messages in batches, recording the payloads of each
+// batch and returning the queued errors in turn.
+type BatchTestOutput struct {
+	batches [][]string
+	errs    []error
+	// Called with the number of batches processed so far.
+	onBatch func(n int)
+}
+
+func (o *BatchTestOutput) Init(config interface{}) error {
+	return nil
+}
+
+func (o *BatchTestOutput) Prepare(or OutputRunner, h PluginHelper) error {
+	return nil
+}
+
+func (o *BatchTestOutput) ProcessMessage(pack *PipelinePack) error {
+	return o.ProcessMessages([]*PipelinePack{pack})
+}
+
+func (o *BatchTestOutput) ProcessMessages(packs []*PipelinePack) error {
+	payloads := make([]string, len(packs))
+	for i, pack := range packs {
+		payloads[i] = pack.Message.GetPayload()
+	}
+	o.batches = append(o.batches, payloads)
+	if o.onBatch != nil {
+		o.onBatch(len(o.batches))
+	}
+	if len(o.errs) == 0 {
+		return nil
+	}
+	err := o.errs[0]
+	o.errs = o.errs[1:]
+	return err
+}
+
+func (o *BatchTestOutput) CleanUp() {}
+
+func RouterSpec(c gs.Context) {
+	recycleChan := make(chan *PipelinePack, 10)
+	newPack := func(typ, payload string) *PipelinePack {
+		pack := NewPipelinePack(recycleChan)
+		pack.Message = ts.GetTestMessage()
+		pack.Message.SetType(typ)
+		pack.Message.SetPayload(payload)
+		return pack
+	}
+	payloads := func(packs []*PipelinePack) []string {
+		p := make([]string, len(packs))
+		for i, pack := range packs {
+			p[i] = pack.Message.GetPayload()
+		}
+		return p
+	}
+	newMatcher := func(matcher string, batchSize int) *MatchRunner {
+		mr, err := NewMatchRunner(matcher, "", nil, 10, nil)
+		c.Assume(err, gs.IsNil)
+		if batchSize > 1 {
+			mr.enableBatching(batchSize)
+		}
+		return mr
+	}
+
+	c.Specify("A batching router", func() {
+		router := NewMessageRouter(10, make(chan struct{}))
+		router.batchSize = 4
+		a1, b, a2 := newPack("a", "a1"), newPack("b", "b"), newPack("a", "a2")
+
+		c.Specify("sends each matcher the packs of a batch it matches", func() {
+			mrA := newMatcher("Type == 'a'", router.batchSize)
+			mrAll := newMatcher("TRUE", router.batchSize)
+			router.fMatcherMap["a"] = mrA
+			router.oMatcherMap["all"] = mrAll
+			router.initMatchSlices()
+
+			router.routeBatch([]*PipelinePack{a1, b, a2})
+			c.Expect(mrA.InChanLen(), gs.Equals, 2)
+			c.Expect(fmt.Sprint(payloads(<-mrA.batchChan)), gs.Equals, "[a1 a2]")
+			c.Expect(fmt.Sprint(payloads(<-mrAll.batchChan)), gs.Equals, "[a1 b a2]")
+			// The router released its own reference.
+			c.Expect(a1.RefCount, gs.Equals, int32(2))
+			c.Expect(b.RefCount, gs.Equals, int32(1))
+			c.Expect(a2.RefCount, gs.Equals, int32(2))
+			c.Expect(len(recycleChan), gs.Equals, 0)
+			for _, pending := range append(router.fPending, router.oPending...) {
+				c.Expect(len(pending), gs.Equals, 0)
+			}
+		})
+
+		c.Specify("gathers the injected packs and batches into one batch", func() {
+			mr := newMatcher("TRUE", router.batchSize)
+			router.fMatcherMap["all"] = mr
+			router.initMatchSlices()
+
+			router.inChan <- a1
+			c.Expect(router.injectBatch([]*PipelinePack{b, a2}), gs.IsNil)
+			router.Start()
+			packs := <-mr.batchChan
+			c.Expect(len(packs), gs.Equals, 3)
+			close(router.inChan)
+		})
+
+		c.Specify("is handed the packs of a decoder in batches", func() {
+			dr := &dRunner{router: router}
+			batch := dr.newBatch()
+			for _, pack := range []*PipelinePack{a1, b, a2, newPack("b", "b2"),
+				newPack("a", "a3")} {
+				c.Expect(batch.add(pack), gs.IsNil)
+			}
+			c.Expect(fmt.Sprint(payloads(<-router.batchInChan)), gs.Equals, "[a1 b a2 b2]")
+			c.Expect(len(router.batchInChan), gs.Equals, 0)
+			c.Expect(batch.flush(), gs.IsNil)
+			c.Expect(fmt.Sprint(payloads(<-router.batchInChan)), gs.Equals, "[a3]")
+			c.Expect(batch.flush(), gs.IsNil)
+			c.Expect(len(router.batchInChan), gs.Equals, 0)
+		})
+
+		c.Specify("only sends the pending packs to their matchers", func() {
+			mr := newMatcher("TRUE", router.batchSize)
+			matchers := []*MatchRunner{nil, mr}
+			pending := [][]*PipelinePack{nil, {a1, a2}}
+			sendPending(matchers, pending)
+			c.Expect(fmt.Sprint(payloads(<-mr.batchChan)), gs.Equals, "[a1 a2]")
+			c.Expect(len(pending[1]), gs.Equals, 0)
+		})
+	})
+
+	c.Specify("A router that doesn't batch routes the injected batches", func() {
+		router := NewMessageRouter(10, make(chan struct{}))
+		mr := newMatcher("TRUE", 0)
+		router.fMatcherMap["all"] = mr
+		router.initMatchSlices()
+		router.Start()
+		c.Expect(router.injectBatch([]*PipelinePack{newPack("a", "1"),
+			newPack("b", "2")}), gs.IsNil)
+		c.Expect((<-mr.inChan).Message.GetPayload(), gs.Equals, "1")
+		c.Expect((<-mr.inChan).Message.GetPayload(), gs.Equals, "2")
+		c.Expect(len(recycleChan), gs.Equals, 0)
+		close(router.inChan)
+	})
+
+	c.Specify("A batch-aware output", func() {
+		pConfig := NewPipelineConfig(nil)
+		output := new(BatchTestOutput)
+		runner, err := NewFORunner("BatchOutput", output,
+			CommonFOConfig{Matcher: "Type == 'a'"}, "BatchTestOutput", 1)
+		c.Assume(err, gs.IsNil)
+		runner.pConfig = pConfig
+		runner.batchChan = make(chan []*PipelinePack, 1)
+		packs := []*PipelinePack{newPack("a", "a1"), newPack("a", "a2"),
+			newPack("a", "a3")}
+		process := func() {
+			runner.batchChan <- packs
+			close(runner.batchChan)
+			c.Expect(runner.batchLoop(output, nil, nil), gs.IsNil)
+		}
+
+		c.Specify("recycles the batch once it's processed", func() {
+			process()
+			c.Expect(fmt.Sprint(output.batches), gs.Equals, "[[a1 a2 a3]]")
+			c.Expect(len(recycleChan), gs.Equals, 3)
+		})
+
+		c.Specify("retries the whole batch", func() {
+			output.errs = []error{NewRetryMessageError("busy")}
+			process()
+			c.Expect(len(output.batches), gs.Equals, 2)
+			c.Expect(fmt.Sprint(output.batches[1]), gs.Equals, "[a1 a2 a3]")
+			c.Expect(len(recycleChan), gs.Equals, 3)
+			for i := 0; i < 3; i++ {
+				pack := <-recycleChan
+				c.Expect(pack.RefCount, gs.Equals, int32(1))
+			}
+		})
+
+		c.Specify("drops the batch it's retrying when shutting down", func() {
+			output.errs = []error{NewRetryMessageError("busy"),
+				NewRetryMessageError("busy"), NewRetryMessageError("busy")}
+			output.onBatch = func(n int) {
+				if n == 2 {
+					pConfig.Globals.stop()
+				}
+			}
+			process()
+			c.Expect(len(output.batches), gs.Equals, 2)
+			c.Expect(len(recycleChan), gs.Equals, 3)
+		})
+
+		c.Specify("is handed the matched packs of a batch by its matcher", func() {
+			mr := newMatcher("Type == 'a'", 4)
+			mr.pluginRunner = runner
+			mr.batchOut = runner.batchChan
+			mr.Start(1)
+			mr.sendBatch([]*PipelinePack{newPack("a", "a1"), newPack("b", "b"),
+				newPack("a", "a2")})
+			mr.Close()
+			c.Expect(runner.batchLoop(output, nil, nil), gs.IsNil)
+			c.Expect(fmt.Sprint(output.batches), gs.Equals, "[[a1 a2]]")
+			c.Expect(len(recycleChan), gs.Equals, 3)
+			c.Expect(mr.InChanLen(), gs.Equals, 0)
+		})
+	})
+}
+
+// Matcher expressions typical of a large configuration, most of them test the
+// Type.
+func benchmarkMatchers(n int) []string {
+	matchers := make([]string, n)
+	for i := range matchers {
+		switch i % 10 {
+		case 0:
+			matchers[i] = fmt.Sprintf("Logger == 'logger%d'", i)
+		case 1:
+			matchers[i] = fmt.Sprintf("Fields[name] == 'field%d'", i)
+		default:
+			matchers[i] = fmt.Sprintf("Type == 'type%d' && Severity <= 6", i)
+		}
+	}
+	return matchers
+}
+
+// Routes b.N packs through a started router to 150 filter matchers whose
+// input channels are drained by goroutines that, like the MatchRunner,
+// evaluate the matcher and release their reference to the pack. Without the
+// index every matcher is indexed as TRUE so the router sends it every pack.
+func benchmarkRouter(b *testing.B, indexed bool) {
+	chanSize := DefaultGlobals().PluginChanSize
+	router := NewMessageRouter(chanSize, make(chan struct{}))
+	var wg sync.WaitGroup
+	for i, matcher := range benchmarkMatchers(150) {
+		spec, err := message.CreateMatcherSpecification(matcher)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if !indexed {
+			matcher = "TRUE"
+		}
+		mr, err := NewMatchRunner(matcher, "", nil, chanSize, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		router.fMatcherMap[fmt.Sprintf("filter%d", i)] = mr
+		wg.Add(1)
+		go func(inChan chan *PipelinePack) {
+			for pack := range inChan {
+				spec.Match(pack.Message)
+				pack.recycle()
+			}
+			wg.Done()
+		}(mr.inChan)
+	}
+	router.initMatchSlices()
+
+	recycleChan := make(chan *PipelinePack, DefaultGlobals().PoolSize)
+	for i := 0; i < cap(recycleChan); i++ {
+		recycleChan <- NewPipelinePack(recycleChan)
+	}
+	msg := ts.GetTestMessage()
+	msg.SetType("type42")
+
+	router.Start()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pack := <-recycleChan
+		pack.Message = msg
+		router.inChan <- pack
+	}
+	close(router.inChan)
+	wg.Wait()
+}
+
+func BenchmarkRouterFanOut150(b *testing.B) {
+	benchmarkRouter(b, false)
+}
+
+func BenchmarkRouterIndexed150(b *testing.B) {
+	benchmarkRouter(b, true)
+}
@@ -196,6 +196,31 @@ func (o *ElasticSearchOutput) ProcessMessage(pack *PipelinePack) error {
 	return nil
 }
 
+// Indexes a batch of messages handed over by the router (see the hekad
+// max_batch_size setting) synchronously, so the runner can retry a batch that
+// failed or write the batch the cluster rejected to the dead letter queue.
+func (o *ElasticSearchOutput) ProcessMessages(packs []*PipelinePack) error {
+	body := make([]byte, 0, 10000)
+	for _, pack := range packs {
+		outBytes, err := o.or.Encode(pack)
+		if err != nil {
+			return fmt.Errorf("can't encode: %s", err)
+		}
+		body = append(body, outBytes...)
+	}
+
+	err, retry := o.bulkIndexer.Index(body)
+	if err != nil {
+		if retry {
+			return NewRetryMessageError("can't index: %s", err)
+		}
+		atomic.AddInt64(&o.dropMessageCount, int64(len(packs)))
+		return fmt.Errorf("can't index: %s", err)
+	}
+	atomic.AddInt64(&o.sentMessageCount, int64(len(packs)))
+	return nil
+}
+
 func (o *ElasticSearchOutput) batchSender() {
 	ok := true
 	for ok {
@@ -0,0 +1,122 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package elasticsearch
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	. "heka/pipeline"
+	ts "heka/pipeline/testsupport"
+)
+
+func ElasticSearchOutputSpec(c gs.Context) {
+	tmpDir, tmpErr := ioutil.TempDir("", "es-output-tests")
+	c.Assume(tmpErr, gs.IsNil)
+	defer func() {
+		tmpErr = os.RemoveAll(tmpDir)
+		c.Expect(tmpErr, gs.IsNil)
+	}()
+
+	// Rejects every bulk request the way the cluster rejects a document it
+	// can't map.
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": "MapperParsingException[failed to parse [count]]",
+			"status": 400}`)
+	}))
+	defer server.Close()
+
+	configFile := filepath.Join(tmpDir, "hekad.toml")
+	err := ioutil.WriteFile(configFile, []byte(fmt.Sprintf(`
+[ESJsonEncoder]
+
+[es]
+type = "ElasticSearchOutput"
+message_matcher = "TRUE"
+server = "%s"
+encoder = "ESJsonEncoder"
+use_buffering = false
+
+[es.dead_letter]
+`, server.URL)), 0644)
+	c.Assume(err, gs.IsNil)
+
+	globals := DefaultGlobals()
+	globals.BaseDir = tmpDir
+	globals.MaxBatchSize = 10
+	pConfig := NewPipelineConfig(globals)
+	c.Assume(pConfig.PreloadFromConfigFile(configFile), gs.IsNil)
+	c.Assume(pConfig.LoadConfig(), gs.IsNil)
+
+	c.Specify("An ElasticSearchOutput handed batches", func() {
+		// The router isn't started by the config, hekad starts it.
+		pConfig.Router().(interface {
+			Start()
+		}).Start()
+		output := pConfig.OutputRunners["es"]
+		c.Assume(pConfig.AddOutputRunner(output), gs.IsNil)
+
+		c.Specify("writes the batch the cluster rejects to the dead letter queue", func() {
+			for _, payload := range []string{"first", "second"} {
+				pack := NewPipelinePack(pConfig.InjectRecycleChan())
+				pack.Message = ts.GetTestMessage()
+				pack.Message.SetPayload(payload)
+				pConfig.Router().InChan() <- pack
+			}
+
+			var payloads []string
+			queue := filepath.Join(tmpDir, "dead_letter", "es")
+			for deadline := time.Now().Add(5 * time.Second); len(payloads) < 2 &&
+				time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+
+				reader, err := OpenQueue(queue)
+				if err != nil {
+					continue
+				}
+				payloads = payloads[:0]
+				for {
+					pack := NewPipelinePack(nil)
+					if reader.NextRecord(pack) != nil {
+						break
+					}
+					payloads = append(payloads, pack.Message.GetPayload())
+					reason, _ := pack.Message.GetFieldValue(DeadLetterErrorField)
+					c.Expect(strings.HasPrefix(reason.(string),
+						"can't index: HTTP response error. Status: 400"), gs.IsTrue)
+				}
+				reader.Close()
+			}
+			c.Expect(fmt.Sprint(payloads), gs.Equals, "[first second]")
+			// Rejected, the batch wasn't retried.
+			c.Expect(atomic.LoadInt32(&requests) >= 1, gs.IsTrue)
+			c.Expect(atomic.LoadInt32(&requests) <= 2, gs.IsTrue)
+		})
+
+		pConfig.RemoveOutputRunner(output)
+	})
+}
@@ -35,6 +35,7 @@ func TestAllSpecs(t *testing.T) {
 	r.Parallel = false
 
 	r.AddSpec(ESEncodersSpec)
+	r.AddSpec(ElasticSearchOutputSpec)
 
 	gs.MainGoTest(r, t)
 }
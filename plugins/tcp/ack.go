@@ -0,0 +1,131 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	. "heka/pipeline"
+)
+
+// In ack mode the TcpInput acknowledges the messages it receives by writing
+// ack frames back on the connection: an ACK byte followed by the number of
+// messages delivered on the connection so far, a big endian uint64. The
+// messages are numbered from 1 on each connection, so an ack acknowledges
+// every message up to its sequence number.
+const (
+	ackFrameMarker = 0x06
+	ackFrameSize   = 9
+	// Time allowed to write an ack frame, a sender that doesn't read the
+	// acks can't block the input.
+	ackWriteTimeout = 5 * time.Second
+)
+
+func writeAck(w io.Writer, seq uint64) error {
+	var frame [ackFrameSize]byte
+	frame[0] = ackFrameMarker
+	binary.BigEndian.PutUint64(frame[1:], seq)
+	_, err := w.Write(frame[:])
+	return err
+}
+
+func readAck(r io.Reader) (seq uint64, err error) {
+	var frame [ackFrameSize]byte
+	if _, err = io.ReadFull(r, frame[:]); err != nil {
+		return
+	}
+	if frame[0] != ackFrameMarker {
+		return 0, fmt.Errorf("invalid ack frame marker: %#x", frame[0])
+	}
+	return binary.BigEndian.Uint64(frame[1:]), nil
+}
+
+// Deliverer counting the messages of a connection delivered to the pipeline
+// and acknowledging them to the sender. The input decodes synchronously in ack
+// mode, so a message has been handed to the router once Deliver returns. Acks
+// are written by a separate goroutine, messages delivered while an ack is
+// written are acknowledged together by the next one.
+type ackDeliverer struct {
+	Deliverer
+	conn      net.Conn
+	delivered uint64
+	ready     chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func newAckDeliverer(deliverer Deliverer, conn net.Conn) *ackDeliverer {
+	return &ackDeliverer{
+		Deliverer: deliverer,
+		conn:      conn,
+		ready:     make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+func (a *ackDeliverer) Deliver(pack *PipelinePack) {
+	a.Deliverer.Deliver(pack)
+	atomic.AddUint64(&a.delivered, 1)
+	select {
+	case a.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (a *ackDeliverer) DeliverFunc() DeliverFunc {
+	return a.Deliver
+}
+
+// Writes the acks until Stop is called or an ack can't be written.
+func (a *ackDeliverer) run() {
+	defer close(a.done)
+	var acked uint64
+	ack := func() error {
+		seq := atomic.LoadUint64(&a.delivered)
+		if seq == acked {
+			return nil
+		}
+		a.conn.SetWriteDeadline(time.Now().Add(ackWriteTimeout))
+		if err := writeAck(a.conn, seq); err != nil {
+			return err
+		}
+		acked = seq
+		return nil
+	}
+	for {
+		select {
+		case <-a.ready:
+			if ack() != nil {
+				return
+			}
+		case <-a.stop:
+			ack()
+			return
+		}
+	}
+}
+
+// Acknowledges the messages delivered since the last ack and stops the ack
+// goroutine.
+func (a *ackDeliverer) Stop() {
+	close(a.stop)
+	<-a.done
+}
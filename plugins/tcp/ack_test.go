@@ -0,0 +1,334 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tcp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"heka/client"
+	. "heka/pipeline"
+	pipeline_ts "heka/pipeline/testsupport"
+	"heka/pipelinemock"
+	plugins_ts "heka/plugins/testsupport"
+)
+
+func AckSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := NewPipelineConfig(nil)
+
+	msgBytes, err := proto.Marshal(pipeline_ts.GetTestMessage())
+	c.Assume(err, gs.IsNil)
+	var framed []byte
+	client.CreateHekaStream(msgBytes, &framed, nil)
+
+	// Reads n frames from the connection.
+	readFrames := func(conn net.Conn, n int) error {
+		buf := make([]byte, len(framed))
+		for i := 0; i < n; i++ {
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				return err
+			}
+			if !bytes.Equal(buf, framed) {
+				return io.ErrUnexpectedEOF
+			}
+		}
+		return nil
+	}
+
+	// Starts a TcpInput whose splitter delivers a pack for every frame read.
+	startInput := func(tcpInput *TcpInput, ith *plugins_ts.InputTestHelper,
+		frameLen int, errChan chan error, srDoneWG *sync.WaitGroup) {
+
+		srDoneWG.Add(1)
+		ith.MockInputRunner.EXPECT().NewDeliverer(gomock.Any()).Return(ith.MockDeliverer)
+		ith.MockDeliverer.EXPECT().Done()
+		ith.MockInputRunner.EXPECT().NewSplitterRunner(gomock.Any()).Return(
+			ith.MockSplitterRunner)
+		ith.MockSplitterRunner.EXPECT().UseMsgBytes().Return(true)
+		ith.MockSplitterRunner.EXPECT().Done().Do(func() {
+			srDoneWG.Done()
+		})
+		splitCall := ith.MockSplitterRunner.EXPECT().SplitStream(gomock.Any(),
+			gomock.Any()).AnyTimes()
+		splitCall.Do(func(conn net.Conn, del Deliverer) {
+			buf := make([]byte, frameLen)
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				splitCall.Return(err)
+				return
+			}
+			del.Deliver(ith.Pack)
+		})
+		errChan <- tcpInput.Run(ith.MockInputRunner, ith.MockHelper)
+	}
+
+	newInputHelper := func() *plugins_ts.InputTestHelper {
+		ith := new(plugins_ts.InputTestHelper)
+		ith.Pack = NewPipelinePack(pConfig.InputRecycleChan())
+		ith.MockHelper = pipelinemock.NewMockPluginHelper(ctrl)
+		ith.MockInputRunner = pipelinemock.NewMockInputRunner(ctrl)
+		ith.MockDeliverer = pipelinemock.NewMockDeliverer(ctrl)
+		ith.MockSplitterRunner = pipelinemock.NewMockSplitterRunner(ctrl)
+		return ith
+	}
+
+	// Returns a TcpOutput in ack mode sending to address, whose cursor
+	// updates are sent to the cursors channel.
+	newOutput := func(address string, cursors chan string) (*TcpOutput,
+		*plugins_ts.OutputTestHelper) {
+
+		tcpOutput := new(TcpOutput)
+		tcpOutput.SetName("test")
+		config := tcpOutput.ConfigStruct().(*TcpOutputConfig)
+		config.Address = address
+		config.UseAck = true
+		useFraming := false
+		config.UseFraming = &useFraming
+		err := tcpOutput.Init(config)
+		c.Assume(err, gs.IsNil)
+
+		oth := plugins_ts.NewOutputTestHelper(ctrl)
+		oth.MockHelper.EXPECT().PipelineConfig().Return(pConfig)
+		err = tcpOutput.Prepare(oth.MockOutputRunner, oth.MockHelper)
+		c.Assume(err, gs.IsNil)
+		oth.MockOutputRunner.EXPECT().Encode(gomock.Any()).Return(framed, nil).AnyTimes()
+		oth.MockOutputRunner.EXPECT().UpdateCursor(gomock.Any()).Do(func(cursor string) {
+			cursors <- cursor
+		}).AnyTimes()
+		return tcpOutput, oth
+	}
+
+	send := func(tcpOutput *TcpOutput, cursor string) error {
+		pack := NewPipelinePack(nil)
+		pack.QueueCursor = cursor
+		return tcpOutput.ProcessMessage(pack)
+	}
+
+	unacked := func(tcpOutput *TcpOutput) int {
+		tcpOutput.ackLock.Lock()
+		defer tcpOutput.ackLock.Unlock()
+		return len(tcpOutput.unacked)
+	}
+
+	c.Specify("ack frames", func() {
+		var buf bytes.Buffer
+		err := writeAck(&buf, 42)
+		c.Expect(err, gs.IsNil)
+		c.Expect(buf.Len(), gs.Equals, ackFrameSize)
+
+		seq, err := readAck(&buf)
+		c.Expect(err, gs.IsNil)
+		c.Expect(seq, gs.Equals, uint64(42))
+
+		_, err = readAck(bytes.NewReader([]byte("not an ack")))
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("a TcpInput in ack mode acknowledges delivered messages", func() {
+		ith := newInputHelper()
+		ith.MockDeliverer.EXPECT().Deliver(ith.Pack).Times(3)
+		tcpInput := new(TcpInput)
+		err := tcpInput.Init(&TcpInputConfig{
+			Net:     "tcp",
+			Address: "localhost:55566",
+			UseAck:  true,
+		})
+		c.Assume(err, gs.IsNil)
+		errChan := make(chan error, 1)
+		var srDoneWG sync.WaitGroup
+		go startInput(tcpInput, ith, 1, errChan, &srDoneWG)
+
+		conn, err := net.Dial("tcp", "localhost:55566")
+		c.Assume(err, gs.IsNil)
+		_, err = conn.Write([]byte("abc"))
+		c.Expect(err, gs.IsNil)
+
+		// Messages delivered together may be acknowledged together.
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var seq uint64
+		for err == nil && seq < 3 {
+			seq, err = readAck(conn)
+		}
+		c.Expect(err, gs.IsNil)
+		c.Expect(seq, gs.Equals, uint64(3))
+		conn.Close()
+
+		tcpInput.Stop()
+		err = <-errChan
+		c.Expect(err, gs.IsNil)
+		srDoneWG.Wait()
+	})
+
+	c.Specify("a TcpInput in ack mode requires synchronous decoding", func() {
+		tcpInput := new(TcpInput)
+		config := tcpInput.ConfigStruct().(*TcpInputConfig)
+		config.Address = "localhost:55566"
+		config.UseAck = true
+		err := tcpInput.Init(config)
+		c.Expect(err, gs.Not(gs.IsNil))
+		c.Expect(err.Error(), gs.Equals, "use_ack requires synchronous_decode to be set")
+
+		config.SyncDecode = true
+		err = tcpInput.Init(config)
+		c.Expect(err, gs.IsNil)
+		tcpInput.listener.Close()
+
+		// Without a decoder the messages go straight to the router.
+		config.SyncDecode = false
+		config.Decoder = ""
+		err = tcpInput.Init(config)
+		c.Expect(err, gs.IsNil)
+		tcpInput.listener.Close()
+	})
+
+	c.Specify("a TcpOutput in ack mode requires buffering", func() {
+		tcpOutput := new(TcpOutput)
+		config := tcpOutput.ConfigStruct().(*TcpOutputConfig)
+		config.UseAck = true
+		useBuffering := false
+		config.UseBuffering = &useBuffering
+		err := tcpOutput.Init(config)
+		c.Expect(err, gs.Not(gs.IsNil))
+		c.Expect(err.Error(), gs.Equals, "use_ack requires use_buffering to be set")
+
+		useBuffering = true
+		err = tcpOutput.Init(config)
+		c.Expect(err, gs.IsNil)
+	})
+
+	c.Specify("a TcpOutput in ack mode", func() {
+		ln, err := net.Listen("tcp", "localhost:55567")
+		c.Assume(err, gs.IsNil)
+		defer ln.Close()
+		accepted := make(chan net.Conn, 1)
+		accept := func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+		cursors := make(chan string, 10)
+		tcpOutput, oth := newOutput("localhost:55567", cursors)
+		defer tcpOutput.CleanUp()
+
+		c.Specify("moves the cursor on acks and resends after a crash", func() {
+			go accept()
+			for _, cursor := range []string{"1", "2", "3"} {
+				err = send(tcpOutput, cursor)
+				c.Expect(err, gs.IsNil)
+			}
+			conn := <-accepted
+			c.Assume(conn, gs.Not(gs.IsNil))
+			err = readFrames(conn, 3)
+			c.Expect(err, gs.IsNil)
+
+			err = writeAck(conn, 2)
+			c.Expect(err, gs.IsNil)
+			c.Expect(<-cursors, gs.Equals, "2")
+			c.Expect(unacked(tcpOutput), gs.Equals, 1)
+
+			// The receiver crashes before acknowledging the last message.
+			tcpOutput.ackLock.Lock()
+			closed := tcpOutput.connClosed
+			tcpOutput.ackLock.Unlock()
+			conn.Close()
+			<-closed
+
+			go accept()
+			err = send(tcpOutput, "4")
+			c.Expect(err, gs.IsNil)
+			conn = <-accepted
+			c.Assume(conn, gs.Not(gs.IsNil))
+			defer conn.Close()
+			// The unacknowledged message comes first, with a new sequence
+			// number.
+			err = readFrames(conn, 2)
+			c.Expect(err, gs.IsNil)
+			c.Expect(atomic.LoadInt64(&tcpOutput.resendMessageCount), gs.Equals, int64(1))
+			c.Expect(len(cursors), gs.Equals, 0)
+
+			err = writeAck(conn, 2)
+			c.Expect(err, gs.IsNil)
+			c.Expect(<-cursors, gs.Equals, "4")
+			c.Expect(unacked(tcpOutput), gs.Equals, 0)
+			c.Expect(atomic.LoadInt64(&tcpOutput.processMessageCount), gs.Equals, int64(4))
+		})
+
+		c.Specify("reconnects when acks don't come", func() {
+			tcpOutput.conf.MaxUnacked = 1
+			tcpOutput.ackTimeout = 50 * time.Millisecond
+			oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+
+			go accept()
+			err = send(tcpOutput, "1")
+			c.Expect(err, gs.IsNil)
+			conn := <-accepted
+			c.Assume(conn, gs.Not(gs.IsNil))
+			defer conn.Close()
+
+			err = send(tcpOutput, "2")
+			_, ok := err.(RetryMessageError)
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(tcpOutput.connection, gs.IsNil)
+			c.Expect(unacked(tcpOutput), gs.Equals, 1)
+			c.Expect(len(cursors), gs.Equals, 0)
+		})
+	})
+
+	c.Specify("a TcpOutput and a TcpInput in ack mode", func() {
+		ith := newInputHelper()
+		ith.MockDeliverer.EXPECT().Deliver(ith.Pack).Times(3)
+		tcpInput := new(TcpInput)
+		err := tcpInput.Init(&TcpInputConfig{
+			Net:     "tcp",
+			Address: "localhost:55568",
+			UseAck:  true,
+		})
+		c.Assume(err, gs.IsNil)
+		errChan := make(chan error, 1)
+		var srDoneWG sync.WaitGroup
+		go startInput(tcpInput, ith, len(framed), errChan, &srDoneWG)
+
+		cursors := make(chan string, 10)
+		tcpOutput, _ := newOutput("localhost:55568", cursors)
+		for _, cursor := range []string{"1", "2", "3"} {
+			err = send(tcpOutput, cursor)
+			c.Expect(err, gs.IsNil)
+		}
+		cursor := <-cursors
+		for cursor != "3" {
+			cursor = <-cursors
+		}
+		c.Expect(unacked(tcpOutput), gs.Equals, 0)
+
+		tcpOutput.CleanUp()
+		tcpInput.Stop()
+		err = <-errChan
+		c.Expect(err, gs.IsNil)
+		srDoneWG.Wait()
+	})
+}
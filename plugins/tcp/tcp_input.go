@@ -57,6 +57,13 @@ type TcpInputConfig struct {
 	Decoder string
 	// So we can default to using HekaFramingSplitter.
 	Splitter string
+	// Set to true to acknowledge the messages received once they've been
+	// delivered to the pipeline, for a TcpOutput with use_ack set.
+	UseAck bool `toml:"use_ack"`
+	// Has to be set along with use_ack when there's a decoder, a message is
+	// only handed to the router by the time Deliver returns if it's decoded
+	// synchronously.
+	SyncDecode bool `toml:"synchronous_decode"`
 }
 
 func (t *TcpInput) ConfigStruct() interface{} {
@@ -72,6 +79,9 @@ func (t *TcpInput) ConfigStruct() interface{} {
 func (t *TcpInput) Init(config interface{}) error {
 	var err error
 	t.config = config.(*TcpInputConfig)
+	if t.config.UseAck && t.config.Decoder != "" && !t.config.SyncDecode {
+		return errors.New("use_ack requires synchronous_decode to be set")
+	}
 	address, err := net.ResolveTCPAddr(t.config.Net, t.config.Address)
 	if err != nil {
 		return fmt.Errorf("ResolveTCPAddress failed: %s\n", err.Error())
@@ -123,7 +133,20 @@ func (t *TcpInput) handleConnection(conn net.Conn) {
 	deliverer := t.ir.NewDeliverer(host)
 	sr := t.ir.NewSplitterRunner(host)
 
+	var (
+		del    Deliverer = deliverer
+		ackDel *ackDeliverer
+	)
+	if t.config.UseAck {
+		ackDel = newAckDeliverer(deliverer, conn)
+		go ackDel.run()
+		del = ackDel
+	}
+
 	defer func() {
+		if ackDel != nil {
+			ackDel.Stop()
+		}
 		conn.Close()
 		t.wg.Done()
 		deliverer.Done()
@@ -146,7 +169,7 @@ func (t *TcpInput) handleConnection(conn net.Conn) {
 		case <-t.stopChan:
 			stopped = true
 		default:
-			err = sr.SplitStream(conn, deliverer)
+			err = sr.SplitStream(conn, del)
 			if err != nil {
 				if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
 					// keep the connection open, we are just checking to see if
@@ -18,6 +18,7 @@ package tcp
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"regexp"
@@ -33,6 +34,7 @@ import (
 type TcpOutput struct {
 	processMessageCount int64
 	dropMessageCount    int64
+	resendMessageCount  int64
 	keepAliveDuration   time.Duration
 	conf                *TcpOutputConfig
 	address             string
@@ -42,6 +44,24 @@ type TcpOutput struct {
 	reportLock          sync.Mutex
 	or                  OutputRunner
 	pConfig             *PipelineConfig
+	ackTimeout          time.Duration
+	// Ack mode state, guarded by ackLock.
+	ackLock sync.Mutex
+	// Messages sent and not acknowledged yet, oldest first. All of them were
+	// sent on the current connection.
+	unacked []unackedRecord
+	// Sequence number of the last message acknowledged on the current
+	// connection.
+	acked uint64
+	// Closed when the current connection breaks, nil when there's none.
+	connClosed chan struct{}
+	// Signaled when messages are acknowledged.
+	ackSignal chan struct{}
+}
+
+type unackedRecord struct {
+	cursor string
+	record []byte
 }
 
 // ConfigStruct for TcpOutput plugin.
@@ -71,6 +91,16 @@ type TcpOutputConfig struct {
 	// Defaults to true for TcpOutput.
 	UseBuffering *bool `toml:"use_buffering"`
 	Buffering    QueueBufferConfig
+	// Set to true to only move the queue cursor past the messages the
+	// TcpInput acknowledged, resending the unacknowledged ones after
+	// reconnecting. The TcpInput must have use_ack set too.
+	UseAck bool `toml:"use_ack"`
+	// Maximum number of messages sent and not acknowledged yet. Defaults to
+	// 1000.
+	MaxUnacked int `toml:"max_unacked"`
+	// Milliseconds to wait for an ack once max_unacked messages are
+	// outstanding, before reconnecting. Defaults to 30000.
+	AckTimeout uint `toml:"ack_timeout"`
 }
 
 func (t *TcpOutput) ConfigStruct() interface{} {
@@ -86,6 +116,8 @@ func (t *TcpOutput) ConfigStruct() interface{} {
 		Encoder:      "ProtobufEncoder",
 		UseBuffering: &b,
 		Buffering:    queueConfig,
+		MaxUnacked:   1000,
+		AckTimeout:   30000,
 	}
 }
 
@@ -111,6 +143,18 @@ func (t *TcpOutput) Init(config interface{}) (err error) {
 		t.keepAliveDuration = time.Duration(t.conf.KeepAlivePeriod) * time.Second
 	}
 
+	if t.conf.UseAck {
+		if t.conf.UseBuffering != nil && !*t.conf.UseBuffering {
+			// The unacknowledged messages are resent from the buffer.
+			return errors.New("use_ack requires use_buffering to be set")
+		}
+		if t.conf.MaxUnacked < 1 {
+			return errors.New("max_unacked must be at least 1")
+		}
+		t.ackTimeout = time.Duration(t.conf.AckTimeout) * time.Millisecond
+		t.ackSignal = make(chan struct{}, 1)
+	}
+
 	return
 }
 
@@ -134,6 +178,12 @@ func (t *TcpOutput) cleanupConn() {
 		t.connection.Close()
 		t.connection = nil
 	}
+	if t.conf.UseAck {
+		// Acks still read from the closed connection are ignored.
+		t.ackLock.Lock()
+		t.connClosed = nil
+		t.ackLock.Unlock()
+	}
 }
 
 func (t *TcpOutput) CleanUp() {
@@ -141,6 +191,9 @@ func (t *TcpOutput) CleanUp() {
 }
 
 func (t *TcpOutput) ProcessMessage(pack *PipelinePack) (err error) {
+	if t.connection != nil && t.conf.UseAck && t.connBroken() {
+		t.cleanupConn()
+	}
 	if t.connection == nil {
 		if err = t.connect(); err != nil {
 			// Explicitly set t.connection to nil because Go, see
@@ -160,18 +213,42 @@ func (t *TcpOutput) ProcessMessage(pack *PipelinePack) (err error) {
 		return fmt.Errorf("can't encode: %s", err)
 	}
 
+	if t.conf.UseAck {
+		if err = t.waitUnacked(t.conf.MaxUnacked - 1); err != nil {
+			t.cleanupConn()
+			return NewRetryMessageError("waiting for acks from %s: %s", t.address, err)
+		}
+		// The record is added before it's sent, its ack could be read
+		// before Write returns.
+		t.ackLock.Lock()
+		t.unacked = append(t.unacked, unackedRecord{
+			cursor: pack.QueueCursor,
+			record: append([]byte(nil), record...),
+		})
+		t.ackLock.Unlock()
+	}
+
 	if n, err = t.connection.Write(record); err != nil {
+		t.dropUnsent()
 		t.cleanupConn()
 		err = NewRetryMessageError("writing to %s: %s", t.address, err)
 	} else if n != len(record) {
+		t.dropUnsent()
 		t.cleanupConn()
 		err = NewRetryMessageError("truncated output to: %s", t.address)
 	} else {
 		atomic.AddInt64(&t.processMessageCount, 1)
-		t.or.UpdateCursor(pack.QueueCursor)
+		if !t.conf.UseAck {
+			t.or.UpdateCursor(pack.QueueCursor)
+		}
 		if t.conf.ReconnectAfter > 0 &&
 			atomic.LoadInt64(&t.processMessageCount)%t.conf.ReconnectAfter == 0 {
 
+			if t.conf.UseAck {
+				// Don't resend what's still in flight on the next connection
+				// unless it has to be.
+				t.waitUnacked(0)
+			}
 			t.cleanupConn()
 		}
 	}
@@ -179,6 +256,115 @@ func (t *TcpOutput) ProcessMessage(pack *PipelinePack) (err error) {
 	return err
 }
 
+// Removes the record of the message that couldn't be sent, the runner will
+// retry it.
+func (t *TcpOutput) dropUnsent() {
+	if !t.conf.UseAck {
+		return
+	}
+	t.ackLock.Lock()
+	t.unacked = t.unacked[:len(t.unacked)-1]
+	t.ackLock.Unlock()
+}
+
+// Returns true if the current connection was closed by the far end.
+func (t *TcpOutput) connBroken() bool {
+	t.ackLock.Lock()
+	closed := t.connClosed
+	t.ackLock.Unlock()
+	select {
+	case <-closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Waits until no more than limit messages are unacknowledged. Fails if the
+// connection breaks or no ack is received for ack_timeout.
+func (t *TcpOutput) waitUnacked(limit int) error {
+	timeout := time.After(t.ackTimeout)
+	for {
+		t.ackLock.Lock()
+		n := len(t.unacked)
+		closed := t.connClosed
+		t.ackLock.Unlock()
+		if n <= limit {
+			return nil
+		}
+		select {
+		case <-t.ackSignal:
+		case <-closed:
+			return errors.New("connection closed")
+		case <-timeout:
+			err := fmt.Errorf("no ack received in %s for %d messages, is use_ack set on the TcpInput?",
+				t.ackTimeout, n)
+			t.or.LogError(err)
+			return err
+		}
+	}
+}
+
+// Reads the acks sent on a connection, moving the queue cursor past the
+// messages acknowledged, until the connection is closed.
+func (t *TcpOutput) readAcks(conn net.Conn, closed chan struct{}) {
+	defer close(closed)
+	for {
+		seq, err := readAck(conn)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		t.ackLock.Lock()
+		if t.connClosed != closed {
+			// The connection has been replaced.
+			t.ackLock.Unlock()
+			return
+		}
+		n := int(seq - t.acked)
+		if seq < t.acked || n > len(t.unacked) {
+			t.ackLock.Unlock()
+			t.or.LogError(fmt.Errorf("invalid ack %d from %s, %d acked and %d unacked",
+				seq, t.address, t.acked, len(t.unacked)))
+			conn.Close()
+			return
+		}
+		if n > 0 {
+			// Updated under the lock so the cursor never moves backward.
+			t.or.UpdateCursor(t.unacked[n-1].cursor)
+			t.unacked = t.unacked[n:]
+			t.acked = seq
+		}
+		t.ackLock.Unlock()
+		select {
+		case t.ackSignal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Starts reading the acks of a new connection and resends the messages
+// that weren't acknowledged on the previous ones.
+func (t *TcpOutput) resendUnacked() error {
+	closed := make(chan struct{})
+	t.ackLock.Lock()
+	t.acked = 0
+	t.connClosed = closed
+	unacked := make([]unackedRecord, len(t.unacked))
+	copy(unacked, t.unacked)
+	t.ackLock.Unlock()
+
+	go t.readAcks(t.connection, closed)
+
+	for _, u := range unacked {
+		if _, err := t.connection.Write(u.record); err != nil {
+			return fmt.Errorf("resending to %s: %s", t.address, err)
+		}
+		atomic.AddInt64(&t.resendMessageCount, 1)
+	}
+	return nil
+}
+
 func (t *TcpOutput) connect() (err error) {
 	dialer := &net.Dialer{LocalAddr: t.localAddress}
 
@@ -205,6 +391,11 @@ func (t *TcpOutput) connect() (err error) {
 			}
 		}
 	}
+	if err == nil && t.conf.UseAck {
+		if err = t.resendUnacked(); err != nil {
+			t.cleanupConn()
+		}
+	}
 	return
 }
 
@@ -218,6 +409,14 @@ func (t *TcpOutput) ReportMsg(msg *message.Message) error {
 		atomic.LoadInt64(&t.processMessageCount), "count")
 	message.NewInt64Field(msg, "DropMessageCount",
 		atomic.LoadInt64(&t.dropMessageCount), "count")
+	if t.conf.UseAck {
+		t.ackLock.Lock()
+		unacked := len(t.unacked)
+		t.ackLock.Unlock()
+		message.NewIntField(msg, "UnackedMessageCount", unacked, "count")
+		message.NewInt64Field(msg, "ResendMessageCount",
+			atomic.LoadInt64(&t.resendMessageCount), "count")
+	}
 
 	return nil
 }
@@ -0,0 +1,802 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012-2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package lua
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	circularBufferModule = "circular_buffer"
+	columnNameSize       = 15
+	unitLabelSize        = 7
+)
+
+var aggregationMethods = []string{"sum", "min", "max", "none"}
+
+const (
+	aggregationSum = iota
+	aggregationMin
+	aggregationMax
+	aggregationNone
+)
+
+var computeFunctions = []string{"sum", "avg", "sd", "min", "max", "variance"}
+
+var annotationTypes = map[string]string{"info": "I", "alert": "A"}
+
+type columnHeader struct {
+	name        string
+	unit        string
+	aggregation int
+}
+
+type cbufAnnotation struct {
+	time   int64 // seconds
+	column int
+	atype  string
+	text   string
+}
+
+// A time series of rows*columns values, each row covering secondsPerRow. The
+// buffer advances when a value newer than the current row is added, the
+// oldest rows are discarded. Values start out as NaN (no data).
+type circularBuffer struct {
+	rows          int
+	columns       int
+	secondsPerRow int64
+	currentTime   int64 // start of the current row in seconds
+	currentRow    int
+	values        []float64
+	headers       []columnHeader
+	delta         map[int64][]float64 // changes since the last cbufd output
+	deltaEnabled  bool
+	format        string
+	annotations   []cbufAnnotation
+}
+
+func newCircularBuffer(rows, columns int, secondsPerRow int64, delta bool) *circularBuffer {
+	cb := &circularBuffer{
+		rows:          rows,
+		columns:       columns,
+		secondsPerRow: secondsPerRow,
+		currentTime:   secondsPerRow * int64(rows-1),
+		currentRow:    rows - 1,
+		values:        make([]float64, rows*columns),
+		headers:       make([]columnHeader, columns),
+		deltaEnabled:  delta,
+		format:        "cbuf",
+	}
+	for i := range cb.values {
+		cb.values[i] = math.NaN()
+	}
+	for i := range cb.headers {
+		cb.headers[i] = columnHeader{name: fmt.Sprintf("Column_%d", i+1), unit: "count"}
+	}
+	if delta {
+		cb.delta = make(map[int64][]float64)
+	}
+	return cb
+}
+
+func (this *circularBuffer) startTime() int64 {
+	return this.currentTime - this.secondsPerRow*int64(this.rows-1)
+}
+
+func (this *circularBuffer) clearRow(row int) {
+	for c := 0; c < this.columns; c++ {
+		this.values[row*this.columns+c] = math.NaN()
+	}
+}
+
+// Returns the row holding the time ns or -1 if it is outside of the buffer.
+// When advance is set a time newer than the current row moves the buffer
+// forward, clearing the rows it wraps over.
+func (this *circularBuffer) row(ns int64, advance bool) int {
+	t := ns / 1e9
+	t -= t % this.secondsPerRow
+	if advance && t > this.currentTime {
+		n := (t - this.currentTime) / this.secondsPerRow
+		clear := n
+		if clear > int64(this.rows) {
+			clear = int64(this.rows)
+		}
+		for i := int64(1); i <= clear; i++ {
+			this.clearRow((this.currentRow + int(i)) % this.rows)
+		}
+		this.currentRow = int((int64(this.currentRow) + n) % int64(this.rows))
+		this.currentTime = t
+		this.pruneAnnotations()
+	}
+	if t > this.currentTime || t < this.startTime() {
+		return -1
+	}
+	back := int((this.currentTime - t) / this.secondsPerRow)
+	return (this.currentRow - back + this.rows) % this.rows
+}
+
+func (this *circularBuffer) pruneAnnotations() {
+	start := this.startTime()
+	kept := this.annotations[:0]
+	for _, a := range this.annotations {
+		if a.time >= start {
+			kept = append(kept, a)
+		}
+	}
+	this.annotations = kept
+}
+
+// Records a change for the cbufd output, sum columns accumulate the
+// difference and the other aggregations keep the latest value.
+func (this *circularBuffer) recordDelta(ns int64, column int, old, value float64) {
+	if !this.deltaEnabled {
+		return
+	}
+	t := ns / 1e9
+	t -= t % this.secondsPerRow
+	d, ok := this.delta[t]
+	if !ok {
+		d = make([]float64, this.columns)
+		for i := range d {
+			d[i] = math.NaN()
+		}
+		this.delta[t] = d
+	}
+	if this.headers[column].aggregation == aggregationSum {
+		if math.IsNaN(old) {
+			old = 0
+		}
+		if math.IsNaN(d[column]) {
+			d[column] = 0
+		}
+		d[column] += value - old
+	} else {
+		d[column] = value
+	}
+}
+
+func (this *circularBuffer) add(ns int64, column int, value float64) (float64, bool) {
+	row := this.row(ns, true)
+	if row == -1 {
+		return 0, false
+	}
+	i := row*this.columns + column
+	old := this.values[i]
+	if math.IsNaN(old) {
+		this.values[i] = value
+	} else {
+		this.values[i] += value
+	}
+	this.recordDelta(ns, column, old, this.values[i])
+	return this.values[i], true
+}
+
+// Overwrites a value, min and max columns only keep the new value if it is
+// smaller or larger respectively.
+func (this *circularBuffer) set(ns int64, column int, value float64) (float64, bool) {
+	row := this.row(ns, true)
+	if row == -1 {
+		return 0, false
+	}
+	i := row*this.columns + column
+	old := this.values[i]
+	switch this.headers[column].aggregation {
+	case aggregationMin:
+		if !math.IsNaN(old) && !(value < old) {
+			return old, true
+		}
+	case aggregationMax:
+		if !math.IsNaN(old) && !(value > old) {
+			return old, true
+		}
+	}
+	this.values[i] = value
+	this.recordDelta(ns, column, old, value)
+	return value, true
+}
+
+// Returns the values of a column between two times (inclusive), ok is false
+// if either time is outside of the buffer.
+func (this *circularBuffer) rangeValues(column int, start, end int64) (values []float64, ok bool) {
+	sr, er := this.row(start, false), this.row(end, false)
+	if sr == -1 || er == -1 || end < start {
+		return nil, false
+	}
+	for r := sr; ; r = (r + 1) % this.rows {
+		values = append(values, this.values[r*this.columns+column])
+		if r == er {
+			break
+		}
+	}
+	return values, true
+}
+
+func (this *circularBuffer) compute(function string, values []float64) (result float64, count int) {
+	var sum, min, max float64
+	min, max = math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		count++
+		sum += v
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	}
+	if count == 0 {
+		return math.NaN(), 0
+	}
+	switch function {
+	case "sum":
+		return sum, count
+	case "avg":
+		return sum / float64(count), count
+	case "min":
+		return min, count
+	case "max":
+		return max, count
+	}
+	mean := sum / float64(count)
+	var sq float64
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			sq += (v - mean) * (v - mean)
+		}
+	}
+	variance := sq / float64(count)
+	if function == "sd" {
+		return math.Sqrt(variance), count
+	}
+	return variance, count
+}
+
+// Mann-Whitney U test of two samples using the normal approximation with a
+// tie correction. Returns the U statistic of the first sample and the one-sided
+// p-value.
+func mannWhitneyU(x, y []float64, continuity bool) (u, p float64, ok bool) {
+	type sample struct {
+		v     float64
+		first bool
+	}
+	var all []sample
+	for _, v := range x {
+		if !math.IsNaN(v) {
+			all = append(all, sample{v, true})
+		}
+	}
+	n1 := len(all)
+	for _, v := range y {
+		if !math.IsNaN(v) {
+			all = append(all, sample{v, false})
+		}
+	}
+	n2 := len(all) - n1
+	if n1 == 0 || n2 == 0 {
+		return 0, 0, false
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].v < all[j].v })
+
+	var r1, ties float64
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+		rank := float64(i+j+1) / 2 // average of the ranks i+1..j
+		for k := i; k < j; k++ {
+			if all[k].first {
+				r1 += rank
+			}
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+
+	fn1, fn2 := float64(n1), float64(n2)
+	u1 := r1 - fn1*(fn1+1)/2
+	u2 := fn1*fn2 - u1
+	big := math.Max(u1, u2)
+	n := fn1 + fn2
+	sd := math.Sqrt(fn1 * fn2 / 12 * ((n + 1) - ties/(n*(n-1))))
+	if sd == 0 {
+		return u1, 1, true
+	}
+	diff := big - fn1*fn2/2
+	if continuity {
+		diff -= 0.5
+	}
+	z := math.Abs(diff / sd)
+	return u1, 0.5 * math.Erfc(z/math.Sqrt2), true
+}
+
+// Formats a value for the cbuf outputs, integral values are written without
+// an exponent so counters stay readable.
+func appendCbufValue(buf []byte, v float64) []byte {
+	switch {
+	case math.IsNaN(v):
+		return append(buf, "nan"...)
+	case math.IsInf(v, 1):
+		return append(buf, "inf"...)
+	case math.IsInf(v, -1):
+		return append(buf, "-inf"...)
+	case v == math.Trunc(v) && math.Abs(v) < 1e15:
+		return strconv.AppendInt(buf, int64(v), 10)
+	}
+	return strconv.AppendFloat(buf, v, 'g', -1, 64)
+}
+
+func (this *circularBuffer) appendHeader(buf []byte, annotations bool) []byte {
+	buf = append(buf, `{"time":`...)
+	buf = strconv.AppendInt(buf, this.startTime(), 10)
+	buf = append(buf, `,"rows":`...)
+	buf = strconv.AppendInt(buf, int64(this.rows), 10)
+	buf = append(buf, `,"columns":`...)
+	buf = strconv.AppendInt(buf, int64(this.columns), 10)
+	buf = append(buf, `,"seconds_per_row":`...)
+	buf = strconv.AppendInt(buf, this.secondsPerRow, 10)
+	buf = append(buf, `,"column_info":[`...)
+	for i, h := range this.headers {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, `{"name":`...)
+		buf = strconv.AppendQuote(buf, h.name)
+		buf = append(buf, `,"unit":`...)
+		buf = strconv.AppendQuote(buf, h.unit)
+		buf = append(buf, `,"aggregation":`...)
+		buf = strconv.AppendQuote(buf, aggregationMethods[h.aggregation])
+		buf = append(buf, '}')
+	}
+	buf = append(buf, ']')
+	if annotations && len(this.annotations) > 0 {
+		buf = append(buf, `,"annotations":[`...)
+		for i, a := range this.annotations {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = append(buf, `{"x":`...)
+			buf = strconv.AppendInt(buf, a.time*1000, 10)
+			buf = append(buf, `,"col":`...)
+			buf = strconv.AppendInt(buf, int64(a.column+1), 10)
+			buf = append(buf, `,"shortText":`...)
+			buf = strconv.AppendQuote(buf, annotationTypes[a.atype])
+			buf = append(buf, `,"text":`...)
+			buf = appendJsonString(buf, a.text)
+			buf = append(buf, '}')
+		}
+		buf = append(buf, ']')
+	}
+	return append(buf, "}\n"...)
+}
+
+// Escapes a string as JSON, strconv.AppendQuote cannot be used for arbitrary
+// text as Go escapes are not all valid JSON.
+func appendJsonString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"', '\\':
+			buf = append(buf, '\\', c)
+		case '\n':
+			buf = append(buf, '\\', 'n')
+		case '\r':
+			buf = append(buf, '\\', 'r')
+		case '\t':
+			buf = append(buf, '\\', 't')
+		default:
+			if c < 0x20 {
+				buf = append(buf, fmt.Sprintf("\\u%04x", c)...)
+			} else {
+				buf = append(buf, c)
+			}
+		}
+	}
+	return append(buf, '"')
+}
+
+// Writes the buffer in the format selected by format(), cbuf is the whole
+// buffer oldest row first and cbufd the rows changed since the last cbufd
+// output. Nothing is written when there are no changes.
+func (this *circularBuffer) AppendPayload(buf []byte) []byte {
+	if this.format == "cbufd" {
+		if len(this.delta) == 0 {
+			return buf
+		}
+		buf = this.appendHeader(buf, false)
+		times := make([]int64, 0, len(this.delta))
+		for t := range this.delta {
+			times = append(times, t)
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+		for _, t := range times {
+			buf = strconv.AppendInt(buf, t, 10)
+			for _, v := range this.delta[t] {
+				buf = append(buf, '\t')
+				buf = appendCbufValue(buf, v)
+			}
+			buf = append(buf, '\n')
+		}
+		this.delta = make(map[int64][]float64)
+		return buf
+	}
+
+	buf = this.appendHeader(buf, true)
+	for i := 1; i <= this.rows; i++ {
+		row := (this.currentRow + i) % this.rows
+		for c := 0; c < this.columns; c++ {
+			if c > 0 {
+				buf = append(buf, '\t')
+			}
+			buf = appendCbufValue(buf, this.values[row*this.columns+c])
+		}
+		buf = append(buf, '\n')
+	}
+	return buf
+}
+
+func (this *circularBuffer) MemoryUsage() uint {
+	return uint(8*len(this.values)+48*len(this.headers)+64*len(this.annotations)) +
+		uint(8*this.columns*len(this.delta))
+}
+
+// Writes the statements recreating the buffer. An existing buffer created by
+// the script is reused so restoring fails if its dimensions changed.
+func (this *circularBuffer) Serialize(name string, buf *bytes.Buffer) error {
+	delta := ""
+	if this.deltaEnabled {
+		delta = ", true"
+	}
+	fmt.Fprintf(buf, "if %s == nil then %s = circular_buffer.new(%d, %d, %d%s) end\n",
+		name, name, this.rows, this.columns, this.secondsPerRow, delta)
+	for i, h := range this.headers {
+		fmt.Fprintf(buf, "%s:set_header(%d, %s, %s, %s)\n", name, i+1,
+			quoteString(h.name), quoteString(h.unit),
+			quoteString(aggregationMethods[h.aggregation]))
+	}
+	fmt.Fprintf(buf, "%s:fromstring(\"%d %d", name, this.currentTime, this.currentRow)
+	var b []byte
+	for _, v := range this.values {
+		b = append(b[:0], ' ')
+		buf.Write(appendCbufValue(b, v))
+	}
+	buf.WriteString("\")\n")
+	for _, a := range this.annotations {
+		fmt.Fprintf(buf, "%s:annotate(%d, %d, %s, %s)\n", name, a.time*1e9,
+			a.column+1, quoteString(a.atype), quoteString(a.text))
+	}
+	return nil
+}
+
+// Restores the time, current row and values written by Serialize.
+func (this *circularBuffer) fromString(s string) error {
+	f := strings.Fields(s)
+	if len(f) < 2+len(this.values) {
+		return fmt.Errorf("fromstring() too few values")
+	}
+	if len(f) > 2+len(this.values) {
+		return fmt.Errorf("fromstring() too many values")
+	}
+	t, err := strconv.ParseInt(f[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("fromstring() invalid time")
+	}
+	row, err := strconv.Atoi(f[1])
+	if err != nil || row < 0 || row >= this.rows {
+		return fmt.Errorf("fromstring() invalid row")
+	}
+	values := make([]float64, len(this.values))
+	for i, v := range f[2:] {
+		if values[i], err = strconv.ParseFloat(v, 64); err != nil {
+			return fmt.Errorf("fromstring() invalid value")
+		}
+	}
+	this.currentTime, this.currentRow, this.values = t, row, values
+	return nil
+}
+
+// Replaces characters that cannot be used in a column name or unit label and
+// truncates it to size.
+func sanitizeLabel(s string, size int) string {
+	b := []byte(s)
+	if len(b) > size {
+		b = b[:size]
+	}
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// Loads the circular_buffer module, it is also exposed as a global to match
+// the Lua 5.1 module convention the existing scripts rely on.
+func loadCircularBuffer(L *lua.LState) int {
+	mt := L.NewTypeMetatable(circularBufferModule)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"add":               cbufAdd,
+		"set":               cbufSet,
+		"get":               cbufGet,
+		"get_range":         cbufGetRange,
+		"compute":           cbufCompute,
+		"mannwhitneyu":      cbufMannWhitneyU,
+		"set_header":        cbufSetHeader,
+		"get_header":        cbufGetHeader,
+		"get_configuration": cbufGetConfiguration,
+		"current_time":      cbufCurrentTime,
+		"annotate":          cbufAnnotate,
+		"format":            cbufFormat,
+		"fromstring":        cbufFromString,
+	}))
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{"new": cbufNew})
+	L.SetGlobal(circularBufferModule, mod)
+	L.Push(mod)
+	return 1
+}
+
+// circular_buffer.new(rows, columns, seconds_per_row, enable_delta)
+func cbufNew(L *lua.LState) int {
+	rows := L.CheckInt(1)
+	columns := L.CheckInt(2)
+	spr := L.CheckInt64(3)
+	delta := L.OptBool(4, false)
+	if rows <= 1 {
+		argError(L, 1, "new", "rows must be > 1")
+	}
+	if columns <= 0 {
+		argError(L, 2, "new", "columns must be > 0")
+	}
+	if spr <= 0 {
+		argError(L, 3, "new", "seconds_per_row is out of range")
+	}
+	ud := L.NewUserData()
+	ud.Value = newCircularBuffer(rows, columns, spr, delta)
+	L.SetMetatable(ud, L.GetTypeMetatable(circularBufferModule))
+	L.Push(ud)
+	return 1
+}
+
+func checkCircularBuffer(L *lua.LState) *circularBuffer {
+	ud := L.CheckUserData(1)
+	cb, ok := ud.Value.(*circularBuffer)
+	if !ok {
+		L.ArgError(1, "circular_buffer expected")
+	}
+	return cb
+}
+
+func checkColumn(L *lua.LState, cb *circularBuffer, n int, fname string) int {
+	c := L.CheckInt(n)
+	if c < 1 || c > cb.columns {
+		argError(L, n, fname, "column out of range")
+	}
+	return c - 1
+}
+
+func checkOption(L *lua.LState, n int, fname string, def string, options []string) string {
+	s := L.OptString(n, def)
+	for _, o := range options {
+		if s == o {
+			return s
+		}
+	}
+	argError(L, n, fname, fmt.Sprintf("invalid option '%s'", s))
+	return ""
+}
+
+// Reads the optional start and end time arguments, they default to the
+// whole buffer.
+func checkTimeRange(L *lua.LState, cb *circularBuffer, n int) (start, end int64) {
+	start = L.OptInt64(n, cb.startTime()*1e9)
+	end = L.OptInt64(n+1, cb.currentTime*1e9)
+	return
+}
+
+func pushValue(L *lua.LState, v float64, ok bool) int {
+	if !ok {
+		L.Push(lua.LNil)
+	} else {
+		L.Push(lua.LNumber(v))
+	}
+	return 1
+}
+
+// cb:add(ns, column, value) returns the new value or nil if ns is outside
+// of the buffer.
+func cbufAdd(L *lua.LState) int {
+	cb := checkCircularBuffer(L)
+	ns := L.CheckInt64(2)
+	c := checkColumn(L, cb, 3, "add")
+	v, ok := cb.add(ns, c, float64(L.CheckNumber(4)))
+	return pushValue(L, v, ok)
+}
+
+// cb:set(ns, column, value) returns the stored value or nil if ns is outside
+// of the buffer.
+func cbufSet(L *lua.LState) int {
+	cb := checkCircularBuffer(L)
+	ns := L.CheckInt64(2)
+	c := checkColumn(L, cb, 3, "set")
+	v, ok := cb.set(ns, c, float64(L.CheckNumber(4)))
+	return pushValue(L, v, ok)
+}
+
+// cb:get(ns, column)
+func cbufGet(L *lua.LState) int {
+	cb := checkCircularBuffer(L)
+	ns := L.CheckInt64(2)
+	c := checkColumn(L, cb, 3, "get")
+	row := cb.row(ns, false)
+	if row == -1 {
+		return pushValue(L, 0, false)
+	}
+	return pushValue(L, cb.values[row*cb.columns+c], true)
+}
+
+// cb:get_range(column, start_ns, end_ns) returns the values as an array.
+func cbufGetRange(L *lua.LState) int {
+	cb := checkCircularBuffer(L)
+	c := checkColumn(L, cb, 2, "get_range")
+	start, end := checkTimeRange(L, cb, 3)
+	values, ok := cb.rangeValues(c, start, end)
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+	t := L.CreateTable(len(values), 0)
+	for _, v := range values {
+		t.Append(lua.LNumber(v))
+	}
+	L.Push(t)
+	return 1
+}
+
+// cb:compute(function, column, start_ns, end_ns) returns the result and the
+// number of rows with data.
+func cbufCompute(L *lua.LState) int {
+	cb := checkCircularBuffer(L)
+	function := checkOption(L, 2, "compute", "", computeFunctions)
+	c := checkColumn(L, cb, 3, "compute")
+	start, end := checkTimeRange(L, cb, 4)
+	values, ok := cb.rangeValues(c, start, end)
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+	result, count := cb.compute(function, values)
+	L.Push(lua.LNumber(result))
+	L.Push(lua.LNumber(count))
+	return 2
+}
+
+// cb:mannwhitneyu(column, start_1, end_1, start_2, end_2, use_continuity)
+// returns U and the p-value.
+func cbufMannWhitneyU(L *lua.LState) int {
+	cb := checkCircularBuffer(L)
+	c := checkColumn(L, cb, 2, "mannwhitneyu")
+	x, ok1 := cb.rangeValues(c, L.CheckInt64(3), L.CheckInt64(4))
+	y, ok2 := cb.rangeValues(c, L.CheckInt64(5), L.CheckInt64(6))
+	if !ok1 || !ok2 {
+		L.Push(lua.LNil)
+		return 1
+	}
+	u, p, ok := mannWhitneyU(x, y, L.OptBool(7, true))
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LNumber(u))
+	L.Push(lua.LNumber(p))
+	return 2
+}
+
+// cb:set_header(column, name, unit, aggregation) returns the column.
+func cbufSetHeader(L *lua.LState) int {
+	cb := checkCircularBuffer(L)
+	c := checkColumn(L, cb, 2, "set_header")
+	h := &cb.headers[c]
+	h.name = sanitizeLabel(L.CheckString(3), columnNameSize)
+	h.unit = sanitizeLabel(L.OptString(4, "count"), unitLabelSize)
+	agg := checkOption(L, 5, "set_header", "sum", aggregationMethods)
+	for i, m := range aggregationMethods {
+		if m == agg {
+			h.aggregation = i
+		}
+	}
+	L.Push(lua.LNumber(c + 1))
+	return 1
+}
+
+// cb:get_header(column) returns the name, unit and aggregation method.
+func cbufGetHeader(L *lua.LState) int {
+	cb := checkCircularBuffer(L)
+	h := cb.headers[checkColumn(L, cb, 2, "get_header")]
+	L.Push(lua.LString(h.name))
+	L.Push(lua.LString(h.unit))
+	L.Push(lua.LString(aggregationMethods[h.aggregation]))
+	return 3
+}
+
+// cb:get_configuration() returns the rows, columns and seconds per row.
+func cbufGetConfiguration(L *lua.LState) int {
+	cb := checkCircularBuffer(L)
+	L.Push(lua.LNumber(cb.rows))
+	L.Push(lua.LNumber(cb.columns))
+	L.Push(lua.LNumber(cb.secondsPerRow))
+	return 3
+}
+
+// cb:current_time() returns the time of the newest row in nanoseconds.
+func cbufCurrentTime(L *lua.LState) int {
+	cb := checkCircularBuffer(L)
+	L.Push(lua.LNumber(cb.currentTime * 1e9))
+	return 1
+}
+
+// cb:annotate(ns, column, type, text) attaches a note to a row, it is
+// dropped when the row leaves the buffer.
+func cbufAnnotate(L *lua.LState) int {
+	cb := checkCircularBuffer(L)
+	ns := L.CheckInt64(2)
+	c := checkColumn(L, cb, 3, "annotate")
+	atype := L.CheckString(4)
+	if _, ok := annotationTypes[atype]; !ok {
+		argError(L, 4, "annotate", fmt.Sprintf("invalid option '%s'", atype))
+	}
+	text := L.CheckString(5)
+	if cb.row(ns, false) == -1 {
+		return 0
+	}
+	t := ns / 1e9
+	t -= t % cb.secondsPerRow
+	for i, a := range cb.annotations {
+		if a.time == t && a.column == c {
+			cb.annotations[i].atype, cb.annotations[i].text = atype, text
+			return 0
+		}
+	}
+	cb.annotations = append(cb.annotations, cbufAnnotation{t, c, atype, text})
+	return 0
+}
+
+// cb:format(format) selects the inject_payload output, "cbuf" or "cbufd".
+func cbufFormat(L *lua.LState) int {
+	cb := checkCircularBuffer(L)
+	format := checkOption(L, 2, "format", "", []string{"cbuf", "cbufd"})
+	if format == "cbufd" && !cb.deltaEnabled {
+		argError(L, 2, "format", "delta output is not enabled")
+	}
+	cb.format = format
+	L.Push(L.Get(1))
+	return 1
+}
+
+// cb:fromstring(data) restores the data written by the preservation.
+func cbufFromString(L *lua.LState) int {
+	cb := checkCircularBuffer(L)
+	if err := cb.fromString(L.CheckString(2)); err != nil {
+		L.RaiseError("%s", err)
+	}
+	return 0
+}
@@ -0,0 +1,262 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012-2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package lua
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// The cjson module, compatible with the Lua CJSON encode/decode API used by
+// the sandbox scripts. Encoding is bounded by the sandbox output_limit.
+
+const (
+	cjsonModule   = "cjson"
+	cjsonMaxDepth = 1000
+	// arrays with more holes are rejected (Lua CJSON encode_sparse_array)
+	cjsonSparseRatio = 2
+	cjsonSparseSafe  = 10
+)
+
+type cjsonEncoder struct {
+	L     *lua.LState
+	null  lua.LValue
+	limit uint
+	buf   []byte
+}
+
+func (e *cjsonEncoder) checkLimit() {
+	if e.limit != 0 && uint(len(e.buf)) > e.limit {
+		e.L.RaiseError("strbuf output_limit exceeded")
+	}
+}
+
+func (e *cjsonEncoder) encode(v lua.LValue, depth int) {
+	switch v := v.(type) {
+	case *lua.LNilType:
+		e.buf = append(e.buf, "null"...)
+	case lua.LBool:
+		e.buf = strconv.AppendBool(e.buf, bool(v))
+	case lua.LNumber:
+		f := float64(v)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			e.L.RaiseError("Cannot serialise number: must not be NaN or Inf")
+		}
+		e.buf = strconv.AppendFloat(e.buf, f, 'g', 14, 64)
+	case lua.LString:
+		e.appendString(string(v))
+	case *lua.LTable:
+		e.encodeTable(v, depth+1)
+	default:
+		if v == e.null {
+			e.buf = append(e.buf, "null"...)
+			return
+		}
+		e.L.RaiseError("Cannot serialise %s: type not supported", v.Type().String())
+	}
+	e.checkLimit()
+}
+
+func (e *cjsonEncoder) appendString(s string) {
+	e.buf = append(e.buf, '"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"', '\\', '/':
+			e.buf = append(e.buf, '\\', c)
+		case '\b':
+			e.buf = append(e.buf, '\\', 'b')
+		case '\f':
+			e.buf = append(e.buf, '\\', 'f')
+		case '\n':
+			e.buf = append(e.buf, '\\', 'n')
+		case '\r':
+			e.buf = append(e.buf, '\\', 'r')
+		case '\t':
+			e.buf = append(e.buf, '\\', 't')
+		default:
+			if c < 0x20 || c == 0x7f {
+				e.buf = append(e.buf, fmt.Sprintf("\\u%04x", c)...)
+			} else {
+				e.buf = append(e.buf, c)
+			}
+		}
+		if len(e.buf)&0xfff == 0 {
+			e.checkLimit()
+		}
+	}
+	e.buf = append(e.buf, '"')
+}
+
+// Returns the length of the table if it is an array (only positive integer
+// keys), otherwise -1.
+func (e *cjsonEncoder) arrayLength(t *lua.LTable) int {
+	max, items := 0, 0
+	for k, _ := t.Next(lua.LNil); k != lua.LNil; k, _ = t.Next(k) {
+		n, ok := k.(lua.LNumber)
+		if !ok || n < 1 || float64(n) != math.Floor(float64(n)) {
+			return -1
+		}
+		if int(n) > max {
+			max = int(n)
+		}
+		items++
+	}
+	if max > items*cjsonSparseRatio && max > cjsonSparseSafe {
+		e.L.RaiseError("Cannot serialise table: excessively sparse array")
+	}
+	return max
+}
+
+// Tables are written in their iteration order, an empty table is an object.
+func (e *cjsonEncoder) encodeTable(t *lua.LTable, depth int) {
+	if depth > cjsonMaxDepth {
+		e.L.RaiseError("Cannot serialise, excessive nesting (%d)", depth)
+	}
+	if n := e.arrayLength(t); n > 0 {
+		e.buf = append(e.buf, '[')
+		for i := 1; i <= n; i++ {
+			if i > 1 {
+				e.buf = append(e.buf, ',')
+			}
+			e.encode(t.RawGetInt(i), depth)
+		}
+		e.buf = append(e.buf, ']')
+		return
+	}
+
+	e.buf = append(e.buf, '{')
+	first := true
+	for k, v := t.Next(lua.LNil); k != lua.LNil; k, v = t.Next(k) {
+		if !first {
+			e.buf = append(e.buf, ',')
+		}
+		first = false
+		switch k := k.(type) {
+		case lua.LString:
+			e.appendString(string(k))
+		case lua.LNumber:
+			e.appendString(k.String())
+		default:
+			e.L.RaiseError("Cannot serialise %s: table key must be a number or string",
+				k.Type().String())
+		}
+		e.buf = append(e.buf, ':')
+		e.encode(v, depth)
+	}
+	e.buf = append(e.buf, '}')
+}
+
+type cjsonDecoder struct {
+	L    *lua.LState
+	null lua.LValue
+	dec  *json.Decoder
+}
+
+func (d *cjsonDecoder) decode(depth int) (lua.LValue, error) {
+	tok, err := d.dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch v := tok.(type) {
+	case nil:
+		return d.null, nil
+	case bool:
+		return lua.LBool(v), nil
+	case json.Number:
+		f, err := strconv.ParseFloat(string(v), 64)
+		return lua.LNumber(f), err
+	case string:
+		return lua.LString(v), nil
+	case json.Delim:
+		if depth >= cjsonMaxDepth {
+			return nil, fmt.Errorf("Found too many nested data structures (%d) at character %d",
+				depth+1, d.dec.InputOffset())
+		}
+		t := d.L.NewTable()
+		for d.dec.More() {
+			if v == '[' {
+				item, err := d.decode(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				t.Append(item)
+				continue
+			}
+			key, err := d.dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			item, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			t.RawSetString(key.(string), item)
+		}
+		if _, err = d.dec.Token(); err != nil { // closing delimiter
+			return nil, err
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("unexpected token %v", tok)
+}
+
+// Loads the cjson module, it is also exposed as a global to match the Lua
+// 5.1 module convention the existing scripts rely on.
+func (this *LuaSandbox) loadCJson(L *lua.LState) int {
+	null := L.NewUserData()
+	mod := L.NewTable()
+	L.SetFuncs(mod, map[string]lua.LGFunction{
+		// cjson.encode(value) returns the JSON string.
+		"encode": func(L *lua.LState) int {
+			e := &cjsonEncoder{L: L, null: null, limit: this.sbConfig.OutputLimit}
+			e.encode(L.CheckAny(1), 0)
+			L.Push(lua.LString(e.buf))
+			return 1
+		},
+		// cjson.decode(string) returns the decoded value, JSON null is
+		// represented by cjson.null.
+		"decode": func(L *lua.LState) int {
+			s := L.CheckString(1)
+			dec := json.NewDecoder(strings.NewReader(s))
+			dec.UseNumber()
+			d := &cjsonDecoder{L: L, null: null, dec: dec}
+			v, err := d.decode(0)
+			if err == nil {
+				if _, err = dec.Token(); err == io.EOF {
+					err = nil
+				} else if err == nil {
+					err = fmt.Errorf("Expected the end but found trailing data at character %d",
+						dec.InputOffset())
+				}
+			}
+			if err != nil {
+				L.RaiseError("%s", err)
+			}
+			L.Push(v)
+			return 1
+		},
+	})
+	mod.RawSetString("null", null)
+	L.SetGlobal(cjsonModule, mod)
+	L.Push(mod)
+	return 1
+}
@@ -0,0 +1,157 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012-2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package lua
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Input and output scripts are configured by the operator and may extend the
+// environment with allow_entries, filters (including the ones loaded through
+// the SandboxManagerFilter), decoders and encoders may not.
+func trustedPluginType(pluginType string) bool {
+	return pluginType == "input" || pluginType == "output"
+}
+
+func (this *LuaSandbox) environmentTemplate() string {
+	if trustedPluginType(this.sbConfig.PluginType) {
+		return SandboxIoTemplate
+	}
+	return SandboxTemplate
+}
+
+// Evaluates the environment template into a table. A separate state without
+// the standard library is used so the evaluation doesn't count against the
+// script's limits.
+func (this *LuaSandbox) environmentConfig() (*lua.LTable, error) {
+	var lua_path []string
+	for _, p := range strings.Split(this.sbConfig.ModuleDirectory, ";") {
+		lua_path = append(lua_path, filepath.Join(p, "?.lua"))
+	}
+	src := fmt.Sprintf(this.environmentTemplate(), this.sbConfig.MemoryLimit,
+		this.sbConfig.InstructionLimit, this.sbConfig.OutputLimit,
+		strings.Join(lua_path, ";"), "")
+
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	if err := L.DoString("return " + src); err != nil {
+		return nil, fmt.Errorf("invalid sandbox environment: %s", luaErrorMessage(err))
+	}
+	env, ok := L.Get(-1).(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("invalid sandbox environment: table expected")
+	}
+	return env, nil
+}
+
+// Sets the module search path and removes the entries and modules the
+// environment denies, unless allow_entries lists them. Entries are named
+// 'function' for the globals and 'module.function' otherwise, a disabled
+// module is allowed by its name.
+func (this *LuaSandbox) applyEnvironment(env *lua.LTable) {
+	L := this.lvm
+	allowed := make(map[string]bool, len(this.sbConfig.AllowEntries))
+	for _, e := range this.sbConfig.AllowEntries {
+		allowed[e] = true
+	}
+
+	pkg, _ := L.GetGlobal("package").(*lua.LTable)
+	if pkg != nil {
+		pkg.RawSetString("path", env.RawGetString("path"))
+		pkg.RawSetString("cpath", env.RawGetString("cpath"))
+	}
+
+	if entries, ok := env.RawGetString("remove_entries").(*lua.LTable); ok {
+		entries.ForEach(func(k, v lua.LValue) {
+			names, ok := v.(*lua.LTable)
+			if !ok {
+				return
+			}
+			module := k.String()
+			t := L.G.Global
+			if module != "" {
+				if t, ok = L.GetGlobal(module).(*lua.LTable); !ok {
+					return
+				}
+			}
+			names.ForEach(func(_, n lua.LValue) {
+				name := n.String()
+				if module != "" && allowed[module+"."+name] ||
+					module == "" && allowed[name] {
+					return
+				}
+				t.RawSetString(name, lua.LNil)
+			})
+		})
+	}
+
+	if modules, ok := env.RawGetString("disable_modules").(*lua.LTable); ok {
+		modules.ForEach(func(k, _ lua.LValue) {
+			name := k.String()
+			if allowed[name] {
+				return
+			}
+			L.SetGlobal(name, lua.LNil)
+			if pkg == nil {
+				return
+			}
+			if loaded, ok := pkg.RawGetString("loaded").(*lua.LTable); ok {
+				loaded.RawSetString(name, lua.LNil)
+			}
+			if preload, ok := pkg.RawGetString("preload").(*lua.LTable); ok {
+				preload.RawSetString(name, L.NewFunction(func(L *lua.LState) int {
+					L.RaiseError("module '%s' disabled", name)
+					return 0
+				}))
+			}
+		})
+	}
+}
+
+// Lists the script and the module files it has required, the loaded modules
+// are looked up on the module search path like require does.
+func (this *LuaSandbox) SourceFiles() []string {
+	files := []string{this.sbConfig.ScriptFilename}
+	L := this.lvm
+	pkg, _ := L.GetGlobal("package").(*lua.LTable)
+	loaded, _ := L.GetField(L.Get(lua.RegistryIndex), "_LOADED").(*lua.LTable)
+	if pkg == nil || loaded == nil {
+		return files
+	}
+	var names []string
+	loaded.ForEach(func(k, _ lua.LValue) {
+		if name, ok := k.(lua.LString); ok {
+			names = append(names, string(name))
+		}
+	})
+	sort.Strings(names)
+	path := strings.Split(lua.LVAsString(pkg.RawGetString("path")), ";")
+	for _, name := range names {
+		name = strings.Replace(name, ".", string(filepath.Separator), -1)
+		for _, template := range path {
+			filename := strings.Replace(template, "?", name, -1)
+			if fileExists(filename) {
+				files = append(files, filename)
+				break
+			}
+		}
+	}
+	return files
+}
@@ -0,0 +1,247 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012-2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package lua
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"unsafe"
+
+	lua "github.com/yuin/gopher-lua"
+	"heka/sandbox"
+)
+
+var (
+	errInstructionLimit = errors.New("instruction_limit exceeded")
+	errMemoryLimit      = errors.New("not enough memory")
+	errShuttingDown     = errors.New("shutting down")
+)
+
+// The memory estimate walks the whole Lua state so it is only refreshed after
+// the script has executed a number of instructions proportional to the size
+// of the last walk, this keeps the accounting overhead roughly constant per
+// instruction no matter how much data the script holds.
+const (
+	memoryCheckMinInterval = 100
+	memoryCheckFactor      = 4
+)
+
+var closedChan = make(chan struct{})
+
+func init() {
+	close(closedChan)
+}
+
+// gopher-lua has no debug hooks but its VM consults the Done channel of the
+// state's context before executing every instruction. limitContext uses that
+// to count instructions and to enforce the instruction and memory limits; a
+// closed channel makes the VM raise the error returned by Err.
+type limitContext struct {
+	context.Context
+	lsb *LuaSandbox
+}
+
+func (c *limitContext) Done() <-chan struct{} {
+	lsb := c.lsb
+	if lsb.limitErr != nil {
+		return closedChan
+	}
+	lsb.instructions++
+	lsb.totalInstructions++
+	if lsb.profiler != nil {
+		lsb.profiler.sample(lsb.lvm)
+	}
+	limit := lsb.sbConfig.InstructionLimit
+	if lsb.restoreLimit > 0 {
+		limit = lsb.restoreLimit
+	}
+	if limit > 0 && lsb.instructions > limit {
+		lsb.limitErr = errInstructionLimit
+		return closedChan
+	}
+	if lsb.totalInstructions >= lsb.nextMemoryCheck && !lsb.checkMemory() {
+		lsb.limitErr = errMemoryLimit
+		return closedChan
+	}
+	return c.Context.Done()
+}
+
+func (c *limitContext) Err() error {
+	if c.lsb.limitErr != nil {
+		return c.lsb.limitErr
+	}
+	if c.Context.Err() != nil {
+		return errShuttingDown
+	}
+	return nil
+}
+
+// Implemented by userdata values that hold memory outside of the Lua state so
+// it can be charged against the sandbox memory limit.
+type memorySizer interface {
+	MemoryUsage() uint
+}
+
+// Approximates the memory held by the Lua state by walking everything
+// reachable from the registry, the globals and the data stack and call frames
+// of the running functions. Sizes are rough Go allocation
+// sizes, they only need to be stable enough to enforce a limit.
+type memoryWalker struct {
+	seen   map[interface{}]struct{}
+	size   uint
+	visits int
+}
+
+func (w *memoryWalker) mark(p interface{}) bool {
+	if _, ok := w.seen[p]; ok {
+		return false
+	}
+	w.seen[p] = struct{}{}
+	w.visits++
+	return true
+}
+
+func (w *memoryWalker) walk(lv lua.LValue) {
+	switch v := lv.(type) {
+	case lua.LString:
+		w.size += 16 + uint(len(v))
+	case *lua.LTable:
+		if !w.mark(v) {
+			return
+		}
+		w.size += 64
+		v.ForEach(func(key, value lua.LValue) {
+			w.size += 32
+			w.walk(key)
+			w.walk(value)
+		})
+		w.walk(v.Metatable)
+	case *lua.LFunction:
+		if !w.mark(v) {
+			return
+		}
+		w.size += 64 + 8*uint(len(v.Upvalues))
+		if !v.IsG {
+			w.walkProto(v.Proto)
+		}
+		for _, uv := range v.Upvalues {
+			w.walk(uv.Value())
+		}
+		if v.Env != nil {
+			w.walk(v.Env)
+		}
+	case *lua.LUserData:
+		if !w.mark(v) {
+			return
+		}
+		w.size += 48
+		if s, ok := v.Value.(memorySizer); ok {
+			w.size += s.MemoryUsage()
+		}
+		if v.Env != nil {
+			w.walk(v.Env)
+		}
+		w.walk(v.Metatable)
+	case *lua.LState:
+		if !w.mark(v) {
+			return
+		}
+		w.size += 1024
+		w.walkStack(v)
+	}
+}
+
+// Returns an unexported struct field as a settable value.
+func unexportedField(v reflect.Value, name string) reflect.Value {
+	f := v.FieldByName(name)
+	return reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem()
+}
+
+// Walks the locals and temporaries held in the registers of a state and the
+// functions of its call frames. gopher-lua doesn't export its data stack so
+// it is read with reflection.
+func (w *memoryWalker) walkStack(ls *lua.LState) {
+	state := reflect.ValueOf(ls).Elem()
+	reg := unexportedField(state, "reg")
+	if reg.IsNil() {
+		return
+	}
+	reg = reg.Elem()
+	array := unexportedField(reg, "array").Interface().([]lua.LValue)
+	top := int(unexportedField(reg, "top").Int())
+
+	// The registers of a running Lua function extend past the top.
+	frame := unexportedField(state, "currentFrame")
+	for ; !frame.IsNil(); frame = frame.Elem().FieldByName("Parent") {
+		fn := frame.Elem().FieldByName("Fn").Interface().(*lua.LFunction)
+		w.walk(fn)
+		if fn.IsG || fn.Proto == nil {
+			continue
+		}
+		end := int(frame.Elem().FieldByName("LocalBase").Int()) + int(fn.Proto.NumUsedRegisters)
+		if end > top {
+			top = end
+		}
+	}
+	if top > len(array) {
+		top = len(array)
+	}
+	for _, lv := range array[:top] {
+		if lv != nil {
+			w.walk(lv)
+		}
+	}
+}
+
+func (w *memoryWalker) walkProto(p *lua.FunctionProto) {
+	if p == nil || !w.mark(p) {
+		return
+	}
+	w.size += 128 + 4*uint(len(p.Code)) + 8*uint(len(p.DbgSourcePositions))
+	for _, c := range p.Constants {
+		w.walk(c)
+	}
+	for _, fp := range p.FunctionPrototypes {
+		w.walkProto(fp)
+	}
+}
+
+func (this *LuaSandbox) memoryUsage() (size uint, visits int) {
+	w := memoryWalker{seen: make(map[interface{}]struct{}, this.lastVisits)}
+	w.walk(this.lvm.G.Registry)
+	w.walk(this.lvm.G.Global)
+	w.walk(this.lvm)
+	return w.size, w.visits
+}
+
+// Refreshes the memory usage statistics, returns false if the memory limit
+// has been exceeded.
+func (this *LuaSandbox) checkMemory() bool {
+	size, visits := this.memoryUsage()
+	this.lastVisits = visits
+	interval := uint64(visits) * memoryCheckFactor
+	if interval < memoryCheckMinInterval {
+		interval = memoryCheckMinInterval
+	}
+	this.nextMemoryCheck = this.totalInstructions + interval
+
+	this.usage[sandbox.TYPE_MEMORY][sandbox.STAT_CURRENT] = size
+	if size > this.usage[sandbox.TYPE_MEMORY][sandbox.STAT_MAXIMUM] {
+		this.usage[sandbox.TYPE_MEMORY][sandbox.STAT_MAXIMUM] = size
+	}
+	limit := this.sbConfig.MemoryLimit
+	return limit == 0 || size <= limit
+}
@@ -0,0 +1,764 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012-2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package lua
+
+import (
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// The lpeg module is a Go implementation of the LPeg API
+// (http://www.inf.puc-rio.br/~roberto/lpeg/lpeg.html). Patterns are immutable
+// trees built by the constructors and operators below and matched by a
+// backtracking interpreter (lua_lpeg_match.go). The and predicate (#patt) is
+// not available as gopher-lua coerces the result of __len to a number,
+// -(-patt) is equivalent.
+
+const (
+	lpegModule      = "lpeg"
+	lpegPatternType = "lpeg-pattern"
+	lpegVersion     = "1.0.0"
+	lpegMaxStack    = 400
+)
+
+type patternKind uint8
+
+const (
+	pAny     patternKind = iota // n bytes
+	pTrue                       // always succeeds
+	pFalse                      // always fails
+	pString                     // literal
+	pSet                        // one byte of a charset
+	pSeq                        // p1 * p2
+	pChoice                     // p1 + p2
+	pRep                        // p1^n, at least n
+	pOpt                        // p1^-n, at most n
+	pNot                        // -p1
+	pBehind                     // B(p1)
+	pGrammar                    // rules
+	pRef                        // V(name) outside of a grammar
+	pCall                       // resolved V(name)
+	pCapture                    // capture of p1
+)
+
+type captureKind uint8
+
+const (
+	capSimple   captureKind = iota // C
+	capConst                       // Cc
+	capPosition                    // Cp
+	capArg                         // Carg
+	capBackref                     // Cb
+	capGroup                       // Cg
+	capTable                       // Ct
+	capSubst                       // Cs
+	capFold                        // Cf
+	capString                      // p / string
+	capNum                         // p / number
+	capQuery                       // p / table
+	capFunction                    // p / function
+	capRuntime                     // Cmt
+)
+
+type charset [8]uint32
+
+func (cs *charset) has(c byte) bool {
+	return cs[c>>5]&(1<<(c&31)) != 0
+}
+
+func (cs *charset) add(c byte) {
+	cs[c>>5] |= 1 << (c & 31)
+}
+
+type pattern struct {
+	kind   patternKind
+	n      int
+	str    string
+	set    *charset
+	p1, p2 *pattern
+	cap    captureKind
+	name   lua.LValue   // group, backref and rule name
+	value  lua.LValue   // string, number, table or function of a capture
+	values []lua.LValue // constant capture values
+	rules  []*pattern   // grammar rules, the first is the initial rule
+	size   uint
+}
+
+func (this *pattern) MemoryUsage() uint {
+	return this.size
+}
+
+func newPattern(kind patternKind) *pattern {
+	return &pattern{kind: kind, size: 64}
+}
+
+func newSet(cs *charset) *pattern {
+	p := newPattern(pSet)
+	p.set = cs
+	return p
+}
+
+func newBinary(kind patternKind, p1, p2 *pattern) *pattern {
+	p := newPattern(kind)
+	p.p1, p.p2 = p1, p2
+	p.size += p1.size + p2.size
+	return p
+}
+
+func newUnary(kind patternKind, p1 *pattern, n int) *pattern {
+	p := newPattern(kind)
+	p.p1, p.n = p1, n
+	p.size += p1.size
+	return p
+}
+
+func newCapture(cap captureKind, p1 *pattern) *pattern {
+	p := newPattern(pCapture)
+	p.cap, p.p1 = cap, p1
+	if p1 != nil {
+		p.size += p1.size
+	}
+	return p
+}
+
+// Returns the charset matched by a single byte pattern.
+func toCharset(p *pattern) (*charset, bool) {
+	switch {
+	case p.kind == pSet:
+		return p.set, true
+	case p.kind == pAny && p.n == 1:
+		cs := new(charset)
+		for i := range cs {
+			cs[i] = 0xffffffff
+		}
+		return cs, true
+	case p.kind == pString && len(p.str) == 1:
+		cs := new(charset)
+		cs.add(p.str[0])
+		return cs, true
+	}
+	return nil, false
+}
+
+// Reports whether the pattern can succeed without consuming input, used to
+// reject loops that would never terminate.
+func nullable(p *pattern, visiting map[*pattern]bool) bool {
+	switch p.kind {
+	case pAny:
+		return p.n == 0
+	case pTrue, pNot, pOpt, pBehind:
+		return true
+	case pFalse, pSet:
+		return false
+	case pString:
+		return len(p.str) == 0
+	case pSeq:
+		return nullable(p.p1, visiting) && nullable(p.p2, visiting)
+	case pChoice:
+		return nullable(p.p1, visiting) || nullable(p.p2, visiting)
+	case pRep:
+		return p.n == 0 || nullable(p.p1, visiting)
+	case pGrammar:
+		return nullable(p.rules[0], visiting)
+	case pCall:
+		if visiting[p.p1] {
+			return false
+		}
+		visiting[p.p1] = true
+		defer delete(visiting, p.p1)
+		return nullable(p.p1, visiting)
+	case pCapture:
+		return p.p1 == nil || nullable(p.p1, visiting)
+	}
+	return false // pRef
+}
+
+// Returns the number of bytes the pattern always consumes or -1 if it varies.
+func fixedLen(p *pattern) int {
+	switch p.kind {
+	case pAny:
+		return p.n
+	case pTrue, pFalse, pNot, pBehind:
+		return 0
+	case pSet:
+		return 1
+	case pString:
+		return len(p.str)
+	case pSeq:
+		n1, n2 := fixedLen(p.p1), fixedLen(p.p2)
+		if n1 < 0 || n2 < 0 {
+			return -1
+		}
+		return n1 + n2
+	case pChoice:
+		if n := fixedLen(p.p1); n == fixedLen(p.p2) {
+			return n
+		}
+	case pCapture:
+		if p.p1 == nil {
+			return 0
+		}
+		if p.cap != capRuntime {
+			return fixedLen(p.p1)
+		}
+	}
+	return -1
+}
+
+func isPattern(v lua.LValue) (*pattern, bool) {
+	if ud, ok := v.(*lua.LUserData); ok {
+		p, ok := ud.Value.(*pattern)
+		return p, ok
+	}
+	return nil, false
+}
+
+func pushPattern(L *lua.LState, p *pattern) int {
+	ud := L.NewUserData()
+	ud.Value = p
+	L.SetMetatable(ud, L.GetTypeMetatable(lpegPatternType))
+	L.Push(ud)
+	return 1
+}
+
+// Converts a Lua value into a pattern following the lpeg.P rules.
+func toPattern(L *lua.LState, n int, fname string) *pattern {
+	switch v := L.Get(n).(type) {
+	case *lua.LUserData:
+		if p, ok := v.Value.(*pattern); ok {
+			return p
+		}
+	case lua.LString:
+		if len(v) == 0 {
+			return newPattern(pTrue)
+		}
+		p := newPattern(pString)
+		p.str = string(v)
+		p.size += uint(len(v))
+		return p
+	case lua.LNumber:
+		if v >= 0 {
+			p := newPattern(pAny)
+			p.n = int(v)
+			return p
+		}
+		p := newPattern(pAny)
+		p.n = int(-v)
+		return newUnary(pNot, p, 0)
+	case lua.LBool:
+		if v {
+			return newPattern(pTrue)
+		}
+		return newPattern(pFalse)
+	case *lua.LTable:
+		return newGrammar(L, v)
+	case *lua.LFunction:
+		p := newCapture(capRuntime, newPattern(pTrue))
+		p.value = v
+		return p
+	}
+	argError(L, n, fname, "pattern expected, got "+L.Get(n).Type().String())
+	return nil
+}
+
+// Builds a grammar from a table of rules. Entry 1 is the initial rule or the
+// name of it, V references are resolved to the rules of this grammar.
+func newGrammar(L *lua.LState, t *lua.LTable) *pattern {
+	g := newPattern(pGrammar)
+	index := make(map[lua.LValue]int)
+	var names []lua.LValue
+	var bodies []*pattern
+
+	initial := t.RawGetInt(1)
+	if initial == lua.LNil {
+		L.RaiseError("grammar has no initial rule")
+	}
+	if _, ok := initial.(lua.LString); ok {
+		if t.RawGet(initial) == lua.LNil {
+			L.RaiseError("initial rule '%s' is not defined in given grammar", initial.String())
+		}
+	}
+
+	add := func(k, v lua.LValue) {
+		L.Push(v)
+		p := toPattern(L, L.GetTop(), "P")
+		L.Pop(1)
+		index[k] = len(bodies)
+		names = append(names, k)
+		bodies = append(bodies, p)
+	}
+	if _, ok := initial.(lua.LString); ok {
+		add(initial, t.RawGet(initial))
+	} else {
+		add(lua.LNumber(1), initial)
+	}
+	t.ForEach(func(k, v lua.LValue) {
+		if k == lua.LNumber(1) || k == initial {
+			return
+		}
+		add(k, v)
+	})
+
+	calls := make(map[int][]*pattern)
+	resolved := make(map[*pattern]*pattern)
+	var resolve, resolveNode func(p *pattern) *pattern
+	resolve = func(p *pattern) *pattern {
+		if r, ok := resolved[p]; ok {
+			return r
+		}
+		r := resolveNode(p)
+		resolved[p] = r
+		return r
+	}
+	resolveNode = func(p *pattern) *pattern {
+		switch p.kind {
+		case pRef:
+			idx, ok := index[p.name]
+			if !ok {
+				L.RaiseError("rule '%s' undefined in given grammar", p.name.String())
+			}
+			c := newPattern(pCall)
+			c.name, c.n = p.name, idx
+			calls[idx] = append(calls[idx], c)
+			return c
+		case pGrammar:
+			return p // already closed
+		}
+		if p.p1 == nil && p.p2 == nil {
+			return p
+		}
+		cp := *p
+		if p.p1 != nil {
+			cp.p1 = resolve(p.p1)
+		}
+		if p.p2 != nil {
+			cp.p2 = resolve(p.p2)
+		}
+		if cp.p1 == p.p1 && cp.p2 == p.p2 {
+			return p
+		}
+		return &cp
+	}
+	for i, b := range bodies {
+		bodies[i] = resolve(b)
+		g.size += bodies[i].size
+	}
+	for idx, cs := range calls {
+		for _, c := range cs {
+			c.p1 = bodies[idx]
+		}
+	}
+	g.rules = bodies
+
+	for i, b := range bodies {
+		path := map[*pattern]bool{b: true}
+		if name, ok := leftRecursive(b, path); ok {
+			L.RaiseError("rule '%s' may be left recursive", name)
+		}
+		if err := checkLoops(b, make(map[*pattern]bool)); err != "" {
+			L.RaiseError("%s in rule '%s'", err, names[i].String())
+		}
+	}
+	return g
+}
+
+// Follows the rules that can be reached without consuming input, reaching a
+// rule already on the path means the grammar would recurse forever.
+func leftRecursive(p *pattern, path map[*pattern]bool) (string, bool) {
+	switch p.kind {
+	case pSeq:
+		if name, ok := leftRecursive(p.p1, path); ok {
+			return name, ok
+		}
+		if nullable(p.p1, make(map[*pattern]bool)) {
+			return leftRecursive(p.p2, path)
+		}
+	case pChoice:
+		if name, ok := leftRecursive(p.p1, path); ok {
+			return name, ok
+		}
+		return leftRecursive(p.p2, path)
+	case pRep, pOpt, pNot, pBehind:
+		return leftRecursive(p.p1, path)
+	case pCapture:
+		if p.p1 != nil {
+			return leftRecursive(p.p1, path)
+		}
+	case pCall:
+		if path[p.p1] {
+			return p.name.String(), true
+		}
+		path[p.p1] = true
+		defer delete(path, p.p1)
+		return leftRecursive(p.p1, path)
+	}
+	return "", false
+}
+
+// Rejects repetitions of a pattern that can match the empty string, the
+// check is repeated once the grammar rules are known.
+func checkLoops(p *pattern, seen map[*pattern]bool) string {
+	if p == nil || seen[p] {
+		return ""
+	}
+	seen[p] = true
+	switch p.kind {
+	case pRep:
+		if nullable(p.p1, make(map[*pattern]bool)) {
+			return "loop body may accept empty string"
+		}
+	case pGrammar:
+		return ""
+	}
+	if err := checkLoops(p.p1, seen); err != "" {
+		return err
+	}
+	return checkLoops(p.p2, seen)
+}
+
+func checkPattern(L *lua.LState, n int) *pattern {
+	return toPattern(L, n, "P")
+}
+
+// lpeg.P(value)
+func lpegP(L *lua.LState) int {
+	return pushPattern(L, checkPattern(L, 1))
+}
+
+// lpeg.S(string) matches any byte of the string.
+func lpegS(L *lua.LState) int {
+	s := L.CheckString(1)
+	cs := new(charset)
+	for i := 0; i < len(s); i++ {
+		cs.add(s[i])
+	}
+	return pushPattern(L, newSet(cs))
+}
+
+// lpeg.R(range, ...) matches any byte in the two character ranges.
+func lpegR(L *lua.LState) int {
+	cs := new(charset)
+	for i := 1; i <= L.GetTop(); i++ {
+		r := L.CheckString(i)
+		if len(r) != 2 {
+			argError(L, i, "R", "range must have two characters")
+		}
+		for c := int(r[0]); c <= int(r[1]); c++ {
+			cs.add(byte(c))
+		}
+	}
+	return pushPattern(L, newSet(cs))
+}
+
+// lpeg.V(name) references a grammar rule.
+func lpegV(L *lua.LState) int {
+	name := L.Get(1)
+	if name == lua.LNil {
+		argError(L, 1, "V", "non-nil value expected")
+	}
+	p := newPattern(pRef)
+	p.name = name
+	return pushPattern(L, p)
+}
+
+// lpeg.B(patt) matches patt behind the current position.
+func lpegB(L *lua.LState) int {
+	p1 := checkPattern(L, 1)
+	n := fixedLen(p1)
+	if n < 0 {
+		argError(L, 1, "B", "pattern may not have fixed length")
+	}
+	return pushPattern(L, newUnary(pBehind, p1, n))
+}
+
+func lpegC(L *lua.LState) int {
+	return pushPattern(L, newCapture(capSimple, checkPattern(L, 1)))
+}
+
+func lpegCc(L *lua.LState) int {
+	p := newCapture(capConst, nil)
+	for i := 1; i <= L.GetTop(); i++ {
+		p.values = append(p.values, L.Get(i))
+	}
+	return pushPattern(L, p)
+}
+
+func lpegCp(L *lua.LState) int {
+	return pushPattern(L, newCapture(capPosition, nil))
+}
+
+func lpegCarg(L *lua.LState) int {
+	p := newCapture(capArg, nil)
+	p.n = L.CheckInt(1)
+	if p.n < 1 {
+		argError(L, 1, "Carg", "invalid argument index")
+	}
+	return pushPattern(L, p)
+}
+
+func lpegCb(L *lua.LState) int {
+	p := newCapture(capBackref, nil)
+	p.name = L.CheckAny(1)
+	return pushPattern(L, p)
+}
+
+func lpegCg(L *lua.LState) int {
+	p := newCapture(capGroup, checkPattern(L, 1))
+	if name := L.Get(2); name != lua.LNil {
+		p.name = name
+	}
+	return pushPattern(L, p)
+}
+
+func lpegCt(L *lua.LState) int {
+	return pushPattern(L, newCapture(capTable, checkPattern(L, 1)))
+}
+
+func lpegCs(L *lua.LState) int {
+	return pushPattern(L, newCapture(capSubst, checkPattern(L, 1)))
+}
+
+func lpegCf(L *lua.LState) int {
+	p := newCapture(capFold, checkPattern(L, 1))
+	p.value = L.CheckFunction(2)
+	return pushPattern(L, p)
+}
+
+func lpegCmt(L *lua.LState) int {
+	p := newCapture(capRuntime, checkPattern(L, 1))
+	p.value = L.CheckFunction(2)
+	return pushPattern(L, p)
+}
+
+// lpeg.type(value) returns "pattern" for patterns and nil otherwise.
+func lpegType(L *lua.LState) int {
+	if _, ok := isPattern(L.Get(1)); ok {
+		L.Push(lua.LString("pattern"))
+	} else {
+		L.Push(lua.LNil)
+	}
+	return 1
+}
+
+func lpegVersionString(L *lua.LState) int {
+	L.Push(lua.LString(lpegVersion))
+	return 1
+}
+
+// lpeg.locale(table) adds the character class patterns to the table (or a
+// new one) and returns it.
+func lpegLocale(L *lua.LState) int {
+	t := L.OptTable(1, L.NewTable())
+	classes := map[string]func(c byte) bool{
+		"alnum":  func(c byte) bool { return isAlpha(c) || isDigit(c) },
+		"alpha":  isAlpha,
+		"cntrl":  func(c byte) bool { return c < 32 || c == 127 },
+		"digit":  isDigit,
+		"graph":  func(c byte) bool { return c > 32 && c < 127 },
+		"lower":  func(c byte) bool { return c >= 'a' && c <= 'z' },
+		"print":  func(c byte) bool { return c >= 32 && c < 127 },
+		"punct":  func(c byte) bool { return c > 32 && c < 127 && !isAlpha(c) && !isDigit(c) },
+		"space":  func(c byte) bool { return c == ' ' || c >= '\t' && c <= '\r' },
+		"upper":  func(c byte) bool { return c >= 'A' && c <= 'Z' },
+		"xdigit": func(c byte) bool { return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F' },
+	}
+	for name, class := range classes {
+		cs := new(charset)
+		for c := 0; c < 256; c++ {
+			if class(byte(c)) {
+				cs.add(byte(c))
+			}
+		}
+		pushPattern(L, newSet(cs))
+		t.RawSetString(name, L.Get(-1))
+		L.Pop(1)
+	}
+	L.Push(t)
+	return 1
+}
+
+func isAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// lpeg.setmaxstack(n) limits the nesting of grammar rule calls.
+func lpegSetMaxStack(L *lua.LState) int {
+	n := L.CheckInt(1)
+	if n <= 0 {
+		argError(L, 1, "setmaxstack", "positive integer expected")
+	}
+	L.G.Registry.RawSetString(lpegModule+".maxstack", lua.LNumber(n))
+	return 0
+}
+
+// patt1 + patt2, ordered choice.
+func lpegAdd(L *lua.LState) int {
+	p1, p2 := checkPattern(L, 1), checkPattern(L, 2)
+	cs1, ok1 := toCharset(p1)
+	cs2, ok2 := toCharset(p2)
+	if ok1 && ok2 {
+		cs := new(charset)
+		for i := range cs {
+			cs[i] = cs1[i] | cs2[i]
+		}
+		return pushPattern(L, newSet(cs))
+	}
+	return pushPattern(L, newBinary(pChoice, p1, p2))
+}
+
+// patt1 - patt2, matches patt1 if patt2 does not match.
+func lpegSub(L *lua.LState) int {
+	p1, p2 := checkPattern(L, 1), checkPattern(L, 2)
+	cs1, ok1 := toCharset(p1)
+	cs2, ok2 := toCharset(p2)
+	if ok1 && ok2 {
+		cs := new(charset)
+		for i := range cs {
+			cs[i] = cs1[i] &^ cs2[i]
+		}
+		return pushPattern(L, newSet(cs))
+	}
+	return pushPattern(L, newBinary(pSeq, newUnary(pNot, p2, 0), p1))
+}
+
+// patt1 * patt2, sequence.
+func lpegMul(L *lua.LState) int {
+	return pushPattern(L, newBinary(pSeq, checkPattern(L, 1), checkPattern(L, 2)))
+}
+
+// patt ^ n, at least n repetitions or at most -n when n is negative.
+func lpegPow(L *lua.LState) int {
+	p1 := checkPattern(L, 1)
+	n := L.CheckInt(2)
+	if n < 0 {
+		return pushPattern(L, newUnary(pOpt, p1, -n))
+	}
+	if nullable(p1, make(map[*pattern]bool)) {
+		L.RaiseError("loop body may accept empty string")
+	}
+	return pushPattern(L, newUnary(pRep, p1, n))
+}
+
+// -patt, matches if patt does not match.
+func lpegUnm(L *lua.LState) int {
+	return pushPattern(L, newUnary(pNot, checkPattern(L, 1), 0))
+}
+
+// patt / value, string, number, table and function captures.
+func lpegDiv(L *lua.LState) int {
+	p1 := checkPattern(L, 1)
+	var p *pattern
+	switch v := L.Get(2).(type) {
+	case lua.LString:
+		p = newCapture(capString, p1)
+	case lua.LNumber:
+		p = newCapture(capNum, p1)
+		p.n = int(v)
+		if p.n < 0 {
+			argError(L, 2, "/", "invalid number")
+		}
+	case *lua.LTable:
+		p = newCapture(capQuery, p1)
+	case *lua.LFunction:
+		p = newCapture(capFunction, p1)
+	default:
+		argError(L, 2, "/", fmt.Sprintf("unexpected %s as 2nd operand to LPeg '/'",
+			L.Get(2).Type().String()))
+	}
+	p.value = L.Get(2)
+	return pushPattern(L, p)
+}
+
+// lpeg.match(patt, subject, init, ...) and patt:match(subject, init, ...)
+func lpegMatch(L *lua.LState) int {
+	p := checkPattern(L, 1)
+	subject := L.CheckString(2)
+	init := L.OptInt(3, 1)
+	switch {
+	case init > len(subject):
+		init = len(subject)
+	case init > 0:
+		init--
+	case -init > len(subject):
+		init = 0
+	default:
+		init = len(subject) + init
+	}
+	var args []lua.LValue
+	for i := 4; i <= L.GetTop(); i++ {
+		args = append(args, L.Get(i))
+	}
+	maxStack := lpegMaxStack
+	if n, ok := L.G.Registry.RawGetString(lpegModule + ".maxstack").(lua.LNumber); ok {
+		maxStack = int(n)
+	}
+	m := &matcher{L: L, subject: subject, args: args, maxStack: maxStack}
+	values, ok := m.run(p, init)
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+	for _, v := range values {
+		L.Push(v)
+	}
+	return len(values)
+}
+
+// Loads the lpeg module, it is also exposed as a global to match the Lua 5.1
+// module convention the existing scripts rely on.
+func loadLpeg(L *lua.LState) int {
+	mt := L.NewTypeMetatable(lpegPatternType)
+	L.SetFuncs(mt, map[string]lua.LGFunction{
+		"__add": lpegAdd,
+		"__sub": lpegSub,
+		"__mul": lpegMul,
+		"__pow": lpegPow,
+		"__unm": lpegUnm,
+		"__div": lpegDiv,
+	})
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"match": lpegMatch,
+	}))
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"P":           lpegP,
+		"S":           lpegS,
+		"R":           lpegR,
+		"V":           lpegV,
+		"B":           lpegB,
+		"C":           lpegC,
+		"Cc":          lpegCc,
+		"Cp":          lpegCp,
+		"Carg":        lpegCarg,
+		"Cb":          lpegCb,
+		"Cg":          lpegCg,
+		"Ct":          lpegCt,
+		"Cs":          lpegCs,
+		"Cf":          lpegCf,
+		"Cmt":         lpegCmt,
+		"match":       lpegMatch,
+		"type":        lpegType,
+		"version":     lpegVersionString,
+		"locale":      lpegLocale,
+		"setmaxstack": lpegSetMaxStack,
+	})
+	L.SetGlobal(lpegModule, mod)
+	L.Push(mod)
+	return 1
+}
@@ -0,0 +1,403 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012-2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package lua
+
+import (
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// A capture recorded while matching. Captures are only turned into Lua values
+// once the whole pattern matched, except for match-time captures which are
+// evaluated immediately and keep their results in values.
+type capture struct {
+	p      *pattern
+	s, e   int
+	kids   []capture
+	values []lua.LValue
+}
+
+type matcher struct {
+	L        *lua.LState
+	subject  string
+	args     []lua.LValue
+	maxStack int
+	depth    int
+}
+
+// Matches the pattern at position i (zero based) and returns the capture
+// values, or the position after the match if there are none.
+func (m *matcher) run(p *pattern, i int) ([]lua.LValue, bool) {
+	var caps []capture
+	e, ok := m.match(p, i, &caps)
+	if !ok {
+		return nil, false
+	}
+	values := m.values(caps, nil)
+	if len(values) == 0 {
+		values = append(values, lua.LNumber(e+1))
+	}
+	return values, true
+}
+
+func (m *matcher) match(p *pattern, i int, caps *[]capture) (int, bool) {
+	s := m.subject
+	switch p.kind {
+	case pAny:
+		if i+p.n > len(s) {
+			return i, false
+		}
+		return i + p.n, true
+	case pTrue:
+		return i, true
+	case pFalse:
+		return i, false
+	case pString:
+		if strings.HasPrefix(s[i:], p.str) {
+			return i + len(p.str), true
+		}
+		return i, false
+	case pSet:
+		if i < len(s) && p.set.has(s[i]) {
+			return i + 1, true
+		}
+		return i, false
+	case pSeq:
+		j, ok := m.match(p.p1, i, caps)
+		if !ok {
+			return i, false
+		}
+		return m.match(p.p2, j, caps)
+	case pChoice:
+		n := len(*caps)
+		if j, ok := m.match(p.p1, i, caps); ok {
+			return j, true
+		}
+		*caps = (*caps)[:n]
+		return m.match(p.p2, i, caps)
+	case pRep:
+		if p.p1.kind == pSet { // fast path for the common set^n
+			j := i
+			for j < len(s) && p.p1.set.has(s[j]) {
+				j++
+			}
+			return j, j-i >= p.n
+		}
+		count := 0
+		for {
+			n := len(*caps)
+			j, ok := m.match(p.p1, i, caps)
+			if !ok || j == i {
+				*caps = (*caps)[:n]
+				break
+			}
+			i = j
+			count++
+		}
+		return i, count >= p.n
+	case pOpt:
+		for count := 0; count < p.n; count++ {
+			n := len(*caps)
+			j, ok := m.match(p.p1, i, caps)
+			if !ok {
+				*caps = (*caps)[:n]
+				break
+			}
+			i = j
+		}
+		return i, true
+	case pNot:
+		n := len(*caps)
+		_, ok := m.match(p.p1, i, caps)
+		*caps = (*caps)[:n]
+		return i, !ok
+	case pBehind:
+		if i < p.n {
+			return i, false
+		}
+		n := len(*caps)
+		if j, ok := m.match(p.p1, i-p.n, caps); !ok || j != i {
+			*caps = (*caps)[:n]
+			return i, false
+		}
+		return i, true
+	case pGrammar:
+		return m.call(p.rules[0], i, caps)
+	case pCall:
+		return m.call(p.p1, i, caps)
+	case pRef:
+		m.L.RaiseError("rule '%s' used outside a grammar", p.name.String())
+	case pCapture:
+		return m.matchCapture(p, i, caps)
+	}
+	return i, false
+}
+
+func (m *matcher) call(rule *pattern, i int, caps *[]capture) (int, bool) {
+	if m.depth >= m.maxStack {
+		m.L.RaiseError("backtrack stack overflow (current limit is %d)", m.maxStack)
+	}
+	m.depth++
+	j, ok := m.match(rule, i, caps)
+	m.depth--
+	return j, ok
+}
+
+func (m *matcher) matchCapture(p *pattern, i int, caps *[]capture) (int, bool) {
+	if p.p1 == nil {
+		*caps = append(*caps, capture{p: p, s: i, e: i})
+		return i, true
+	}
+	var kids []capture
+	j, ok := m.match(p.p1, i, &kids)
+	if !ok {
+		return i, false
+	}
+	c := capture{p: p, s: i, e: j, kids: kids}
+	if p.cap == capRuntime {
+		args := append([]lua.LValue{lua.LString(m.subject), lua.LNumber(j + 1)},
+			m.nestedValues(&c, nil, false)...)
+		results := m.callFunction(p.value, args)
+		if len(results) == 0 {
+			return i, false
+		}
+		switch r := results[0].(type) {
+		case lua.LBool:
+			if !r {
+				return i, false
+			}
+		case lua.LNumber:
+			if int(r) < j+1 || int(r) > len(m.subject)+1 {
+				m.L.RaiseError("invalid position returned by match-time capture")
+			}
+			j = int(r) - 1
+		default:
+			if r == lua.LNil {
+				return i, false
+			}
+			m.L.RaiseError("invalid return value from match-time capture (a %s)",
+				r.Type().String())
+		}
+		c = capture{p: p, s: i, e: j, values: results[1:]}
+	}
+	*caps = append(*caps, c)
+	return j, true
+}
+
+func (m *matcher) callFunction(fn lua.LValue, args []lua.LValue) []lua.LValue {
+	L := m.L
+	top := L.GetTop()
+	L.Push(fn)
+	for _, a := range args {
+		L.Push(a)
+	}
+	L.Call(len(args), lua.MultRet)
+	n := L.GetTop() - top
+	results := make([]lua.LValue, n)
+	for k := 0; k < n; k++ {
+		results[k] = L.Get(top + 1 + k)
+	}
+	L.Pop(n)
+	return results
+}
+
+// The captures preceding the one being evaluated, used to resolve back
+// references to the most recent group with a given name.
+type capEnv struct {
+	caps   []capture
+	idx    int
+	parent *capEnv
+}
+
+func (m *matcher) values(caps []capture, parent *capEnv) (values []lua.LValue) {
+	for k := range caps {
+		env := &capEnv{caps: caps, idx: k, parent: parent}
+		values = append(values, m.captureValues(&caps[k], env)...)
+	}
+	return values
+}
+
+// Returns the values of the nested captures, or the matched text when there
+// are none (or always prepended when whole is set).
+func (m *matcher) nestedValues(c *capture, env *capEnv, whole bool) []lua.LValue {
+	values := m.values(c.kids, env)
+	if whole || len(values) == 0 {
+		values = append([]lua.LValue{lua.LString(m.subject[c.s:c.e])}, values...)
+	}
+	return values
+}
+
+func (m *matcher) firstValue(c *capture, env *capEnv) lua.LValue {
+	return m.nestedValues(c, env, false)[0]
+}
+
+func (m *matcher) captureValues(c *capture, env *capEnv) []lua.LValue {
+	p := c.p
+	switch p.cap {
+	case capSimple:
+		return m.nestedValues(c, env, true)
+	case capConst:
+		return p.values
+	case capPosition:
+		return []lua.LValue{lua.LNumber(c.s + 1)}
+	case capArg:
+		if p.n > len(m.args) {
+			m.L.RaiseError("reference to absent extra argument #%d", p.n)
+		}
+		return []lua.LValue{m.args[p.n-1]}
+	case capBackref:
+		return m.backref(p.name, env)
+	case capGroup:
+		if p.name != nil {
+			return nil // only visible to tables and back references
+		}
+		return m.nestedValues(c, env, false)
+	case capTable:
+		t := m.L.NewTable()
+		for k := range c.kids {
+			kid := &c.kids[k]
+			kenv := &capEnv{caps: c.kids, idx: k, parent: env}
+			if kid.p.cap == capGroup && kid.p.name != nil {
+				t.RawSet(kid.p.name, m.firstValue(kid, kenv))
+				continue
+			}
+			for _, v := range m.captureValues(kid, kenv) {
+				t.Append(v)
+			}
+		}
+		return []lua.LValue{t}
+	case capSubst:
+		var b strings.Builder
+		cur := c.s
+		for k := range c.kids {
+			kid := &c.kids[k]
+			b.WriteString(m.subject[cur:kid.s])
+			values := m.captureValues(kid, &capEnv{caps: c.kids, idx: k, parent: env})
+			if len(values) == 0 {
+				b.WriteString(m.subject[kid.s:kid.e])
+			} else {
+				switch v := values[0].(type) {
+				case lua.LString, lua.LNumber:
+					b.WriteString(v.String())
+				default:
+					if v == lua.LFalse || v == lua.LNil {
+						b.WriteString(m.subject[kid.s:kid.e])
+					} else {
+						m.L.RaiseError("invalid replacement value (a %s)", v.Type().String())
+					}
+				}
+			}
+			cur = kid.e
+		}
+		b.WriteString(m.subject[cur:c.e])
+		return []lua.LValue{lua.LString(b.String())}
+	case capFold:
+		if len(c.kids) == 0 {
+			m.L.RaiseError("no initial value for fold capture")
+		}
+		first := m.captureValues(&c.kids[0], &capEnv{caps: c.kids, idx: 0, parent: env})
+		if len(first) == 0 {
+			m.L.RaiseError("no initial value for fold capture")
+		}
+		acc := first[0]
+		for k := 1; k < len(c.kids); k++ {
+			values := m.captureValues(&c.kids[k], &capEnv{caps: c.kids, idx: k, parent: env})
+			results := m.callFunction(p.value, append([]lua.LValue{acc}, values...))
+			if len(results) > 0 {
+				acc = results[0]
+			} else {
+				acc = lua.LNil
+			}
+		}
+		return []lua.LValue{acc}
+	case capString:
+		return []lua.LValue{lua.LString(m.formatString(c, env))}
+	case capNum:
+		if p.n == 0 {
+			return nil
+		}
+		values := m.nestedValues(c, env, false)
+		if p.n > len(values) {
+			m.L.RaiseError("no capture '%d'", p.n)
+		}
+		return values[p.n-1 : p.n]
+	case capQuery:
+		v := m.L.GetTable(p.value, m.firstValue(c, env))
+		if v == lua.LNil {
+			return nil
+		}
+		return []lua.LValue{v}
+	case capFunction:
+		return m.callFunction(p.value, m.nestedValues(c, env, false))
+	case capRuntime:
+		return c.values
+	}
+	return nil
+}
+
+// Expands the %0 (whole match) and %1-%9 (capture values) references of a
+// string capture.
+func (m *matcher) formatString(c *capture, env *capEnv) string {
+	format := string(c.p.value.(lua.LString))
+	var values []lua.LValue
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		ch := format[i]
+		if ch != '%' || i+1 == len(format) {
+			b.WriteByte(ch)
+			continue
+		}
+		i++
+		ch = format[i]
+		if ch < '0' || ch > '9' {
+			b.WriteByte(ch)
+			continue
+		}
+		if ch == '0' {
+			b.WriteString(m.subject[c.s:c.e])
+			continue
+		}
+		if values == nil {
+			values = m.nestedValues(c, env, false)
+		}
+		n := int(ch - '0')
+		if n > len(values) {
+			m.L.RaiseError("invalid capture index (%%%d in replacement string)", n)
+		}
+		switch v := values[n-1].(type) {
+		case lua.LString, lua.LNumber:
+			b.WriteString(v.String())
+		default:
+			m.L.RaiseError("invalid capture value (a %s)", v.Type().String())
+		}
+	}
+	return b.String()
+}
+
+// Finds the most recent complete group capture with the name, searching the
+// preceding captures at each nesting level outwards.
+func (m *matcher) backref(name lua.LValue, env *capEnv) []lua.LValue {
+	for e := env; e != nil; e = e.parent {
+		for k := e.idx - 1; k >= 0; k-- {
+			c := &e.caps[k]
+			if c.p.cap == capGroup && c.p.name == name {
+				return m.nestedValues(c, &capEnv{caps: e.caps, idx: k, parent: e.parent}, false)
+			}
+		}
+	}
+	m.L.RaiseError("back reference '%s' not found", name.String())
+	return nil
+}
@@ -0,0 +1,314 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012-2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/pborman/uuid"
+	lua "github.com/yuin/gopher-lua"
+	"heka/message"
+)
+
+// Builds a Heka message from a Lua table. The table uses the message header
+// names as keys (Uuid, Timestamp, Type, Logger, Severity, Payload,
+// EnvVersion, Pid, Hostname) and an optional Fields table keyed by field
+// name. A missing Uuid is generated, a missing Timestamp is set from now.
+func tableToMessage(t *lua.LTable, now func() int64) (msg *message.Message, err error) {
+	msg = new(message.Message)
+
+	switch v := t.RawGetString("Uuid").(type) {
+	case *lua.LNilType:
+		msg.SetUuid(uuid.NewRandom())
+	case lua.LString:
+		if len(v) == 16 {
+			msg.SetUuid([]byte(v))
+		} else if b := uuid.Parse(string(v)); b != nil {
+			msg.SetUuid(b)
+		} else {
+			return nil, errors.New("invalid Uuid")
+		}
+	default:
+		return nil, fmt.Errorf("Uuid must be a string, got %s", v.Type())
+	}
+
+	switch v := headerNumber(t.RawGetString("Timestamp")).(type) {
+	case *lua.LNilType:
+		msg.SetTimestamp(now())
+	case lua.LNumber:
+		msg.SetTimestamp(int64(v))
+	default:
+		return nil, fmt.Errorf("Timestamp must be a number, got %s", v.Type())
+	}
+
+	headers := []struct {
+		name string
+		set  func(string)
+	}{
+		{"Type", msg.SetType},
+		{"Logger", msg.SetLogger},
+		{"Payload", msg.SetPayload},
+		{"EnvVersion", msg.SetEnvVersion},
+		{"Hostname", msg.SetHostname},
+	}
+	for _, h := range headers {
+		switch v := t.RawGetString(h.name).(type) {
+		case *lua.LNilType:
+		case lua.LString, lua.LNumber:
+			h.set(v.String())
+		default:
+			return nil, fmt.Errorf("%s must be a string, got %s", h.name, v.Type())
+		}
+	}
+
+	switch v := headerNumber(t.RawGetString("Severity")).(type) {
+	case *lua.LNilType:
+	case lua.LNumber:
+		msg.SetSeverity(int32(v))
+	default:
+		return nil, fmt.Errorf("Severity must be a number, got %s", v.Type())
+	}
+
+	switch v := headerNumber(t.RawGetString("Pid")).(type) {
+	case *lua.LNilType:
+	case lua.LNumber:
+		msg.SetPid(int32(v))
+	default:
+		return nil, fmt.Errorf("Pid must be a number, got %s", v.Type())
+	}
+
+	switch v := t.RawGetString("Fields").(type) {
+	case *lua.LNilType:
+	case *lua.LTable:
+		if err = tableToFields(msg, v); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Fields must be a table, got %s", v.Type())
+	}
+	return msg, nil
+}
+
+// Adds the entries of a Lua Fields table to the message in table iteration
+// order. Fields are either keyed by name, with the value being a scalar, an
+// array or a table of the form {value=..., representation=...,
+// value_type=...}, or listed as an array of such tables carrying a name key
+// (the form produced by decode_message).
+func tableToFields(msg *message.Message, fields *lua.LTable) error {
+	for k, v := fields.Next(lua.LNil); k != lua.LNil; k, v = fields.Next(k) {
+		var name string
+		switch k := k.(type) {
+		case lua.LString:
+			name = string(k)
+		case lua.LNumber:
+			t, ok := v.(*lua.LTable)
+			if !ok {
+				return fmt.Errorf("field %s must be a table, got %s", k, v.Type())
+			}
+			n, ok := t.RawGetString("name").(lua.LString)
+			if !ok {
+				return fmt.Errorf("field %s is missing a name", k)
+			}
+			name = string(n)
+		default:
+			return fmt.Errorf("field name must be a string, got %s", k.Type())
+		}
+		f, err := valueToField(name, v)
+		if err != nil {
+			return err
+		}
+		msg.AddField(f)
+	}
+	return nil
+}
+
+// Converts a scalar, an array of scalars or a nested field table into a
+// message field.
+func valueToField(name string, lv lua.LValue) (f *message.Field, err error) {
+	f = &message.Field{Name: &name}
+	var valueType lua.LValue = lua.LNil
+	if t, ok := lv.(*lua.LTable); ok && t.RawGetString("value") != lua.LNil {
+		switch r := t.RawGetString("representation").(type) {
+		case *lua.LNilType:
+		case lua.LString:
+			if len(r) > 0 {
+				f.Representation = proto.String(string(r))
+			}
+		default:
+			return nil, fmt.Errorf("representation must be a string, got %s", r.Type())
+		}
+		valueType = t.RawGetString("value_type")
+		lv = t.RawGetString("value")
+	}
+
+	var values []lua.LValue
+	if t, ok := lv.(*lua.LTable); ok {
+		n := t.Len()
+		if n == 0 {
+			return nil, errors.New("unsupported type: nil")
+		}
+		values = make([]lua.LValue, n)
+		for i := 1; i <= n; i++ {
+			values[i-1] = t.RawGetInt(i)
+		}
+	} else {
+		values = []lua.LValue{lv}
+	}
+
+	var ft message.Field_ValueType
+	switch vt := valueType.(type) {
+	case *lua.LNilType:
+		switch values[0].Type() {
+		case lua.LTNumber:
+			ft = message.Field_DOUBLE
+		case lua.LTBool:
+			ft = message.Field_BOOL
+		default:
+			ft = message.Field_STRING
+		}
+	case lua.LNumber:
+		ft = message.Field_ValueType(vt)
+		if _, ok := message.Field_ValueType_name[int32(ft)]; !ok {
+			return nil, fmt.Errorf("invalid value_type: %d", int(vt))
+		}
+	default:
+		return nil, fmt.Errorf("value_type must be a number, got %s", vt.Type())
+	}
+
+	first := values[0].Type()
+	for _, v := range values {
+		if v.Type() != first {
+			return nil, errors.New("array has mixed types")
+		}
+		switch v := v.(type) {
+		case lua.LString:
+			switch ft {
+			case message.Field_STRING:
+				f.ValueString = append(f.ValueString, string(v))
+			case message.Field_BYTES:
+				f.ValueBytes = append(f.ValueBytes, []byte(v))
+			default:
+				return nil, fmt.Errorf("value_type %s does not accept a string", ft)
+			}
+		case lua.LNumber:
+			switch ft {
+			case message.Field_DOUBLE:
+				f.ValueDouble = append(f.ValueDouble, float64(v))
+			case message.Field_INTEGER:
+				f.ValueInteger = append(f.ValueInteger, int64(v))
+			default:
+				return nil, fmt.Errorf("value_type %s does not accept a number", ft)
+			}
+		case lua.LBool:
+			if ft != message.Field_BOOL {
+				return nil, fmt.Errorf("value_type %s does not accept a boolean", ft)
+			}
+			f.ValueBool = append(f.ValueBool, bool(v))
+		default:
+			return nil, fmt.Errorf("unsupported type: %s", v.Type())
+		}
+	}
+	if ft != message.Field_STRING {
+		f.ValueType = ft.Enum()
+	}
+	return f, nil
+}
+
+// Converts a Heka message into the table form accepted by inject_message.
+func messageToTable(L *lua.LState, msg *message.Message) *lua.LTable {
+	t := L.NewTable()
+	if msg.Uuid != nil {
+		t.RawSetString("Uuid", lua.LString(msg.Uuid))
+	}
+	if msg.Timestamp != nil {
+		t.RawSetString("Timestamp", lua.LNumber(msg.GetTimestamp()))
+	}
+	if msg.Type != nil {
+		t.RawSetString("Type", lua.LString(msg.GetType()))
+	}
+	if msg.Logger != nil {
+		t.RawSetString("Logger", lua.LString(msg.GetLogger()))
+	}
+	if msg.Severity != nil {
+		t.RawSetString("Severity", lua.LNumber(msg.GetSeverity()))
+	}
+	if msg.Payload != nil {
+		t.RawSetString("Payload", lua.LString(msg.GetPayload()))
+	}
+	if msg.EnvVersion != nil {
+		t.RawSetString("EnvVersion", lua.LString(msg.GetEnvVersion()))
+	}
+	if msg.Pid != nil {
+		t.RawSetString("Pid", lua.LNumber(msg.GetPid()))
+	}
+	if msg.Hostname != nil {
+		t.RawSetString("Hostname", lua.LString(msg.GetHostname()))
+	}
+	if len(msg.Fields) == 0 {
+		return t
+	}
+
+	fields := L.CreateTable(len(msg.Fields), 0)
+	for _, f := range msg.Fields {
+		ft := L.NewTable()
+		ft.RawSetString("name", lua.LString(f.GetName()))
+		ft.RawSetString("value_type", lua.LNumber(f.GetValueType()))
+		if f.Representation != nil {
+			ft.RawSetString("representation", lua.LString(f.GetRepresentation()))
+		}
+		values := L.NewTable()
+		switch f.GetValueType() {
+		case message.Field_STRING:
+			for _, v := range f.ValueString {
+				values.Append(lua.LString(v))
+			}
+		case message.Field_BYTES:
+			for _, v := range f.ValueBytes {
+				values.Append(lua.LString(v))
+			}
+		case message.Field_INTEGER:
+			for _, v := range f.ValueInteger {
+				values.Append(lua.LNumber(v))
+			}
+		case message.Field_DOUBLE:
+			for _, v := range f.ValueDouble {
+				values.Append(lua.LNumber(v))
+			}
+		case message.Field_BOOL:
+			for _, v := range f.ValueBool {
+				values.Append(lua.LBool(v))
+			}
+		}
+		ft.RawSetString("value", values)
+		fields.Append(ft)
+	}
+	t.RawSetString("Fields", fields)
+	return t
+}
+
+// Numeric strings are accepted for the numeric headers, like the C sandbox
+// coerced them with lua_tonumber.
+func headerNumber(v lua.LValue) lua.LValue {
+	if s, ok := v.(lua.LString); ok {
+		if n, err := strconv.ParseFloat(strings.TrimSpace(string(s)), 64); err == nil {
+			return lua.LNumber(n)
+		}
+	}
+	return v
+}
@@ -63,6 +63,7 @@ func (p *luaStatePool) New() *lua.LState {
 	L := lua.NewState()
 
 	luaJson.Preload(L)
+	L.PreloadModule(lpegModule, loadLpeg)
 
 	//L.PreloadModule("scriptOps", scriptModule)
 
@@ -0,0 +1,190 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012-2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package lua
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+
+	lua "github.com/yuin/gopher-lua"
+	"heka/message"
+	"heka/sandbox"
+)
+
+type profileFunction struct {
+	name         string
+	source       string
+	line         int
+	calls        uint64
+	instructions uint64
+	lines        map[int]uint64
+}
+
+func (f *profileFunction) label() string {
+	return fmt.Sprintf("%s (%s:%d)", f.name, f.source, f.line)
+}
+
+// Counts the instructions executed by each Lua function and line and the
+// calls of each function. It samples every instruction from the limit
+// context so it is only created when the profile option is set.
+type luaProfiler struct {
+	functions map[*lua.FunctionProto]*profileFunction
+	last      lua.Debug // the frame of the previous instruction
+}
+
+func newLuaProfiler() *luaProfiler {
+	return &luaProfiler{functions: make(map[*lua.FunctionProto]*profileFunction)}
+}
+
+// Called by startCall, the first frame of a call from Go is always new.
+func (p *luaProfiler) reset() {
+	p.last = lua.Debug{}
+}
+
+// Records the instruction about to be executed, gopher-lua has already
+// advanced the frame's program counter so the current line is the
+// instruction's.
+func (p *luaProfiler) sample(L *lua.LState) {
+	dbg, ok := L.GetStack(0)
+	if !ok {
+		return
+	}
+	frame := *dbg
+	fn, err := L.GetInfo("fl", dbg, lua.LNil)
+	f, ok := fn.(*lua.LFunction)
+	if err != nil || !ok || f.IsG {
+		return
+	}
+	pf := p.functions[f.Proto]
+	if pf == nil {
+		pf = &profileFunction{
+			name:   functionName(L, dbg, f),
+			source: f.Proto.SourceName,
+			line:   f.Proto.LineDefined,
+			lines:  make(map[int]uint64),
+		}
+		p.functions[f.Proto] = pf
+	}
+	pf.instructions++
+	if dbg.CurrentLine > 0 {
+		pf.lines[dbg.CurrentLine]++
+	}
+	if frame != p.last && p.called(L) {
+		pf.calls++
+	}
+	p.last = frame
+}
+
+// A frame is entered by a call when the previous instruction was executed by
+// its caller, possibly through Go functions like pcall, or when it was
+// called from Go. Otherwise the function is resumed after a call returned.
+func (p *luaProfiler) called(L *lua.LState) bool {
+	for level := 1; ; level++ {
+		dbg, ok := L.GetStack(level)
+		if !ok {
+			return p.last == lua.Debug{}
+		}
+		if *dbg == p.last {
+			return true
+		}
+		fn, _ := L.GetInfo("f", dbg, lua.LNil)
+		if f, ok := fn.(*lua.LFunction); !ok || !f.IsG {
+			return false
+		}
+	}
+}
+
+// Names a function after the call site, the functions called from Go
+// (process_message, timer_event) are looked up in the globals.
+func functionName(L *lua.LState, dbg *lua.Debug, f *lua.LFunction) string {
+	if f.Proto.LineDefined == 0 {
+		return "main chunk"
+	}
+	L.GetInfo("n", dbg, lua.LNil)
+	if dbg.Name != "" && dbg.Name != "?" && dbg.Name != "main chunk" {
+		return dbg.Name
+	}
+	name := "?"
+	L.G.Global.ForEach(func(k, v lua.LValue) {
+		if g, ok := v.(*lua.LFunction); ok && !g.IsG && g.Proto == f.Proto {
+			name = k.String()
+		}
+	})
+	return name
+}
+
+// Returns the functions ordered by the instructions they executed.
+func (p *luaProfiler) sorted() []*profileFunction {
+	fns := make([]*profileFunction, 0, len(p.functions))
+	for _, f := range p.functions {
+		fns = append(fns, f)
+	}
+	sort.Slice(fns, func(i, j int) bool {
+		if fns[i].instructions != fns[j].instructions {
+			return fns[i].instructions > fns[j].instructions
+		}
+		return fns[i].label() < fns[j].label()
+	})
+	return fns
+}
+
+func (this *LuaSandbox) Profiling() bool {
+	return this.profiler != nil
+}
+
+// Adds the instruction and call counts of the busiest functions to a report
+// message.
+func (this *LuaSandbox) ReportProfile(msg *message.Message) {
+	sandbox.ReportProfile(msg, this.ProfileCounts())
+}
+
+func (this *LuaSandbox) ProfileCounts() []sandbox.ProfileCount {
+	if this.profiler == nil {
+		return nil
+	}
+	counts := make([]sandbox.ProfileCount, 0, len(this.profiler.functions))
+	for _, f := range this.profiler.functions {
+		counts = append(counts, sandbox.ProfileCount{
+			Function:     f.label(),
+			Instructions: f.instructions,
+			Calls:        f.calls,
+		})
+	}
+	return counts
+}
+
+// Writes the profile as tab separated text, a line per function ordered by
+// the instructions executed followed by its lines in source order.
+func (this *LuaSandbox) WriteProfile(w io.Writer) error {
+	if this.profiler == nil {
+		return nil
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# %s\n# instructions\tcalls\tfunction\n", this.sbConfig.ScriptFilename)
+	for _, f := range this.profiler.sorted() {
+		fmt.Fprintf(bw, "%d\t%d\t%s\n", f.instructions, f.calls, f.label())
+		lines := make([]int, 0, len(f.lines))
+		for l := range f.lines {
+			lines = append(lines, l)
+		}
+		sort.Ints(lines)
+		for _, l := range lines {
+			fmt.Fprintf(bw, "%d\t\t%s:%d\n", f.lines[l], f.source, l)
+		}
+	}
+	return bw.Flush()
+}
@@ -20,18 +20,21 @@ import (
 	"fmt"
 	lua "github.com/yuin/gopher-lua"
 	"log"
-	"path/filepath"
+	"os"
 	"strconv"
 	"strings"
 	"time"
-	"unsafe"
 
+	"github.com/gogo/protobuf/proto"
 	"github.com/pborman/uuid"
 	"heka/message"
 	"heka/pipeline"
 	"heka/sandbox"
 )
 
+// The Lua environment templates, inputs and outputs are trusted with the io
+// module and the os functions touching the system. The debug and channel
+// modules gopher-lua adds are never available.
 const SandboxIoTemplate = `{
 memory_limit = %d,
 instruction_limit = %d,
@@ -39,8 +42,10 @@ output_limit = %d,
 path = [[%s]],
 cpath = [[%s]],
 remove_entries = {
-[''] = { 'dofile', 'load', 'loadfile','loadstring', 'print'},
-os = {'exit', 'setlocale'}}}`
+[''] = { '_printregs', 'dofile', 'load', 'loadfile','loadstring', 'print'},
+os = {'exit', 'setenv', 'setlocale'}},
+disable_modules = {channel = 1, debug = 1}
+}`
 
 const SandboxTemplate = `{
 memory_limit = %d,
@@ -49,10 +54,10 @@ output_limit = %d,
 path = [[%s]],
 cpath = [[%s]],
 remove_entries = {
-[''] = {'collectgarbage','coroutine','dofile','load','loadfile','loadstring','newproxy','print'},
-os = {'getenv','execute','exit','remove','rename','setlocale','tmpname'}
+[''] = {'_printregs','collectgarbage','coroutine','dofile','load','loadfile','loadstring','newproxy','print'},
+os = {'getenv','execute','exit','remove','rename','setenv','setlocale','tmpname'}
 },
-disable_modules = {io = 1}
+disable_modules = {channel = 1, debug = 1, io = 1}
 }`
 
 func extractLuaFieldName(wrapped string) (fn string, found bool) {
@@ -65,56 +70,75 @@ func extractLuaFieldName(wrapped string) (fn string, found bool) {
 	return
 }
 
-func lookup_field(msg *message.Message, fn string, fi, ai int) (int,
-	unsafe.Pointer, int) {
+// Raises a Lua error formatted like the reference implementation's
+// luaL_argerror.
+func argError(L *lua.LState, n int, fname, extramsg string) {
+	L.RaiseError("bad argument #%d to '%s' (%s)", n, fname, extramsg)
+}
+
+func checkString(L *lua.LState, n int, fname string) string {
+	switch v := L.Get(n).(type) {
+	case lua.LString:
+		return string(v)
+	case lua.LNumber:
+		return v.String()
+	}
+	argError(L, n, fname, "string expected, got "+L.Get(n).Type().String())
+	return ""
+}
 
+func checkInt(L *lua.LState, n int, fname string) int {
+	if v, ok := L.Get(n).(lua.LNumber); ok {
+		return int(v)
+	}
+	argError(L, n, fname, "number expected, got "+L.Get(n).Type().String())
+	return 0
+}
+
+func lookup_field(msg *message.Message, fn string, fi, ai int) lua.LValue {
 	var field *message.Field
 	if fi != 0 {
 		fields := msg.FindAllFields(fn)
 		if fi >= len(fields) {
-			return 0, unsafe.Pointer(nil), 0
+			return lua.LNil
 		}
 		field = fields[fi]
 	} else {
 		if field = msg.FindFirstField(fn); field == nil {
-			return 0, unsafe.Pointer(nil), 0
+			return lua.LNil
 		}
 	}
-	fieldType := int(field.GetValueType())
 	switch field.GetValueType() {
 	case message.Field_STRING:
 		if ai >= len(field.ValueString) {
 			break
 		}
-		value := field.ValueString[ai]
-		return fieldType, unsafe.Pointer(&value), len(value)
+		return lua.LString(field.ValueString[ai])
 	case message.Field_BYTES:
 		if ai >= len(field.ValueBytes) {
 			break
 		}
-		value := field.ValueBytes[ai]
-		valueLen := len(value)
-		if valueLen == 0 {
+		if len(field.ValueBytes[ai]) == 0 {
 			break
 		}
-		return fieldType, unsafe.Pointer(&field.ValueBytes[ai][0]), valueLen
+		return lua.LString(field.ValueBytes[ai])
 	case message.Field_INTEGER:
 		if ai >= len(field.ValueInteger) {
 			break
 		}
-		return fieldType, unsafe.Pointer(&field.ValueInteger[ai]), 0
+		return lua.LNumber(field.ValueInteger[ai])
 	case message.Field_DOUBLE:
 		if ai >= len(field.ValueDouble) {
 			break
 		}
-		return fieldType, unsafe.Pointer(&field.ValueDouble[ai]), 0
+		return lua.LNumber(field.ValueDouble[ai])
 	case message.Field_BOOL:
 		if ai >= len(field.ValueBool) {
 			break
 		}
-		return fieldType, unsafe.Pointer(&field.ValueBool[ai]), 0
+		return lua.LBool(field.ValueBool[ai])
 	}
-	return 0, unsafe.Pointer(nil), 0
+	return lua.LNil
 }
 
 // Enforces field and array index limits.
@@ -151,18 +175,26 @@ func write_to_field(msg *message.Message, fn string, value interface{}, rep stri
 	field = fields[fi]
 	switch field.GetValueType() {
 	case message.Field_STRING:
-
+		v, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("type error, '%s' is a string field", field.GetName())
+		}
 		if ai > len(field.ValueString) {
 			return errors.New("bad array index")
 		}
 		if ai == len(field.ValueString) {
-			field.ValueString = append(field.ValueString, value.(string))
+			field.ValueString = append(field.ValueString, v)
 		} else {
-			field.ValueString[ai] = value.(string)
+			field.ValueString[ai] = v
 		}
 	case message.Field_BYTES:
-		v, ok := value.([]byte)
-		if !ok {
+		var v []byte
+		switch b := value.(type) {
+		case []byte:
+			v = b
+		case string:
+			v = []byte(b)
+		default:
 			return fmt.Errorf("type error, '%s' is a bytes field", field.GetName())
 		}
 		if ai > len(field.ValueBytes) {
@@ -174,7 +206,8 @@ func write_to_field(msg *message.Message, fn string, value interface{}, rep stri
 			field.ValueBytes[ai] = v
 		}
 	case message.Field_INTEGER:
-		v, ok := value.(int32)
+		// Lua only has doubles, integer fields are truncated on write.
+		v, ok := value.(float64)
 		if !ok {
 			return fmt.Errorf("type error, '%s' is an integer field", field.GetName())
 		}
@@ -271,113 +304,100 @@ func delete_field(msg *message.Message, fn string, fi, ai int, has_ai bool) erro
 	return nil
 }
 
-func go_lua_read_message(ptr unsafe.Pointer, c string, fi, ai int) (int, unsafe.Pointer,
-	int) {
-	var lsb *LuaSandbox = (*LuaSandbox)(ptr)
-	if lsb.pack != nil {
-		fieldName := c
-		switch fieldName {
-		case "Type":
-			value := lsb.pack.Message.GetType()
-			cs := &value // freed by the caller
-			return int(message.Field_STRING), unsafe.Pointer(cs),
-				len(value)
-		case "Logger":
-			value := lsb.pack.Message.GetLogger()
-			cs := &value // freed by the caller
-			return int(message.Field_STRING), unsafe.Pointer(cs),
-				len(value)
-		case "Payload":
-			value := lsb.pack.Message.GetPayload()
-			cs := &value // freed by the caller
-			return int(message.Field_STRING), unsafe.Pointer(cs),
-				len(value)
-		case "EnvVersion":
-			value := lsb.pack.Message.GetEnvVersion()
-			cs := &value // freed by the caller
-			return int(message.Field_STRING), unsafe.Pointer(cs),
-				len(value)
-		case "Hostname":
-			value := lsb.pack.Message.GetHostname()
-			cs := &value // freed by the caller
-			return int(message.Field_STRING), unsafe.Pointer(cs),
-				len(value)
-		case "Uuid":
-			value := lsb.pack.Message.GetUuidString()
-			cs := &value // freed by the caller
-			return int(message.Field_STRING), unsafe.Pointer(cs),
-				len(value)
-		case "Timestamp":
-			return int(message.Field_INTEGER),
-				unsafe.Pointer(lsb.pack.Message.Timestamp), 0
-		case "Severity":
-			return int(message.Field_INTEGER),
-				unsafe.Pointer(lsb.pack.Message.Severity), 0
-		case "Pid":
-			return int(message.Field_INTEGER),
-				unsafe.Pointer(lsb.pack.Message.Pid), 0
-		case "raw":
-			if len(lsb.pack.MsgBytes) > 0 {
-				return int(message.Field_BYTES),
-					unsafe.Pointer(&lsb.pack.MsgBytes[0]),
-					len(lsb.pack.MsgBytes)
-			}
-		default:
-			if fn, found := extractLuaFieldName(fieldName); found {
-				return lookup_field(lsb.pack.Message, fn, fi, ai)
-			}
+func (this *LuaSandbox) readMessage(fieldName string, fi, ai int) lua.LValue {
+	if this.pack == nil {
+		return lua.LNil
+	}
+	msg := this.pack.Message
+	switch fieldName {
+	case "Type":
+		return lua.LString(msg.GetType())
+	case "Logger":
+		return lua.LString(msg.GetLogger())
+	case "Payload":
+		return lua.LString(msg.GetPayload())
+	case "EnvVersion":
+		return lua.LString(msg.GetEnvVersion())
+	case "Hostname":
+		return lua.LString(msg.GetHostname())
+	case "Uuid":
+		return lua.LString(msg.GetUuidString())
+	case "Timestamp":
+		if msg.Timestamp != nil {
+			return lua.LNumber(*msg.Timestamp)
+		}
+	case "Severity":
+		if msg.Severity != nil {
+			return lua.LNumber(*msg.Severity)
+		}
+	case "Pid":
+		if msg.Pid != nil {
+			return lua.LNumber(*msg.Pid)
+		}
+	case "raw":
+		if len(this.pack.MsgBytes) > 0 {
+			return lua.LString(this.pack.MsgBytes)
+		}
+	default:
+		if fn, found := extractLuaFieldName(fieldName); found {
+			return lookup_field(msg, fn, fi, ai)
 		}
 	}
-	return 0, unsafe.Pointer(nil), 0
+	return lua.LNil
 }
 
-//export go_lua_write_message_string
-func go_lua_write_message_string(ptr unsafe.Pointer, c, v, rep string,
-	fi, ai int) int {
+// Prepares the pack for modification, encoders work on a copy of the message
+// so the original can still be delivered to any other outputs.
+func (this *LuaSandbox) writablePack(src string) bool {
+	if this.pack == nil {
+		this.globals.LogMessage(src, "No sandbox pack.")
+		return false
+	}
+	this.pack.TrustMsgBytes = false
+	if !this.messageCopied && this.sbConfig.PluginType == "encoder" {
+		this.pack.Message = message.CopyMessage(this.pack.Message)
+		this.messageCopied = true
+	}
+	return true
+}
 
-	var lsb *LuaSandbox = (*LuaSandbox)(ptr)
-	if lsb.pack == nil {
-		lsb.globals.LogMessage("go_lua_write_message_string", "No sandbox pack.")
+func (this *LuaSandbox) writeMessageString(c, v, rep string, fi, ai int) int {
+	if !this.writablePack("write_message_string") {
 		return 1
 	}
-	lsb.pack.TrustMsgBytes = false
-	if !lsb.messageCopied && lsb.sbConfig.PluginType == "encoder" {
-		lsb.pack.Message = message.CopyMessage(lsb.pack.Message)
-		lsb.messageCopied = true
-	}
 
 	fieldName := c
 	switch fieldName {
 	case "Type":
-		lsb.pack.Message.SetType(v)
+		this.pack.Message.SetType(v)
 		return 0
 	case "Logger":
-		lsb.pack.Message.SetLogger(v)
+		this.pack.Message.SetLogger(v)
 		return 0
 	case "Payload":
-		lsb.pack.Message.SetPayload(v)
+		this.pack.Message.SetPayload(v)
 		return 0
 	case "EnvVersion":
-		lsb.pack.Message.SetEnvVersion(v)
+		this.pack.Message.SetEnvVersion(v)
 		return 0
 	case "Hostname":
-		lsb.pack.Message.SetHostname(v)
+		this.pack.Message.SetHostname(v)
 		return 0
 	case "Uuid":
 		value := v
 		var uuidBytes []byte
 		if uuidBytes = uuid.Parse(value); uuidBytes == nil {
-			lsb.globals.LogMessage("go_lua_write_message_string",
+			this.globals.LogMessage("write_message_string",
 				"Bad UUID string.")
 			return 1
 		}
-		lsb.pack.Message.SetUuid(uuidBytes)
+		this.pack.Message.SetUuid(uuidBytes)
 		return 0
 	case "Timestamp":
 		vStr := v
 		// First make sure we have anything at all.
 		if vStr == "" {
-			lsb.globals.LogMessage("go_lua_write_message_string",
+			this.globals.LogMessage("write_message_string",
 				"Empty timestamp string.")
 			return 1
 		}
@@ -392,250 +412,405 @@ func go_lua_write_message_string(ptr unsafe.Pointer, c, v, rep string,
 			var parsedTime time.Time
 			parsedTime, err = message.ForgivingTimeParse("", vStr, loc)
 			if err != nil {
-				lsb.globals.LogMessage("go_lua_write_message_string",
+				this.globals.LogMessage("write_message_string",
 					"Can't parse timestamp string.")
 				return 1
 			}
 			value = parsedTime.UnixNano()
 		}
-		lsb.pack.Message.SetTimestamp(value)
+		this.pack.Message.SetTimestamp(value)
 		return 0
 	case "Severity":
 		value, err := strconv.ParseInt(v, 0, 32)
 		if err != nil {
-			lsb.globals.LogMessage("go_lua_write_message_string",
+			this.globals.LogMessage("write_message_string",
 				"Can't parse severity value.")
 			return 1
 		}
-		lsb.pack.Message.SetSeverity(int32(value))
+		this.pack.Message.SetSeverity(int32(value))
 		return 0
 	case "Pid":
 		value, err := strconv.ParseInt(v, 0, 32)
 		if err != nil {
-			lsb.globals.LogMessage("go_lua_write_message_string",
+			this.globals.LogMessage("write_message_string",
 				"Can't parse PID value.")
 			return 1
 		}
-		lsb.pack.Message.SetPid(int32(value))
+		this.pack.Message.SetPid(int32(value))
 		return 0
 	default:
 		if fn, found := extractLuaFieldName(fieldName); found {
-			if err := write_to_field(lsb.pack.Message, fn, v, rep, fi, ai); err != nil {
-				lsb.globals.LogMessage("go_lua_write_message_string", err.Error())
+			if err := write_to_field(this.pack.Message, fn, v, rep, fi, ai); err != nil {
+				this.globals.LogMessage("write_message_string", err.Error())
 				return 1
 			}
 			return 0
 		}
 	}
-	lsb.globals.LogMessage("go_lua_write_message_string", "Bad field name.")
+	this.globals.LogMessage("write_message_string", "Bad field name.")
 	return 1
 }
 
-//export go_lua_write_message_double
-func go_lua_write_message_double(ptr unsafe.Pointer, c string, v float64, rep string,
+func (this *LuaSandbox) writeMessageDouble(c string, v float64, rep string,
 	fi, ai int) int {
 
-	fieldName := c
-	var lsb *LuaSandbox = (*LuaSandbox)(ptr)
-	if lsb.pack == nil {
-		lsb.globals.LogMessage("go_lua_write_message_double", "No sandbox pack.")
+	if !this.writablePack("write_message_double") {
 		return 1
 	}
-	lsb.pack.TrustMsgBytes = false
-	if !lsb.messageCopied && lsb.sbConfig.PluginType == "encoder" {
-		lsb.pack.Message = message.CopyMessage(lsb.pack.Message)
-		lsb.messageCopied = true
-	}
 
+	fieldName := c
 	switch fieldName {
 	case "Severity":
-		value := int32(v)
-		lsb.pack.Message.SetSeverity(value)
+		this.pack.Message.SetSeverity(int32(v))
 		return 0
 	case "Pid":
-		value := int32(v)
-		lsb.pack.Message.SetPid(value)
+		this.pack.Message.SetPid(int32(v))
 		return 0
 	case "Timestamp":
-		value := int64(v)
-		lsb.pack.Message.SetTimestamp(value)
+		this.pack.Message.SetTimestamp(int64(v))
 		return 0
 	default:
 		if fn, found := extractLuaFieldName(fieldName); found {
-			value := float64(v)
-			if err := write_to_field(lsb.pack.Message, fn, value, rep, fi, ai); err != nil {
-				lsb.globals.LogMessage("go_lua_write_message_double", err.Error())
+			if err := write_to_field(this.pack.Message, fn, v, rep, fi, ai); err != nil {
+				this.globals.LogMessage("write_message_double", err.Error())
 				return 1
 			}
 			return 0
 		}
 	}
-	lsb.globals.LogMessage("go_lua_write_message_double", "Bad field name.")
+	this.globals.LogMessage("write_message_double", "Bad field name.")
 	return 1
 }
 
-//export go_lua_write_message_bool
-func go_lua_write_message_bool(ptr unsafe.Pointer, c string, v bool, rep string,
+func (this *LuaSandbox) writeMessageBool(c string, v bool, rep string,
 	fi, ai int) int {
 
-	fieldName := c
-	var lsb *LuaSandbox = (*LuaSandbox)(ptr)
-	if lsb.pack == nil {
-		lsb.globals.LogMessage("go_lua_write_message_bool", "No sandbox pack.")
+	if !this.writablePack("write_message_bool") {
 		return 1
 	}
-	lsb.pack.TrustMsgBytes = false
-	if !lsb.messageCopied && lsb.sbConfig.PluginType == "encoder" {
-		lsb.pack.Message = message.CopyMessage(lsb.pack.Message)
-		lsb.messageCopied = true
-	}
 
-	if fn, found := extractLuaFieldName(fieldName); found {
-		if err := write_to_field(lsb.pack.Message, fn, v, rep, fi, ai); err != nil {
-			lsb.globals.LogMessage("go_lua_write_message_bool", err.Error())
+	if fn, found := extractLuaFieldName(c); found {
+		if err := write_to_field(this.pack.Message, fn, v, rep, fi, ai); err != nil {
+			this.globals.LogMessage("write_message_bool", err.Error())
 			return 1
 		}
 		return 0
 	}
-	lsb.globals.LogMessage("go_lua_write_message_bool", "Bad field name.")
+	this.globals.LogMessage("write_message_bool", "Bad field name.")
 	return 1
 }
 
-//export go_lua_delete_message_field
-func go_lua_delete_message_field(ptr unsafe.Pointer, c string, fi, ai int, has_ai bool) int {
-
-	fieldName := c
-	var lsb *LuaSandbox = (*LuaSandbox)(ptr)
-	if lsb.pack == nil {
-		lsb.globals.LogMessage("go_lua_delete_message_field", "No sandbox pack.")
+func (this *LuaSandbox) deleteMessageField(c string, fi, ai int, has_ai bool) int {
+	if !this.writablePack("delete_message_field") {
 		return 1
 	}
-	lsb.pack.TrustMsgBytes = false
-	if !lsb.messageCopied && lsb.sbConfig.PluginType == "encoder" {
-		lsb.pack.Message = message.CopyMessage(lsb.pack.Message)
-		lsb.messageCopied = true
-	}
 
-	if fn, found := extractLuaFieldName(fieldName); found {
-		if err := delete_field(lsb.pack.Message, fn, fi, ai, has_ai); err != nil {
-			lsb.globals.LogMessage("go_lua_delete_message_field", err.Error())
+	if fn, found := extractLuaFieldName(c); found {
+		if err := delete_field(this.pack.Message, fn, fi, ai, has_ai); err != nil {
+			this.globals.LogMessage("delete_message_field", err.Error())
 			return 1
 		}
 		return 0
 	}
-	lsb.globals.LogMessage("go_lua_delete_message_field", "Bad field name.")
+	this.globals.LogMessage("delete_message_field", "Bad field name.")
 	return 1
 }
 
-//export go_lua_read_next_field
-func go_lua_read_next_field(ptr unsafe.Pointer) (int, unsafe.Pointer, int,
-	unsafe.Pointer, int, unsafe.Pointer, int, int) {
+// read_message(variableName, fieldIndex, arrayIndex)
+func (this *LuaSandbox) luaReadMessage(L *lua.LState) int {
+	fi, ai := 0, 0
+	switch L.GetTop() {
+	case 3:
+		if ai = checkInt(L, 3, "read_message"); ai < 0 {
+			argError(L, 3, "read_message", "array index must be >= 0")
+		}
+		fallthrough
+	case 2:
+		if fi = checkInt(L, 2, "read_message"); fi < 0 {
+			argError(L, 2, "read_message", "field index must be >= 0")
+		}
+		fallthrough
+	case 1:
+	default:
+		L.RaiseError("read_message() incorrect number of arguments")
+	}
+	L.Push(this.readMessage(checkString(L, 1, "read_message"), fi, ai))
+	return 1
+}
+
+// write_message(variableName, value, representation, fieldIndex, arrayIndex)
+func (this *LuaSandbox) luaWriteMessage(L *lua.LState) int {
+	fi, ai := 0, 0
+	hasAi := false
+	rep := ""
+	switch L.GetTop() {
+	case 5:
+		if ai = checkInt(L, 5, "write_message"); ai < 0 {
+			argError(L, 5, "write_message", "array index must be >= 0")
+		}
+		hasAi = true
+		fallthrough
+	case 4:
+		if fi = checkInt(L, 4, "write_message"); fi < 0 {
+			argError(L, 4, "write_message", "field index must be >= 0")
+		}
+		fallthrough
+	case 3:
+		rep = checkString(L, 3, "write_message")
+		fallthrough
+	case 2:
+	default:
+		L.RaiseError("write_message() incorrect number of arguments")
+	}
+	name := checkString(L, 1, "write_message")
+
+	var result int
+	switch v := L.Get(2).(type) {
+	case lua.LNumber:
+		result = this.writeMessageDouble(name, float64(v), rep, fi, ai)
+	case lua.LString:
+		result = this.writeMessageString(name, string(v), rep, fi, ai)
+	case lua.LBool:
+		result = this.writeMessageBool(name, bool(v), rep, fi, ai)
+	case *lua.LNilType:
+		result = this.deleteMessageField(name, fi, ai, hasAi)
+	default:
+		L.RaiseError("write_message() only accepts numeric, string, or boolean field values, or nil to delete")
+	}
+	if result != 0 {
+		L.RaiseError("write_message() failed")
+	}
+	return 0
+}
+
+// read_next_field() returns type, name, value, representation, count
+func (this *LuaSandbox) luaReadNextField(L *lua.LState) int {
+	if L.GetTop() != 0 {
+		L.RaiseError("read_next_field() takes no arguments")
+	}
+	if this.pack == nil || this.field >= len(this.pack.Message.Fields) {
+		for i := 0; i < 5; i++ {
+			L.Push(lua.LNil)
+		}
+		return 5
+	}
+	field := this.pack.Message.Fields[this.field]
+	this.field++
+
 	var (
-		fieldType         int
-		name              string
-		namePtr           unsafe.Pointer
-		nameLen           int
-		representation    string
-		representationPtr unsafe.Pointer
-		representationLen int
-		valuePtr          unsafe.Pointer
-		valueLen          int
-		fieldLen          int
+		value    lua.LValue = lua.LNil
+		fieldLen int
 	)
-	var lsb *LuaSandbox = (*LuaSandbox)(ptr)
-	if lsb.pack != nil && lsb.field < len(lsb.pack.Message.Fields) {
-		field := lsb.pack.Message.Fields[lsb.field]
-		lsb.field++
-
-		fieldType = int(field.GetValueType())
-		name = field.GetName()
-		namePtr = unsafe.Pointer(&name) // freed by the caller
-		nameLen = len(name)
-		representation = field.GetRepresentation()
-		representationPtr = unsafe.Pointer(&representation) // freed by the caller
-		representationLen = len(representation)
-		switch field.GetValueType() {
-		case message.Field_STRING:
-			fieldLen = len(field.ValueString)
-			if fieldLen == 0 {
-				break
-			}
-			value := field.ValueString[0]
-			valuePtr = unsafe.Pointer(&value) // freed by the caller
-			valueLen = len(value)
-		case message.Field_BYTES:
-			fieldLen = len(field.ValueBytes)
-			if fieldLen == 0 {
-				break
-			}
-			value := field.ValueBytes[0]
-			valueLen = len(value)
-			if valueLen == 0 {
-				break
-			}
-			valuePtr = unsafe.Pointer(&field.ValueBytes[0][0])
-		case message.Field_INTEGER:
-			fieldLen = len(field.ValueInteger)
-			if fieldLen == 0 {
-				break
-			}
-			valuePtr = unsafe.Pointer(&field.ValueInteger[0])
-		case message.Field_DOUBLE:
-			fieldLen = len(field.ValueDouble)
-			if fieldLen == 0 {
-				break
-			}
-			valuePtr = unsafe.Pointer(&field.ValueDouble[0])
-		case message.Field_BOOL:
-			fieldLen = len(field.ValueBool)
-			if fieldLen == 0 {
-				break
-			}
-			valuePtr = unsafe.Pointer(&field.ValueBool[0])
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		if fieldLen = len(field.ValueString); fieldLen > 0 {
+			value = lua.LString(field.ValueString[0])
+		}
+	case message.Field_BYTES:
+		if fieldLen = len(field.ValueBytes); fieldLen > 0 && len(field.ValueBytes[0]) > 0 {
+			value = lua.LString(field.ValueBytes[0])
+		}
+	case message.Field_INTEGER:
+		if fieldLen = len(field.ValueInteger); fieldLen > 0 {
+			value = lua.LNumber(field.ValueInteger[0])
+		}
+	case message.Field_DOUBLE:
+		if fieldLen = len(field.ValueDouble); fieldLen > 0 {
+			value = lua.LNumber(field.ValueDouble[0])
+		}
+	case message.Field_BOOL:
+		if fieldLen = len(field.ValueBool); fieldLen > 0 {
+			value = lua.LBool(field.ValueBool[0])
 		}
 	}
-
-	return fieldType, namePtr, nameLen, valuePtr, valueLen,
-		representationPtr, representationLen, fieldLen
+	L.Push(lua.LNumber(field.GetValueType()))
+	L.Push(lua.LString(field.GetName()))
+	L.Push(value)
+	L.Push(lua.LString(field.GetRepresentation()))
+	L.Push(lua.LNumber(fieldLen))
+	return 5
 }
 
-//export go_lua_read_config
-func go_lua_read_config(ptr unsafe.Pointer, c string) (int, unsafe.Pointer, int) {
-	name := c
-	var lsb *LuaSandbox = (*LuaSandbox)(ptr)
-	if lsb.config == nil {
-		return 0, unsafe.Pointer(nil), 0
+// read_config(name)
+func (this *LuaSandbox) luaReadConfig(L *lua.LState) int {
+	if L.GetTop() != 1 {
+		L.RaiseError("read_config() must have a single argument")
+	}
+	name := checkString(L, 1, "read_config")
+	if this.config == nil {
+		L.Push(lua.LNil)
+		return 1
 	}
 
-	v := lsb.config[name]
-	switch v.(type) {
+	switch v := this.config[name].(type) {
 	case string:
-		s := v.(string)
-		cs := &s // freed by the caller
-		return int(message.Field_STRING), unsafe.Pointer(cs), len(s)
+		L.Push(lua.LString(v))
 	case bool:
-		b := v.(bool)
-		return int(message.Field_BOOL), unsafe.Pointer(&b), 0
+		L.Push(lua.LBool(v))
 	case int64:
-		d := float64(v.(int64))
-		return int(message.Field_DOUBLE), unsafe.Pointer(&d), 0
+		L.Push(lua.LNumber(v))
 	case float64:
-		d := v.(float64)
-		return int(message.Field_DOUBLE), unsafe.Pointer(&d), 0
+		L.Push(lua.LNumber(v))
+	default:
+		L.Push(lua.LNil)
+	}
+	return 1
+}
+
+// Converts an injection callback result into the corresponding Lua error.
+func injectError(L *lua.LState, fname string, result int) {
+	switch result {
+	case 0:
+		return
+	case 1:
+		L.RaiseError("%s() protobuf unmarshal failed", fname)
+	case 2:
+		L.RaiseError("%s() exceeded InjectMessage count", fname)
+	case 3:
+		L.RaiseError("%s() exceeded MaxMsgLoops", fname)
+	case 4:
+		L.RaiseError("%s() creates a circular reference (matches this plugin's message_matcher)", fname)
+	case 5:
+		L.RaiseError("%s() aborted", fname)
+	default:
+		L.RaiseError("%s() unknown error", fname)
+	}
+}
+
+// inject_message(table or protobuf string)
+func (this *LuaSandbox) luaInjectMessage(L *lua.LState) int {
+	if L.GetTop() != 1 {
+		L.RaiseError("inject_message() takes a single string or table argument")
+	}
+	var payload string
+	switch v := L.Get(1).(type) {
+	case lua.LString:
+		payload = string(v)
+	case *lua.LTable:
+		msg, err := tableToMessage(v, this.sbConfig.Timestamp)
+		if err != nil {
+			L.RaiseError("inject_message() could not encode protobuf - %s", err)
+		}
+		b, err := proto.Marshal(msg)
+		if err != nil {
+			L.RaiseError("inject_message() could not encode protobuf - %s", err)
+		}
+		payload = string(b)
+	default:
+		L.RaiseError("inject_message() takes a single string or table argument")
+	}
+	if !this.checkOutput(uint(len(payload))) {
+		L.RaiseError("output_limit exceeded")
+	}
+	injectError(L, "inject_message", this.injectMessage(payload, "", ""))
+	return 0
+}
+
+// inject_payload(payload_type, payload_name, ...) appends the optional
+// arguments to the output buffer and injects its content, an empty
+// payload_type defaults to "txt".
+func (this *LuaSandbox) luaInjectPayload(L *lua.LState) int {
+	payload_type := checkString(L, 1, "inject_payload")
+	payload_name := checkString(L, 2, "inject_payload")
+	if len(payload_type) == 0 {
+		payload_type = "txt"
+	}
+	for i := 3; i <= L.GetTop(); i++ {
+		this.appendOutput(L, i, "inject_payload")
+	}
+	if len(this.output) == 0 {
+		return 0
+	}
+	payload := string(this.output)
+	this.output = this.output[:0]
+	injectError(L, "inject_payload", this.injectMessage(payload, payload_type, payload_name))
+	return 0
+}
+
+// Implemented by userdata values that can be written to the output buffer.
+type payloadWriter interface {
+	AppendPayload(buf []byte) []byte
+}
+
+// add_to_payload(...) appends the string representation of each argument to
+// the output buffer, the buffer is flushed by inject_payload.
+func (this *LuaSandbox) luaAddToPayload(L *lua.LState) int {
+	n := L.GetTop()
+	if n == 0 {
+		argError(L, 0, "add_to_payload", "must have at least one argument")
+	}
+	for i := 1; i <= n; i++ {
+		this.appendOutput(L, i, "add_to_payload")
+	}
+	return 0
+}
+
+func (this *LuaSandbox) appendOutput(L *lua.LState, n int, fname string) {
+	switch v := L.Get(n).(type) {
+	case lua.LString:
+		this.output = append(this.output, v...)
+	case lua.LNumber:
+		this.output = strconv.AppendFloat(this.output, float64(v), 'g', -1, 64)
+	case lua.LBool:
+		this.output = strconv.AppendBool(this.output, bool(v))
+	case *lua.LNilType:
+		this.output = append(this.output, "nil"...)
+	case *lua.LUserData:
+		w, ok := v.Value.(payloadWriter)
+		if !ok {
+			argError(L, n, fname, "unsupported type")
+		}
+		this.output = w.AppendPayload(this.output)
+	default:
+		argError(L, n, fname, "unsupported type")
 	}
-	return 0, unsafe.Pointer(nil), 0
+	if !this.checkOutput(uint(len(this.output))) {
+		this.output = this.output[:0]
+		L.RaiseError("output_limit exceeded")
+	}
+}
+
+// decode_message(protobuf string) returns the message as a table in the form
+// accepted by inject_message.
+func (this *LuaSandbox) luaDecodeMessage(L *lua.LState) int {
+	b := L.CheckString(1)
+	msg := new(message.Message)
+	if err := proto.Unmarshal([]byte(b), msg); err != nil {
+		L.RaiseError("decode_message() protobuf unmarshal failed")
+	}
+	L.Push(messageToTable(L, msg))
+	return 1
+}
+
+// Records the size of pending output, returns false if it exceeds the output
+// limit.
+func (this *LuaSandbox) checkOutput(size uint) bool {
+	this.usage[sandbox.TYPE_OUTPUT][sandbox.STAT_CURRENT] = size
+	if size > this.usage[sandbox.TYPE_OUTPUT][sandbox.STAT_MAXIMUM] {
+		this.usage[sandbox.TYPE_OUTPUT][sandbox.STAT_MAXIMUM] = size
+	}
+	limit := this.sbConfig.OutputLimit
+	return limit == 0 || size <= limit
 }
 
-func go_lua_inject_message(ptr unsafe.Pointer, payload string,
-	payload_len int, payload_type, payload_name string) int {
-	var lsb *LuaSandbox = (*LuaSandbox)(ptr)
-	return lsb.injectMessage(payload[:payload_len],
-		payload_type, payload_name)
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Strips the stack traceback gopher-lua appends to runtime errors, leaving
+// just the message raised by the script or the API function.
+func luaErrorMessage(err error) string {
+	if apiErr, ok := err.(*lua.ApiError); ok {
+		return apiErr.Object.String()
+	}
+	return err.Error()
 }
 
 //todo lua pool
 type LuaSandbox struct {
 	lvm           *lua.LState
+	ctx           context.Context
 	lcancel       context.CancelFunc
 	pack          *pipeline.PipelinePack
 	injectMessage func(payload, payload_type, payload_name string) int
@@ -645,99 +820,191 @@ type LuaSandbox struct {
 	globals       *pipeline.GlobalConfigStruct
 	sbConfig      *sandbox.SandboxConfig
 	lerr          error
+	status        int
+	output        []byte
+	usage         [3][3]uint
+
+	instructions      uint
+	totalInstructions uint64
+	nextMemoryCheck   uint64
+	lastVisits        int
+	limitErr          error
+	// Instruction limit of the call restoring preserved data, 0 when not
+	// restoring.
+	restoreLimit uint
+	profiler          *luaProfiler
 }
 
 // 初始化lua虚拟机
 func CreateLuaSandbox(conf *sandbox.SandboxConfig) (sandbox.Sandbox, error) {
-	var (
-		lua_path, lua_cpath []string
-		template            string
-	)
 	lsb := new(LuaSandbox)
 	lsb.sbConfig = conf
-	//cs := conf.ScriptFilename
-
-	paths := strings.Split(conf.ModuleDirectory, ";")
-	for _, p := range paths {
-		lua_path = append(lua_path, filepath.Join(p, "?.lua"))
-		lua_cpath = append(lua_cpath, filepath.Join(p, "?.so"))
-	}
-
-	if conf.PluginType == "output" || conf.PluginType == "input" {
-		template = SandboxIoTemplate
-	} else {
-		template = SandboxTemplate
-	}
-	//todo 支持lua脚本的路径加载配置
-
-	cfg := fmt.Sprintf(template,
-		conf.MemoryLimit,
-		conf.InstructionLimit,
-		conf.OutputLimit,
-		strings.Join(lua_path, ";"),
-		strings.Join(lua_cpath, ";"))
-	fmt.Println(cfg)
-	lsb.lvm = lua.NewState()
-	ctx, cancel := context.WithCancel(context.Background())
-	lsb.lcancel = cancel
-	lsb.lvm.SetContext(ctx)
-	lsb.sbConfig = conf
-	lsb.lvm.SetGlobal("inject_payload", lsb.lvm.NewFunction(lsb.luaInjectMessage))
-	if lsb.lvm == nil {
-		return nil, fmt.Errorf("Sandbox creation failed")
-	}
+	lsb.ctx, lsb.lcancel = context.WithCancel(context.Background())
+	lsb.usage[sandbox.TYPE_MEMORY][sandbox.STAT_LIMIT] = conf.MemoryLimit
+	lsb.usage[sandbox.TYPE_INSTRUCTIONS][sandbox.STAT_LIMIT] = conf.InstructionLimit
+	lsb.usage[sandbox.TYPE_OUTPUT][sandbox.STAT_LIMIT] = conf.OutputLimit
 	lsb.injectMessage = func(p, pt, pn string) int {
 		log.Printf("payload_type: %s\npayload_name: %s\npayload: %s\n", pt, pn, p)
 		return 0
 	}
 	lsb.config = conf.Config
 	lsb.globals = conf.Globals
+	if conf.Profile {
+		lsb.profiler = newLuaProfiler()
+	}
+	if len(conf.AllowEntries) > 0 && !trustedPluginType(conf.PluginType) {
+		return nil, fmt.Errorf("allow_entries is only available to inputs and outputs")
+	}
+	if err := lsb.newState(); err != nil {
+		return nil, err
+	}
+	lsb.checkMemory()
 	return lsb, nil
 }
 
+// Creates the Lua state the script runs in, Init replaces it with a fresh
+// one when preserved data cannot be restored.
+func (this *LuaSandbox) newState() error {
+	env, err := this.environmentConfig()
+	if err != nil {
+		return err
+	}
+
+	this.lvm = lua.NewState()
+	if this.lvm == nil {
+		return fmt.Errorf("Sandbox creation failed")
+	}
+	this.lvm.SetContext(&limitContext{Context: this.ctx, lsb: this})
+	this.lvm.PreloadModule(circularBufferModule, loadCircularBuffer)
+	this.lvm.PreloadModule(lpegModule, loadLpeg)
+	this.lvm.PreloadModule(cjsonModule, this.loadCJson)
+	this.patchStdlib()
+	this.applyEnvironment(env)
+	this.registerMessageApi()
+	return nil
+}
+
+// Exposes the Heka message API to the script. write_message is only
+// available to decoders and encoders, the other plugin types must treat the
+// message as read only.
+func (this *LuaSandbox) registerMessageApi() {
+	L := this.lvm
+	L.SetGlobal("read_message", L.NewFunction(this.luaReadMessage))
+	L.SetGlobal("read_next_field", L.NewFunction(this.luaReadNextField))
+	L.SetGlobal("read_config", L.NewFunction(this.luaReadConfig))
+	L.SetGlobal("inject_message", L.NewFunction(this.luaInjectMessage))
+	L.SetGlobal("inject_payload", L.NewFunction(this.luaInjectPayload))
+	L.SetGlobal("add_to_payload", L.NewFunction(this.luaAddToPayload))
+	L.SetGlobal("decode_message", L.NewFunction(this.luaDecodeMessage))
+	switch this.sbConfig.PluginType {
+	case "decoder", "encoder":
+		L.SetGlobal("write_message", L.NewFunction(this.luaWriteMessage))
+	}
+}
+
 func (this *LuaSandbox) Init(dataFile string) error {
-	//todo : load data file
-	return this.lvm.DoFile(this.sbConfig.ScriptFilename)
-	//return nil
+	return this.init(dataFile, false)
+}
+
+func (this *LuaSandbox) Restore(dataFile string) error {
+	return this.init(dataFile, true)
 }
 
+func (this *LuaSandbox) init(dataFile string, restore bool) error {
+	// The preserved data is verified and evaluated before the script's top
+	// level runs, it is installed once the top level has set the script's
+	// initial state so the restored values take precedence.
+	var staged *preservedData
+	if dataFile != "" && fileExists(dataFile) {
+		var err error
+		if staged, err = this.stageGlobals(dataFile); err != nil {
+			if restore {
+				err = fmt.Errorf("restore_global_data %s", err)
+				this.terminate(err.Error())
+				return err
+			}
+			this.discardPreservedData(err)
+		}
+	}
+	if err := this.loadScript(); err != nil {
+		return err
+	}
+	if staged != nil {
+		if err := this.installGlobals(staged); err != nil {
+			if _, ok := err.(*versionError); restore && !ok {
+				err = fmt.Errorf("restore_global_data %s", err)
+				this.terminate(err.Error())
+				return err
+			}
+			this.discardPreservedData(err)
+			this.lvm.Close()
+			if err = this.newState(); err != nil {
+				this.terminate(err.Error())
+				return err
+			}
+			if err = this.loadScript(); err != nil {
+				return err
+			}
+		}
+	}
+	if !this.checkMemory() {
+		this.terminate(errMemoryLimit.Error())
+		return errors.New(this.LastError())
+	}
+	this.status = sandbox.STATUS_RUNNING
+	return nil
+}
+
+func (this *LuaSandbox) discardPreservedData(err error) {
+	this.globals.LogMessage(this.sbConfig.ScriptFilename,
+		fmt.Sprintf("restore_global_data %s, discarding the preserved data", err))
+}
+
+// Runs the top level of the script.
+func (this *LuaSandbox) loadScript() error {
+	fn, err := this.lvm.LoadFile(this.sbConfig.ScriptFilename)
+	if err != nil {
+		if aerr, ok := err.(*lua.ApiError); ok && aerr.Type == lua.ApiErrorFile {
+			if perr, ok := aerr.Cause.(*os.PathError); ok {
+				err = fmt.Errorf("cannot open %s: %s", this.sbConfig.ScriptFilename, perr.Err)
+			}
+		}
+		this.terminate(err.Error())
+		return err
+	}
+	this.startCall()
+	this.lvm.Push(fn)
+	err = this.lvm.PCall(0, lua.MultRet, nil)
+	this.endCall()
+	if err != nil || this.limitErr != nil {
+		this.terminate(this.callError(err))
+		return errors.New(this.LastError())
+	}
+	return nil
+}
+
+// Interrupts a running script, it is safe to call from another goroutine.
 func (this *LuaSandbox) Stop() {
-	//todo : save data file
-	//todo : close lua state
-	//sandbox_stop(this.lvm)
 	this.lcancel()
-
 }
 
-func (this *LuaSandbox) Destroy(dataFile string) error {
-	//todo : save data file
-	//todo : close lua state
-	//todo : hook
+func (this *LuaSandbox) Destroy(dataFile string) (err error) {
+	if dataFile != "" {
+		if err = this.preserveGlobals(dataFile); err != nil {
+			err = fmt.Errorf("Destroy() %s", err)
+		}
+	}
+	this.lcancel()
 	this.lvm.Close()
+	return
+}
 
-	//lua_sethook(lua, lstop, LUA_MASKCALL|LUA_MASKRET|LUA_MASKCOUNT, 1)
-	return nil
+func (this *LuaSandbox) Preserve(dataFile string) error {
+	return this.preserveGlobals(dataFile)
 }
 
-/*
-LSB_UNKNOWN     = 0,
-LSB_RUNNING     = 1,
-LSB_TERMINATED  = 2,
-LSB_STOP        = 3
-*/
 func (this *LuaSandbox) Status() int {
-	status := this.lvm.Status(this.lvm)
-	switch status {
-	case "running":
-		return 1
-	case "suspended":
-		return 2
-	case "dead":
-		return 3
-	case "normal":
-		return 4
-	}
-	return 0
+	return this.status
 }
 
 func (this *LuaSandbox) LastError() string {
@@ -748,53 +1015,125 @@ func (this *LuaSandbox) LastError() string {
 }
 
 func (this *LuaSandbox) Usage(utype, ustat int) uint {
-	//todo
-	return 10
-	//return uint(lsb_usage(this.lvm, lsb_usage_type(utype),
-	//	lsb_usage_stat(ustat)))
+	if utype < 0 || utype >= len(this.usage) || ustat < 0 ||
+		ustat >= len(this.usage[utype]) {
+		return 0
+	}
+	return this.usage[utype][ustat]
+}
+
+func (this *LuaSandbox) terminate(msg string) {
+	this.lerr = errors.New(msg)
+	this.status = sandbox.STATUS_TERMINATED
+}
+
+// Resets the per call instruction count, the instruction limit applies to
+// each call into the script individually.
+func (this *LuaSandbox) startCall() {
+	this.instructions = 0
+	this.limitErr = nil
+	if this.profiler != nil {
+		this.profiler.reset()
+	}
+}
+
+func (this *LuaSandbox) endCall() {
+	this.usage[sandbox.TYPE_INSTRUCTIONS][sandbox.STAT_CURRENT] = this.instructions
+	if this.instructions > this.usage[sandbox.TYPE_INSTRUCTIONS][sandbox.STAT_MAXIMUM] {
+		this.usage[sandbox.TYPE_INSTRUCTIONS][sandbox.STAT_MAXIMUM] = this.instructions
+	}
+	if this.limitErr == nil && this.totalInstructions >= this.nextMemoryCheck &&
+		!this.checkMemory() {
+		this.limitErr = errMemoryLimit
+	}
+}
+
+// Translates a failed call into the sandbox error message, limit violations
+// are reported without the script position of the instruction that hit them.
+func (this *LuaSandbox) callError(err error) string {
+	if this.limitErr != nil {
+		return this.limitErr.Error()
+	}
+	if err == nil {
+		return ""
+	}
+	return luaErrorMessage(err)
 }
 
 func (this *LuaSandbox) ProcessMessage(pack *pipeline.PipelinePack) int {
+	if this.status != sandbox.STATUS_RUNNING {
+		return 1
+	}
+	fn := this.lvm.GetGlobal("process_message")
+	if fn.Type() != lua.LTFunction {
+		this.terminate("process_message() function was not found")
+		return 1
+	}
 	this.field = 0
 	this.messageCopied = false
 	this.pack = pack
 
+	this.startCall()
 	err := this.lvm.CallByParam(lua.P{
-		Fn:      this.lvm.GetGlobal("process_message"),
-		NRet:    1, //返回值数量
+		Fn:      fn,
+		NRet:    2,
 		Protect: true,
 	})
+	this.endCall()
 	this.pack = nil
-	if err != nil {
-		log.Printf("process_message error: %s\n", err.Error())
+	if err != nil || this.limitErr != nil {
+		this.terminate("process_message() " + this.callError(err))
 		return 1
 	}
-	ret := this.lvm.Get(-1) // returned value
-	this.lvm.Pop(1)         // remove received value
-	return int(ret.(lua.LNumber))
+
+	status, msg := this.lvm.Get(-2), this.lvm.Get(-1)
+	this.lvm.Pop(2)
+	retval, ok := status.(lua.LNumber)
+	if !ok {
+		this.terminate("process_message() must return a numeric status code")
+		return 1
+	}
+	switch msg := msg.(type) {
+	case lua.LString:
+		this.lerr = errors.New(string(msg))
+	case *lua.LNilType:
+		this.lerr = nil
+	default:
+		this.terminate("process_message() must return a nil or string error message")
+		return 1
+	}
+	return int(retval)
 }
 
 func (this *LuaSandbox) TimerEvent(ns int64) int {
-	if err := this.lvm.CallByParam(lua.P{
-		Fn:      this.lvm.GetGlobal("timer_event"),
-		NRet:    0, //返回值数量
+	if this.status != sandbox.STATUS_RUNNING {
+		return 1
+	}
+	fn := this.lvm.GetGlobal("timer_event")
+	if fn.Type() != lua.LTFunction {
+		this.terminate("timer_event() function was not found")
+		return 1
+	}
+
+	this.startCall()
+	err := this.lvm.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    0,
 		Protect: true,
-	}, lua.LNumber(ns)); err != nil {
-		log.Printf("timer_event error: %s\n", err.Error())
+	}, lua.LNumber(ns))
+	this.endCall()
+	if err != nil || this.limitErr != nil {
+		this.terminate("timer_event() " + this.callError(err))
 		return 1
 	}
 	return 0
 }
 
-//payload, payload_type, payload_name string
-func (this *LuaSandbox) luaInjectMessage(L *lua.LState) int {
-	payload := L.ToString(1)
-	payload_type := L.ToString(2)
-	payload_name := L.ToString(3)
-	fmt.Println(payload, payload_type, payload_name)
-	return 0
+// Registers the function that delivers the payloads injected by the script,
+// its return value is reported to the script by inject_payload and
+// inject_message (0 success, 1 protobuf unmarshal failed, 2 exceeded the
+// InjectMessage count, 3 exceeded MaxMsgLoops, 4 circular reference,
+// 5 aborted).
+func (this *LuaSandbox) InjectMessage(f func(payload, payload_type, payload_name string) int) {
+	this.injectMessage = f
 }
-
-func (this *LuaSandbox)InjectMessage(f func(payload, payload_type, payload_name string) int)  {
-	//f()
-}
\ No newline at end of file
@@ -15,9 +15,15 @@
 package lua_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"runtime"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -163,7 +169,7 @@ func TestFailedInit(t *testing.T) {
 		t.Errorf("status should be %d, received %d",
 			STATUS_TERMINATED, sb.Status())
 	}
-	s := "cannot open ./testsupport/missing.lua: No such file or directory"
+	s := "cannot open ./testsupport/missing.lua: no such file or directory"
 	if sb.LastError() != s {
 		t.Errorf("LastError() should be \"%s\", received: \"%s\"", s, sb.LastError())
 	}
@@ -295,11 +301,11 @@ func TestAPIErrors(t *testing.T) {
 		"invalid error message",
 	}
 	msgs := []string{
-		"process_message() ./testsupport/errors.lua:11: module 'unknown' not found:\n\tno file 'unknown.lua'\n\tno file 'unknown.so'",
+		"process_message() ./testsupport/errors.lua:11: module unknown not found:\n\tno field package.preload['unknown']\n\tstat unknown.lua: no such file or directory, ",
 		"process_message() ./testsupport/errors.lua:13: bad argument #0 to 'add_to_payload' (must have at least one argument)",
 		"process_message() not enough memory",
 		"process_message() instruction_limit exceeded",
-		"process_message() ./testsupport/errors.lua:22: attempt to perform arithmetic on global 'x' (a nil value)",
+		"process_message() ./testsupport/errors.lua:22: cannot perform add operation between nil and number",
 		"process_message() must return a numeric status code",
 		"process_message() must return a numeric status code",
 		"process_message() ./testsupport/errors.lua:28: read_message() incorrect number of arguments",
@@ -309,14 +315,10 @@ func TestAPIErrors(t *testing.T) {
 		"process_message() ./testsupport/errors.lua:37: output_limit exceeded",
 		"process_message() ./testsupport/errors.lua:40: read_config() must have a single argument",
 		"process_message() ./testsupport/errors.lua:42: read_next_field() takes no arguments",
-		"process_message() ./testsupport/errors.lua:44: attempt to call global 'write_message' (a nil value)",
+		"process_message() ./testsupport/errors.lua:44: attempt to call a non-function object",
 		"process_message() must return a nil or string error message",
 	}
 
-	if runtime.GOOS == "windows" {
-		msgs[0] = "process_message() ./testsupport/errors.lua:11: module 'unknown' not found:\n\tno file 'unknown.lua'\n\tno file 'unknown.dll'"
-	}
-
 	var sbc SandboxConfig
 	sbc.ScriptFilename = "./testsupport/errors.lua"
 	sbc.MemoryLimit = 32767
@@ -346,6 +348,32 @@ func TestAPIErrors(t *testing.T) {
 	}
 }
 
+func TestMemoryLimitLocal(t *testing.T) {
+	pack := getTestPack()
+	var sbc SandboxConfig
+	sbc.ScriptFilename = "./testsupport/memory_local.lua"
+	sbc.MemoryLimit = 1024 * 1024
+	sb, err := lua.CreateLuaSandbox(&sbc)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer sb.Destroy("")
+	if err = sb.Init(""); err != nil {
+		t.Fatalf("%s", err)
+	}
+	r := sb.ProcessMessage(pack)
+	if r != 1 || STATUS_TERMINATED != sb.Status() {
+		t.Errorf("status should be %d, received %d", STATUS_TERMINATED, sb.Status())
+	}
+	s := "process_message() not enough memory"
+	if sb.LastError() != s {
+		t.Errorf("LastError() should be \"%s\", received: \"%s\"", s, sb.LastError())
+	}
+	if b := sb.Usage(TYPE_MEMORY, STAT_MAXIMUM); b <= sbc.MemoryLimit {
+		t.Errorf("maximum memory should be > %d, using %d", sbc.MemoryLimit, b)
+	}
+}
+
 func TestWriteMessageErrors(t *testing.T) {
 	pack := getTestPack()
 	// NewPipelineConfig sets up Globals for error logging
@@ -664,6 +692,81 @@ func TestPreserveFailure(t *testing.T) {
 	}
 }
 
+func TestPreserveRestore(t *testing.T) {
+	var sbc SandboxConfig
+	sbc.ScriptFilename = "./testsupport/preserve.lua"
+	sbc.MemoryLimit = 65536
+	sbc.InstructionLimit = 1000
+	pack := getTestPack()
+	output := filepath.Join(os.TempDir(), "preserve.lua.data")
+	defer os.Remove(output)
+
+	tests := []struct {
+		name         string
+		data         string // written to the data file when set
+		expect       int
+		restoreFails bool // Restore fails rather than discarding the data
+	}{
+		{"round trip", "", 2, false},
+		{"version mismatch", "if _PRESERVATION_VERSION and _PRESERVATION_VERSION ~= 0 then return end\n_G[\"count\"] = 10\n", 1, false},
+		{"corrupt data", "_G[\"count\"] = ", 1, true},
+		{"bad checksum", "-- preservation_data size=89 crc32c=00000000\n" +
+			"if _PRESERVATION_VERSION and _PRESERVATION_VERSION ~= 1 then return end\n" +
+			"_G[\"count\"] = 10\n", 1, true},
+		{"endless loop", "while true do end\n", 1, true},
+		{"memory limit", strings.Repeat("_G[#_G + 1] = \""+strings.Repeat("x", 1024)+"\"\n", 100), 1, true},
+	}
+	for _, test := range tests {
+		sb, err := lua.CreateLuaSandbox(&sbc)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if err = sb.Init(""); err != nil {
+			t.Fatalf("%s", err)
+		}
+		if r := sb.ProcessMessage(pack); r != 1 {
+			t.Errorf("%s: ProcessMessage should return 1, received %d", test.name, r)
+		}
+		if err = sb.Destroy(output); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if test.data != "" {
+			if err = ioutil.WriteFile(output, []byte(test.data), 0644); err != nil {
+				t.Fatalf("%s", err)
+			}
+		}
+
+		sb, err = lua.CreateLuaSandbox(&sbc)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		err = sb.(Reloadable).Restore(output)
+		if test.restoreFails {
+			if err == nil {
+				t.Errorf("%s: Restore should have failed", test.name)
+			} else if sb.Status() != STATUS_TERMINATED {
+				t.Errorf("%s: Restore should terminate the sandbox", test.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		sb.Destroy("")
+
+		sb, err = lua.CreateLuaSandbox(&sbc)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if err = sb.Init(output); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if r := sb.ProcessMessage(pack); r != test.expect {
+			t.Errorf("%s: ProcessMessage should return %d, received %d %s",
+				test.name, test.expect, r, sb.LastError())
+		}
+		sb.Destroy("")
+	}
+}
+
 func TestFailedMessageInjection(t *testing.T) {
 	var sbc SandboxConfig
 	sbc.ScriptFilename = "./testsupport/loop.lua"
@@ -745,11 +848,11 @@ func TestInjectMessage(t *testing.T) {
 	cnt := 0
 	sb.InjectMessage(func(p, pt, pn string) int {
 		if len(pt) == 0 { // no type is a Heka protobuf message
-			if p[18:] != outputs[cnt] { // ignore the UUID
+			if !sameMessage(p[18:], outputs[cnt]) { // ignore the UUID
 				t.Errorf("Output is incorrect, expected: \"%x\" received: \"%x\"", outputs[cnt], p[18:])
 			}
 		} else {
-			if p != outputs[cnt] {
+			if !sameJSON(p, outputs[cnt]) {
 				t.Errorf("Output is incorrect, expected: \"%s\" received: \"%s\"", outputs[cnt], p)
 			}
 		}
@@ -803,6 +906,84 @@ func TestInjectMessage(t *testing.T) {
 	}
 }
 
+// Compares two outputs as JSON values when they are both valid JSON, the key
+// order follows the Lua table iteration order which differs between
+// gopher-lua (insertion order) and the C Lua the expected outputs were
+// captured with (hash order).
+func sameJSON(a, b string) bool {
+	if a == b {
+		return true
+	}
+	var va, vb interface{}
+	if json.Unmarshal([]byte(a), &va) != nil || json.Unmarshal([]byte(b), &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// Compares two encoded messages by content. The order of the fields follows
+// the Lua table iteration order, which differs between gopher-lua and the C
+// Lua the expected outputs were captured with, and single values may be
+// encoded packed or not.
+func sameMessage(a, b string) bool {
+	ma, mb := new(message.Message), new(message.Message)
+	if proto.Unmarshal([]byte(a), ma) != nil || proto.Unmarshal([]byte(b), mb) != nil {
+		return false
+	}
+	for _, m := range []*message.Message{ma, mb} {
+		sort.Slice(m.Fields, func(i, j int) bool {
+			return m.Fields[i].GetName() < m.Fields[j].GetName()
+		})
+	}
+	return proto.Equal(ma, mb)
+}
+
+func TestInjectMessageNumericStrings(t *testing.T) {
+	var sbc SandboxConfig
+	sbc.ScriptFilename = "./testsupport/inject_message.lua"
+	sbc.ModuleDirectory = "./modules"
+	sbc.MemoryLimit = 100000
+	sbc.InstructionLimit = 1000
+	sbc.OutputLimit = 8000
+	pack := getTestPack()
+	sb, err := lua.CreateLuaSandbox(&sbc)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err = sb.Init(""); err != nil {
+		t.Fatalf("%s", err)
+	}
+	cnt := 0
+	sb.InjectMessage(func(p, pt, pn string) int {
+		msg := new(message.Message)
+		if err := proto.Unmarshal([]byte(p), msg); err != nil {
+			t.Errorf("%s", err)
+		}
+		// grammar captures are strings, the numeric headers are converted
+		if msg.GetTimestamp() != 1e9 || msg.GetSeverity() != 4 || msg.GetPid() != 1234 {
+			t.Errorf("Numeric headers expected 1000000000 4 1234 received %d %d %d",
+				msg.GetTimestamp(), msg.GetSeverity(), msg.GetPid())
+		}
+		cnt++
+		return 0
+	})
+	pack.Message.SetPayload("numeric strings")
+	if r := sb.ProcessMessage(pack); r != 0 {
+		t.Errorf("ProcessMessage should return 0, received %d %s", r, sb.LastError())
+	}
+	pack.Message.SetPayload("error non numeric string")
+	if r := sb.ProcessMessage(pack); r != 1 {
+		t.Errorf("ProcessMessage should return 1, received %d", r)
+	}
+	if s := sb.LastError(); !strings.Contains(s, "Severity must be a number, got string") {
+		t.Errorf("Unexpected error: %s", s)
+	}
+	sb.Destroy("")
+	if cnt != 1 {
+		t.Errorf("InjectMessage was called %d times, expected 1", cnt)
+	}
+}
+
 func TestInjectMessageError(t *testing.T) {
 	var sbc SandboxConfig
 	tests := []string{
@@ -1057,6 +1238,110 @@ func TestExternalModule(t *testing.T) {
 	sb.Destroy("")
 }
 
+func TestEnvironment(t *testing.T) {
+	disabled := "./testsupport/environment.lua:23: module 'io' disabled"
+	tests := []struct {
+		plugin   string
+		allow    []string
+		expected string
+	}{
+		{"filter", nil, disabled},
+		{"decoder", nil, disabled},
+		{"encoder", nil, disabled},
+		{"input", nil, "coroutine io os.execute os.getenv"},
+		{"output", []string{"dofile", "os.exit", "debug"},
+			"dofile coroutine debug io os.execute os.getenv os.exit"},
+	}
+
+	for _, test := range tests {
+		var sbc SandboxConfig
+		sbc.ScriptFilename = "./testsupport/environment.lua"
+		sbc.MemoryLimit = 100000
+		sbc.InstructionLimit = 1000
+		sbc.OutputLimit = 8000
+		sbc.PluginType = test.plugin
+		sbc.AllowEntries = test.allow
+		sb, err := lua.CreateLuaSandbox(&sbc)
+		if err != nil {
+			t.Fatalf("%s: %s", test.plugin, err)
+		}
+		if err = sb.Init(""); err != nil {
+			t.Fatalf("%s: %s", test.plugin, err)
+		}
+		sb.InjectMessage(func(p, pt, pn string) int {
+			if p != test.expected {
+				t.Errorf("%s: expected: \"%s\" received: \"%s\"", test.plugin, test.expected, p)
+			}
+			return 0
+		})
+		if r := sb.ProcessMessage(getTestPack()); r != 0 {
+			t.Errorf("%s: ProcessMessage should return 0, received %d %s", test.plugin, r, sb.LastError())
+		}
+		sb.Destroy("")
+	}
+
+	var sbc SandboxConfig
+	sbc.ScriptFilename = "./testsupport/environment.lua"
+	sbc.PluginType = "filter"
+	sbc.AllowEntries = []string{"io"}
+	if _, err := lua.CreateLuaSandbox(&sbc); err == nil {
+		t.Errorf("allow_entries should be rejected for a filter")
+	}
+}
+
+func TestProfile(t *testing.T) {
+	var sbc SandboxConfig
+	sbc.ScriptFilename = "./testsupport/profile.lua"
+	sbc.MemoryLimit = 100000
+	sbc.InstructionLimit = 1000
+	sbc.OutputLimit = 8000
+	sbc.Profile = true
+	sb, err := lua.CreateLuaSandbox(&sbc)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err = sb.Init(""); err != nil {
+		t.Fatalf("%s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if r := sb.ProcessMessage(getTestPack()); r != 0 {
+			t.Errorf("ProcessMessage should return 0, received %d %s", r, sb.LastError())
+		}
+	}
+	p := sb.(Profiler)
+	var b bytes.Buffer
+	if err = p.WriteProfile(&b); err != nil {
+		t.Fatalf("%s", err)
+	}
+	expected := `# ./testsupport/profile.lua
+# instructions	calls	function
+140	2	process_message (./testsupport/profile.lua:11)
+16		./testsupport/profile.lua:12
+30		./testsupport/profile.lua:13
+34		./testsupport/profile.lua:15
+42		./testsupport/profile.lua:16
+14		./testsupport/profile.lua:17
+4		./testsupport/profile.lua:18
+12	6	add (./testsupport/profile.lua:5)
+12		./testsupport/profile.lua:6
+6	1	main chunk (./testsupport/profile.lua:0)
+1		./testsupport/profile.lua:5
+2		./testsupport/profile.lua:9
+2		./testsupport/profile.lua:11
+`
+	if b.String() != expected {
+		t.Errorf("expected:\n%s\nreceived:\n%s", expected, b.String())
+	}
+
+	msg := new(message.Message)
+	p.ReportProfile(msg)
+	label := "add (./testsupport/profile.lua:5)"
+	if v, ok := msg.GetFieldValue("ProfileCalls-" + label); !ok || v.(int64) != 6 {
+		t.Errorf("ProfileCalls-%s should be 6, received %v", label, v)
+	}
+	sb.Destroy("")
+}
+
 func TestReadNextField(t *testing.T) {
 	var sbc SandboxConfig
 	sbc.ScriptFilename = "./testsupport/read_next_field.lua"
@@ -1151,7 +1436,7 @@ func TestAnnotation(t *testing.T) {
 	}
 	cnt := 0
 	sb.InjectMessage(func(p, pt, pn string) int {
-		if p != tests[cnt] {
+		if !sameJSON(p, tests[cnt]) {
 			t.Errorf("Output is incorrect, expected: \"%s\" received: \"%s\"", tests[cnt], p)
 		}
 		cnt++
@@ -1437,3 +1722,69 @@ func BenchmarkSandboxLpegDecoder(b *testing.B) {
 	}
 	sb.Destroy("")
 }
+
+func TestCircularBuffer(t *testing.T) {
+	var sbc SandboxConfig
+	header := "{\"time\":%d,\"rows\":3,\"columns\":2,\"seconds_per_row\":60,\"column_info\":[{\"name\":\"Requests_sec\",\"unit\":\"count\",\"aggregation\":\"sum\"},{\"name\":\"Max_Latency\",\"unit\":\"ms\",\"aggregation\":\"max\"}]%s}\n"
+	annotation := ",\"annotations\":[{\"x\":60000,\"col\":2,\"shortText\":\"A\",\"text\":\"spike\"}]"
+	tests := []string{
+		fmt.Sprintf(header, 0, annotation) + "nan\tnan\n3\t10\n4\tnan\n",
+		fmt.Sprintf(header, 0, "") + "60\t3\t10\n120\t4\tnan\n",
+		fmt.Sprintf(header, 60, annotation) + "3\t10\n4\tnan\n1\tnan\n",
+	}
+
+	sbc.ScriptFilename = "./testsupport/circular_buffer.lua"
+	sbc.MemoryLimit = 100000
+	sbc.InstructionLimit = 1000
+	sbc.OutputLimit = 1024
+	pack := getTestPack()
+	output := filepath.Join(os.TempDir(), "circular_buffer.lua.data")
+	defer os.Remove(output)
+
+	cnt := 0
+	inject := func(p, pt, pn string) int {
+		if pt != "cbuf" || pn != "test" {
+			t.Errorf("Incorrect payload type/name: %s %s", pt, pn)
+		}
+		if p != tests[cnt] {
+			t.Errorf("Output is incorrect, expected: \"%s\" received: \"%s\"", tests[cnt], p)
+		}
+		cnt++
+		return 0
+	}
+	run := func(sb Sandbox, ts int64) {
+		pack.Message.SetTimestamp(ts)
+		if r := sb.ProcessMessage(pack); r != 0 {
+			t.Errorf("ProcessMessage should return 0, received %d %s", r, sb.LastError())
+		}
+	}
+
+	sb, err := lua.CreateLuaSandbox(&sbc)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err = sb.Init(""); err != nil {
+		t.Fatalf("%s", err)
+	}
+	sb.InjectMessage(inject)
+	run(sb, 0)
+	run(sb, 1)
+	if err = sb.Destroy(output); err != nil {
+		t.Errorf("%s", err)
+	}
+
+	// the values and annotations must survive the preservation
+	sb, err = lua.CreateLuaSandbox(&sbc)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err = sb.Init(output); err != nil {
+		t.Fatalf("%s", err)
+	}
+	sb.InjectMessage(inject)
+	run(sb, 2)
+	sb.Destroy("")
+	if cnt != len(tests) {
+		t.Errorf("Executed %d test, expected %d", cnt, len(tests))
+	}
+}
@@ -0,0 +1,329 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012-2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package lua
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// The global a script sets to invalidate previously preserved data, the data
+// file is only restored when the versions match.
+const preservationVersion = "_PRESERVATION_VERSION"
+
+// Instructions allowed per line of a preserved data file, on top of the
+// instruction_limit, when it is restored. Every line is a single assignment
+// or call so restoring large data can't fail on the limit while a corrupt
+// file still can't run forever.
+const restoreInstructionsPerLine = 16
+
+// The first line of a preserved data file records the size and the CRC-32C
+// of the rest of the file. Files written by older versions have none and are
+// restored without the check.
+const preservationHeader = "-- preservation_data size=%d crc32c=%08x\n"
+
+var (
+	preservationHeaderRe  = regexp.MustCompile(`^-- preservation_data size=(\d+) crc32c=([0-9a-f]{8})\n`)
+	preservationVersionRe = regexp.MustCompile(`^if ` + preservationVersion + ` and ` +
+		preservationVersion + ` ~= (\S+) then return end\n`)
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Implemented by userdata values that can be preserved, Serialize writes the
+// Lua statements that recreate the value under the given name.
+type luaSerializer interface {
+	Serialize(name string, buf *bytes.Buffer) error
+}
+
+type serializer struct {
+	buf    bytes.Buffer
+	seen   map[lua.LValue]string
+	ignore map[lua.LValue]bool
+}
+
+// Writes the script's global data as a Lua chunk that restores it when
+// executed. Functions, threads, tables holding loaded modules and userdata
+// that cannot serialize itself are skipped; tables or userdata referenced
+// more than once are restored as shared references.
+func (this *LuaSandbox) serializeGlobals() ([]byte, error) {
+	L := this.lvm
+	s := &serializer{
+		seen:   make(map[lua.LValue]string),
+		ignore: map[lua.LValue]bool{L.G.Global: true},
+	}
+	if loaded, ok := L.GetField(L.Get(lua.RegistryIndex), "_LOADED").(*lua.LTable); ok {
+		loaded.ForEach(func(_, v lua.LValue) { s.ignore[v] = true })
+	}
+
+	version := lua.LNumber(0)
+	if v, ok := L.GetGlobal(preservationVersion).(lua.LNumber); ok {
+		version = v
+	}
+	fmt.Fprintf(&s.buf, "if %s and %s ~= %s then return end\n",
+		preservationVersion, preservationVersion, formatNumber(version))
+
+	globals := L.G.Global
+	for k, v := globals.Next(lua.LNil); k != lua.LNil; k, v = globals.Next(k) {
+		if err := s.serializeKvp("_G", k, v); err != nil {
+			return nil, err
+		}
+	}
+	return s.buf.Bytes(), nil
+}
+
+func (s *serializer) ignoreValue(v lua.LValue) bool {
+	switch v := v.(type) {
+	case *lua.LTable:
+		return s.ignore[v]
+	case *lua.LUserData:
+		_, ok := v.Value.(luaSerializer)
+		return !ok
+	case lua.LString, lua.LNumber, lua.LBool:
+		return false
+	}
+	return true
+}
+
+func (s *serializer) serializeKvp(parent string, k, v lua.LValue) error {
+	if s.ignoreValue(v) {
+		return nil
+	}
+	key, err := serializeKey(k)
+	if err != nil {
+		return err
+	}
+	name := parent + "[" + key + "]"
+	if ref, ok := s.seen[v]; ok {
+		fmt.Fprintf(&s.buf, "%s = %s\n", name, ref)
+		return nil
+	}
+
+	switch v := v.(type) {
+	case lua.LString:
+		fmt.Fprintf(&s.buf, "%s = %s\n", name, quoteString(string(v)))
+	case lua.LNumber:
+		fmt.Fprintf(&s.buf, "%s = %s\n", name, formatNumber(v))
+	case lua.LBool:
+		fmt.Fprintf(&s.buf, "%s = %t\n", name, bool(v))
+	case *lua.LTable:
+		s.seen[v] = name
+		fmt.Fprintf(&s.buf, "%s = {}\n", name)
+		for ck, cv := v.Next(lua.LNil); ck != lua.LNil; ck, cv = v.Next(ck) {
+			if err = s.serializeKvp(name, ck, cv); err != nil {
+				return err
+			}
+		}
+	case *lua.LUserData:
+		s.seen[v] = name
+		return v.Value.(luaSerializer).Serialize(name, &s.buf)
+	}
+	return nil
+}
+
+func serializeKey(k lua.LValue) (string, error) {
+	switch k := k.(type) {
+	case lua.LString:
+		return quoteString(string(k)), nil
+	case lua.LNumber:
+		return formatNumber(k), nil
+	case lua.LBool:
+		return strconv.FormatBool(bool(k)), nil
+	}
+	return "", fmt.Errorf("serialize_data cannot preserve type '%s'", k.Type())
+}
+
+// Formats a number so that it is read back as exactly the same value.
+func formatNumber(n lua.LNumber) string {
+	f := float64(n)
+	switch {
+	case math.IsNaN(f):
+		return "0/0"
+	case math.IsInf(f, 1):
+		return "1/0"
+	case math.IsInf(f, -1):
+		return "-1/0"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Quotes a string as a Lua literal, strconv.Quote cannot be used as Lua 5.1
+// does not understand Go's hex and unicode escapes.
+func quoteString(s string) string {
+	buf := make([]byte, 0, len(s)+2)
+	buf = append(buf, '"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"', '\\':
+			buf = append(buf, '\\', c)
+		case '\n':
+			buf = append(buf, '\\', 'n')
+		case '\r':
+			buf = append(buf, '\\', 'r')
+		default:
+			if c < 0x20 || c == 0x7f {
+				buf = append(buf, fmt.Sprintf("\\%03d", c)...)
+			} else {
+				buf = append(buf, c)
+			}
+		}
+	}
+	return string(append(buf, '"'))
+}
+
+// Writes the preserved data to a temporary file in the same directory and
+// renames it into place so an interrupted shutdown never leaves a truncated
+// data file behind.
+func (this *LuaSandbox) preserveGlobals(dataFile string) error {
+	data, err := this.serializeGlobals()
+	if err != nil {
+		os.Remove(dataFile)
+		return err
+	}
+	header := fmt.Sprintf(preservationHeader, len(data), crc32.Checksum(data, crc32cTable))
+	data = append([]byte(header), data...)
+	tmp, err := ioutil.TempFile(filepath.Dir(dataFile), filepath.Base(dataFile))
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dataFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Preserved data evaluated into a table standing for the globals, along with
+// the preservation version it was written with.
+type preservedData struct {
+	globals *lua.LTable
+	version lua.LNumber
+}
+
+// Reads a preserved data file, verifying its checksum when it has one.
+func readPreservedData(dataFile string) (chunk []byte, version lua.LNumber, err error) {
+	if chunk, err = ioutil.ReadFile(dataFile); err != nil {
+		return
+	}
+	if m := preservationHeaderRe.FindSubmatch(chunk); m != nil {
+		chunk = chunk[len(m[0]):]
+		size, _ := strconv.Atoi(string(m[1]))
+		if size != len(chunk) {
+			return nil, 0, fmt.Errorf("preserved data size is %d, expected %d", len(chunk), size)
+		}
+		if sum := fmt.Sprintf("%08x", crc32.Checksum(chunk, crc32cTable)); sum != string(m[2]) {
+			return nil, 0, fmt.Errorf("preserved data checksum is %s, expected %s", sum, m[2])
+		}
+	}
+	if m := preservationVersionRe.FindSubmatch(chunk); m != nil {
+		v, perr := strconv.ParseFloat(string(m[1]), 64)
+		if perr != nil {
+			return nil, 0, fmt.Errorf("invalid preservation version: %s", m[1])
+		}
+		version = lua.LNumber(v)
+	}
+	return
+}
+
+// Evaluates a preserved data file before the script's top level runs. The
+// data is restored into a table of its own instead of the globals, with the
+// memory limit and an instruction limit sized for the file in force, so a
+// corrupt file can't disturb the script.
+func (this *LuaSandbox) stageGlobals(dataFile string) (*preservedData, error) {
+	chunk, version, err := readPreservedData(dataFile)
+	if err != nil {
+		return nil, err
+	}
+	L := this.lvm
+	fn, err := L.Load(bytes.NewReader(chunk), dataFile)
+	if err != nil {
+		return nil, errors.New(strings.TrimSpace(err.Error()))
+	}
+	staged := L.NewTable()
+	staged.RawSetString("_G", staged)
+	// Circular buffers are restored through their module.
+	L.Push(L.NewFunction(loadCircularBuffer))
+	L.Call(0, 1)
+	staged.RawSetString(circularBufferModule, L.Get(-1))
+	L.Pop(1)
+	fn.Env = staged
+
+	this.startCall()
+	if this.sbConfig.InstructionLimit > 0 {
+		this.restoreLimit = this.sbConfig.InstructionLimit +
+			restoreInstructionsPerLine*uint(bytes.Count(chunk, []byte("\n"))+1)
+	}
+	L.Push(fn)
+	err = L.PCall(0, 0, nil)
+	this.endCall()
+	this.restoreLimit = 0
+	if err != nil || this.limitErr != nil {
+		return nil, errors.New(this.callError(err))
+	}
+	staged.RawSetString("_G", lua.LNil)
+	staged.RawSetString(circularBufferModule, lua.LNil)
+	return &preservedData{globals: staged, version: version}, nil
+}
+
+// The script's preservation version was changed, the data is discarded on
+// purpose.
+type versionError struct {
+	version   lua.LNumber
+	preserved lua.LNumber
+}
+
+func (e *versionError) Error() string {
+	return fmt.Sprintf("preservation version is %s, the data was preserved with %s",
+		formatNumber(e.version), formatNumber(e.preserved))
+}
+
+// Moves the staged data into the globals once the script's top level has
+// run, provided the script's preservation version matches the data's.
+func (this *LuaSandbox) installGlobals(data *preservedData) error {
+	L := this.lvm
+	version := lua.LNumber(0)
+	if v, ok := L.GetGlobal(preservationVersion).(lua.LNumber); ok {
+		version = v
+	}
+	if version != data.version {
+		return &versionError{version: version, preserved: data.version}
+	}
+	data.globals.ForEach(func(k, v lua.LValue) {
+		L.G.Global.RawSet(k, v)
+	})
+	if !this.checkMemory() {
+		return errMemoryLimit
+	}
+	return nil
+}
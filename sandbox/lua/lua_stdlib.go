@@ -0,0 +1,83 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012-2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package lua
+
+import (
+	"regexp"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Adjusts the gopher-lua standard library where it differs from the C Lua
+// behaviour the sandbox scripts and modules were written against.
+
+var formatDirective = regexp.MustCompile(`%[-+ #0]*[0-9]*(\.[0-9]*)?[a-zA-Z%]`)
+
+// Gives %g and %G the C default precision of 6 significant digits, Go would
+// use the shortest representation instead.
+func cFormatString(format string) string {
+	return formatDirective.ReplaceAllStringFunc(format, func(d string) string {
+		conv := d[len(d)-1]
+		if (conv == 'g' || conv == 'G') && !strings.Contains(d, ".") {
+			return d[:len(d)-1] + ".6" + string(conv)
+		}
+		return d
+	})
+}
+
+func (this *LuaSandbox) patchStdlib() {
+	L := this.lvm
+	// rawset returns the table, folding captures with it relies on that.
+	L.SetGlobal("rawset", L.NewFunction(func(L *lua.LState) int {
+		t := L.CheckTable(1)
+		t.RawSet(L.CheckAny(2), L.CheckAny(3))
+		L.SetTop(1)
+		return 1
+	}))
+	if str, ok := L.GetGlobal("string").(*lua.LTable); ok {
+		format := str.RawGetString("format")
+		str.RawSetString("format", L.NewFunction(func(L *lua.LState) int {
+			top := L.GetTop()
+			args := make([]lua.LValue, top)
+			args[0] = lua.LString(cFormatString(L.CheckString(1)))
+			for i := 2; i <= top; i++ {
+				args[i-1] = L.Get(i)
+			}
+			L.Push(format)
+			for _, a := range args {
+				L.Push(a)
+			}
+			L.Call(top, 1)
+			return 1
+		}))
+	}
+	if os, ok := L.GetGlobal("os").(*lua.LTable); ok {
+		date := os.RawGetString("date")
+		// os.date(format, nil) formats the current time like C Lua does.
+		os.RawSetString("date", L.NewFunction(func(L *lua.LState) int {
+			top := L.GetTop()
+			for top > 0 && L.Get(top) == lua.LNil {
+				top--
+			}
+			L.Push(date)
+			for i := 1; i <= top; i++ {
+				L.Push(L.Get(i))
+			}
+			L.Call(top, 1)
+			return 1
+		}))
+	}
+}
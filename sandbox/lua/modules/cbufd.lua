@@ -0,0 +1,38 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+--[[
+Circular buffer delta grammar
+
+API
+^^^
+**grammar**
+    Parses a cbufd payload (the circular buffer "cbufd" format). Captures an
+    array of rows, each row an array of the column values (nan for an
+    unchanged column) with the row time in nanoseconds under the 'time' key;
+    the JSON header line is captured under the 'header' key.
+--]]
+
+local l = require "lpeg"
+l.locale(l)
+local tonumber = tonumber
+
+local M = {}
+setfenv(1, M) -- Remove external access to contain everything in the module
+
+local eol = l.P"\n"
+local header = l.Cg((1 - eol)^1, "header") * eol
+
+local time = l.digit^1 / function(s) return tonumber(s) * 1e9 end
+local number = (l.P"-"^-1 * l.digit^1 * (l.P"." * l.digit^0)^-1
+                * (l.S"eE" * l.S"+-"^-1 * l.digit^1)^-1) / tonumber
+local value = number
+            + l.P"nan" / function() return 0/0 end
+            + l.P"inf" / function() return 1/0 end
+            + l.P"-inf" / function() return -1/0 end
+local row = l.Ct(l.Cg(time, "time") * ("\t" * value)^1 * eol)
+
+grammar = l.Ct(header * row^1) * -1
+
+return M
@@ -0,0 +1,294 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+--[[
+Web server log grammars
+
+API
+^^^
+**build_nginx_grammar(log_format)**
+    Builds a grammar from an Nginx 'log_format' configuration string. The
+    variables are captured under their names, with these conversions:
+
+    - time_local, time_iso8601, msec: captured as 'time' in nanoseconds since
+      the UNIX epoch.
+    - remote_addr, realip_remote_addr, server_addr: IP address field tables.
+    - status, body_bytes_sent, bytes_sent, request_length, connection,
+      connection_requests, content_length, pid, remote_port, server_port:
+      numbers, a '-' value is not captured.
+    - request_time, upstream_response_time, upstream_connect_time,
+      upstream_header_time: field tables with the "s" representation.
+
+    *Arguments*
+        - log_format (string) e.g. '$remote_addr [$time_local] "$request" $status'
+
+    *Return*
+        - grammar capturing a table of the variables
+
+**build_apache_grammar(log_format)**
+    Builds a grammar from an Apache 'LogFormat' configuration string, the
+    format codes are captured using the Nginx variable names e.g. %h as
+    remote_addr, %t as time, %>s as status and %{User-Agent}i as
+    http_user_agent.
+
+    *Arguments*
+        - log_format (string) e.g. '%h %l %u %t "%r" %>s %b'
+
+    *Return*
+        - grammar capturing a table of the format codes
+
+**normalize_user_agent(user_agent)**
+    Reduces a user agent string to the browser, its major version and the
+    operating system.
+
+    *Arguments*
+        - user_agent (string)
+
+    *Return*
+        - browser (string or nil), version (number or nil), os (string or nil)
+
+**nginx_error_grammar**
+    Grammar capturing an Nginx error log line as a Heka message table with
+    the Timestamp, Severity, Pid and Payload headers and the tid and
+    connection fields.
+--]]
+
+local l = require "lpeg"
+l.locale(l)
+local dt = require "date_time"
+local ip = require "ip_address"
+local syslog = require "syslog"
+local error = error
+local ipairs = ipairs
+local pairs = pairs
+local pcall = pcall
+local string = require "string"
+local tonumber = tonumber
+local type = type
+
+local M = {}
+setfenv(1, M) -- Remove external access to contain everything in the module
+
+local integer = l.digit^1 / tonumber
+local float = (l.digit^1 * (l.P"." * l.digit^0)^-1) / tonumber
+
+local function number_or_dash(name)
+    return l.P"-" + l.Cg(integer, name)
+end
+
+local function seconds_field(name)
+    local value = l.Ct(l.Cg(float, "value") * l.Cg(l.Cc"s", "representation"))
+    return l.P"-" + l.Cg(value, name)
+end
+
+local function ip_field(name)
+    return l.Cg(ip.v4_field + ip.v6_field, name)
+end
+
+local msec = (l.digit^1 * "." * l.digit^1) / function(s)
+    return tonumber(s) * 1e9
+end
+
+local nginx_variables = {
+    time_local = l.Cg(dt.clf_timestamp / dt.time_to_ns, "time"),
+    time_iso8601 = l.Cg(dt.rfc3339 / dt.time_to_ns, "time"),
+    msec = l.Cg(msec, "time"),
+    remote_addr = ip_field("remote_addr"),
+    realip_remote_addr = ip_field("realip_remote_addr"),
+    server_addr = ip_field("server_addr"),
+    status = l.Cg(integer, "status"),
+    body_bytes_sent = number_or_dash("body_bytes_sent"),
+    bytes_sent = number_or_dash("bytes_sent"),
+    request_length = number_or_dash("request_length"),
+    connection = number_or_dash("connection"),
+    connection_requests = number_or_dash("connection_requests"),
+    content_length = number_or_dash("content_length"),
+    pid = number_or_dash("pid"),
+    remote_port = number_or_dash("remote_port"),
+    server_port = number_or_dash("server_port"),
+    request_time = seconds_field("request_time"),
+    upstream_response_time = seconds_field("upstream_response_time"),
+    upstream_connect_time = seconds_field("upstream_connect_time"),
+    upstream_header_time = seconds_field("upstream_header_time"),
+}
+
+-- Captures a variable as a string, it extends to the following text of the
+-- format (or the end of the line).
+local function string_capture(tokens, i, name)
+    local nxt = tokens[i + 1]
+    if type(nxt) ~= "string" then
+        return l.Cg(l.P(1)^0, name)
+    end
+    return l.Cg((1 - l.P(nxt))^0, name)
+end
+
+-- Builds the grammar from a token array of literal strings and variable
+-- names ({name = "status"}), variables resolves the typed ones.
+local function build_grammar(tokens, variables)
+    local grammar = l.P(true)
+    for i, t in ipairs(tokens) do
+        if type(t) == "string" then
+            grammar = grammar * t
+        else
+            grammar = grammar * (variables[t.name] or string_capture(tokens, i, t.name))
+        end
+    end
+    return l.Ct(grammar)
+end
+
+local nginx_literal = l.C((1 - l.P"$")^1)
+local nginx_name = (l.alnum + "_")^1
+local nginx_variable = l.P"$" * l.Ct(l.Cg(nginx_name, "name") + "{" * l.Cg(nginx_name, "name") * "}")
+local nginx_format = l.Ct((nginx_variable + nginx_literal)^0) * -1
+
+function build_nginx_grammar(log_format)
+    local tokens = nginx_format:match(log_format)
+    if not tokens then
+        error(string.format("invalid log_format: %s", log_format))
+    end
+    return build_grammar(tokens, nginx_variables)
+end
+
+local apache_codes = {
+    a = "remote_addr",
+    A = "server_addr",
+    B = "body_bytes_sent",
+    b = "body_bytes_sent",
+    D = "request_time_us",
+    f = "request_filename",
+    h = "remote_addr",
+    H = "server_protocol",
+    I = "request_length",
+    k = "connection_requests",
+    l = "remote_logname",
+    m = "request_method",
+    O = "bytes_sent",
+    p = "server_port",
+    P = "pid",
+    q = "query_string",
+    r = "request",
+    s = "status",
+    t = "time_local",
+    T = "request_time",
+    u = "remote_user",
+    U = "uri",
+    v = "server_name",
+    V = "server_name",
+    X = "connection_status",
+}
+
+local apache_prefixes = {
+    C = "cookie_",
+    e = "env_",
+    i = "http_",
+    n = "note_",
+    o = "sent_http_",
+}
+
+local apache_variables = {
+    remote_addr = ip_field("remote_addr") + l.Cg((1 - l.space)^1, "remote_addr"),
+    request_time_us = l.P"-" + l.Cg(l.Ct(l.Cg(integer, "value") * l.Cg(l.Cc"us", "representation")), "request_time"),
+    request_time = seconds_field("request_time"),
+    time_local = "[" * nginx_variables.time_local * "]", -- %t includes the brackets
+}
+for k, v in pairs(nginx_variables) do
+    if not apache_variables[k] then apache_variables[k] = v end
+end
+
+local function apache_token(arg, code)
+    if arg and code == "t" then
+        return {name = "time", grammar = l.Cg(dt.build_strftime_grammar(arg) / dt.time_to_ns, "time")}
+    end
+    if arg then
+        local prefix = apache_prefixes[code]
+        if not prefix then
+            error(string.format("unsupported LogFormat code: %%{%s}%s", arg, code))
+        end
+        return {name = prefix .. string.gsub(string.lower(arg), "-", "_")}
+    end
+    local name = apache_codes[code]
+    if not name then
+        error(string.format("unsupported LogFormat code: %%%s", code))
+    end
+    return {name = name}
+end
+
+local apache_literal = l.C((1 - l.P"%")^1) + l.P"%%" * l.Cc"%"
+local apache_code = l.P"%" * l.S"<>"^-1 * l.S"!,0123456789"^0
+                  * (l.P"{" * l.C((1 - l.P"}")^0) * "}" + l.Cc(false))
+                  * l.C(l.alpha) / apache_token
+local apache_format = l.Ct((apache_code + apache_literal)^0) * -1
+
+function build_apache_grammar(log_format)
+    local ok, tokens = pcall(apache_format.match, apache_format, log_format)
+    if not ok or not tokens then
+        error(string.format("invalid LogFormat: %s", log_format))
+    end
+    local variables = {}
+    for k, v in pairs(apache_variables) do
+        variables[k] = v
+    end
+    for _, t in ipairs(tokens) do
+        if type(t) == "table" and t.grammar then
+            variables[t.name] = t.grammar
+        end
+    end
+    return build_grammar(tokens, variables)
+end
+
+local function version_of(ua, pattern)
+    local v = string.match(ua, pattern)
+    if v then return tonumber(v) end
+end
+
+-- browser name, the pattern capturing its major version, ordered so the
+-- browsers embedding other browser names in their agent string come first
+local browsers = {
+    {"Edge", "Edge/(%d+)"},
+    {"Opera", "OPR/(%d+)"},
+    {"Chrome", "Chrome/(%d+)"},
+    {"Firefox", "Firefox/(%d+)"},
+    {"MSIE", "MSIE (%d+)"},
+    {"MSIE", "Trident/.*rv:(%d+)"},
+    {"Safari", "Version/(%d+).*Safari/"},
+}
+
+local operating_systems = {
+    {"Windows", "Windows"},
+    {"iPad", "iPad"},
+    {"iPhone", "iPhone"},
+    {"Macintosh", "Macintosh"},
+    {"Android", "Android"},
+    {"Chrome OS", "CrOS"},
+    {"Linux", "Linux"},
+}
+
+function normalize_user_agent(ua)
+    if type(ua) ~= "string" then return end
+
+    local browser, version, os
+    for _, b in ipairs(browsers) do
+        version = version_of(ua, b[2])
+        if version then
+            browser = b[1]
+            break
+        end
+    end
+    for _, o in ipairs(operating_systems) do
+        if string.find(ua, o[2], 1, true) then
+            os = o[1]
+            break
+        end
+    end
+    return browser, version, os
+end
+
+nginx_error_grammar = l.Ct(
+    l.Cg(dt.build_strftime_grammar("%Y/%m/%d %H:%M:%S") / dt.time_to_ns, "Timestamp")
+    * l.space^1 * "[" * l.Cg(syslog.severity, "Severity") * "]"
+    * l.space^1 * l.Cg(integer, "Pid") * "#"
+    * l.Cg(l.Ct(l.Cg(integer, "tid") * ":" * (l.space^1 * "*" * l.Cg(integer, "connection"))^-1), "Fields")
+    * l.space^1 * l.Cg(l.P(1)^0, "Payload"))
+
+return M
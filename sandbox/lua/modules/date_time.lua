@@ -0,0 +1,219 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+--[[
+Date/time grammars
+
+The grammars capture a time table with the keys year, month, day, hour, min,
+sec, sec_frac and optionally offset_sign, offset_hour, offset_min; pass it to
+time_to_ns to get the nanoseconds since the UNIX epoch.
+
+API
+^^^
+**rfc3339**
+    Captures an RFC 3339 timestamp (2014-02-10T12:58:59.123-08:00) as a time
+    table.
+
+**clf_timestamp**
+    Captures a Common Log Format timestamp (10/Feb/2014:08:46:41 -0800) as a
+    time table.
+
+**rfc3164_timestamp**
+    Captures a syslog timestamp (Feb 10 12:58:58) as a time table, the year is
+    set to the current (UTC) year.
+
+**build_strftime_grammar(fmt)**
+    Builds a grammar from a strftime format string.
+
+    *Arguments*
+        - fmt (string) strftime format e.g. "%Y-%m-%d %H:%M:%S", the supported
+          specifiers are %a %A %b %B %c %C %d %D %e %F %h %H %I %j %m %M %n %p
+          %r %R %s %S %t %T %u %w %x %X %y %Y %z %Z and %%.
+
+    *Return*
+        - grammar capturing a time table, an error is raised for an invalid
+          format
+
+**time_to_ns(t)**
+    Converts a time table into nanoseconds since the UNIX epoch, missing
+    date fields default to 1970-01-01 and a missing offset means UTC.
+
+    *Arguments*
+        - t (table) time table
+
+    *Return*
+        - nanoseconds (number)
+--]]
+
+local l = require "lpeg"
+l.locale(l)
+local error = error
+local math = require "math"
+local os = require "os"
+local pairs = pairs
+local string = require "string"
+local tonumber = tonumber
+
+local floor = math.floor
+
+local M = {}
+setfenv(1, M) -- Remove external access to contain everything in the module
+
+local function two_digits(lo, hi)
+    return l.R(lo) * l.R(hi)
+end
+
+local month_abbr = {Jan = 1, Feb = 2, Mar = 3, Apr = 4, May = 5, Jun = 6,
+                    Jul = 7, Aug = 8, Sep = 9, Oct = 10, Nov = 11, Dec = 12}
+local month_full = {January = 1, February = 2, March = 3, April = 4, May = 5,
+                    June = 6, July = 7, August = 8, September = 9,
+                    October = 10, November = 11, December = 12}
+
+local function month_name(t)
+    local p = l.P(false)
+    for k, v in pairs(t) do
+        p = p + l.P(k) * l.Cc(v)
+    end
+    return p
+end
+
+local day_abbr = l.P"Mon" + "Tue" + "Wed" + "Thu" + "Fri" + "Sat" + "Sun"
+local day_full = l.P"Monday" + "Tuesday" + "Wednesday" + "Thursday"
+               + "Friday" + "Saturday" + "Sunday"
+
+local b_month = l.Cg(month_name(month_abbr), "month")
+local B_month = l.Cg(month_name(month_full), "month")
+
+local Y_year = l.Cg(l.digit * l.digit * l.digit * l.digit / tonumber, "year")
+local y_year = l.Cg(l.digit * l.digit / function(s)
+    local y = tonumber(s)
+    if y < 69 then return y + 2000 end
+    return y + 1900
+end, "year")
+local C_century = l.digit * l.digit
+local m_month = l.Cg((l.P"0" * l.R"19" + l.P"1" * l.R"02") / tonumber, "month")
+local d_day = l.Cg((l.P"0" * l.R"19" + l.R"12" * l.digit + l.P"3" * l.R"01") / tonumber, "day")
+local e_day = l.Cg((l.P" " * l.R"19" + l.R"12" * l.digit + l.P"3" * l.R"01" + l.R"19") / tonumber, "day")
+local H_hour = l.Cg((two_digits("01", "09") + l.P"2" * l.R"03") / tonumber, "hour")
+local I_hour = l.Cg((l.P"0" * l.R"19" + l.P"1" * l.R"02") / tonumber, "hour")
+local M_min = l.Cg(two_digits("05", "09") / tonumber, "min")
+local S_sec = l.Cg((two_digits("05", "09") + l.P"60") / tonumber, "sec")
+local j_yday = l.digit * l.digit * l.digit
+local p_period = l.Cg(l.C(l.S"AaPp" * l.S"Mm"), "period")
+local s_epoch = l.Cg(l.digit^1 / tonumber, "sec")
+local sec_frac = l.Cg(l.P"." * l.digit^1 / tonumber, "sec_frac")
+local numoffset = l.Cg(l.S"+-", "offset_sign")
+                * l.Cg(two_digits("01", "09") / tonumber, "offset_hour")
+                * l.P":"^-1
+                * l.Cg(two_digits("05", "09") / tonumber, "offset_min")
+local z_offset = l.P"Z" + numoffset
+local Z_name = l.alpha^1
+
+local hms = H_hour * ":" * M_min * ":" * S_sec
+
+local strftime_specifiers = {
+    a = day_abbr,
+    A = day_full,
+    b = b_month,
+    B = B_month,
+    c = day_abbr * " " * b_month * " " * e_day * " " * hms * " " * Y_year,
+    C = C_century,
+    d = d_day,
+    D = m_month * "/" * d_day * "/" * y_year,
+    e = e_day,
+    F = Y_year * "-" * m_month * "-" * d_day,
+    h = b_month,
+    H = H_hour,
+    I = I_hour,
+    j = j_yday,
+    m = m_month,
+    M = M_min,
+    n = l.space^1,
+    p = p_period,
+    r = I_hour * ":" * M_min * ":" * S_sec * " " * p_period,
+    R = H_hour * ":" * M_min,
+    s = s_epoch,
+    S = S_sec,
+    t = l.space^1,
+    T = hms,
+    u = l.R"17",
+    w = l.R"06",
+    x = m_month * "/" * d_day * "/" * y_year,
+    X = hms,
+    y = y_year,
+    Y = Y_year,
+    z = z_offset,
+    Z = Z_name,
+    ["%"] = l.P"%",
+}
+
+local function concat(a, b)
+    return a * b
+end
+
+local specifier = l.P"%" * l.S"EO"^-1 * l.C(1) / function(c)
+    local p = strftime_specifiers[c]
+    if not p then
+        error(string.format("unsupported strftime format specifier: %%%s", c))
+    end
+    return p
+end
+local literal = l.C((1 - l.P"%")^1) / l.P
+local strftime_format = l.Cf(l.Cc(l.P(true)) * (specifier + literal)^0, concat) * -1
+
+function build_strftime_grammar(fmt)
+    local p = strftime_format:match(fmt)
+    if not p then
+        error(string.format("invalid strftime format: %s", fmt))
+    end
+    return l.Ct(p)
+end
+
+rfc3339 = l.Ct(Y_year * "-" * m_month * "-" * d_day * l.S"Tt "
+               * hms * sec_frac^-1 * (l.P"z" + z_offset))
+
+clf_timestamp = build_strftime_grammar("%d/%b/%Y:%H:%M:%S %z")
+
+rfc3164_timestamp = l.Ct(b_month * " " * e_day * " " * hms) / function(t)
+    t.year = os.date("!*t").year
+    return t
+end
+
+-- days since the epoch of a proleptic Gregorian date
+local function days_from_civil(y, m, d)
+    if m <= 2 then y = y - 1 end
+    local era = floor(y / 400)
+    local yoe = y - era * 400
+    local doy = floor((153 * ((m + 9) % 12) + 2) / 5) + d - 1
+    local doe = yoe * 365 + floor(yoe / 4) - floor(yoe / 100) + doy
+    return era * 146097 + doe - 719468
+end
+
+function time_to_ns(t)
+    local hour = t.hour or 0
+    if t.period then
+        if hour == 12 then hour = 0 end
+        if string.upper(t.period) == "PM" then hour = hour + 12 end
+    end
+
+    local secs = days_from_civil(t.year or 1970, t.month or 1, t.day or 1) * 86400
+    + hour * 3600 + (t.min or 0) * 60 + (t.sec or 0)
+
+    if t.offset_hour then
+        local offset = t.offset_hour * 3600 + (t.offset_min or 0) * 60
+        if t.offset_sign == "-" then
+            secs = secs + offset
+        else
+            secs = secs - offset
+        end
+    end
+
+    local ns = secs * 1e9
+    if t.sec_frac and t.sec_frac == t.sec_frac then
+        ns = ns + floor(t.sec_frac * 1e9 + 0.5)
+    end
+    return ns
+end
+
+return M
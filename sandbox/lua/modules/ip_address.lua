@@ -0,0 +1,71 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+--[[
+IP address grammars
+
+API
+^^^
+**v4**
+    Matches an IPv4 address in dotted decimal notation.
+
+**v6**
+    Matches an IPv6 address (RFC 3986, including the embedded IPv4 forms).
+
+**v4_field**
+    Captures an IPv4 address as a Heka field table
+    {value = "127.0.0.1", representation = "ipv4"}.
+
+**v6_field**
+    Captures an IPv6 address as a Heka field table
+    {value = "::1", representation = "ipv6"}.
+--]]
+
+local l = require "lpeg"
+l.locale(l)
+
+local M = {}
+setfenv(1, M) -- Remove external access to contain everything in the module
+
+local dec_octet = l.P"25" * l.R"05"
+                + l.P"2" * l.R"04" * l.digit
+                + l.P"1" * l.digit * l.digit
+                + l.R"19" * l.digit
+                + l.digit
+
+v4 = dec_octet * "." * dec_octet * "." * dec_octet * "." * dec_octet
+
+local h16 = l.xdigit * l.xdigit^-3
+-- a group followed by a single colon, a double colon ends the group list
+local h16c = h16 * ":" * -l.P":"
+local ls32 = h16c * h16 + v4
+
+local function exactly(patt, n)
+    local p = l.P(true)
+    for i = 1, n do
+        p = p * patt
+    end
+    return p
+end
+
+-- up to n+1 leading groups before the double colon (p^-0 would mean p^0)
+local function upto(n)
+    if n == 0 then return h16^-1 * "::" end
+    return (h16c^-n * h16)^-1 * "::"
+end
+
+v6 = exactly(h16c, 6) * ls32
+   + "::" * exactly(h16c, 5) * ls32
+   + upto(0) * exactly(h16c, 4) * ls32
+   + upto(1) * exactly(h16c, 3) * ls32
+   + upto(2) * exactly(h16c, 2) * ls32
+   + upto(3) * h16c * ls32
+   + upto(4) * ls32
+   + upto(5) * h16
+   + upto(6)
+
+v4_field = l.Ct(l.Cg(l.C(v4), "value") * l.Cg(l.Cc"ipv4", "representation"))
+v6_field = l.Ct(l.Cg(l.C(v6), "value") * l.Cg(l.Cc"ipv6", "representation"))
+
+return M
@@ -0,0 +1,74 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+--[[
+MySQL slow query log grammars
+
+API
+^^^
+**slow_query_grammar**
+    Grammar capturing a MySQL slow query log entry as a Heka message table:
+    Timestamp (from the 'SET timestamp=' statement), Payload (the SQL) and
+    the Query_time, Lock_time (representation "s"), Rows_sent and
+    Rows_examined fields.
+
+**mariadb_slow_query_grammar**
+    Same as slow_query_grammar for the MariaDB variant of the log, the
+    additional '# Name: value' header lines (Thread_id, Schema, QC_hit ...)
+    are captured as fields too, numeric values as numbers.
+--]]
+
+local l = require "lpeg"
+l.locale(l)
+local rawset = rawset
+local tonumber = tonumber
+
+local M = {}
+setfenv(1, M) -- Remove external access to contain everything in the module
+
+local sep = l.P"\n"
+local line = (1 - sep)^0 * sep
+local space = l.S" \t"^1
+local integer = l.digit^1 / tonumber
+local float = (l.digit^1 * (l.P"." * l.digit^0)^-1) / tonumber
+
+-- a (name, value) capture pair for folding into the fields table
+local function pair(name, value)
+    return l.Cg(l.Cc(name) * value)
+end
+
+local function seconds(name)
+    return pair(name, l.Ct(l.Cg(float, "value") * l.Cg(l.Cc"s", "representation")))
+end
+
+local user = l.P"# User@Host: " * line
+
+local query_time = l.P"# Query_time: " * seconds("Query_time")
+                 * space * "Lock_time: " * seconds("Lock_time")
+                 * space * "Rows_sent: " * pair("Rows_sent", integer)
+                 * space * "Rows_examined: " * pair("Rows_examined", integer)
+                 * line
+
+-- MariaDB '# Name: value  Name: value' header lines
+local name = (l.alnum + "_")^1
+local value = (1 - l.S" \t\n")^1 / function(s) return tonumber(s) or s end
+local header_pair = l.Cg(l.C(name) * ":" * space * value)
+local header = l.P"# " * -l.P"Query_time:" * -l.P"administrator"
+             * header_pair * (space * header_pair)^0 * l.S" \t"^0 * sep
+
+local use_db = l.P"use " * line
+local timestamp = l.P"SET " * (1 - l.P"timestamp=" - sep)^0 * "timestamp="
+                * l.Cg(integer / function(n) return n * 1e9 end, "Timestamp") * ";" * sep
+local admin = l.P"# administrator command: " * line
+local sql = l.Cg(l.P(1)^1, "Payload")
+
+local function grammar(fields)
+    return l.Ct(user * l.Cg(l.Cf(l.Ct"" * fields, rawset), "Fields")
+                * use_db^-1 * timestamp * admin^-1 * sql)
+end
+
+slow_query_grammar = grammar(query_time)
+mariadb_slow_query_grammar = grammar(header^0 * query_time * header^0)
+
+return M
@@ -0,0 +1,186 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+--[[
+Syslog grammars
+
+API
+^^^
+**build_rsyslog_grammar(template)**
+    Builds a grammar from an rsyslog template string, property names are case
+    insensitive and are captured under their lower case name. Special
+    captures:
+
+    - pri: table {severity = n, facility = n}
+    - syslogtag: table {programname = "name", pid = n}
+    - timestamp/timereported/timegenerated: nanoseconds since the UNIX epoch,
+      timereported is captured as timestamp. The date-rfc3164 (default),
+      date-rfc3339, date-mysql, date-pgsql and date-unixtimestamp options are
+      supported.
+    - syslogseverity, syslogfacility, syslogpriority (and the -text variants):
+      numbers.
+    - msg with the sp-if-no-1st-sp option matches an optional space and
+      captures nothing, with drop-last-lf the trailing line feed is left to the
+      following template text.
+
+    *Arguments*
+        - template (string) rsyslog template e.g.
+          "%TIMESTAMP% %HOSTNAME% %syslogtag%%msg:::sp-if-no-1st-sp%%msg:::drop-last-lf%\n"
+
+    *Return*
+        - grammar capturing a table of the properties, an error is raised for
+          an invalid template
+
+**severity**
+    Grammar capturing a syslog severity name (emerg ... debug) as its number.
+
+**facility**
+    Grammar capturing a syslog facility name (kern ... local7) as its number.
+--]]
+
+local l = require "lpeg"
+l.locale(l)
+local dt = require "date_time"
+local error = error
+local ipairs = ipairs
+local pairs = pairs
+local math = require "math"
+local string = require "string"
+local tonumber = tonumber
+local type = type
+
+local M = {}
+setfenv(1, M) -- Remove external access to contain everything in the module
+
+local function names(list, base)
+    local p = l.P(false)
+    for i, v in ipairs(list) do
+        p = p + l.P(v) * l.Cc(i - 1 + base)
+    end
+    return p
+end
+
+-- longer names first so a prefix does not win
+severity = l.P"panic" * l.Cc(0)
+         + names({"emerg", "alert", "crit"}, 0)
+         + l.P"error" * l.Cc(3) + l.P"err" * l.Cc(3)
+         + l.P"warning" * l.Cc(4) + l.P"warn" * l.Cc(4)
+         + names({"notice", "info", "debug"}, 5)
+
+facility = names({"kern", "user", "mail", "daemon"}, 0)
+         + l.P"authpriv" * l.Cc(10) + l.P"auth" * l.Cc(4)
+         + names({"syslog", "lpr", "news", "uucp", "cron"}, 5)
+         + l.P"security" * l.Cc(4)
+         + names({"ftp", "ntp", "logaudit", "logalert", "clock"}, 11)
+         + names({"local0", "local1", "local2", "local3", "local4", "local5",
+                  "local6", "local7"}, 16)
+
+local integer = l.digit^1 / tonumber
+
+local pri = l.digit^1 / function(s)
+    local n = tonumber(s)
+    return {severity = n % 8, facility = math.floor(n / 8)}
+end
+
+local programname = (1 - l.S"[: \t")^1
+local syslogtag = l.Ct(l.Cg(programname, "programname")
+                       * ("[" * l.Cg(integer, "pid") * "]")^-1
+                       * l.P":"^-1)
+
+local date_options = {
+    ["date-rfc3164"] = dt.rfc3164_timestamp / dt.time_to_ns,
+    ["date-rfc3164-buggyday"] = dt.rfc3164_timestamp / dt.time_to_ns,
+    ["date-rfc3339"] = dt.rfc3339 / dt.time_to_ns,
+    ["date-mysql"] = dt.build_strftime_grammar("%Y%m%d%H%M%S") / dt.time_to_ns,
+    ["date-pgsql"] = dt.build_strftime_grammar("%Y-%m-%d %H:%M:%S") / dt.time_to_ns,
+    ["date-unixtimestamp"] = integer / function(n) return n * 1e9 end,
+}
+
+local property_grammars = {
+    pri = pri,
+    syslogtag = syslogtag,
+    syslogseverity = integer,
+    ["syslogseverity-text"] = severity,
+    syslogpriority = integer,
+    ["syslogpriority-text"] = severity,
+    syslogfacility = integer,
+    ["syslogfacility-text"] = facility,
+    ["protocol-version"] = integer,
+    procid = integer + l.C"-",
+}
+
+local property_names = {
+    timereported = "timestamp",
+}
+
+local date_properties = {
+    timestamp = true,
+    timereported = true,
+    timegenerated = true,
+}
+
+-- Parses the template into an array of literal strings and property tables
+-- {name = "msg", options = "drop-last-lf"}.
+local literal = l.C((1 - l.P"%")^1)
+local property = l.P"%" * l.Ct(l.Cg((1 - l.S"%:")^1 / string.lower, "name")
+                               * (":" * (1 - l.S"%:")^0
+                                  * ":" * (1 - l.S"%:")^0
+                                  * ":" * l.Cg((1 - l.P"%")^0, "options"))^-1) * "%"
+local template_grammar = l.Ct((literal + property)^0) * -1
+
+local function has_option(options, opt)
+    if not options then return false end
+    for o in string.gmatch(options, "[^,]+") do
+        if o == opt then return true end
+    end
+    return false
+end
+
+-- Captures a property value, it extends to the following template text.
+local function value_capture(tokens, i)
+    local nxt = tokens[i + 1]
+    if type(nxt) ~= "string" then
+        if has_option(tokens[i].options, "drop-last-lf") then
+            return l.C((1 - (l.P"\n" * -1))^0) * l.P"\n"^-1
+        end
+        return l.C(l.P(1)^0)
+    end
+    if i + 1 == #tokens then
+        return l.C((1 - (l.P(nxt) * -1))^0) -- the last text must end the input
+    end
+    return l.C((1 - l.P(nxt))^0)
+end
+
+function build_rsyslog_grammar(template)
+    local tokens = template_grammar:match(template)
+    if not tokens then
+        error(string.format("invalid rsyslog template: %s", template))
+    end
+
+    local grammar = l.P(true)
+    for i, t in ipairs(tokens) do
+        local p
+        if type(t) == "string" then
+            p = l.P(t)
+        elseif t.name == "msg" and has_option(t.options, "sp-if-no-1st-sp") then
+            p = l.P" "^-1
+        else
+            local name = property_names[t.name] or t.name
+            local value
+            if date_properties[t.name] then
+                value = date_options["date-rfc3164"]
+                for opt, g in pairs(date_options) do
+                    if has_option(t.options, opt) then value = g end
+                end
+            else
+                value = property_grammars[t.name] or value_capture(tokens, i)
+            end
+            p = l.Cg(value, name)
+        end
+        grammar = grammar * p
+    end
+    return l.Ct(grammar)
+end
+
+return M
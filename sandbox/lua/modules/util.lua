@@ -0,0 +1,59 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+--[[
+Utility functions
+
+API
+^^^
+**table_to_fields(t, fields, parent, separator, max_depth)**
+    Flattens a nested table into a Heka fields table, the nested keys are
+    joined with the separator. Tables below max_depth are JSON encoded.
+
+    *Arguments*
+        - t (table) table to flatten
+        - fields (table) receives the flattened key/values
+        - parent (string, nil) key prefix
+        - separator (string, nil) key separator, defaults to "."
+        - max_depth (number, nil) nesting depth to flatten, nil for unlimited
+
+    *Return*
+        - none, an error is raised if a table cannot be encoded
+--]]
+
+require "cjson"
+local cjson = cjson
+local pairs = pairs
+local tostring = tostring
+local type = type
+
+local M = {}
+setfenv(1, M) -- Remove external access to contain everything in the module
+
+local function flatten(t, fields, parent, separator, max_depth, depth)
+    for k, v in pairs(t) do
+        local key = tostring(k)
+        if parent then
+            key = parent .. separator .. key
+        end
+        if type(v) == "table" then
+            if max_depth and depth >= max_depth then
+                fields[key] = cjson.encode(v)
+            else
+                flatten(v, fields, key, separator, max_depth, depth + 1)
+            end
+        else
+            fields[key] = v
+        end
+    end
+end
+
+function table_to_fields(t, fields, parent, separator, max_depth)
+    if type(separator) ~= "string" then
+        separator = "."
+    end
+    flatten(t, fields, parent, separator, max_depth, 1)
+end
+
+return M
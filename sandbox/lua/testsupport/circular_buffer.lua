@@ -0,0 +1,62 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+require "circular_buffer"
+
+data = circular_buffer.new(3, 2, 60, true)
+assert(data:set_header(1, "Requests/sec") == 1)
+data:set_header(2, "Max Latency", "ms", "max")
+
+local function test_api()
+    assert(data:add(60e9, 1, 1) == 1)
+    assert(data:add(60e9, 1, 2) == 3)
+    assert(data:set(60e9, 2, 10) == 10)
+    assert(data:set(60e9, 2, 5) == 10, "max aggregation")
+    assert(data:add(120e9, 1, 4) == 4)
+    assert(data:get(120e9, 1) == 4)
+    local v = data:get(0, 1)
+    assert(v ~= v, "nan expected")
+    assert(data:get(-60e9, 1) == nil)
+
+    local sum, n = data:compute("sum", 1)
+    assert(sum == 7 and n == 2, sum)
+    assert(data:compute("avg", 1) == 3.5)
+    assert(data:compute("min", 1) == 3)
+    assert(data:compute("max", 1, 0, 60e9) == 3)
+    assert(data:compute("sd", 1) == 0.5)
+    assert(not pcall(data.compute, data, "bogus", 1))
+    assert(not pcall(data.get, data, 0, 3))
+
+    local rows, cols, spr = data:get_configuration()
+    assert(rows == 3 and cols == 2 and spr == 60)
+    assert(data:current_time() == 120e9)
+    local name, unit, agg = data:get_header(2)
+    assert(name == "Max_Latency" and unit == "ms" and agg == "max", name)
+
+    local cb = circular_buffer.new(2, 1, 1)
+    assert(not pcall(cb.format, cb, "cbufd"), "delta is not enabled")
+
+    cb = circular_buffer.new(6, 1, 1)
+    for i = 1, 6 do cb:set((i - 1) * 1e9, 1, i) end
+    local u1, p1 = cb:mannwhitneyu(1, 0, 2e9, 3e9, 5e9)
+    local u2, p2 = cb:mannwhitneyu(1, 3e9, 5e9, 0, 2e9)
+    assert(u1 == 0 and u2 == 9, "U of the first range")
+    assert(p1 == p2 and p1 < 0.05, p1)
+    data:annotate(60e9, 2, "alert", "spike")
+end
+
+function process_message ()
+    local test = read_message("Timestamp")
+
+    if test == 0 then
+        test_api()
+        inject_payload("cbuf", "test", data)
+    elseif test == 1 then
+        inject_payload("cbuf", "test", data:format("cbufd"))
+    elseif test == 2 then
+        assert(data:add(180e9, 1, 1) == 1)
+        inject_payload("cbuf", "test", data:format("cbuf"))
+    end
+    return 0
+end
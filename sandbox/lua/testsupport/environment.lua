@@ -0,0 +1,27 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+-- Reports which of the restricted entries are available to the script.
+local entries = {
+    {"dofile", dofile},
+    {"loadstring", loadstring},
+    {"print", print},
+    {"coroutine", coroutine},
+    {"debug", debug},
+    {"io", io},
+    {"os.execute", os.execute},
+    {"os.getenv", os.getenv},
+    {"os.exit", os.exit},
+}
+
+function process_message()
+    local available = {}
+    for i, e in ipairs(entries) do
+        if e[2] then available[#available + 1] = e[1] end
+    end
+    local ok, err = pcall(require, "io")
+    if not ok then available[#available + 1] = err end
+    inject_payload("txt", "", table.concat(available, " "))
+    return 0
+end
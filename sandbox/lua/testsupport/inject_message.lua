@@ -67,6 +67,10 @@ function process_message ()
         inject_message("\010\016\111\021\235\034\090\107\077\120\169\175\058\232\153\002\231\132\016\128\148\235\220\003\082\027\010\005count\016\003\058\016\000\000\000\000\000\000\240\063\000\000\000\000\000\000\240\063")
     elseif msg == "error invalid protobuf string" then
         inject_message("boom")
+    elseif msg == "numeric strings" then
+        inject_message({Timestamp = "1000000000", Severity = "4", Pid = " 1234 "})
+    elseif msg == "error non numeric string" then
+        inject_message({Severity = "warning"})
     end
     return 0
 end
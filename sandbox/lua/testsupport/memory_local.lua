@@ -0,0 +1,14 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+function process_message ()
+    local t = {}
+    for i=1,2000000 do
+        t[i] = i
+    end
+    return 0
+end
+
+function timer_event()
+end
@@ -0,0 +1,31 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+_PRESERVATION_VERSION = 1
+
+count = 0
+rates = {99.1, 98, key="val"}
+kvp = {a="foo", r=rates}
+cycle = {type="cycle"}
+cycle.self = cycle
+str = "quote \" backslash \\ newline \n nul \0 tab \t"
+nan = 0/0
+func = function (s) return s end
+
+function process_message ()
+    count = count + 1
+    if count > 1 then
+        if kvp.r ~= rates or rates[1] ~= 99.1 or rates.key ~= "val" then
+            error("shared reference not restored")
+        end
+        if cycle.self ~= cycle or cycle.type ~= "cycle" then
+            error("cycle not restored")
+        end
+        if str ~= "quote \" backslash \\ newline \n nul \0 tab \t" then
+            error("string not restored")
+        end
+        if nan == nan then error("nan not restored") end
+    end
+    return count
+end
@@ -0,0 +1,19 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+local function add(a, b)
+    return a + b
+end
+
+count = 0
+
+function process_message()
+    for i = 1, 3 do
+        count = add(count, i)
+    end
+    while count < 20 do
+        count = count + 1
+    end
+    return 0
+end
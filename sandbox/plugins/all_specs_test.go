@@ -16,7 +16,10 @@
 package plugins
 
 import (
+	"encoding/json"
 	"os"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -54,3 +57,33 @@ func getTestMessage() *message.Message {
 	msg.AddField(field)
 	return msg
 }
+
+// The JSON keys and the InfluxDB lines follow the Lua table iteration order,
+// which differs between gopher-lua (insertion order) and the C Lua the
+// expected outputs were captured with (hash order). The outputs are
+// normalized before they are compared.
+
+// Re-encodes a JSON document with sorted keys, invalid JSON is returned
+// unchanged.
+func normalizeJSON(s string) string {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// Sorts the tags of each InfluxDB line protocol line and the lines.
+func normalizeLines(s string) string {
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	for i, line := range lines {
+		parts := strings.SplitN(line, " ", 2)
+		key := strings.Split(parts[0], ",")
+		sort.Strings(key[1:])
+		parts[0] = strings.Join(key, ",")
+		lines[i] = strings.Join(parts, " ")
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -29,7 +29,6 @@ import (
 	"heka/message"
 	"heka/pipeline"
 	. "heka/sandbox"
-	"heka/sandbox/lua"
 	"github.com/pborman/uuid"
 )
 
@@ -39,13 +38,11 @@ type SandboxDecoder struct {
 	processMessageFailures int64
 	processMessageSamples  int64
 	processMessageDuration int64
-	sb                     Sandbox
+	sandboxes              []*decoderSandbox
+	pool                   chan *decoderSandbox
+	watcher                *scriptWatcher
 	sbc                    *SandboxConfig
-	preservationFile       string
 	reportLock             sync.Mutex
-	sample                 bool
-	pack                   *pipeline.PipelinePack
-	packs                  []*pipeline.PipelinePack
 	dRunner                pipeline.DecoderRunner
 	name                   string
 	tz                     *time.Location
@@ -53,6 +50,19 @@ type SandboxDecoder struct {
 	pConfig                *pipeline.PipelineConfig
 }
 
+// One script instance of the decoder pool along with the state of the message
+// it is decoding.
+type decoderSandbox struct {
+	sb               Sandbox
+	preservationFile string
+	inject           func(payload, payload_type, payload_name string) int
+	generation       int64
+	sample           bool
+	usage            sandboxUsage
+	pack             *pipeline.PipelinePack
+	packs            []*pipeline.PipelinePack
+}
+
 func (s *SandboxDecoder) ConfigStruct() interface{} {
 	return NewSandboxConfig(s.pConfig.Globals)
 }
@@ -92,12 +102,14 @@ func (s *SandboxDecoder) Init(config interface{}) (err error) {
 	}
 
 	switch s.sbc.ScriptType {
-	case "lua":
+	case "lua", "tengo":
 	default:
 		return fmt.Errorf("unsupported script type: %s", s.sbc.ScriptType)
 	}
 
-	s.sample = true
+	if s.sbc.PoolSize < 1 {
+		return fmt.Errorf("pool_size must be at least 1")
+	}
 	return
 }
 
@@ -139,48 +151,68 @@ func copyMessageHeaders(dst *message.Message, src *message.Message) {
 }
 
 func (s *SandboxDecoder) SetDecoderRunner(dr pipeline.DecoderRunner) {
-	if s.sb != nil {
+	if s.sandboxes != nil {
 		return // no-op already initialized
 	}
 
 	s.dRunner = dr
-	var original *message.Message
-	var err error
-
-	switch s.sbc.ScriptType {
-	case "lua":
-		s.sb, err = lua.CreateLuaSandbox(s.sbc)
-	default:
-		err = fmt.Errorf("unsupported script type: %s", s.sbc.ScriptType)
+	name := dr.Name()
+	s.pool = make(chan *decoderSandbox, s.sbc.PoolSize)
+	for i := 0; i < s.sbc.PoolSize; i++ {
+		// The first instance keeps the preservation file name of a decoder
+		// without a pool.
+		filename := name + DATA_EXT
+		if i > 0 {
+			filename = fmt.Sprintf("%s-%d%s", name, i, DATA_EXT)
+		}
+		ds, err := s.newSandbox(filename)
+		if err != nil {
+			dr.LogError(err)
+			s.destroy()
+			s.pConfig.Globals.ShutDown(1)
+			return
+		}
+		s.sandboxes = append(s.sandboxes, ds)
+		s.pool <- ds
+	}
+	if s.sbc.ReloadOnChange {
+		var err error
+		if s.watcher, err = newScriptWatcher(s.sandboxes[0].sb); err != nil {
+			dr.LogError(err)
+			s.destroy()
+			s.pConfig.Globals.ShutDown(1)
+		}
 	}
+}
 
-	if err == nil {
-		s.preservationFile = filepath.Join(s.pConfig.Globals.PrependBaseDir(DATA_DIR),
-			dr.Name()+DATA_EXT)
-		if s.sbc.PreserveData && fileExists(s.preservationFile) {
-			err = s.sb.Init(s.preservationFile)
+func (s *SandboxDecoder) newSandbox(filename string) (ds *decoderSandbox, err error) {
+	ds = &decoderSandbox{sample: true}
+	if ds.sb, err = createSandbox(s.sbc); err == nil {
+		ds.preservationFile = filepath.Join(s.pConfig.Globals.PrependBaseDir(DATA_DIR),
+			filename)
+		if s.sbc.PreserveData && fileExists(ds.preservationFile) {
+			err = ds.sb.Init(ds.preservationFile)
 		} else {
-			err = s.sb.Init("")
+			err = ds.sb.Init("")
 		}
 	}
 	if err != nil {
-		dr.LogError(err)
-		if s.sb != nil {
-			s.sb.Destroy("")
-			s.sb = nil
+		if ds.sb != nil {
+			ds.sb.Destroy("")
 		}
-		s.pConfig.Globals.ShutDown(1)
-		return
+		return nil, err
 	}
+	ds.usage.collect(ds.sb)
 
-	s.sb.InjectMessage(func(payload, payload_type, payload_name string) int {
-		if s.pack == nil {
-			s.pack = dr.NewPack()
-			if s.pack == nil {
+	var original *message.Message
+	ds.inject = func(payload, payload_type, payload_name string) int {
+		if ds.pack == nil {
+			ds.pack = s.dRunner.NewPack()
+			if ds.pack == nil {
 				return 5 // We're aborting, exit out.
 			}
-			if original == nil && len(s.packs) > 0 {
-				original = s.packs[0].Message // payload injections have the original header data in the first pack
+			if original == nil && len(ds.packs) > 0 {
+				original = ds.packs[0].Message // payload injections have the original header data in the first pack
 			}
 		} else {
 			original = nil // processing a new message, clear the old message
@@ -188,73 +220,94 @@ func (s *SandboxDecoder) SetDecoderRunner(dr pipeline.DecoderRunner) {
 		if len(payload_type) == 0 { // heka protobuf message
 			// write protobuf encoding to MsgBytes
 			needed := len(payload)
-			if cap(s.pack.MsgBytes) < needed {
-				s.pack.MsgBytes = make([]byte, len(payload))
+			if cap(ds.pack.MsgBytes) < needed {
+				ds.pack.MsgBytes = make([]byte, len(payload))
 			} else {
-				s.pack.MsgBytes = s.pack.MsgBytes[:len(payload)]
+				ds.pack.MsgBytes = ds.pack.MsgBytes[:len(payload)]
 			}
-			copy(s.pack.MsgBytes, payload)
-			s.pack.TrustMsgBytes = true
+			copy(ds.pack.MsgBytes, payload)
+			ds.pack.TrustMsgBytes = true
 
 			if original == nil {
 				original = new(message.Message)
-				copyMessageHeaders(original, s.pack.Message) // save off the header values since unmarshal will wipe them out
+				copyMessageHeaders(original, ds.pack.Message) // save off the header values since unmarshal will wipe them out
 			}
-			if nil != proto.Unmarshal(s.pack.MsgBytes, s.pack.Message) {
+			if nil != proto.Unmarshal(ds.pack.MsgBytes, ds.pack.Message) {
 				return 1
 			}
 			if s.tz != time.UTC {
 				const layout = "2006-01-02T15:04:05.999999999" // remove the incorrect UTC tz info
-				t := time.Unix(0, s.pack.Message.GetTimestamp())
+				t := time.Unix(0, ds.pack.Message.GetTimestamp())
 				t = t.In(time.UTC)
 				ct, _ := time.ParseInLocation(layout, t.Format(layout), s.tz)
-				s.pack.Message.SetTimestamp(ct.UnixNano())
-				s.pack.TrustMsgBytes = false
+				ds.pack.Message.SetTimestamp(ct.UnixNano())
+				ds.pack.TrustMsgBytes = false
 			}
 		} else {
-			s.pack.TrustMsgBytes = false
-			s.pack.Message.SetPayload(payload)
+			ds.pack.TrustMsgBytes = false
+			ds.pack.Message.SetPayload(payload)
 			ptype, _ := message.NewField("payload_type", payload_type, "file-extension")
-			s.pack.Message.AddField(ptype)
+			ds.pack.Message.AddField(ptype)
 			pname, _ := message.NewField("payload_name", payload_name, "")
-			s.pack.Message.AddField(pname)
+			ds.pack.Message.AddField(pname)
 		}
 		if original != nil {
 			// if future injections fail to set the standard headers, use the values
 			// from the original message.
-			if s.pack.Message.Uuid == nil {
-				s.pack.Message.SetUuid(uuid.NewRandom()) // UUID should always be unique
-				s.pack.TrustMsgBytes = false
+			if ds.pack.Message.Uuid == nil {
+				ds.pack.Message.SetUuid(uuid.NewRandom()) // UUID should always be unique
+				ds.pack.TrustMsgBytes = false
 			}
-			if s.pack.Message.Timestamp == nil {
-				s.pack.Message.SetTimestamp(original.GetTimestamp())
-				s.pack.TrustMsgBytes = false
+			if ds.pack.Message.Timestamp == nil {
+				ds.pack.Message.SetTimestamp(original.GetTimestamp())
+				ds.pack.TrustMsgBytes = false
 			}
-			if s.pack.Message.Type == nil {
-				s.pack.Message.SetType(original.GetType())
-				s.pack.TrustMsgBytes = false
+			if ds.pack.Message.Type == nil {
+				ds.pack.Message.SetType(original.GetType())
+				ds.pack.TrustMsgBytes = false
 			}
-			if s.pack.Message.Hostname == nil {
-				s.pack.Message.SetHostname(original.GetHostname())
-				s.pack.TrustMsgBytes = false
+			if ds.pack.Message.Hostname == nil {
+				ds.pack.Message.SetHostname(original.GetHostname())
+				ds.pack.TrustMsgBytes = false
 			}
-			if s.pack.Message.Logger == nil {
-				s.pack.Message.SetLogger(original.GetLogger())
-				s.pack.TrustMsgBytes = false
+			if ds.pack.Message.Logger == nil {
+				ds.pack.Message.SetLogger(original.GetLogger())
+				ds.pack.TrustMsgBytes = false
 			}
-			if s.pack.Message.Severity == nil {
-				s.pack.Message.SetSeverity(original.GetSeverity())
-				s.pack.TrustMsgBytes = false
+			if ds.pack.Message.Severity == nil {
+				ds.pack.Message.SetSeverity(original.GetSeverity())
+				ds.pack.TrustMsgBytes = false
 			}
-			if s.pack.Message.Pid == nil {
-				s.pack.Message.SetPid(original.GetPid())
-				s.pack.TrustMsgBytes = false
+			if ds.pack.Message.Pid == nil {
+				ds.pack.Message.SetPid(original.GetPid())
+				ds.pack.TrustMsgBytes = false
 			}
 		}
-		s.packs = append(s.packs, s.pack)
-		s.pack = nil
+		ds.packs = append(ds.packs, ds.pack)
+		ds.pack = nil
 		return 0
-	})
+	}
+	ds.sb.InjectMessage(ds.inject)
+	return ds, nil
+}
+
+// Swaps a new instance of the changed script into a pool instance, the
+// running one is kept if the new one fails to load.
+func (s *SandboxDecoder) reload(ds *decoderSandbox) {
+	sb, err := reloadSandbox(ds.sb, s.sbc, ds.preservationFile)
+	if err != nil {
+		s.dRunner.LogError(fmt.Errorf("reload failed, keeping the running script: %s", err))
+		return
+	}
+	sb.InjectMessage(ds.inject)
+	s.reportLock.Lock()
+	old := ds.sb
+	ds.sb = sb
+	ds.usage.collect(sb)
+	s.reportLock.Unlock()
+	old.Destroy("")
+	s.watcher.watch(sb.(Reloadable).SourceFiles())
+	s.dRunner.LogMessage(fmt.Sprintf("reloaded %s", s.sbc.ScriptFilename))
 }
 
 func (s *SandboxDecoder) Shutdown() {
@@ -268,73 +321,106 @@ func (s *SandboxDecoder) destroy() error {
 	s.reportLock.Lock()
 
 	var err error
-	if s.sb != nil {
+	for _, ds := range s.sandboxes {
+		perr := writeProfile(ds.sb, ds.preservationFile)
+		var derr error
 		if s.sbc.PreserveData {
-			err = s.sb.Destroy(s.preservationFile)
+			derr = ds.sb.Destroy(ds.preservationFile)
 		} else {
-			err = s.sb.Destroy("")
+			derr = ds.sb.Destroy("")
+		}
+		if err == nil {
+			err = derr
+		}
+		if err == nil {
+			err = perr
 		}
-		s.sb = nil
+	}
+	s.sandboxes = nil
+	s.pool = nil
+	if s.watcher != nil {
+		s.watcher.close()
+		s.watcher = nil
 	}
 	s.reportLock.Unlock()
 	return err
 }
 
+// Decode may be called concurrently, each call is handled by a free instance
+// of the pool.
 func (s *SandboxDecoder) Decode(pack *pipeline.PipelinePack) (packs []*pipeline.PipelinePack,
 	err error) {
 
-	if s.sb == nil {
+	pool := s.pool
+	if pool == nil {
 		err = fmt.Errorf("SandboxDecoder has been terminated")
 		return
 	}
-	s.pack = pack
+	ds := <-pool
+	defer func() { pool <- ds }()
+
+	if s.watcher != nil {
+		if generation := s.watcher.Generation(); generation != ds.generation {
+			ds.generation = generation
+			s.reload(ds)
+		}
+	}
+
+	ds.pack = pack
 	atomic.AddInt64(&s.processMessageCount, 1)
 
 	var startTime time.Time
-	if s.sample {
+	if ds.sample {
 		startTime = time.Now()
 	}
-	retval := s.sb.ProcessMessage(s.pack)
-	if s.sample {
+	retval := ds.sb.ProcessMessage(ds.pack)
+	if ds.sample {
 		duration := time.Since(startTime).Nanoseconds()
 		s.reportLock.Lock()
+		ds.usage.collect(ds.sb)
 		s.processMessageDuration += duration
 		s.processMessageSamples++
 		s.reportLock.Unlock()
 	}
-	s.sample = 0 == rand.Intn(s.sampleDenominator)
+	ds.sample = 0 == rand.Intn(s.sampleDenominator)
 	if retval > 0 {
-		err = fmt.Errorf("FATAL: %s", s.sb.LastError())
+		err = fmt.Errorf("FATAL: %s", ds.sb.LastError())
 		s.dRunner.LogError(err)
 		s.pConfig.Globals.ShutDown(1)
 	}
 	if retval < 0 {
 		atomic.AddInt64(&s.processMessageFailures, 1)
-		if s.pack != nil {
+		if ds.pack != nil {
 			err = fmt.Errorf("Failed parsing: %s payload: %s",
-				s.sb.LastError(), s.pack.Message.GetPayload())
+				ds.sb.LastError(), ds.pack.Message.GetPayload())
 		} else {
-			err = fmt.Errorf("Failed after a successful inject_message call: %s", s.sb.LastError())
+			err = fmt.Errorf("Failed after a successful inject_message call: %s", ds.sb.LastError())
 		}
-		if len(s.packs) > 1 {
-			for _, p := range s.packs[1:] {
+		if len(ds.packs) > 1 {
+			for _, p := range ds.packs[1:] {
 				p.Recycle(nil)
 			}
 		}
-		s.packs = nil
+		ds.packs = nil
 	}
-	if retval == 0 && s.pack != nil {
+	if retval == 0 && ds.pack != nil {
 		// InjectMessage was never called, we're passing the original message
 		// through.
 		packs = append(packs, pack)
-		s.pack = nil
+		ds.pack = nil
 	} else {
-		packs = s.packs
+		packs = ds.packs
 	}
-	s.packs = nil
+	ds.packs = nil
 	return packs, err
 }
 
+// Satisfies the `pipeline.ConcurrentDecoder` interface so the DecoderRunner
+// decodes with one goroutine per instance of the pool.
+func (s *SandboxDecoder) Concurrency() (workers int, preserveOrder bool) {
+	return s.sbc.PoolSize, s.sbc.PreserveOrder
+}
+
 func (s *SandboxDecoder) EncodesMsgBytes() bool {
 	return true
 }
@@ -345,18 +431,28 @@ func (s *SandboxDecoder) ReportMsg(msg *message.Message) error {
 	s.reportLock.Lock()
 	defer s.reportLock.Unlock()
 
-	if s.sb == nil {
+	if s.sandboxes == nil {
 		return fmt.Errorf("Decoder is not running")
 	}
 
-	message.NewIntField(msg, "Memory", int(s.sb.Usage(TYPE_MEMORY,
-		STAT_CURRENT)), "B")
-	message.NewIntField(msg, "MaxMemory", int(s.sb.Usage(TYPE_MEMORY,
-		STAT_MAXIMUM)), "B")
-	message.NewIntField(msg, "MaxInstructions", int(s.sb.Usage(
-		TYPE_INSTRUCTIONS, STAT_MAXIMUM)), "count")
-	message.NewIntField(msg, "MaxOutput", int(s.sb.Usage(TYPE_OUTPUT,
-		STAT_MAXIMUM)), "B")
+	// The memory in use is summed over the pool, the maximums are the largest
+	// of any instance and the profiles are merged. The usage is the snapshot
+	// each instance took at its last sampled message, the instances can't be
+	// read while the workers run them.
+	var memory, maxMemory, maxInstructions, maxOutput uint
+	profiles := make([][]ProfileCount, 0, len(s.sandboxes))
+	for _, ds := range s.sandboxes {
+		memory += ds.usage.memory
+		maxMemory = maxUint(maxMemory, ds.usage.maxMemory)
+		maxInstructions = maxUint(maxInstructions, ds.usage.maxInstructions)
+		maxOutput = maxUint(maxOutput, ds.usage.maxOutput)
+		profiles = append(profiles, ds.usage.profile)
+	}
+	message.NewIntField(msg, "Memory", int(memory), "B")
+	message.NewIntField(msg, "MaxMemory", int(maxMemory), "B")
+	message.NewIntField(msg, "MaxInstructions", int(maxInstructions), "count")
+	message.NewIntField(msg, "MaxOutput", int(maxOutput), "B")
+	message.NewIntField(msg, "PoolSize", len(s.sandboxes), "count")
 	message.NewInt64Field(msg, "ProcessMessageCount", atomic.LoadInt64(&s.processMessageCount), "count")
 	message.NewInt64Field(msg, "ProcessMessageFailures", atomic.LoadInt64(&s.processMessageFailures), "count")
 	message.NewInt64Field(msg, "ProcessMessageSamples", s.processMessageSamples, "count")
@@ -367,9 +463,18 @@ func (s *SandboxDecoder) ReportMsg(msg *message.Message) error {
 	}
 	message.NewInt64Field(msg, "ProcessMessageAvgDuration", tmp, "ns")
 
+	ReportProfile(msg, profiles...)
+
 	return nil
 }
 
+func maxUint(a, b uint) uint {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 func init() {
 	pipeline.RegisterPlugin("SandboxDecoder", func() interface{} {
 		return new(SandboxDecoder)
@@ -2,7 +2,10 @@ package plugins
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"heka/message"
@@ -105,6 +108,230 @@ func DecoderSpec(c gs.Context) {
 			})
 		})
 
+		c.Specify("that runs a tengo script", func() {
+			dRunner.EXPECT().Name().Return("tengo_decoder")
+			conf.ScriptFilename = "../tengo/testsupport/decoder.tengo"
+			conf.ScriptType = "tengo"
+			err := decoder.Init(conf)
+			c.Assume(err, gs.IsNil)
+			decoder.SetDecoderRunner(dRunner)
+
+			c.Specify("decodes simple messages", func() {
+				pack.Message.SetPayload("1376389920 debug id=2321 url=example.com item=1")
+				_, err = decoder.Decode(pack)
+				c.Assume(err, gs.IsNil)
+				c.Expect(pack.Message.GetTimestamp(), gs.Equals, int64(1376389920000000000))
+				c.Expect(pack.Message.GetSeverity(), gs.Equals, int32(7))
+				value, _ := pack.Message.GetFieldValue("url")
+				c.Expect(value, gs.Equals, "example.com")
+				decoder.Shutdown()
+			})
+
+			c.Specify("reports the error value of a failed parse", func() {
+				data := "1376389920 bogus id=2321"
+				pack.Message.SetPayload(data)
+				packs, err := decoder.Decode(pack)
+				c.Expect(len(packs), gs.Equals, 0)
+				c.Expect(err.Error(), gs.Equals, "Failed parsing: unknown severity payload: "+data)
+				decoder.Shutdown()
+			})
+		})
+
+		c.Specify("with a pool of script instances", func() {
+			dRunner.EXPECT().Name().Return("pool")
+			conf.ScriptFilename = "../lua/testsupport/decoder.lua"
+			conf.ModuleDirectory = "../lua/modules"
+			conf.PoolSize = 3
+			conf.PreserveData = true
+			err := decoder.Init(conf)
+			c.Assume(err, gs.IsNil)
+			decoder.SetDecoderRunner(dRunner)
+
+			c.Specify("decodes concurrently", func() {
+				workers, preserveOrder := decoder.Concurrency()
+				c.Expect(workers, gs.Equals, 3)
+				c.Expect(preserveOrder, gs.IsTrue)
+
+				errs := make(chan error, 30)
+				for i := 0; i < 30; i++ {
+					go func(i int) {
+						pack := pipeline.NewPipelinePack(supply)
+						pack.Message.SetPayload(fmt.Sprintf(
+							"1376389920 debug id=%d url=example.com item=1", i))
+						_, err := decoder.Decode(pack)
+						if err == nil {
+							if id, _ := pack.Message.GetFieldValue("id"); id != fmt.Sprint(i) {
+								err = fmt.Errorf("expected id %d, got %v", i, id)
+							}
+						}
+						errs <- err
+					}(i)
+				}
+				for i := 0; i < 30; i++ {
+					c.Expect(<-errs, gs.IsNil)
+				}
+
+				msg := new(message.Message)
+				c.Expect(decoder.ReportMsg(msg), gs.IsNil)
+				value, _ := msg.GetFieldValue("PoolSize")
+				c.Expect(value, gs.Equals, int64(3))
+				value, _ = msg.GetFieldValue("ProcessMessageCount")
+				c.Expect(value, gs.Equals, int64(30))
+				value, _ = msg.GetFieldValue("MaxInstructions")
+				c.Expect(value.(int64) > 0, gs.IsTrue)
+			})
+
+			c.Specify("preserves the data of every instance", func() {
+				decoder.Shutdown()
+				for _, name := range []string{"pool.data", "pool-1.data", "pool-2.data"} {
+					filename := "sandbox_preservation/" + name
+					_, err = os.Stat(filename)
+					c.Expect(err, gs.IsNil)
+					c.Expect(os.Remove(filename), gs.IsNil)
+				}
+			})
+		})
+
+		c.Specify("with a profiled pool merges the profiles of every instance", func() {
+			dRunner.EXPECT().Name().Return("profiled")
+			conf.ScriptFilename = "../lua/testsupport/decoder.lua"
+			conf.ModuleDirectory = "../lua/modules"
+			conf.PoolSize = 3
+			conf.Profile = true
+			err := decoder.Init(conf)
+			c.Assume(err, gs.IsNil)
+			decoder.sampleDenominator = 1
+			decoder.SetDecoderRunner(dRunner)
+			defer func() {
+				decoder.Shutdown()
+				for _, name := range []string{"profiled", "profiled-1", "profiled-2"} {
+					os.Remove("sandbox_preservation/" + name + ".profile")
+				}
+			}()
+
+			errs := make(chan error, 30)
+			for i := 0; i < 30; i++ {
+				go func(i int) {
+					pack := pipeline.NewPipelinePack(supply)
+					pack.Message.SetPayload(fmt.Sprintf(
+						"1376389920 debug id=%d url=example.com item=1", i))
+					_, err := decoder.Decode(pack)
+					errs <- err
+				}(i)
+			}
+			for i := 0; i < 30; i++ {
+				c.Expect(<-errs, gs.IsNil)
+			}
+
+			msg := new(message.Message)
+			c.Expect(decoder.ReportMsg(msg), gs.IsNil)
+			var calls int64
+			for _, f := range msg.Fields {
+				if strings.HasPrefix(f.GetName(), "ProfileCalls-process_message ") {
+					calls += f.GetValueInteger()[0]
+				}
+			}
+			c.Expect(calls, gs.Equals, int64(30))
+		})
+
+		c.Specify("that reloads on change", func() {
+			dir, err := ioutil.TempDir("", "reload")
+			c.Assume(err, gs.IsNil)
+			defer os.RemoveAll(dir)
+			script := filepath.Join(dir, "reload.lua")
+			module := filepath.Join(dir, "reload_version.lua")
+			writeFile := func(filename, content string) {
+				c.Assume(ioutil.WriteFile(filename, []byte(content), 0644), gs.IsNil)
+				// make sure the change is visible even with a coarse mtime
+				later := time.Now().Add(time.Duration(len(content)) * time.Second)
+				c.Assume(os.Chtimes(filename, later, later), gs.IsNil)
+			}
+			writeFile(module, "local M = {}\nsetfenv(1, M)\nversion = 1\nreturn M\n")
+			writeFile(script, `local v = require "reload_version"
+count = 0
+function process_message()
+    count = count + 1
+    write_message("Fields[count]", count)
+    write_message("Fields[version]", v.version)
+    return 0
+end
+`)
+			dRunner.EXPECT().Name().Return("reload")
+			conf.ScriptFilename = script
+			conf.ModuleDirectory = dir
+			conf.ReloadOnChange = true
+			err = decoder.Init(conf)
+			c.Assume(err, gs.IsNil)
+			decoder.SetDecoderRunner(dRunner)
+			defer decoder.Shutdown()
+
+			decode := func() (count, version interface{}) {
+				pack := pipeline.NewPipelinePack(supply)
+				_, err := decoder.Decode(pack)
+				c.Expect(err, gs.IsNil)
+				count, _ = pack.Message.GetFieldValue("count")
+				version, _ = pack.Message.GetFieldValue("version")
+				return
+			}
+			count, version := decode()
+			c.Expect(count, gs.Equals, float64(1))
+			c.Expect(version, gs.Equals, float64(1))
+
+			c.Specify("swaps in the changed module keeping the state", func() {
+				dRunner.EXPECT().LogMessage("reloaded " + script)
+				writeFile(module, "local M = {}\nsetfenv(1, M)\nversion = 2\nreturn M\n")
+				decoder.watcher.check()
+				count, version = decode()
+				c.Expect(count, gs.Equals, float64(2))
+				c.Expect(version, gs.Equals, float64(2))
+			})
+
+			c.Specify("keeps running the old script when the new one fails", func() {
+				var logged error
+				dRunner.EXPECT().LogError(gomock.Any()).Do(func(err error) { logged = err })
+				writeFile(script, "syntax error")
+				decoder.watcher.check()
+				count, version = decode()
+				c.Expect(count, gs.Equals, float64(2))
+				c.Expect(version, gs.Equals, float64(1))
+				c.Expect(strings.HasPrefix(logged.Error(),
+					"reload failed, keeping the running script: "+script), gs.IsTrue)
+			})
+
+			c.Specify("keeps running the old script when the new one can't restore its data", func() {
+				body := `
+function process_message()
+    count = count + 1
+    write_message("Fields[count]", count)
+    write_message("Fields[version]", v.version)
+    return 0
+end
+`
+				dRunner.EXPECT().LogMessage("reloaded " + script)
+				writeFile(script, "local v = require \"reload_version\"\ncount = 0\n"+
+					"data = string.rep(\"x\", 65536)\n"+body)
+				decoder.watcher.check()
+				count, version = decode()
+				c.Expect(count, gs.Equals, float64(2))
+
+				// The new script fits the memory limit on its own but not
+				// with the restored data.
+				pad := int(decoder.sbc.MemoryLimit) -
+					int(decoder.sandboxes[0].usage.memory) + 32768
+				var logged error
+				dRunner.EXPECT().LogError(gomock.Any()).Do(func(err error) { logged = err })
+				writeFile(script, fmt.Sprintf("local v = require \"reload_version\"\ncount = 0\n"+
+					"pad = string.rep(\"y\", %d)\n", pad)+body)
+				decoder.watcher.check()
+				count, version = decode()
+				c.Expect(count, gs.Equals, float64(3))
+				c.Expect(version, gs.Equals, float64(1))
+				c.Assume(logged, gs.Not(gs.IsNil))
+				c.Expect(logged.Error(), gs.Equals,
+					"reload failed, keeping the running script: restore_global_data not enough memory")
+			})
+		})
+
 		c.Specify("that only uses write_message", func() {
 			conf.ScriptFilename = "../lua/testsupport/write_message_decoder.lua"
 			conf.ModuleDirectory = "../lua/modules"
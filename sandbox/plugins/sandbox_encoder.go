@@ -29,6 +29,7 @@ import (
 	"heka/pipeline"
 	"heka/sandbox"
 	"heka/sandbox/lua"
+	"heka/sandbox/tengo"
 )
 
 type SandboxEncoder struct {
@@ -64,6 +65,7 @@ type SandboxEncoderConfig struct {
 	Profile          bool
 	Config           map[string]interface{}
 	PluginType       string
+	Clock            func() int64 `toml:"-"`
 }
 
 // Heka will call this before calling any other methods to give us access to
@@ -101,6 +103,7 @@ func (s *SandboxEncoder) Init(config interface{}) (err error) {
 		Profile:          conf.Profile,
 		Config:           conf.Config,
 		PluginType:       "encoder",
+		Clock:            conf.Clock,
 	}
 	globals := s.pConfig.Globals
 	s.sbc.ScriptFilename = globals.PrependShareDir(s.sbc.ScriptFilename)
@@ -123,6 +126,8 @@ func (s *SandboxEncoder) Init(config interface{}) (err error) {
 	switch s.sbc.ScriptType {
 	case "lua":
 		s.sb, err = lua.CreateLuaSandbox(s.sbc)
+	case "tengo":
+		s.sb, err = tengo.CreateTengoSandbox(s.sbc)
 	default:
 		return fmt.Errorf("Unsupported script type: %s", s.sbc.ScriptType)
 	}
@@ -154,6 +159,7 @@ func (s *SandboxEncoder) Init(config interface{}) (err error) {
 func (s *SandboxEncoder) Stop() {
 	s.reportLock.Lock()
 	if s.sb != nil {
+		writeProfile(s.sb, s.preservationFile)
 		if s.sbc.PreserveData {
 			s.sb.Destroy(s.preservationFile)
 		} else {
@@ -244,6 +250,8 @@ func (s *SandboxEncoder) ReportMsg(msg *message.Message) error {
 	}
 	message.NewInt64Field(msg, "ProcessMessageAvgDuration", tmp, "ns")
 
+	reportProfile(s.sb, msg)
+
 	return nil
 }
 
@@ -156,7 +156,7 @@ func EncoderSpec(c gs.Context) {
 			result, err = encoder.Encode(pack)
 			c.Expect(err, gs.IsNil)
 			expected := `{"gauges":[{"value":1,"measure_time":1410823460,"name":"HTTP_200","source":"hostname"},{"value":2,"measure_time":1410823460,"name":"HTTP_300","source":"hostname"},{"value":3,"measure_time":1410823460,"name":"HTTP_400","source":"hostname"},{"value":4,"measure_time":1410823460,"name":"HTTP_500","source":"hostname"},{"value":5,"measure_time":1410823460,"name":"HTTP_UNKNOWN","source":"hostname"},{"value":6,"measure_time":1410823465,"name":"HTTP_200","source":"hostname"},{"value":7,"measure_time":1410823465,"name":"HTTP_300","source":"hostname"},{"value":8,"measure_time":1410823465,"name":"HTTP_400","source":"hostname"},{"value":9,"measure_time":1410823465,"name":"HTTP_500","source":"hostname"},{"value":10,"measure_time":1410823465,"name":"HTTP_UNKNOWN","source":"hostname"},{"value":11,"measure_time":1410823470,"name":"HTTP_200","source":"hostname"},{"value":12,"measure_time":1410823470,"name":"HTTP_300","source":"hostname"},{"value":13,"measure_time":1410823470,"name":"HTTP_400","source":"hostname"},{"value":14,"measure_time":1410823470,"name":"HTTP_500","source":"hostname"},{"value":15,"measure_time":1410823470,"name":"HTTP_UNKNOWN","source":"hostname"},{"value":16,"measure_time":1410823475,"name":"HTTP_200","source":"hostname"},{"value":17,"measure_time":1410823475,"name":"HTTP_300","source":"hostname"},{"value":18,"measure_time":1410823475,"name":"HTTP_400","source":"hostname"},{"value":19,"measure_time":1410823475,"name":"HTTP_500","source":"hostname"},{"value":20,"measure_time":1410823475,"name":"HTTP_UNKNOWN","source":"hostname"}]}`
-			c.Expect(string(result), gs.Equals, expected)
+			c.Expect(normalizeJSON(string(result)), gs.Equals, normalizeJSON(expected))
 
 			c.Specify("and correctly advances", func() {
 				payload := `{"time":1410823475,"rows":5,"columns":5,"seconds_per_row":5,"column_info":[{"name":"HTTP_200","unit":"count","aggregation":"sum"},{"name":"HTTP_300","unit":"count","aggregation":"sum"},{"name":"HTTP_400","unit":"count","aggregation":"sum"},{"name":"HTTP_500","unit":"count","aggregation":"sum"},{"name":"HTTP_UNKNOWN","unit":"count","aggregation":"sum"}]}
@@ -170,7 +170,7 @@ func EncoderSpec(c gs.Context) {
 				result, err = encoder.Encode(pack)
 				c.Expect(err, gs.IsNil)
 				expected := `{"gauges":[{"value":21,"measure_time":1410823480,"name":"HTTP_200","source":"hostname"},{"value":22,"measure_time":1410823480,"name":"HTTP_300","source":"hostname"},{"value":23,"measure_time":1410823480,"name":"HTTP_400","source":"hostname"},{"value":24,"measure_time":1410823480,"name":"HTTP_500","source":"hostname"},{"value":25,"measure_time":1410823480,"name":"HTTP_UNKNOWN","source":"hostname"},{"value":1,"measure_time":1410823485,"name":"HTTP_200","source":"hostname"},{"value":2,"measure_time":1410823485,"name":"HTTP_300","source":"hostname"},{"value":3,"measure_time":1410823485,"name":"HTTP_400","source":"hostname"},{"value":4,"measure_time":1410823485,"name":"HTTP_500","source":"hostname"},{"value":5,"measure_time":1410823485,"name":"HTTP_UNKNOWN","source":"hostname"},{"value":6,"measure_time":1410823490,"name":"HTTP_200","source":"hostname"},{"value":8,"measure_time":1410823490,"name":"HTTP_400","source":"hostname"},{"value":10,"measure_time":1410823490,"name":"HTTP_UNKNOWN","source":"hostname"}]}`
-				c.Expect(string(result), gs.Equals, expected)
+				c.Expect(normalizeJSON(string(result)), gs.Equals, normalizeJSON(expected))
 			})
 		})
 	})
@@ -223,7 +223,7 @@ func EncoderSpec(c gs.Context) {
 			result, err := encoder.Encode(pack)
 			c.Expect(err, gs.IsNil)
 			expected := `[{"points":[[54321000,"my_type","Payload value lorem ipsum","hostname",12345,"Logger",4,"",[123,456],["0_first","0_second"],["1_first","1_second"]]],"name":"series","columns":["time","Type","Payload","Hostname","Pid","Logger","Severity","EnvVersion","intField","strField","strField2"]}]`
-			c.Expect(string(result), gs.Equals, expected)
+			c.Expect(normalizeJSON(string(result)), gs.Equals, normalizeJSON(expected))
 		})
 
 		c.Specify("interpolates series name correctly", func() {
@@ -233,7 +233,7 @@ func EncoderSpec(c gs.Context) {
 			result, err := encoder.Encode(pack)
 			c.Expect(err, gs.IsNil)
 			expected := `[{"points":[[54321000,"my_type","Payload value lorem ipsum","hostname",12345,"Logger",4,"",[123,456],["0_first","0_second"],["1_first","1_second"]]],"name":"series.12345.my_type.0_first.123","columns":["time","Type","Payload","Hostname","Pid","Logger","Severity","EnvVersion","intField","strField","strField2"]}]`
-			c.Expect(string(result), gs.Equals, expected)
+			c.Expect(normalizeJSON(string(result)), gs.Equals, normalizeJSON(expected))
 		})
 
 		c.Specify("skips specified correctly", func() {
@@ -243,7 +243,7 @@ func EncoderSpec(c gs.Context) {
 			result, err := encoder.Encode(pack)
 			c.Expect(err, gs.IsNil)
 			expected := `[{"points":[[54321000,"hostname",12345,"Logger",4,"",[123,456]]],"name":"series","columns":["time","Hostname","Pid","Logger","Severity","EnvVersion","intField"]}]`
-			c.Expect(string(result), gs.Equals, expected)
+			c.Expect(normalizeJSON(string(result)), gs.Equals, normalizeJSON(expected))
 		})
 	})
 
@@ -306,7 +306,7 @@ strField_vidx_1,Logger=Logger,Type=my_type,Severity=4,Hostname=hostname value="0
 intField,Logger=Logger,Type=my_type,Severity=4,Hostname=hostname value=123.000000 54321000
 intField_vidx_1,Logger=Logger,Type=my_type,Severity=4,Hostname=hostname value=456.000000 54321000
 `
-			c.Expect(string(result), gs.Equals, expected)
+			c.Expect(normalizeLines(string(result)), gs.Equals, normalizeLines(expected))
 		})
 
 		c.Specify("skips specified fields", func() {
@@ -320,7 +320,7 @@ byteField_vidx_1,Logger=Logger,Type=my_type,Severity=4,Hostname=hostname value="
 intField,Logger=Logger,Type=my_type,Severity=4,Hostname=hostname value=123.000000 54321000
 byteField,Logger=Logger,Type=my_type,Severity=4,Hostname=hostname value="first" 54321000
 `
-			c.Expect(string(result), gs.Equals, expected)
+			c.Expect(normalizeLines(string(result)), gs.Equals, normalizeLines(expected))
 		})
 
 		c.Specify("honors tag_fields", func() {
@@ -336,7 +336,7 @@ byteField_vidx_1,Logger=Logger,Hostname=hostname,strField=0_first,strField_vidx_
 intField,Logger=Logger,Hostname=hostname,strField=0_first,strField_vidx_1=0_second,strField_fidx_1=1_first,strField_fidx_1_vidx_1=1_second value=123.000000 54321000
 byteField,Logger=Logger,Hostname=hostname,strField=0_first,strField_vidx_1=0_second,strField_fidx_1=1_first,strField_fidx_1_vidx_1=1_second value="first" 54321000
 `
-			c.Expect(string(result), gs.Equals, expected)
+			c.Expect(normalizeLines(string(result)), gs.Equals, normalizeLines(expected))
 		})
 	})
 
@@ -22,6 +22,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -31,6 +32,7 @@ import (
 	"heka/pipeline"
 	. "heka/sandbox"
 	"heka/sandbox/lua"
+	"heka/sandbox/tengo"
 )
 
 func fileExists(path string) bool {
@@ -41,6 +43,51 @@ func fileExists(path string) bool {
 	return false
 }
 
+// Writes the profile of a sandbox created with the profile option next to
+// its preservation file, e.g. sandbox_preservation/MyFilter.profile.
+func writeProfile(sb Sandbox, preservationFile string) error {
+	p, ok := sb.(Profiler)
+	if !ok || !p.Profiling() || preservationFile == "" {
+		return nil
+	}
+	f, err := os.Create(strings.TrimSuffix(preservationFile, DATA_EXT) + PROFILE_EXT)
+	if err != nil {
+		return err
+	}
+	if err = p.WriteProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func reportProfile(sb Sandbox, msg *message.Message) {
+	if p, ok := sb.(Profiler); ok {
+		p.ReportProfile(msg)
+	}
+}
+
+// Usage statistics and profile of a sandbox. They are collected by the
+// goroutine running the sandbox, under the plugin's report lock, so reports
+// don't read the sandbox while it runs.
+type sandboxUsage struct {
+	memory          uint
+	maxMemory       uint
+	maxInstructions uint
+	maxOutput       uint
+	profile         []ProfileCount
+}
+
+func (u *sandboxUsage) collect(sb Sandbox) {
+	u.memory = sb.Usage(TYPE_MEMORY, STAT_CURRENT)
+	u.maxMemory = sb.Usage(TYPE_MEMORY, STAT_MAXIMUM)
+	u.maxInstructions = sb.Usage(TYPE_INSTRUCTIONS, STAT_MAXIMUM)
+	u.maxOutput = sb.Usage(TYPE_OUTPUT, STAT_MAXIMUM)
+	if p, ok := sb.(Profiler); ok && p.Profiling() {
+		u.profile = p.ProfileCounts()
+	}
+}
+
 // Heka Filter plugin that acts as a wrapper for sandboxed filter scripts.
 // Each sanboxed filter (whether statically defined in the config or
 // dynamically loaded through the sandbox manager) maps to exactly one
@@ -59,9 +106,11 @@ type SandboxFilter struct {
 	sbc                    *SandboxConfig
 	preservationFile       string
 	reportLock             sync.Mutex
+	usage                  sandboxUsage
 	name                   string
 	sampleDenominator      int
 	manager                *SandboxManagerFilter
+	watcher                *scriptWatcher
 	pConfig                *pipeline.PipelineConfig
 }
 
@@ -105,6 +154,11 @@ func (this *SandboxFilter) Init(config interface{}) (err error) {
 		if err != nil {
 			return
 		}
+	case "tengo":
+		this.sb, err = tengo.CreateTengoSandbox(this.sbc)
+		if err != nil {
+			return
+		}
 	default:
 		return fmt.Errorf("unsupported script type: %s", this.sbc.ScriptType)
 	}
@@ -115,6 +169,9 @@ func (this *SandboxFilter) Init(config interface{}) (err error) {
 	} else {
 		err = this.sb.Init("")
 	}
+	if err == nil {
+		this.usage.collect(this.sb)
+	}
 
 	return
 }
@@ -128,14 +185,10 @@ func (this *SandboxFilter) ReportMsg(msg *message.Message) error {
 		return nil
 	}
 
-	message.NewIntField(msg, "Memory", int(this.sb.Usage(TYPE_MEMORY,
-		STAT_CURRENT)), "B")
-	message.NewIntField(msg, "MaxMemory", int(this.sb.Usage(TYPE_MEMORY,
-		STAT_MAXIMUM)), "B")
-	message.NewIntField(msg, "MaxInstructions", int(this.sb.Usage(
-		TYPE_INSTRUCTIONS, STAT_MAXIMUM)), "count")
-	message.NewIntField(msg, "MaxOutput", int(this.sb.Usage(TYPE_OUTPUT,
-		STAT_MAXIMUM)), "B")
+	message.NewIntField(msg, "Memory", int(this.usage.memory), "B")
+	message.NewIntField(msg, "MaxMemory", int(this.usage.maxMemory), "B")
+	message.NewIntField(msg, "MaxInstructions", int(this.usage.maxInstructions), "count")
+	message.NewIntField(msg, "MaxOutput", int(this.usage.maxOutput), "B")
 	message.NewInt64Field(msg, "ProcessMessageCount", atomic.LoadInt64(&this.processMessageCount), "count")
 	message.NewInt64Field(msg, "ProcessMessageFailures", atomic.LoadInt64(&this.processMessageFailures), "count")
 	message.NewInt64Field(msg, "InjectMessageCount", atomic.LoadInt64(&this.injectMessageCount), "count")
@@ -161,6 +214,8 @@ func (this *SandboxFilter) ReportMsg(msg *message.Message) error {
 	}
 	message.NewInt64Field(msg, "TimerEventAvgDuration", tmp, "ns")
 
+	ReportProfile(msg, this.usage.profile)
+
 	return nil
 }
 
@@ -189,9 +244,20 @@ func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper
 	} else {
 		samplesNeeded = int64(cap(inChan)) - 1
 	}
+	var reload chan struct{}
+	if this.sbc.ReloadOnChange {
+		watcher, e := newScriptWatcher(this.sb)
+		if e != nil {
+			return e
+		}
+		defer watcher.close()
+		this.watcher = watcher
+		reload = watcher.C
+	}
+
 	// We assign to the return value of Run() for errors in the closure so that
 	// the plugin runner can determine what caused the SandboxFilter to return.
-	this.sb.InjectMessage(func(payload, payload_type, payload_name string) int {
+	inject := func(payload, payload_type, payload_name string) int {
 		if injectionCount == 0 {
 			err = pipeline.TerminatedError("exceeded InjectMessage count")
 			return 2
@@ -231,10 +297,14 @@ func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper
 		}
 		atomic.AddInt64(&this.injectMessageCount, 1)
 		return 0
-	})
+	}
+	this.sb.InjectMessage(inject)
 
 	for ok {
 		select {
+		case <-reload:
+			this.reload(fr, inject)
+
 		case pack, ok = <-inChan:
 			if !ok {
 				break
@@ -260,6 +330,7 @@ func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper
 			if sample {
 				duration = time.Since(startTime).Nanoseconds()
 				this.reportLock.Lock()
+				this.usage.collect(this.sb)
 				this.processMessageDuration += duration
 				this.processMessageSamples++
 				if this.sbc.Profile {
@@ -304,6 +375,7 @@ func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper
 			}
 			duration = time.Since(startTime).Nanoseconds()
 			this.reportLock.Lock()
+			this.usage.collect(this.sb)
 			this.timerEventDuration += duration
 			this.timerEventSamples++
 			this.reportLock.Unlock()
@@ -352,10 +424,6 @@ func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper
 		}
 	}
 
-	if this.manager != nil {
-		this.manager.PluginExited()
-	}
-
 	destroyErr := this.destroy()
 	if destroyErr != nil {
 		if err != nil {
@@ -364,19 +432,50 @@ func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper
 			err = destroyErr
 		}
 	}
+
+	// The manager is told once the data has been preserved, so an updated
+	// version of the script can pick it up.
+	if this.manager != nil {
+		this.manager.PluginExited(this, err)
+	}
 	return err
 }
 
+// Swaps in a new instance of the changed script, the running one is kept if
+// the new one fails to load.
+func (this *SandboxFilter) reload(fr pipeline.FilterRunner,
+	inject func(payload, payload_type, payload_name string) int) {
+
+	sb, err := reloadSandbox(this.sb, this.sbc, this.preservationFile)
+	if err != nil {
+		fr.LogError(fmt.Errorf("reload failed, keeping the running script: %s", err))
+		return
+	}
+	sb.InjectMessage(inject)
+	this.reportLock.Lock()
+	old := this.sb
+	this.sb = sb
+	this.usage.collect(sb)
+	this.reportLock.Unlock()
+	old.Destroy("")
+	this.watcher.watch(sb.(Reloadable).SourceFiles())
+	fr.LogMessage(fmt.Sprintf("reloaded %s", this.sbc.ScriptFilename))
+}
+
 func (this *SandboxFilter) destroy() error {
 	this.reportLock.Lock()
 
 	var err error
 	if this.sb != nil {
+		perr := writeProfile(this.sb, this.preservationFile)
 		if this.sbc.PreserveData {
 			err = this.sb.Destroy(this.preservationFile)
 		} else {
 			err = this.sb.Destroy("")
 		}
+		if err == nil {
+			err = perr
+		}
 
 		this.sb = nil
 	}
@@ -111,6 +111,52 @@ func FilterSpec(c gs.Context) {
 			c.Expect(err.Error(), gs.Equals, termErr.Error())
 		})
 
+		c.Specify("Runs a tengo script", func() {
+			injected := pipeline.NewPipelinePack(nil)
+			var timer <-chan time.Time
+			fth.MockFilterRunner.EXPECT().Ticker().Return(timer)
+			fth.MockFilterRunner.EXPECT().InChan().Return(inChan)
+			fth.MockFilterRunner.EXPECT().UsesBuffering().Return(true)
+			fth.MockFilterRunner.EXPECT().Name().Return("tengo_count")
+			fth.MockFilterRunner.EXPECT().Inject(injected).Return(true)
+			fth.MockHelper.EXPECT().PipelinePack(uint(0)).Return(injected, nil)
+			fth.MockHelper.EXPECT().PipelineConfig().Return(pConfig)
+
+			config.ScriptFilename = "../tengo/testsupport/simple_count.tengo"
+			config.ScriptType = "tengo"
+			err := sbFilter.Init(config)
+			c.Assume(err, gs.IsNil)
+			inChan <- pack
+			close(inChan)
+			err = sbFilter.Run(fth.MockFilterRunner, fth.MockHelper)
+			c.Expect(err, gs.IsNil)
+			c.Expect(injected.Message.GetPayload(), gs.Equals, "1")
+		})
+
+		c.Specify("Terminates a tengo script allocating past its memory limit", func() {
+			terminated := pipeline.NewPipelinePack(nil)
+			var timer <-chan time.Time
+			fth.MockFilterRunner.EXPECT().Ticker().Return(timer)
+			fth.MockFilterRunner.EXPECT().InChan().Return(inChan)
+			fth.MockFilterRunner.EXPECT().UsesBuffering().Return(true)
+			fth.MockFilterRunner.EXPECT().Name().Return("tengo_errors")
+			fth.MockFilterRunner.EXPECT().Inject(terminated).Return(true)
+			fth.MockHelper.EXPECT().PipelinePack(uint(0)).Return(terminated, nil)
+			fth.MockHelper.EXPECT().PipelineConfig().Return(pConfig)
+
+			config.ScriptFilename = "../tengo/testsupport/errors.tengo"
+			config.ScriptType = "tengo"
+			err := sbFilter.Init(config)
+			c.Assume(err, gs.IsNil)
+			pack.Message.SetPayload("text.repeat() out of memory")
+			inChan <- pack
+			close(inChan)
+			err = sbFilter.Run(fth.MockFilterRunner, fth.MockHelper)
+			c.Expect(err.Error(), gs.Equals,
+				pipeline.TerminatedError("process_message() not enough memory").Error())
+			c.Expect(terminated.Message.GetType(), gs.Equals, "heka.sandbox-terminated")
+		})
+
 		c.Specify("Preserves data", func() {
 			var timer <-chan time.Time
 			fth.MockFilterRunner.EXPECT().Ticker().Return(timer)
@@ -288,7 +334,7 @@ func FilterSpec(c gs.Context) {
 			sbmFilter.Init(config)
 			go func() {
 				err := sbmFilter.loadSandbox(fth.MockFilterRunner, fth.MockHelper, sbxMgrsDir,
-					msg)
+					msg, "")
 				errChan <- err
 			}()
 
@@ -302,6 +348,126 @@ func FilterSpec(c gs.Context) {
 			ok := pConfig.RemoveFilterRunner(fullSbxName)
 			c.Expect(ok, gs.IsTrue)
 		})
+
+		c.Specify("Enforces the per signer filter quota", func() {
+			config.MaxFiltersPerSigner = 1
+			sbmFilter.Init(config)
+			sbmFilter.sandboxes["SandboxManagerFilter-Counter"] = &managedSandbox{
+				Signer: "alice", Version: 1}
+			err := sbmFilter.checkQuotas("alice", nil)
+			c.Expect(err.Error(), gs.Equals,
+				"signer 'alice' attempted to load more than 1 filters")
+			c.Expect(sbmFilter.checkQuotas("bob", nil), gs.IsNil)
+			c.Expect(sbmFilter.checkQuotas("alice",
+				sbmFilter.sandboxes["SandboxManagerFilter-Counter"]), gs.IsNil)
+		})
+
+		c.Specify("Enforces the total memory quota", func() {
+			config.MaxTotalMemory = 1024
+			sbmFilter.Init(config)
+			err := sbmFilter.checkQuotas("alice", nil)
+			c.Expect(err.Error(), gs.Equals,
+				"loading the filter would exceed the total memory limit of 1024 bytes")
+		})
+
+		c.Specify("Only responds with an error to a failed load", func() {
+			sbmFilter.Init(config)
+			f, _ := message.NewField("action", "load", "")
+			pack.Message.AddField(f)
+			f, _ = message.NewField("config", "[broken", "toml")
+			pack.Message.AddField(f)
+			resp := pipeline.NewPipelinePack(nil)
+			fth.MockFilterRunner.EXPECT().InChan().Return(inChan)
+			fth.MockFilterRunner.EXPECT().Name().Return("SandboxManagerFilter").AnyTimes()
+			fth.MockFilterRunner.EXPECT().LogError(gomock.Any())
+			fth.MockHelper.EXPECT().PipelinePack(uint(0)).Return(resp, nil)
+			fth.MockFilterRunner.EXPECT().Inject(resp).Return(true)
+			inChan <- pack
+			close(inChan)
+			c.Expect(sbmFilter.Run(fth.MockFilterRunner, fth.MockHelper), gs.IsNil)
+			c.Expect(resp.Message.GetType(), gs.Equals, "heka.sandbox-manager")
+			status, _ := resp.Message.GetFieldValue("status")
+			c.Expect(status, gs.Equals, "error")
+		})
+
+		c.Specify("Reserves the memory limit of each loaded filter", func() {
+			sbxMgrName := "SandboxManagerFilter"
+			config.MaxFilters = 3
+			config.MaxTotalMemory = 2 * config.MemoryLimit
+			sbmFilter.Init(config)
+			fth.MockFilterRunner.EXPECT().Name().Return(sbxMgrName).AnyTimes()
+			fth.MockHelper.EXPECT().Filter(gomock.Any()).Return(nil, false).AnyTimes()
+			fth.MockFilterRunner.EXPECT().LogMessage(gomock.Any()).AnyTimes()
+
+			fMatchChan := pConfig.Router().AddFilterMatcher()
+			load := func(name string) error {
+				msg := getTestMessage()
+				msg.SetPayload("function process_message() return 0 end")
+				f, err := message.NewField("config", fmt.Sprintf(`
+				[%s]
+				type = "SandboxFilter"
+				message_matcher = "TRUE"
+				script_type = "lua"
+				`, name), "toml")
+				c.Assume(err, gs.IsNil)
+				msg.AddField(f)
+				errChan := make(chan error, 1)
+				go func() {
+					errChan <- sbmFilter.loadSandbox(fth.MockFilterRunner, fth.MockHelper,
+						sbxMgrsDir, msg, "")
+				}()
+				select {
+				case <-fMatchChan:
+					return <-errChan
+				case err := <-errChan:
+					return err
+				}
+			}
+
+			// The idle filters use a fraction of their limit.
+			c.Expect(load("A"), gs.IsNil)
+			c.Expect(load("B"), gs.IsNil)
+			err := load("C")
+			c.Expect(err.Error(), gs.Equals, fmt.Sprintf("loadSandbox failed: loading the "+
+				"filter would exceed the total memory limit of %d bytes", config.MaxTotalMemory))
+
+			go func() {
+				for i := 0; i < 2; i++ {
+					<-pConfig.Router().RemoveFilterMatcher()
+				}
+			}()
+			for _, name := range []string{"A", "B"} {
+				c.Expect(pConfig.RemoveFilterRunner(sbxMgrName+"-"+name), gs.IsTrue)
+			}
+		})
+
+		c.Specify("Lists the managed filters", func() {
+			sbmFilter.Init(config)
+			sbmFilter.sandboxes["SandboxManagerFilter-Counter"] = &managedSandbox{
+				Signer: "alice", Version: 2}
+			sbmFilter.sandboxes["SandboxManagerFilter-Alerts"] = &managedSandbox{
+				Signer: "bob", Version: 1, lastError: "FATAL: process_message() failed"}
+			fth.MockFilterRunner.EXPECT().Name().Return("SandboxManagerFilter")
+			resp := new(message.Message)
+			sbmFilter.listSandboxes(fth.MockFilterRunner, resp)
+			c.Expect(resp.GetPayload(), gs.Equals, "Name\tVersion\tStatus\tSigner\n"+
+				"Alerts\t1\tterminated\tbob\n"+
+				"Counter\t2\tstopped\talice\n")
+		})
+
+		c.Specify("Reports the status of a managed filter", func() {
+			sbmFilter.Init(config)
+			sbmFilter.sandboxes["SandboxManagerFilter-Alerts"] = &managedSandbox{
+				Signer: "bob", Version: 3, lastError: "FATAL: process_message() failed"}
+			fth.MockFilterRunner.EXPECT().Name().Return("SandboxManagerFilter")
+			f, _ := message.NewField("name", "Alerts", "")
+			msg.AddField(f)
+			resp := new(message.Message)
+			err := sbmFilter.sandboxStatus(fth.MockFilterRunner, msg, resp)
+			c.Expect(err, gs.IsNil)
+			c.Expect(resp.GetPayload(), gs.Equals, "Status: terminated\nVersion: 3\n"+
+				"Signer: bob\nLastError: FATAL: process_message() failed\n")
+		})
 	})
 
 	c.Specify("A Load Average Stats filter", func() {
@@ -742,7 +908,7 @@ intField_vidx_1,Logger=Logger,Type=my_type,Severity=4,Hostname=hostname value=45
 			for i := 0; i < 6; i++ {
 				pl += fmt.Sprintf(msgStr, i*100)
 			}
-			c.Expect(m.GetPayload(), gs.Equals, pl)
+			c.Expect(normalizeLines(m.GetPayload()), gs.Equals, normalizeLines(pl))
 
 		})
 
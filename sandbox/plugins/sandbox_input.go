@@ -29,6 +29,7 @@ import (
 	"heka/pipeline"
 	. "heka/sandbox"
 	"heka/sandbox/lua"
+	"heka/sandbox/tengo"
 )
 
 // Heka Input plugin that acts as a wrapper for sandboxed input scripts.
@@ -86,6 +87,11 @@ func (s *SandboxInput) Init(config interface{}) (err error) {
 		if err != nil {
 			return
 		}
+	case "tengo":
+		s.sb, err = tengo.CreateTengoSandbox(s.sbc)
+		if err != nil {
+			return
+		}
 	default:
 		return fmt.Errorf("unsupported script type: %s", s.sbc.ScriptType)
 	}
@@ -169,11 +175,15 @@ func (s *SandboxInput) destroy() error {
 
 	s.reportLock.Lock()
 	if s.sb != nil {
+		perr := writeProfile(s.sb, s.preservationFile)
 		if s.sbc.PreserveData {
 			err = s.sb.Destroy(s.preservationFile)
 		} else {
 			err = s.sb.Destroy("")
 		}
+		if err == nil {
+			err = perr
+		}
 		s.sb = nil
 	}
 	s.reportLock.Unlock()
@@ -212,6 +222,8 @@ func (s *SandboxInput) ReportMsg(msg *message.Message) error {
 	message.NewInt64Field(msg, "ProcessMessageFailures", atomic.LoadInt64(&s.processMessageFailures), "count")
 	message.NewInt64Field(msg, "ProcessMessageBytes", atomic.LoadInt64(&s.processMessageBytes), "B")
 
+	reportProfile(s.sb, msg)
+
 	return nil
 }
 
@@ -16,6 +16,9 @@
 package plugins
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math"
@@ -23,6 +26,9 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -32,6 +38,9 @@ import (
 	. "heka/sandbox"
 )
 
+// How long an update waits for the running version of a filter to stop.
+var sandboxStopTimeout = 10 * time.Second
+
 // Heka Filter plugin that listens for (signed) control messages and
 // dynamically creates, manages, and destroys sandboxed filter scripts as
 // instructed.
@@ -39,11 +48,15 @@ type SandboxManagerFilter struct {
 	processMessageCount int64
 	currentFilters      int32
 	maxFilters          int
+	maxFiltersPerSigner int
+	maxTotalMemory      uint
 	workingDirectory    string
 	moduleDirectory     string
 	memoryLimit         uint
 	instructionLimit    uint
 	outputLimit         uint
+	sandboxes           map[string]*managedSandbox
+	sandboxesLock       sync.Mutex
 	pConfig             *pipeline.PipelineConfig
 }
 
@@ -52,6 +65,13 @@ type SandboxManagerFilterConfig struct {
 	// Maximum number of sandboxed filters this instance will be allowed to
 	// manage.
 	MaxFilters int `toml:"max_filters"`
+	// Maximum number of sandboxed filters loaded by the same message signer,
+	// 0 means no limit.
+	MaxFiltersPerSigner int `toml:"max_filters_per_signer"`
+	// Maximum memory in bytes used by all the managed sandboxes together, a
+	// filter is only loaded if its memory limit fits in what is left. 0 means
+	// no limit.
+	MaxTotalMemory uint `toml:"max_total_memory"`
 	// Path to file system directory the sandbox manager can use for storing
 	// dynamic filter scripts and data. Relative paths will be relative to the
 	// Heka base_dir. Defaults to a directory in ${BASE_DIR}/sbxmgrs that is
@@ -71,6 +91,26 @@ type SandboxManagerFilterConfig struct {
 	MessageMatcher string `toml:"message_matcher"`
 }
 
+// A filter loaded by the manager. The signer and version are stored next to
+// the script in the working directory, e.g. SandboxManager-Counter.json.
+type managedSandbox struct {
+	Signer    string `json:"signer"`
+	Version   int    `json:"version"`
+	filter    *SandboxFilter // nil once the filter has exited
+	lastError string
+	exited    chan struct{}
+}
+
+func (ms *managedSandbox) status() string {
+	switch {
+	case ms.filter != nil:
+		return "running"
+	case ms.lastError != "":
+		return "terminated"
+	}
+	return "stopped"
+}
+
 func (this *SandboxManagerFilter) ConfigStruct() interface{} {
 	sbDefaults := NewSandboxConfig(this.pConfig.Globals).(*SandboxConfig)
 	return &SandboxManagerFilterConfig{
@@ -83,8 +123,22 @@ func (this *SandboxManagerFilter) ConfigStruct() interface{} {
 	}
 }
 
-func (s *SandboxManagerFilter) PluginExited() {
+// Called by a managed filter once it has stopped, err is the error it stopped
+// with.
+func (s *SandboxManagerFilter) PluginExited(filter *SandboxFilter, err error) {
 	atomic.AddInt32(&s.currentFilters, -1)
+	s.sandboxesLock.Lock()
+	defer s.sandboxesLock.Unlock()
+	for _, ms := range s.sandboxes {
+		if ms.filter == filter {
+			ms.filter = nil
+			if err != nil {
+				ms.lastError = err.Error()
+			}
+			close(ms.exited)
+			break
+		}
+	}
 }
 
 // Heka will call this before calling any other methods to give us access to
@@ -99,6 +153,9 @@ func (this *SandboxManagerFilter) Init(config interface{}) (err error) {
 	conf := config.(*SandboxManagerFilterConfig)
 	globals := this.pConfig.Globals
 	this.maxFilters = conf.MaxFilters
+	this.maxFiltersPerSigner = conf.MaxFiltersPerSigner
+	this.maxTotalMemory = conf.MaxTotalMemory
+	this.sandboxes = make(map[string]*managedSandbox)
 	this.workingDirectory = globals.PrependBaseDir(conf.WorkingDirectory)
 	this.moduleDirectory = conf.ModuleDirectory
 	this.memoryLimit = conf.MemoryLimit
@@ -186,56 +243,428 @@ func removeAll(dir, glob string) {
 	}
 }
 
+// Returns the files of a version of a managed sandbox, the current version
+// has no suffix, e.g. Counter.toml, Counter.lua and Counter.json, the previous
+// one the ".prev" suffix.
+func versionFiles(dir, name, suffix string) (files []string) {
+	matches, _ := filepath.Glob(filepath.Join(dir, name+".*"+suffix))
+	for _, fn := range matches {
+		ext := strings.TrimSuffix(filepath.Base(fn)[len(name)+1:], suffix)
+		if !strings.Contains(ext, ".") {
+			files = append(files, fn)
+		}
+	}
+	return
+}
+
+// Replaces the files of the version with the `to` suffix with the ones of the
+// version with the `from` suffix.
+func moveVersion(dir, name, from, to string) error {
+	for _, fn := range versionFiles(dir, name, to) {
+		os.Remove(fn)
+	}
+	for _, fn := range versionFiles(dir, name, from) {
+		if err := os.Rename(fn, strings.TrimSuffix(fn, from)+to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readManagedSandbox(dir, name string) *managedSandbox {
+	ms := &managedSandbox{Version: 1}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, name+".json")); err == nil {
+		json.Unmarshal(b, ms)
+	}
+	return ms
+}
+
+func writeManagedSandbox(dir, name string, ms *managedSandbox) error {
+	b, err := json.Marshal(ms)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name+".json"), b, 0600)
+}
+
+// Decodes a sandbox configuration, returning the name and configuration of
+// its first (and only used) section.
+func decodeSandboxConfig(config string) (name string, conf toml.Primitive, err error) {
+	var configFile pipeline.ConfigFile
+	if _, err = toml.Decode(config, &configFile); err != nil {
+		return
+	}
+	for name, conf = range configFile {
+		return
+	}
+	return "", conf, errors.New("no sandbox configuration section")
+}
+
+// Writes the configuration and script of a sandbox to the working directory.
+func writeSandboxFiles(dir, name, config string, conf toml.Primitive, script string) error {
+	var sbc SandboxConfig
+	// Default, will get overwritten if necessary
+	sbc.ScriptType = "lua"
+	if err := toml.PrimitiveDecode(conf, &sbc); err != nil {
+		return err
+	}
+	confFile := filepath.Join(dir, fmt.Sprintf("%s.toml", name))
+	if err := ioutil.WriteFile(confFile, []byte(config), 0600); err != nil {
+		return err
+	}
+	scriptFile := filepath.Join(dir, fmt.Sprintf("%s.%s", name, sbc.ScriptType))
+	return ioutil.WriteFile(scriptFile, []byte(script), 0600)
+}
+
+// Creates and starts the filter of a managed sandbox.
+func (this *SandboxManagerFilter) startSandbox(dir, name string, conf toml.Primitive,
+	ms *managedSandbox) error {
+
+	runner, err := this.createRunner(dir, name, conf)
+	if err != nil {
+		return err
+	}
+	this.sandboxesLock.Lock()
+	ms.filter = runner.Plugin().(*SandboxFilter)
+	ms.lastError = ""
+	ms.exited = make(chan struct{})
+	this.sandboxes[name] = ms
+	this.sandboxesLock.Unlock()
+
+	if err = this.pConfig.AddFilterRunner(runner); err != nil {
+		this.sandboxesLock.Lock()
+		ms.filter = nil
+		ms.lastError = err.Error()
+		close(ms.exited)
+		this.sandboxesLock.Unlock()
+		return err
+	}
+	atomic.AddInt32(&this.currentFilters, 1)
+	return nil
+}
+
+// Stops the filter of a managed sandbox and waits for it to exit, so its data
+// is preserved before another version is started.
+func (this *SandboxManagerFilter) stopSandbox(name string, ms *managedSandbox) error {
+	this.sandboxesLock.Lock()
+	running, exited := ms.filter != nil, ms.exited
+	this.sandboxesLock.Unlock()
+	if !running {
+		return nil
+	}
+	this.pConfig.RemoveFilterRunner(name)
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(sandboxStopTimeout):
+		return fmt.Errorf("%s did not stop within %s", name, sandboxStopTimeout)
+	}
+}
+
+func (this *SandboxManagerFilter) lookup(fr pipeline.FilterRunner,
+	msg *message.Message) (string, *managedSandbox, error) {
+
+	fv, _ := msg.GetFieldValue("name")
+	name, ok := fv.(string)
+	if !ok {
+		return "", nil, errors.New("missing the name field")
+	}
+	name = getSandboxName(fr.Name(), name)
+	this.sandboxesLock.Lock()
+	ms := this.sandboxes[name]
+	this.sandboxesLock.Unlock()
+	if ms == nil {
+		return name, nil, fmt.Errorf("%s is not loaded", name)
+	}
+	return name, ms, nil
+}
+
+// Checks the per signer and total memory quotas before a filter is started.
+// Each running filter reserves the memory limit it's allowed to grow to. The
+// filter being replaced by an update, if any, is not counted.
+func (this *SandboxManagerFilter) checkQuotas(signer string, replacing *managedSandbox) error {
+	this.sandboxesLock.Lock()
+	defer this.sandboxesLock.Unlock()
+
+	var filters int
+	memory := this.memoryLimit
+	for _, ms := range this.sandboxes {
+		if ms == replacing {
+			continue
+		}
+		if ms.Signer == signer {
+			filters++
+		}
+		if ms.filter != nil {
+			memory += this.memoryLimit
+		}
+	}
+	if this.maxFiltersPerSigner > 0 && filters >= this.maxFiltersPerSigner {
+		return fmt.Errorf("signer '%s' attempted to load more than %d filters", signer,
+			this.maxFiltersPerSigner)
+	}
+	if this.maxTotalMemory > 0 && memory > this.maxTotalMemory {
+		return fmt.Errorf("loading the filter would exceed the total memory limit of %d bytes",
+			this.maxTotalMemory)
+	}
+	return nil
+}
+
 // Parses a Heka message and extracts the information necessary to start a new
 // SandboxFilter
 func (this *SandboxManagerFilter) loadSandbox(fr pipeline.FilterRunner,
-	h pipeline.PluginHelper, dir string, msg *message.Message) (err error) {
+	h pipeline.PluginHelper, dir string, msg *message.Message, signer string) (err error) {
 
 	fv, _ := msg.GetFieldValue("config")
 	if config, ok := fv.(string); ok {
-		var configFile pipeline.ConfigFile
-		if _, err = toml.Decode(config, &configFile); err != nil {
+		var name string
+		var conf toml.Primitive
+		if name, conf, err = decodeSandboxConfig(config); err != nil {
 			return fmt.Errorf("loadSandbox failed: %s\n", err)
 		}
+		name = getSandboxName(fr.Name(), name)
+		if _, ok := h.Filter(name); ok {
+			return fmt.Errorf("loadSandbox failed: %s is already running, use update to replace it", name)
+		}
+		// a terminated filter of the same name is replaced
+		this.sandboxesLock.Lock()
+		terminated := this.sandboxes[name]
+		this.sandboxesLock.Unlock()
+		if err = this.checkQuotas(signer, terminated); err != nil {
+			return fmt.Errorf("loadSandbox failed: %s", err)
+		}
+		fr.LogMessage(fmt.Sprintf("Loading: %s", name))
+		ms := &managedSandbox{Signer: signer, Version: 1}
+		if err = writeSandboxFiles(dir, name, config, conf, msg.GetPayload()); err == nil {
+			err = writeManagedSandbox(dir, name, ms)
+		}
+		if err == nil {
+			err = this.startSandbox(dir, name, conf, ms)
+		}
+		if err != nil {
+			this.sandboxesLock.Lock()
+			delete(this.sandboxes, name)
+			this.sandboxesLock.Unlock()
+			removeAll(dir, fmt.Sprintf("%s.*", name))
+		}
+	}
+	return
+}
 
-		for name, conf := range configFile {
-			name = getSandboxName(fr.Name(), name)
-			if _, ok := h.Filter(name); ok {
-				// todo support reload
-				return fmt.Errorf("loadSandbox failed: %s is already running", name)
-			}
-			fr.LogMessage(fmt.Sprintf("Loading: %s", name))
-			confFile := filepath.Join(dir, fmt.Sprintf("%s.toml", name))
-			err = ioutil.WriteFile(confFile, []byte(config), 0600)
-			if err != nil {
-				return
-			}
-			var sbc SandboxConfig
-			// Default, will get overwritten if necessary
-			sbc.ScriptType = "lua"
-			if err = toml.PrimitiveDecode(conf, &sbc); err != nil {
-				return fmt.Errorf("loadSandbox failed: %s\n", err)
-			}
-			scriptFile := filepath.Join(dir, fmt.Sprintf("%s.%s", name, sbc.ScriptType))
-			err = ioutil.WriteFile(scriptFile, []byte(msg.GetPayload()), 0600)
-			if err != nil {
-				removeAll(dir, fmt.Sprintf("%s.*", name))
-				return
-			}
-			var runner pipeline.FilterRunner
-			runner, err = this.createRunner(dir, name, conf)
-			if err != nil {
-				removeAll(dir, fmt.Sprintf("%s.*", name))
-				return
-			}
-			err = this.pConfig.AddFilterRunner(runner)
-			if err == nil {
-				atomic.AddInt32(&this.currentFilters, 1)
+// Replaces the script (and optionally the configuration) of a running
+// filter. The replaced version is kept to roll back to, which happens
+// automatically if the new version fails to start.
+func (this *SandboxManagerFilter) updateSandbox(fr pipeline.FilterRunner, dir string,
+	msg *message.Message) (int, error) {
+
+	name, ms, err := this.lookup(fr, msg)
+	if err != nil {
+		return 0, err
+	}
+	var config string
+	if fv, _ := msg.GetFieldValue("config"); fv != nil {
+		config, _ = fv.(string)
+	} else {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name+".toml"))
+		if err != nil {
+			return 0, err
+		}
+		config = string(b)
+	}
+	section, conf, err := decodeSandboxConfig(config)
+	if err != nil {
+		return 0, err
+	}
+	if getSandboxName(fr.Name(), section) != name {
+		return 0, fmt.Errorf("the configuration is for %s", getSandboxName(fr.Name(), section))
+	}
+	if err = this.checkQuotas(ms.Signer, ms); err != nil {
+		return 0, err
+	}
+
+	if err = this.stopSandbox(name, ms); err != nil {
+		return 0, err
+	}
+	if err = moveVersion(dir, name, "", ".prev"); err != nil {
+		return 0, err
+	}
+	next := &managedSandbox{Signer: ms.Signer, Version: ms.Version + 1}
+	if err = writeSandboxFiles(dir, name, config, conf, msg.GetPayload()); err == nil {
+		if err = writeManagedSandbox(dir, name, next); err == nil {
+			fr.LogMessage(fmt.Sprintf("Updating: %s to version %d", name, next.Version))
+			if err = this.startSandbox(dir, name, conf, next); err == nil {
+				return next.Version, nil
 			}
-			break // only interested in the first item
 		}
 	}
-	return
+	if rerr := this.restartVersion(dir, name, ".prev", ""); rerr != nil {
+		return 0, fmt.Errorf("%s, rolling back failed: %s", err, rerr)
+	}
+	return 0, fmt.Errorf("%s, rolled back to version %d", err, ms.Version)
+}
+
+// Replaces the running version of a filter with the previous one, the
+// replaced version becomes the previous one.
+func (this *SandboxManagerFilter) rollbackSandbox(fr pipeline.FilterRunner, dir string,
+	msg *message.Message) (int, error) {
+
+	name, ms, err := this.lookup(fr, msg)
+	if err != nil {
+		return 0, err
+	}
+	if len(versionFiles(dir, name, ".prev")) == 0 {
+		return 0, fmt.Errorf("%s has no previous version", name)
+	}
+	if err = this.stopSandbox(name, ms); err != nil {
+		return 0, err
+	}
+	if err = moveVersion(dir, name, "", ".next"); err != nil {
+		return 0, err
+	}
+	if err = this.restartVersion(dir, name, ".prev", ".next"); err != nil {
+		// put the version that was running back in place
+		if rerr := this.restartVersion(dir, name, ".next", ".prev"); rerr != nil {
+			return 0, fmt.Errorf("%s, restarting version %d failed: %s", err, ms.Version, rerr)
+		}
+		return 0, err
+	}
+	this.sandboxesLock.Lock()
+	version := this.sandboxes[name].Version
+	this.sandboxesLock.Unlock()
+	return version, nil
+}
+
+// Moves the files of the `from` version into place and starts it, the files
+// currently in place are kept with the `keep` suffix (or removed if it is
+// empty).
+func (this *SandboxManagerFilter) restartVersion(dir, name, from, keep string) error {
+	if keep == "" {
+		for _, fn := range versionFiles(dir, name, "") {
+			os.Remove(fn)
+		}
+	}
+	if err := moveVersion(dir, name, from, ""); err != nil {
+		return err
+	}
+	if keep == ".next" {
+		if err := moveVersion(dir, name, ".next", ".prev"); err != nil {
+			return err
+		}
+	}
+	var configFile pipeline.ConfigFile
+	if _, err := toml.DecodeFile(filepath.Join(dir, name+".toml"), &configFile); err != nil {
+		return err
+	}
+	for _, conf := range configFile {
+		return this.startSandbox(dir, name, conf, readManagedSandbox(dir, name))
+	}
+	return errors.New("no sandbox configuration section")
+}
+
+func (this *SandboxManagerFilter) unloadSandbox(fr pipeline.FilterRunner, dir string,
+	msg *message.Message) error {
+
+	fv, _ := msg.GetFieldValue("name")
+	name, ok := fv.(string)
+	if !ok {
+		return errors.New("missing the name field")
+	}
+	name = getSandboxName(fr.Name(), name)
+	this.sandboxesLock.Lock()
+	ms := this.sandboxes[name]
+	delete(this.sandboxes, name)
+	this.sandboxesLock.Unlock()
+	// A terminated filter has already been removed from the pipeline, only
+	// its files are left.
+	if this.pConfig.RemoveFilterRunner(name) || ms != nil {
+		removeAll(dir, fmt.Sprintf("%s.*", name))
+		return nil
+	}
+	return fmt.Errorf("%s is not loaded", name)
+}
+
+// Writes a table of the managed filters to the response payload.
+func (this *SandboxManagerFilter) listSandboxes(fr pipeline.FilterRunner,
+	resp *message.Message) {
+
+	prefix := getNormalizedName(fr.Name()) + "-"
+	this.sandboxesLock.Lock()
+	defer this.sandboxesLock.Unlock()
+
+	names := make([]string, 0, len(this.sandboxes))
+	for name := range this.sandboxes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Name\tVersion\tStatus\tSigner\n")
+	for _, name := range names {
+		ms := this.sandboxes[name]
+		fmt.Fprintf(&b, "%s\t%d\t%s\t%s\n", strings.TrimPrefix(name, prefix), ms.Version,
+			ms.status(), ms.Signer)
+	}
+	message.NewIntField(resp, "RunningFilters", int(atomic.LoadInt32(&this.currentFilters)),
+		"count")
+	resp.SetPayload(b.String())
+}
+
+// Adds the state and the usage statistics of a filter to the response, the
+// payload lists them one per line.
+func (this *SandboxManagerFilter) sandboxStatus(fr pipeline.FilterRunner,
+	msg, resp *message.Message) error {
+
+	_, ms, err := this.lookup(fr, msg)
+	if err != nil {
+		return err
+	}
+	this.sandboxesLock.Lock()
+	filter := ms.filter
+	message.NewStringField(resp, "Status", ms.status())
+	message.NewIntField(resp, "Version", ms.Version, "")
+	message.NewStringField(resp, "Signer", ms.Signer)
+	if ms.lastError != "" {
+		message.NewStringField(resp, "LastError", ms.lastError)
+	}
+	this.sandboxesLock.Unlock()
+	if filter != nil {
+		filter.ReportMsg(resp)
+	}
+
+	var b bytes.Buffer
+	for _, f := range resp.Fields {
+		fmt.Fprintf(&b, "%s: %v", f.GetName(), f.GetValue())
+		if rep := f.GetRepresentation(); rep != "" {
+			fmt.Fprintf(&b, " %s", rep)
+		}
+		b.WriteString("\n")
+	}
+	resp.SetPayload(b.String())
+	return nil
+}
+
+// Injects the response to a control message, it is matched to the request
+// with the request_id field.
+func (this *SandboxManagerFilter) respond(fr pipeline.FilterRunner, h pipeline.PluginHelper,
+	request *message.Message, action string, resp *message.Message, err error) {
+
+	p, e := h.PipelinePack(0)
+	if e != nil {
+		fr.LogError(fmt.Errorf("can't send the %s response: %s", action, e.Error()))
+		return
+	}
+	p.Message.SetType("heka.sandbox-manager")
+	p.Message.SetLogger(fr.Name())
+	p.Message.SetPayload(resp.GetPayload())
+	p.Message.Fields = resp.Fields
+	message.NewStringField(p.Message, "action", action)
+	message.NewStringField(p.Message, "request_id", request.GetUuidString())
+	if err != nil {
+		message.NewStringField(p.Message, "status", "error")
+		p.Message.SetPayload(err.Error())
+	} else {
+		message.NewStringField(p.Message, "status", "ok")
+	}
+	fr.Inject(p)
 }
 
 // On Heka restarts this function reloads all previously running SandboxFilters
@@ -253,20 +682,15 @@ func (this *SandboxManagerFilter) restoreSandboxes(fr pipeline.FilterRunner,
 				continue
 			}
 			for _, conf := range configFile {
-				var runner pipeline.FilterRunner
 				name := path.Base(fn[:len(fn)-5])
 				fr.LogMessage(fmt.Sprintf("Loading: %s", name))
-				runner, err = this.createRunner(dir, name, conf)
+				err = this.startSandbox(dir, name, conf, readManagedSandbox(dir, name))
 				if err != nil {
 					fr.LogError(fmt.Errorf("createRunner failed: %s\n", err.Error()))
+					this.sandboxesLock.Lock()
+					delete(this.sandboxes, name)
+					this.sandboxesLock.Unlock()
 					removeAll(dir, fmt.Sprintf("%s.*", name))
-					break
-				}
-				err = this.pConfig.AddFilterRunner(runner)
-				if err != nil {
-					fr.LogError(err)
-				} else {
-					atomic.AddInt32(&this.currentFilters, 1)
 				}
 				break // only interested in the first item
 			}
@@ -298,39 +722,49 @@ func (this *SandboxManagerFilter) Run(fr pipeline.FilterRunner,
 					delta/1e9))
 				break
 			}
-			action, _ := pack.Message.GetFieldValue("action")
+			fv, _ := pack.Message.GetFieldValue("action")
+			action, _ := fv.(string)
+			resp := new(message.Message)
+			var err error
 			switch action {
 			case "load":
 				current := int(atomic.LoadInt32(&this.currentFilters))
 				if current < this.maxFilters {
-					err := this.loadSandbox(fr, h, this.workingDirectory, pack.Message)
+					err = this.loadSandbox(fr, h, this.workingDirectory, pack.Message,
+						pack.Signer)
 					if err != nil {
-						p, e := h.PipelinePack(0)
-						if e != nil {
-							fr.LogError(err)
-							fr.LogError(fmt.Errorf("can't send termination message: %s", e.Error()))
-							break
-						}
-						p.Message.SetType("heka.sandbox-terminated")
-						p.Message.SetLogger(pipeline.HEKA_DAEMON)
-						message.NewStringField(p.Message, "plugin", fr.Name())
-						p.Message.SetPayload(err.Error())
-						fr.Inject(p)
+						// The error response is the only message injected, the
+						// filter never ran so it isn't reported as terminated.
 						fr.LogError(err)
 					}
 				} else {
-					fr.LogError(fmt.Errorf("%s attempted to load more than %d filters",
-						fr.Name(), this.maxFilters))
+					err = fmt.Errorf("%s attempted to load more than %d filters",
+						fr.Name(), this.maxFilters)
+					fr.LogError(err)
 				}
 			case "unload":
-				fv, _ := pack.Message.GetFieldValue("name")
-				if name, ok := fv.(string); ok {
-					name = getSandboxName(fr.Name(), name)
-					if this.pConfig.RemoveFilterRunner(name) {
-						removeAll(this.workingDirectory, fmt.Sprintf("%s.*", name))
-					}
+				err = this.unloadSandbox(fr, this.workingDirectory, pack.Message)
+			case "update", "rollback":
+				var version int
+				if action == "update" {
+					version, err = this.updateSandbox(fr, this.workingDirectory, pack.Message)
+				} else {
+					version, err = this.rollbackSandbox(fr, this.workingDirectory, pack.Message)
+				}
+				if err != nil {
+					fr.LogError(fmt.Errorf("%s failed: %s", action, err))
+				} else {
+					message.NewIntField(resp, "Version", version, "")
+					resp.SetPayload(fmt.Sprintf("running version %d", version))
 				}
+			case "list":
+				this.listSandboxes(fr, resp)
+			case "status":
+				err = this.sandboxStatus(fr, pack.Message, resp)
+			default:
+				err = fmt.Errorf("unknown action: '%s'", action)
 			}
+			this.respond(fr, h, pack.Message, action, resp, err)
 			pack.Recycle(nil)
 		}
 	}
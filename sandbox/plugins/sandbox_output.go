@@ -28,6 +28,7 @@ import (
 	"heka/pipeline"
 	. "heka/sandbox"
 	"heka/sandbox/lua"
+	"heka/sandbox/tengo"
 )
 
 // Heka Output plugin that acts as a wrapper for sandboxed output scripts.
@@ -81,6 +82,11 @@ func (s *SandboxOutput) Init(config interface{}) (err error) {
 		if err != nil {
 			return
 		}
+	case "tengo":
+		s.sb, err = tengo.CreateTengoSandbox(s.sbc)
+		if err != nil {
+			return
+		}
 	default:
 		return fmt.Errorf("unsupported script type: %s", s.sbc.ScriptType)
 	}
@@ -179,11 +185,15 @@ func (s *SandboxOutput) destroy() error {
 	var err error
 	s.reportLock.Lock()
 	if s.sb != nil {
+		perr := writeProfile(s.sb, s.preservationFile)
 		if s.sbc.PreserveData {
 			err = s.sb.Destroy(s.preservationFile)
 		} else {
 			err = s.sb.Destroy("")
 		}
+		if err == nil {
+			err = perr
+		}
 		s.sb = nil
 	}
 	s.reportLock.Unlock()
@@ -224,6 +234,8 @@ func (s *SandboxOutput) ReportMsg(msg *message.Message) error {
 	}
 	message.NewInt64Field(msg, "TimerEventAvgDuration", tmp, "ns")
 
+	reportProfile(s.sb, msg)
+
 	return nil
 }
 
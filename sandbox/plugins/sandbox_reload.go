@@ -0,0 +1,164 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "heka/sandbox"
+	"heka/sandbox/lua"
+	"heka/sandbox/tengo"
+)
+
+// How often the files of a reload_on_change script are checked.
+var reloadInterval = time.Second
+
+func createSandbox(sbc *SandboxConfig) (Sandbox, error) {
+	switch sbc.ScriptType {
+	case "lua":
+		return lua.CreateLuaSandbox(sbc)
+	case "tengo":
+		return tengo.CreateTengoSandbox(sbc)
+	}
+	return nil, fmt.Errorf("unsupported script type: %s", sbc.ScriptType)
+}
+
+// Creates a new instance of a running sandbox's script, carrying the data
+// preserved from the running sandbox across. The running sandbox is left
+// untouched, it is up to the caller to swap the new one in and destroy it.
+func reloadSandbox(sb Sandbox, sbc *SandboxConfig, preservationFile string) (Sandbox, error) {
+	r, ok := sb.(Reloadable)
+	if !ok {
+		return nil, fmt.Errorf("%s sandboxes cannot be reloaded", sbc.ScriptType)
+	}
+	dataFile := preservationFile + ".reload"
+	if err := r.Preserve(dataFile); err != nil {
+		return nil, err
+	}
+	defer os.Remove(dataFile)
+
+	newSb, err := createSandbox(sbc)
+	if err != nil {
+		return nil, err
+	}
+	// The new script must take over the data, otherwise the old one keeps
+	// running.
+	if err = newSb.(Reloadable).Restore(dataFile); err != nil {
+		newSb.Destroy("")
+		return nil, err
+	}
+	return newSb, nil
+}
+
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) (v fileVersion) {
+	if fi, err := os.Stat(path); err == nil {
+		v.modTime = fi.ModTime()
+		v.size = fi.Size()
+	}
+	return
+}
+
+// Polls the files a script was loaded from. The generation is incremented,
+// and a notification sent on C, every time any of them is modified, created
+// or removed.
+type scriptWatcher struct {
+	C          chan struct{}
+	lock       sync.Mutex
+	files      map[string]fileVersion
+	generation int64
+	stop       chan struct{}
+}
+
+func newScriptWatcher(sb Sandbox) (*scriptWatcher, error) {
+	r, ok := sb.(Reloadable)
+	if !ok {
+		return nil, fmt.Errorf("reload_on_change is not supported by this script type")
+	}
+	w := &scriptWatcher{
+		C:     make(chan struct{}, 1),
+		files: make(map[string]fileVersion),
+		stop:  make(chan struct{}),
+	}
+	w.watch(r.SourceFiles())
+	go w.poll()
+	return w, nil
+}
+
+// Sets the files to watch after a reload. The files already watched keep
+// their recorded version so a change made while reloading is not missed.
+func (w *scriptWatcher) watch(files []string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	watched := make(map[string]fileVersion, len(files))
+	for _, f := range files {
+		if v, ok := w.files[f]; ok {
+			watched[f] = v
+		} else {
+			watched[f] = statFile(f)
+		}
+	}
+	w.files = watched
+}
+
+func (w *scriptWatcher) check() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	changed := false
+	for f, v := range w.files {
+		if current := statFile(f); current != v {
+			w.files[f] = current
+			changed = true
+		}
+	}
+	if changed {
+		atomic.AddInt64(&w.generation, 1)
+		select {
+		case w.C <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (w *scriptWatcher) Generation() int64 {
+	return atomic.LoadInt64(&w.generation)
+}
+
+func (w *scriptWatcher) poll() {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.check()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *scriptWatcher) close() {
+	close(w.stop)
+}
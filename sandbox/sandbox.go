@@ -14,7 +14,14 @@
 
 package sandbox
 
-import "heka/pipeline"
+import (
+	"io"
+	"sort"
+	"time"
+
+	"heka/message"
+	"heka/pipeline"
+)
 
 const (
 	STATUS_UNKNOWN    = 0
@@ -29,8 +36,12 @@ const (
 	TYPE_INSTRUCTIONS = 1
 	TYPE_OUTPUT       = 2
 
-	DATA_DIR = "sandbox_preservation"
-	DATA_EXT = ".data"
+	DATA_DIR    = "sandbox_preservation"
+	DATA_EXT    = ".data"
+	PROFILE_EXT = ".profile"
+
+	// Number of functions added to a report message by ReportProfile.
+	PROFILE_REPORT_SIZE = 5
 )
 
 type Sandbox interface {
@@ -52,20 +63,87 @@ type Sandbox interface {
 	InjectMessage(f func(payload, payload_type, payload_name string) int)
 }
 
+// Implemented by the sandboxes supporting the profile option.
+type Profiler interface {
+	// True if the sandbox was created with profiling enabled.
+	Profiling() bool
+	// Adds a summary of the profile to a report message.
+	ReportProfile(msg *message.Message)
+	// Returns the counts of every profiled function.
+	ProfileCounts() []ProfileCount
+	// Writes the complete profile.
+	WriteProfile(w io.Writer) error
+}
+
+// Instructions executed by and calls of a profiled function.
+type ProfileCount struct {
+	Function     string
+	Instructions uint64
+	Calls        uint64
+}
+
+// Sums the counts of the profiles by function, e.g. those of the instances of
+// a pool, and adds the counts of the busiest functions to a report message.
+func ReportProfile(msg *message.Message, profiles ...[]ProfileCount) {
+	merged := make(map[string]*ProfileCount)
+	var counts []*ProfileCount
+	for _, profile := range profiles {
+		for _, pc := range profile {
+			m, ok := merged[pc.Function]
+			if !ok {
+				m = &ProfileCount{Function: pc.Function}
+				merged[pc.Function] = m
+				counts = append(counts, m)
+			}
+			m.Instructions += pc.Instructions
+			m.Calls += pc.Calls
+		}
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Instructions != counts[j].Instructions {
+			return counts[i].Instructions > counts[j].Instructions
+		}
+		return counts[i].Function < counts[j].Function
+	})
+	for i, pc := range counts {
+		if i == PROFILE_REPORT_SIZE {
+			break
+		}
+		message.NewInt64Field(msg, "ProfileInstructions-"+pc.Function,
+			int64(pc.Instructions), "count")
+		message.NewInt64Field(msg, "ProfileCalls-"+pc.Function, int64(pc.Calls), "count")
+	}
+}
+
 type SandboxConfig struct {
-	ScriptType           string `toml:"script_type"`
-	ScriptFilename       string `toml:"filename"`
-	ModuleDirectory      string `toml:"module_directory"`
-	PreserveData         bool   `toml:"preserve_data"`
-	MemoryLimit          uint   `toml:"memory_limit"`
-	InstructionLimit     uint   `toml:"instruction_limit"`
-	OutputLimit          uint   `toml:"output_limit"`
-	CanExit              bool   `toml:"can_exit"`
-	TimerEventOnShutdown bool   `toml:"timer_event_on_shutdown"`
+	ScriptType           string   `toml:"script_type"`
+	ScriptFilename       string   `toml:"filename"`
+	ModuleDirectory      string   `toml:"module_directory"`
+	PreserveData         bool     `toml:"preserve_data"`
+	MemoryLimit          uint     `toml:"memory_limit"`
+	InstructionLimit     uint     `toml:"instruction_limit"`
+	OutputLimit          uint     `toml:"output_limit"`
+	CanExit              bool     `toml:"can_exit"`
+	TimerEventOnShutdown bool     `toml:"timer_event_on_shutdown"`
+	AllowEntries         []string `toml:"allow_entries"`
+	ReloadOnChange       bool     `toml:"reload_on_change"`
+	PoolSize             int      `toml:"pool_size"`
+	PreserveOrder        bool     `toml:"preserve_order"`
 	Profile              bool
 	Config               map[string]interface{}
 	Globals              *pipeline.GlobalConfigStruct
 	PluginType           string
+	// Clock stamping the messages injected without a Timestamp, defaults to
+	// the wall clock. heka-sbtest sets it to its simulated clock.
+	Clock func() int64 `toml:"-"`
+}
+
+// Returns the timestamp of a message injected without one.
+func (this *SandboxConfig) Timestamp() int64 {
+	if this.Clock != nil {
+		return this.Clock()
+	}
+	return time.Now().UnixNano()
 }
 
 func NewSandboxConfig(globals *pipeline.GlobalConfigStruct) interface{} {
@@ -77,5 +155,24 @@ func NewSandboxConfig(globals *pipeline.GlobalConfigStruct) interface{} {
 		ScriptType:       "lua",
 		Globals:          globals,
 		CanExit:          true,
+		PoolSize:         1,
+		PreserveOrder:    true,
 	}
 }
+
+// A configuration reload starts the new instance of a plugin preserving its
+// data once the previous one has written it.
+func (this *SandboxConfig) PreservesData() bool {
+	return this.PreserveData
+}
+
+// Implemented by the sandboxes supporting the reload_on_change option.
+type Reloadable interface {
+	// The script file followed by the module files loaded by the script.
+	SourceFiles() []string
+	// Writes the preserved data like Destroy but leaves the sandbox running.
+	Preserve(dataFile string) error
+	// Initializes the sandbox like Init but fails, rather than discarding
+	// the data, when the preserved data cannot be restored.
+	Restore(dataFile string) error
+}
@@ -0,0 +1,722 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012-2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tengo
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/gogo/protobuf/proto"
+	"github.com/pborman/uuid"
+	"heka/message"
+	"heka/sandbox"
+)
+
+// Exposes the Heka message API to the script. write_message is only
+// available to decoders and encoders, the other plugin types must treat the
+// message as read only.
+func (this *TengoSandbox) registerMessageApi() {
+	this.define("read_message", this.tengoReadMessage)
+	this.define("read_next_field", this.tengoReadNextField)
+	this.define("read_config", this.tengoReadConfig)
+	this.define("add_to_payload", this.tengoAddToPayload)
+	this.define("inject_payload", this.tengoInjectPayload)
+	this.define("inject_message", this.tengoInjectMessage)
+	this.define("decode_message", this.tengoDecodeMessage)
+	switch this.sbConfig.PluginType {
+	case "decoder", "encoder":
+		this.define("write_message", this.tengoWriteMessage)
+	}
+}
+
+// Formats an argument error like the Lua sandbox does.
+func argError(n int, fname, extramsg string) error {
+	return fmt.Errorf("bad argument #%d to '%s' (%s)", n, fname, extramsg)
+}
+
+func typeName(o tengo.Object) string {
+	if o == nil {
+		return "undefined"
+	}
+	return o.TypeName()
+}
+
+func checkString(args []tengo.Object, n int, fname string) (string, error) {
+	if n <= len(args) {
+		switch v := args[n-1].(type) {
+		case *tengo.String:
+			return v.Value, nil
+		case *tengo.Int, *tengo.Float:
+			return v.String(), nil
+		}
+	}
+	return "", argError(n, fname, "string expected, got "+typeName(argAt(args, n)))
+}
+
+func checkInt(args []tengo.Object, n int, fname string) (int, error) {
+	if n <= len(args) {
+		switch v := args[n-1].(type) {
+		case *tengo.Int:
+			return int(v.Value), nil
+		case *tengo.Float:
+			return int(v.Value), nil
+		}
+	}
+	return 0, argError(n, fname, "int expected, got "+typeName(argAt(args, n)))
+}
+
+func argAt(args []tengo.Object, n int) tengo.Object {
+	if n <= len(args) {
+		return args[n-1]
+	}
+	return nil
+}
+
+func extractFieldName(wrapped string) (fn string, found bool) {
+	if l := len(wrapped); l > 0 && wrapped[l-1] == ']' {
+		if strings.HasPrefix(wrapped, "Fields[") {
+			fn = wrapped[7 : l-1]
+			found = true
+		}
+	}
+	return
+}
+
+func lookupField(msg *message.Message, fn string, fi, ai int) tengo.Object {
+	var field *message.Field
+	if fi != 0 {
+		fields := msg.FindAllFields(fn)
+		if fi >= len(fields) {
+			return tengo.UndefinedValue
+		}
+		field = fields[fi]
+	} else if field = msg.FindFirstField(fn); field == nil {
+		return tengo.UndefinedValue
+	}
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		if ai < len(field.ValueString) {
+			return &tengo.String{Value: field.ValueString[ai]}
+		}
+	case message.Field_BYTES:
+		if ai < len(field.ValueBytes) {
+			return &tengo.Bytes{Value: field.ValueBytes[ai]}
+		}
+	case message.Field_INTEGER:
+		if ai < len(field.ValueInteger) {
+			return &tengo.Int{Value: field.ValueInteger[ai]}
+		}
+	case message.Field_DOUBLE:
+		if ai < len(field.ValueDouble) {
+			return &tengo.Float{Value: field.ValueDouble[ai]}
+		}
+	case message.Field_BOOL:
+		if ai < len(field.ValueBool) {
+			if field.ValueBool[ai] {
+				return tengo.TrueValue
+			}
+			return tengo.FalseValue
+		}
+	}
+	return tengo.UndefinedValue
+}
+
+// Writes a value into an existing field or appends a new one. Only existing
+// fields may be modified, or the field and array length extended by one.
+func writeField(msg *message.Message, fn string, value interface{}, rep string,
+	fi, ai int) error {
+
+	fields := msg.FindAllFields(fn)
+	if fi > len(fields) {
+		return errors.New("bad field index")
+	}
+	if fi == len(fields) {
+		if ai != 0 {
+			return errors.New("bad array index")
+		}
+		field, err := message.NewField(fn, value, rep)
+		if err != nil {
+			return fmt.Errorf("Can't create field: %s", err)
+		}
+		msg.AddField(field)
+		return nil
+	}
+
+	field := fields[fi]
+	var n int
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		n = len(field.ValueString)
+	case message.Field_BYTES:
+		n = len(field.ValueBytes)
+	case message.Field_INTEGER:
+		n = len(field.ValueInteger)
+	case message.Field_DOUBLE:
+		n = len(field.ValueDouble)
+	case message.Field_BOOL:
+		n = len(field.ValueBool)
+	}
+	if ai > n {
+		return errors.New("bad array index")
+	}
+
+	typeErr := fmt.Errorf("type error, '%s' is a %s field", field.GetName(),
+		strings.ToLower(field.GetValueType().String()))
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		v, ok := value.(string)
+		if !ok {
+			return typeErr
+		}
+		if ai == n {
+			field.ValueString = append(field.ValueString, v)
+		} else {
+			field.ValueString[ai] = v
+		}
+	case message.Field_BYTES:
+		var v []byte
+		switch b := value.(type) {
+		case []byte:
+			v = b
+		case string:
+			v = []byte(b)
+		default:
+			return typeErr
+		}
+		if ai == n {
+			field.ValueBytes = append(field.ValueBytes, v)
+		} else {
+			field.ValueBytes[ai] = v
+		}
+	case message.Field_INTEGER:
+		var v int64
+		switch i := value.(type) {
+		case int64:
+			v = i
+		case float64:
+			v = int64(i)
+		default:
+			return typeErr
+		}
+		if ai == n {
+			field.ValueInteger = append(field.ValueInteger, v)
+		} else {
+			field.ValueInteger[ai] = v
+		}
+	case message.Field_DOUBLE:
+		var v float64
+		switch f := value.(type) {
+		case int64:
+			v = float64(f)
+		case float64:
+			v = f
+		default:
+			return typeErr
+		}
+		if ai == n {
+			field.ValueDouble = append(field.ValueDouble, v)
+		} else {
+			field.ValueDouble[ai] = v
+		}
+	case message.Field_BOOL:
+		v, ok := value.(bool)
+		if !ok {
+			return typeErr
+		}
+		if ai == n {
+			field.ValueBool = append(field.ValueBool, v)
+		} else {
+			field.ValueBool[ai] = v
+		}
+	}
+	field.Representation = &rep
+	return nil
+}
+
+// Deletes a field, or a single array entry when hasAi is set. Deleting a
+// field that does not exist is a no-op.
+func deleteField(msg *message.Message, fn string, fi, ai int, hasAi bool) error {
+	fields := msg.FindAllFields(fn)
+	if len(fields) == 0 {
+		return nil
+	}
+	if fi > len(fields)-1 {
+		return errors.New("bad field index")
+	}
+	field := fields[fi]
+	if !hasAi {
+		msg.DeleteField(field)
+		return nil
+	}
+
+	var n int
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		n = len(field.ValueString)
+	case message.Field_BYTES:
+		n = len(field.ValueBytes)
+	case message.Field_INTEGER:
+		n = len(field.ValueInteger)
+	case message.Field_DOUBLE:
+		n = len(field.ValueDouble)
+	case message.Field_BOOL:
+		n = len(field.ValueBool)
+	}
+	if ai > n-1 {
+		return errors.New("bad array index")
+	}
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		field.ValueString = append(field.ValueString[:ai], field.ValueString[ai+1:]...)
+	case message.Field_BYTES:
+		field.ValueBytes = append(field.ValueBytes[:ai], field.ValueBytes[ai+1:]...)
+	case message.Field_INTEGER:
+		field.ValueInteger = append(field.ValueInteger[:ai], field.ValueInteger[ai+1:]...)
+	case message.Field_DOUBLE:
+		field.ValueDouble = append(field.ValueDouble[:ai], field.ValueDouble[ai+1:]...)
+	case message.Field_BOOL:
+		field.ValueBool = append(field.ValueBool[:ai], field.ValueBool[ai+1:]...)
+	}
+	return nil
+}
+
+func (this *TengoSandbox) readMessage(fieldName string, fi, ai int) tengo.Object {
+	if this.pack == nil {
+		return tengo.UndefinedValue
+	}
+	msg := this.pack.Message
+	switch fieldName {
+	case "Type":
+		return &tengo.String{Value: msg.GetType()}
+	case "Logger":
+		return &tengo.String{Value: msg.GetLogger()}
+	case "Payload":
+		return &tengo.String{Value: msg.GetPayload()}
+	case "EnvVersion":
+		return &tengo.String{Value: msg.GetEnvVersion()}
+	case "Hostname":
+		return &tengo.String{Value: msg.GetHostname()}
+	case "Uuid":
+		return &tengo.String{Value: msg.GetUuidString()}
+	case "Timestamp":
+		if msg.Timestamp != nil {
+			return &tengo.Int{Value: *msg.Timestamp}
+		}
+	case "Severity":
+		if msg.Severity != nil {
+			return &tengo.Int{Value: int64(*msg.Severity)}
+		}
+	case "Pid":
+		if msg.Pid != nil {
+			return &tengo.Int{Value: int64(*msg.Pid)}
+		}
+	case "raw":
+		if len(this.pack.MsgBytes) > 0 {
+			return &tengo.Bytes{Value: this.pack.MsgBytes}
+		}
+	default:
+		if fn, found := extractFieldName(fieldName); found {
+			return lookupField(msg, fn, fi, ai)
+		}
+	}
+	return tengo.UndefinedValue
+}
+
+// Prepares the pack for modification, encoders work on a copy of the message
+// so the original can still be delivered to any other outputs.
+func (this *TengoSandbox) writablePack() error {
+	if this.pack == nil {
+		return errors.New("write_message() no sandbox pack")
+	}
+	this.pack.TrustMsgBytes = false
+	if !this.messageCopied && this.sbConfig.PluginType == "encoder" {
+		this.pack.Message = message.CopyMessage(this.pack.Message)
+		this.messageCopied = true
+	}
+	return nil
+}
+
+func (this *TengoSandbox) writeHeader(name string, value interface{}) (bool, error) {
+	msg := this.pack.Message
+	s, isString := value.(string)
+	var n int64
+	switch v := value.(type) {
+	case int64:
+		n = v
+	case float64:
+		n = int64(v)
+	case string:
+		if name == "Severity" || name == "Pid" || name == "Timestamp" {
+			var err error
+			if n, err = strconv.ParseInt(v, 0, 64); err != nil && name != "Timestamp" {
+				return true, fmt.Errorf("can't parse %s value", name)
+			}
+		}
+	}
+
+	switch name {
+	case "Type", "Logger", "Payload", "EnvVersion", "Hostname":
+		if !isString {
+			return true, fmt.Errorf("%s must be a string", name)
+		}
+		map[string]func(string){
+			"Type":       msg.SetType,
+			"Logger":     msg.SetLogger,
+			"Payload":    msg.SetPayload,
+			"EnvVersion": msg.SetEnvVersion,
+			"Hostname":   msg.SetHostname,
+		}[name](s)
+	case "Uuid":
+		b := uuid.Parse(s)
+		if !isString || b == nil {
+			return true, errors.New("bad UUID string")
+		}
+		msg.SetUuid(b)
+	case "Timestamp":
+		if isString && n == 0 {
+			t, err := message.ForgivingTimeParse("", s, time.UTC)
+			if err != nil {
+				return true, errors.New("can't parse timestamp string")
+			}
+			n = t.UnixNano()
+		}
+		msg.SetTimestamp(n)
+	case "Severity":
+		msg.SetSeverity(int32(n))
+	case "Pid":
+		msg.SetPid(int32(n))
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// read_message(variableName, fieldIndex, arrayIndex)
+func (this *TengoSandbox) tengoReadMessage(args ...tengo.Object) (tengo.Object, error) {
+	fi, ai := 0, 0
+	var err error
+	switch len(args) {
+	case 3:
+		if ai, err = checkInt(args, 3, "read_message"); err != nil {
+			return nil, err
+		}
+		if ai < 0 {
+			return nil, argError(3, "read_message", "array index must be >= 0")
+		}
+		fallthrough
+	case 2:
+		if fi, err = checkInt(args, 2, "read_message"); err != nil {
+			return nil, err
+		}
+		if fi < 0 {
+			return nil, argError(2, "read_message", "field index must be >= 0")
+		}
+		fallthrough
+	case 1:
+	default:
+		return nil, errors.New("read_message() incorrect number of arguments")
+	}
+	name, err := checkString(args, 1, "read_message")
+	if err != nil {
+		return nil, err
+	}
+	return this.readMessage(name, fi, ai), nil
+}
+
+// write_message(variableName, value, representation, fieldIndex, arrayIndex),
+// an undefined value deletes the field or array entry.
+func (this *TengoSandbox) tengoWriteMessage(args ...tengo.Object) (tengo.Object, error) {
+	fi, ai := 0, 0
+	hasAi := false
+	rep := ""
+	var err error
+	switch len(args) {
+	case 5:
+		if ai, err = checkInt(args, 5, "write_message"); err != nil {
+			return nil, err
+		}
+		if ai < 0 {
+			return nil, argError(5, "write_message", "array index must be >= 0")
+		}
+		hasAi = true
+		fallthrough
+	case 4:
+		if fi, err = checkInt(args, 4, "write_message"); err != nil {
+			return nil, err
+		}
+		if fi < 0 {
+			return nil, argError(4, "write_message", "field index must be >= 0")
+		}
+		fallthrough
+	case 3:
+		if rep, err = checkString(args, 3, "write_message"); err != nil {
+			return nil, err
+		}
+		fallthrough
+	case 2:
+	default:
+		return nil, errors.New("write_message() incorrect number of arguments")
+	}
+	name, err := checkString(args, 1, "write_message")
+	if err != nil {
+		return nil, err
+	}
+	if err = this.writablePack(); err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	switch v := args[1].(type) {
+	case *tengo.Int:
+		value = v.Value
+	case *tengo.Float:
+		value = v.Value
+	case *tengo.String:
+		value = v.Value
+	case *tengo.Bytes:
+		value = v.Value
+	case *tengo.Bool:
+		value = !v.IsFalsy()
+	case *tengo.Undefined:
+		if fn, found := extractFieldName(name); found {
+			err = deleteField(this.pack.Message, fn, fi, ai, hasAi)
+		} else {
+			err = errors.New("bad field name")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("write_message() failed: %s", err)
+		}
+		return nil, nil
+	default:
+		return nil, errors.New("write_message() only accepts int, float, string, bytes, or bool field values, or undefined to delete")
+	}
+
+	handled, err := this.writeHeader(name, value)
+	if !handled {
+		if fn, found := extractFieldName(name); found {
+			err = writeField(this.pack.Message, fn, value, rep, fi, ai)
+		} else {
+			err = errors.New("bad field name")
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("write_message() failed: %s", err)
+	}
+	return nil, nil
+}
+
+// read_next_field() returns a map with the type, name, value, representation
+// and count of the next field or undefined once all fields have been read.
+func (this *TengoSandbox) tengoReadNextField(args ...tengo.Object) (tengo.Object, error) {
+	if len(args) != 0 {
+		return nil, errors.New("read_next_field() takes no arguments")
+	}
+	if this.pack == nil || this.field >= len(this.pack.Message.Fields) {
+		return tengo.UndefinedValue, nil
+	}
+	field := this.pack.Message.Fields[this.field]
+	this.field++
+
+	var count int
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		count = len(field.ValueString)
+	case message.Field_BYTES:
+		count = len(field.ValueBytes)
+	case message.Field_INTEGER:
+		count = len(field.ValueInteger)
+	case message.Field_DOUBLE:
+		count = len(field.ValueDouble)
+	case message.Field_BOOL:
+		count = len(field.ValueBool)
+	}
+	return &tengo.Map{Value: map[string]tengo.Object{
+		"type":           &tengo.Int{Value: int64(field.GetValueType())},
+		"name":           &tengo.String{Value: field.GetName()},
+		"value":          lookupField(&message.Message{Fields: []*message.Field{field}}, field.GetName(), 0, 0),
+		"representation": &tengo.String{Value: field.GetRepresentation()},
+		"count":          &tengo.Int{Value: int64(count)},
+	}}, nil
+}
+
+// read_config(name)
+func (this *TengoSandbox) tengoReadConfig(args ...tengo.Object) (tengo.Object, error) {
+	if len(args) != 1 {
+		return nil, errors.New("read_config() must have a single argument")
+	}
+	name, err := checkString(args, 1, "read_config")
+	if err != nil {
+		return nil, err
+	}
+	switch v := this.config[name].(type) {
+	case string, bool, int64, float64:
+		return tengo.FromInterface(v)
+	}
+	return tengo.UndefinedValue, nil
+}
+
+// add_to_payload(...) appends the string representation of each argument to
+// the output buffer, the buffer is flushed by inject_payload.
+func (this *TengoSandbox) tengoAddToPayload(args ...tengo.Object) (tengo.Object, error) {
+	if len(args) == 0 {
+		return nil, argError(0, "add_to_payload", "must have at least one argument")
+	}
+	for i := range args {
+		if err := this.appendOutput(args, i+1, "add_to_payload"); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (this *TengoSandbox) appendOutput(args []tengo.Object, n int, fname string) error {
+	switch v := args[n-1].(type) {
+	case *tengo.String:
+		this.output = append(this.output, v.Value...)
+	case *tengo.Bytes:
+		this.output = append(this.output, v.Value...)
+	case *tengo.Int:
+		this.output = strconv.AppendInt(this.output, v.Value, 10)
+	case *tengo.Float:
+		this.output = strconv.AppendFloat(this.output, v.Value, 'g', -1, 64)
+	case *tengo.Bool:
+		this.output = strconv.AppendBool(this.output, !v.IsFalsy())
+	case *tengo.Char:
+		this.output = append(this.output, string(v.Value)...)
+	case *tengo.Undefined:
+		this.output = append(this.output, "undefined"...)
+	default:
+		return argError(n, fname, "unsupported type")
+	}
+	if !this.checkOutput(uint(len(this.output))) {
+		this.output = this.output[:0]
+		return errors.New("output_limit exceeded")
+	}
+	return nil
+}
+
+// Records the size of pending output, returns false if it exceeds the output
+// limit.
+func (this *TengoSandbox) checkOutput(size uint) bool {
+	this.usage[sandbox.TYPE_OUTPUT][sandbox.STAT_CURRENT] = size
+	if size > this.usage[sandbox.TYPE_OUTPUT][sandbox.STAT_MAXIMUM] {
+		this.usage[sandbox.TYPE_OUTPUT][sandbox.STAT_MAXIMUM] = size
+	}
+	limit := this.sbConfig.OutputLimit
+	return limit == 0 || size <= limit
+}
+
+// Converts an injection callback result into the corresponding script error.
+func injectError(fname string, result int) error {
+	switch result {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%s() protobuf unmarshal failed", fname)
+	case 2:
+		return fmt.Errorf("%s() exceeded InjectMessage count", fname)
+	case 3:
+		return fmt.Errorf("%s() exceeded MaxMsgLoops", fname)
+	case 4:
+		return fmt.Errorf("%s() creates a circular reference (matches this plugin's message_matcher)", fname)
+	case 5:
+		return fmt.Errorf("%s() aborted", fname)
+	}
+	return fmt.Errorf("%s() unknown error", fname)
+}
+
+// inject_payload(payload_type, payload_name, ...) appends the optional
+// arguments to the output buffer and injects its content, an empty
+// payload_type defaults to "txt".
+func (this *TengoSandbox) tengoInjectPayload(args ...tengo.Object) (tengo.Object, error) {
+	payload_type, err := checkString(args, 1, "inject_payload")
+	if err != nil {
+		return nil, err
+	}
+	payload_name, err := checkString(args, 2, "inject_payload")
+	if err != nil {
+		return nil, err
+	}
+	if len(payload_type) == 0 {
+		payload_type = "txt"
+	}
+	for i := 3; i <= len(args); i++ {
+		if err = this.appendOutput(args, i, "inject_payload"); err != nil {
+			return nil, err
+		}
+	}
+	if len(this.output) == 0 {
+		return nil, nil
+	}
+	payload := string(this.output)
+	this.output = this.output[:0]
+	return nil, injectError("inject_payload", this.injectMessage(payload, payload_type, payload_name))
+}
+
+// inject_message(map or protobuf string)
+func (this *TengoSandbox) tengoInjectMessage(args ...tengo.Object) (tengo.Object, error) {
+	if len(args) != 1 {
+		return nil, errors.New("inject_message() takes a single string or map argument")
+	}
+	var payload string
+	switch v := args[0].(type) {
+	case *tengo.String:
+		payload = v.Value
+	case *tengo.Bytes:
+		payload = string(v.Value)
+	case *tengo.Map, *tengo.ImmutableMap:
+		msg, err := mapToMessage(v, this.sbConfig.Timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("inject_message() could not encode protobuf - %s", err)
+		}
+		b, err := proto.Marshal(msg)
+		if err != nil {
+			return nil, fmt.Errorf("inject_message() could not encode protobuf - %s", err)
+		}
+		payload = string(b)
+	default:
+		return nil, errors.New("inject_message() takes a single string or map argument")
+	}
+	if !this.checkOutput(uint(len(payload))) {
+		return nil, errors.New("output_limit exceeded")
+	}
+	return nil, injectError("inject_message", this.injectMessage(payload, "", ""))
+}
+
+// decode_message(protobuf) returns the message as a map in the form accepted
+// by inject_message.
+func (this *TengoSandbox) tengoDecodeMessage(args ...tengo.Object) (tengo.Object, error) {
+	if len(args) != 1 {
+		return nil, errors.New("decode_message() takes a single argument")
+	}
+	var b []byte
+	switch v := args[0].(type) {
+	case *tengo.String:
+		b = []byte(v.Value)
+	case *tengo.Bytes:
+		b = v.Value
+	default:
+		return nil, argError(1, "decode_message", "bytes expected, got "+typeName(v))
+	}
+	msg := new(message.Message)
+	if err := proto.Unmarshal(b, msg); err != nil {
+		return nil, errors.New("decode_message() protobuf unmarshal failed")
+	}
+	return messageToMap(msg), nil
+}
@@ -0,0 +1,399 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012-2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tengo
+
+import (
+	"errors"
+	"reflect"
+	"unsafe"
+
+	"github.com/d5/tengo/v2"
+	"github.com/d5/tengo/v2/parser"
+	"github.com/d5/tengo/v2/stdlib"
+	"heka/sandbox"
+)
+
+var (
+	errInstructionLimit = errors.New("instruction_limit exceeded")
+	errMemoryLimit      = errors.New("not enough memory")
+	errShuttingDown     = errors.New("shutting down")
+)
+
+// The memory estimate walks all the script's globals so it is only refreshed
+// after the script has executed a number of instructions proportional to the
+// size of the last walk.
+const (
+	memoryCheckMinInterval = 100
+	memoryCheckFactor      = 4
+)
+
+// The Tengo VM has no instruction hook. Instead every compiled function is
+// rewritten to call a counter on entry and before each backward jump, the
+// counter is charged with the number of instructions executed since the
+// previous call: the instructions outside of any loop on entry and the loop
+// body on a backward jump. Branches are not taken into account so the count
+// is an upper bound.
+func (this *TengoSandbox) instrument(bc *tengo.Bytecode) {
+	counter := len(bc.Constants)
+	bc.Constants = append(bc.Constants, &tengo.UserFunction{
+		Name:  "instruction_counter",
+		Value: this.countInstructions,
+	})
+	weights := make(map[int64]int)
+	weight := func(n int) int {
+		idx, ok := weights[int64(n)]
+		if !ok {
+			idx = len(bc.Constants)
+			bc.Constants = append(bc.Constants, &tengo.Int{Value: int64(n)})
+			weights[int64(n)] = idx
+		}
+		return idx
+	}
+
+	fns := []*tengo.CompiledFunction{bc.MainFunction}
+	for _, c := range bc.Constants {
+		if fn, ok := c.(*tengo.CompiledFunction); ok {
+			fns = append(fns, fn)
+		}
+	}
+	for _, fn := range fns {
+		instrumentFunction(fn, counter, weight)
+	}
+}
+
+type instruction struct {
+	pos      int
+	op       parser.Opcode
+	operands []int
+}
+
+func isJump(op parser.Opcode) bool {
+	switch op {
+	case parser.OpJump, parser.OpJumpFalsy, parser.OpAndJump, parser.OpOrJump:
+		return true
+	}
+	return false
+}
+
+func instrumentFunction(fn *tengo.CompiledFunction, counter int,
+	weight func(n int) int) {
+
+	var code []instruction
+	for pos := 0; pos < len(fn.Instructions); {
+		op := fn.Instructions[pos]
+		operands, read := parser.ReadOperands(parser.OpcodeOperands[op],
+			fn.Instructions[pos+1:])
+		code = append(code, instruction{pos, op, operands})
+		pos += 1 + read
+	}
+
+	// a backward jump closes a loop spanning from its target to itself
+	loopWeight := make(map[int]int)
+	inLoop := make([]bool, len(code))
+	for i, ins := range code {
+		if ins.op != parser.OpJump || ins.operands[0] > ins.pos {
+			continue
+		}
+		for j := i; j >= 0 && code[j].pos >= ins.operands[0]; j-- {
+			inLoop[j] = true
+			loopWeight[i]++
+		}
+	}
+	entryWeight := 0
+	for _, l := range inLoop {
+		if !l {
+			entryWeight++
+		}
+	}
+
+	charge := func(n int) []byte {
+		b := tengo.MakeInstruction(parser.OpConstant, counter)
+		b = append(b, tengo.MakeInstruction(parser.OpConstant, weight(n))...)
+		b = append(b, tengo.MakeInstruction(parser.OpCall, 1, 0)...)
+		return append(b, tengo.MakeInstruction(parser.OpPop)...)
+	}
+
+	var out []byte
+	sourceMap := make(map[int]parser.Pos, len(fn.SourceMap))
+	target := make(map[int]int, len(code)+1) // jump destinations
+	at := make([]int, len(code))             // rewritten instruction positions
+	if len(code) > 0 {
+		sourceMap[0] = fn.SourcePos(0)
+	}
+	out = append(out, charge(entryWeight)...)
+	for i, ins := range code {
+		target[ins.pos] = len(out)
+		if n, ok := loopWeight[i]; ok {
+			sourceMap[len(out)] = fn.SourcePos(ins.pos)
+			out = append(out, charge(n)...)
+		}
+		at[i] = len(out)
+		if p, ok := fn.SourceMap[ins.pos]; ok {
+			sourceMap[len(out)] = p
+		}
+		out = append(out, tengo.MakeInstruction(ins.op, ins.operands...)...)
+	}
+	target[len(fn.Instructions)] = len(out)
+
+	for i, ins := range code {
+		if isJump(ins.op) {
+			copy(out[at[i]:], tengo.MakeInstruction(ins.op, target[ins.operands[0]]))
+		}
+	}
+	fn.Instructions = out
+	fn.SourceMap = sourceMap
+}
+
+func (this *TengoSandbox) countInstructions(args ...tengo.Object) (tengo.Object, error) {
+	n := uint(args[0].(*tengo.Int).Value)
+	this.instructions += n
+	this.totalInstructions += uint64(n)
+	if this.limitErr != nil {
+		return nil, this.limitErr
+	}
+	if this.sbConfig.InstructionLimit > 0 &&
+		this.instructions > this.sbConfig.InstructionLimit {
+		this.limitErr = errInstructionLimit
+		return nil, this.limitErr
+	}
+	if this.totalInstructions >= this.nextMemoryCheck && !this.checkMemory() {
+		this.limitErr = errMemoryLimit
+		return nil, this.limitErr
+	}
+	return nil, nil
+}
+
+// Approximates the memory held by the script by walking its globals and the
+// stack and call frames of the running VM. Sizes
+// are rough Go allocation sizes, they only need to be stable enough to
+// enforce a limit.
+type memoryWalker struct {
+	seen   map[tengo.Object]struct{}
+	size   uint
+	visits int
+}
+
+func (w *memoryWalker) mark(o tengo.Object) bool {
+	if _, ok := w.seen[o]; ok {
+		return false
+	}
+	w.seen[o] = struct{}{}
+	w.visits++
+	return true
+}
+
+func (w *memoryWalker) walk(o tengo.Object) {
+	switch v := o.(type) {
+	case nil:
+	case *tengo.String:
+		w.size += 32 + uint(len(v.Value))
+	case *tengo.Bytes:
+		w.size += 32 + uint(len(v.Value))
+	case *tengo.Array:
+		if w.mark(v) {
+			w.size += 32 + 16*uint(len(v.Value))
+			for _, e := range v.Value {
+				w.walk(e)
+			}
+		}
+	case *tengo.ImmutableArray:
+		if w.mark(v) {
+			w.size += 32 + 16*uint(len(v.Value))
+			for _, e := range v.Value {
+				w.walk(e)
+			}
+		}
+	case *tengo.Map:
+		if w.mark(v) {
+			w.size += 48
+			for k, e := range v.Value {
+				w.size += 32 + uint(len(k))
+				w.walk(e)
+			}
+		}
+	case *tengo.ImmutableMap:
+		if w.mark(v) {
+			w.size += 48
+			for k, e := range v.Value {
+				w.size += 32 + uint(len(k))
+				w.walk(e)
+			}
+		}
+	case *tengo.CompiledFunction:
+		if w.mark(v) {
+			w.size += 64 + uint(len(v.Instructions)) + 8*uint(len(v.Free))
+			for _, p := range v.Free {
+				if p.Value != nil {
+					w.walk(*p.Value)
+				}
+			}
+		}
+	case *tengo.Error:
+		w.size += 16
+		w.walk(v.Value)
+	default:
+		w.size += 16
+	}
+}
+
+// Returns an unexported struct field as a settable value.
+func unexportedField(v reflect.Value, name string) reflect.Value {
+	f := v.FieldByName(name)
+	return reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem()
+}
+
+// Walks the locals and temporaries on the stack of a running VM and the
+// functions of its call frames. tengo doesn't export the VM state so it is
+// read with reflection.
+func (w *memoryWalker) walkVM(vm *tengo.VM) {
+	state := reflect.ValueOf(vm).Elem()
+	sp := int(unexportedField(state, "sp").Int())
+	stack := unexportedField(state, "stack")
+	for i := 0; i < sp && i < stack.Len(); i++ {
+		o, _ := stack.Index(i).Interface().(tengo.Object)
+		w.walk(o)
+	}
+	frames := unexportedField(state, "frames")
+	n := int(unexportedField(state, "framesIndex").Int())
+	for i := 0; i < n && i < frames.Len(); i++ {
+		frame := frames.Index(i)
+		if fn, ok := unexportedField(frame, "fn").Interface().(*tengo.CompiledFunction); ok {
+			w.walk(fn)
+		}
+		for _, p := range unexportedField(frame, "freeVars").Interface().([]*tengo.ObjectPtr) {
+			if p != nil && p.Value != nil {
+				w.walk(*p.Value)
+			}
+		}
+	}
+}
+
+func (this *TengoSandbox) memoryUsage() (size uint, visits int) {
+	w := memoryWalker{seen: make(map[tengo.Object]struct{}, this.lastVisits)}
+	for _, o := range this.vars {
+		w.walk(o)
+	}
+	if this.vm != nil {
+		w.walkVM(this.vm)
+	}
+	return w.size, w.visits
+}
+
+// Refreshes the memory usage statistics, returns false if the memory limit
+// has been exceeded.
+func (this *TengoSandbox) checkMemory() bool {
+	size, visits := this.memoryUsage()
+	this.lastVisits = visits
+	interval := uint64(visits) * memoryCheckFactor
+	if interval < memoryCheckMinInterval {
+		interval = memoryCheckMinInterval
+	}
+	this.nextMemoryCheck = this.totalInstructions + interval
+
+	this.usage[sandbox.TYPE_MEMORY][sandbox.STAT_CURRENT] = size
+	if size > this.usage[sandbox.TYPE_MEMORY][sandbox.STAT_MAXIMUM] {
+		this.usage[sandbox.TYPE_MEMORY][sandbox.STAT_MAXIMUM] = size
+	}
+	limit := this.sbConfig.MemoryLimit
+	return limit == 0 || size <= limit
+}
+
+// Checks a string or byte slice of count items of size bytes fits in what is
+// left of the memory limit before it's allocated. The usage estimate is only
+// refreshed between instructions, a single call could otherwise allocate far
+// beyond the limit.
+func (this *TengoSandbox) checkAllocation(size, count int) error {
+	limit := this.sbConfig.MemoryLimit
+	if limit == 0 || size <= 0 || count <= 0 {
+		return nil
+	}
+	var avail uint
+	if current := this.usage[sandbox.TYPE_MEMORY][sandbox.STAT_CURRENT]; current < limit {
+		avail = limit - current
+	}
+	if uint(count) > avail/uint(size) {
+		this.limitErr = errMemoryLimit
+		return this.limitErr
+	}
+	return nil
+}
+
+// Wraps a function allocating a result whose size is computed from its
+// arguments, the size is checked against the memory limit first.
+func (this *TengoSandbox) limitAllocation(name string, fn tengo.CallableFunc,
+	size func(args []tengo.Object) (int, int)) *tengo.UserFunction {
+
+	return &tengo.UserFunction{
+		Name: name,
+		Value: func(args ...tengo.Object) (tengo.Object, error) {
+			if err := this.checkAllocation(size(args)); err != nil {
+				return nil, err
+			}
+			return fn(args...)
+		},
+	}
+}
+
+// Replaces the bytes builtin, bytes(n) allocates n bytes.
+func (this *TengoSandbox) limitBuiltins() {
+	for _, fn := range tengo.GetAllBuiltinFunctions() {
+		if fn.Name != "bytes" {
+			continue
+		}
+		symbol := this.symbols.Define(fn.Name)
+		this.vars[symbol.Index] = this.limitAllocation(fn.Name, fn.Value,
+			func(args []tengo.Object) (int, int) {
+				if len(args) == 0 {
+					return 0, 0
+				}
+				if n, ok := args[0].(*tengo.Int); ok {
+					return 1, int(n.Value)
+				}
+				return 0, 0
+			})
+	}
+}
+
+// Returns the standard library modules scripts may import, the text functions
+// padding or repeating a string are limited to the available memory.
+func (this *TengoSandbox) moduleMap() *tengo.ModuleMap {
+	modules := stdlib.GetModuleMap(stdlibModules...)
+	text := make(map[string]tengo.Object)
+	for name, fn := range stdlib.BuiltinModules["text"] {
+		text[name] = fn
+	}
+	limit := func(name string, size func(args []tengo.Object) (int, int)) {
+		text[name] = this.limitAllocation(name, text[name].(*tengo.UserFunction).Value, size)
+	}
+	limit("repeat", func(args []tengo.Object) (int, int) {
+		if len(args) != 2 {
+			return 0, 0
+		}
+		s, _ := tengo.ToString(args[0])
+		n, _ := tengo.ToInt(args[1])
+		return len(s), n
+	})
+	padSize := func(args []tengo.Object) (int, int) {
+		if len(args) < 2 {
+			return 0, 0
+		}
+		width, _ := tengo.ToInt(args[1])
+		return 1, width
+	}
+	limit("pad_left", padSize)
+	limit("pad_right", padSize)
+	modules.AddBuiltinModule("text", text)
+	return modules
+}
@@ -0,0 +1,367 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012-2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tengo
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/d5/tengo/v2"
+	"github.com/gogo/protobuf/proto"
+	"github.com/pborman/uuid"
+	"heka/message"
+)
+
+func mapValue(o tengo.Object) map[string]tengo.Object {
+	switch v := o.(type) {
+	case *tengo.Map:
+		return v.Value
+	case *tengo.ImmutableMap:
+		return v.Value
+	}
+	return nil
+}
+
+func arrayValue(o tengo.Object) ([]tengo.Object, bool) {
+	switch v := o.(type) {
+	case *tengo.Array:
+		return v.Value, true
+	case *tengo.ImmutableArray:
+		return v.Value, true
+	}
+	return nil, false
+}
+
+func isUndefined(o tengo.Object) bool {
+	return o == nil || o == tengo.UndefinedValue
+}
+
+// Builds a Heka message from a Tengo map, see the Lua sandbox's
+// tableToMessage for the accepted keys. A missing Uuid is generated, a
+// missing Timestamp is set from now.
+func mapToMessage(o tengo.Object, now func() int64) (msg *message.Message, err error) {
+	m := mapValue(o)
+	msg = new(message.Message)
+
+	switch v := m["Uuid"].(type) {
+	case nil, *tengo.Undefined:
+		msg.SetUuid(uuid.NewRandom())
+	case *tengo.String:
+		if len(v.Value) == 16 {
+			msg.SetUuid([]byte(v.Value))
+		} else if b := uuid.Parse(v.Value); b != nil {
+			msg.SetUuid(b)
+		} else {
+			return nil, errors.New("invalid Uuid")
+		}
+	case *tengo.Bytes:
+		if len(v.Value) != 16 {
+			return nil, errors.New("invalid Uuid")
+		}
+		msg.SetUuid(v.Value)
+	default:
+		return nil, fmt.Errorf("Uuid must be a string, got %s", v.TypeName())
+	}
+
+	switch v := m["Timestamp"].(type) {
+	case nil, *tengo.Undefined:
+		msg.SetTimestamp(now())
+	case *tengo.Int:
+		msg.SetTimestamp(v.Value)
+	case *tengo.Float:
+		msg.SetTimestamp(int64(v.Value))
+	case *tengo.Time:
+		msg.SetTimestamp(v.Value.UnixNano())
+	default:
+		return nil, fmt.Errorf("Timestamp must be a number, got %s", v.TypeName())
+	}
+
+	headers := []struct {
+		name string
+		set  func(string)
+	}{
+		{"Type", msg.SetType},
+		{"Logger", msg.SetLogger},
+		{"Payload", msg.SetPayload},
+		{"EnvVersion", msg.SetEnvVersion},
+		{"Hostname", msg.SetHostname},
+	}
+	for _, h := range headers {
+		switch v := m[h.name].(type) {
+		case nil, *tengo.Undefined:
+		case *tengo.String:
+			h.set(v.Value)
+		case *tengo.Int, *tengo.Float:
+			h.set(v.String())
+		default:
+			return nil, fmt.Errorf("%s must be a string, got %s", h.name, v.TypeName())
+		}
+	}
+
+	numbers := []struct {
+		name string
+		set  func(int32)
+	}{
+		{"Severity", msg.SetSeverity},
+		{"Pid", msg.SetPid},
+	}
+	for _, h := range numbers {
+		switch v := m[h.name].(type) {
+		case nil, *tengo.Undefined:
+		case *tengo.Int:
+			h.set(int32(v.Value))
+		case *tengo.Float:
+			h.set(int32(v.Value))
+		default:
+			return nil, fmt.Errorf("%s must be a number, got %s", h.name, v.TypeName())
+		}
+	}
+
+	if fields := m["Fields"]; !isUndefined(fields) {
+		if err = mapToFields(msg, fields); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// Adds the Fields entry of an injected map to the message. Fields are either
+// a map keyed by field name, added in name order as Tengo maps are unordered,
+// or an array of maps carrying a name key (the form produced by
+// decode_message).
+func mapToFields(msg *message.Message, fields tengo.Object) error {
+	if values, ok := arrayValue(fields); ok {
+		for i, v := range values {
+			m := mapValue(v)
+			if m == nil {
+				return fmt.Errorf("field %d must be a map, got %s", i, v.TypeName())
+			}
+			n, ok := m["name"].(*tengo.String)
+			if !ok {
+				return fmt.Errorf("field %d is missing a name", i)
+			}
+			f, err := valueToField(n.Value, v)
+			if err != nil {
+				return err
+			}
+			msg.AddField(f)
+		}
+		return nil
+	}
+
+	m := mapValue(fields)
+	if m == nil {
+		return fmt.Errorf("Fields must be a map or an array, got %s", fields.TypeName())
+	}
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f, err := valueToField(name, m[name])
+		if err != nil {
+			return err
+		}
+		msg.AddField(f)
+	}
+	return nil
+}
+
+// Converts a scalar, an array of scalars or a nested field map into a
+// message field.
+func valueToField(name string, o tengo.Object) (f *message.Field, err error) {
+	f = &message.Field{Name: &name}
+	var valueType tengo.Object
+	if m := mapValue(o); m != nil && !isUndefined(m["value"]) {
+		switch r := m["representation"].(type) {
+		case nil, *tengo.Undefined:
+		case *tengo.String:
+			if len(r.Value) > 0 {
+				f.Representation = proto.String(r.Value)
+			}
+		default:
+			return nil, fmt.Errorf("representation must be a string, got %s", r.TypeName())
+		}
+		valueType = m["value_type"]
+		o = m["value"]
+	}
+
+	values, ok := arrayValue(o)
+	if !ok {
+		values = []tengo.Object{o}
+	}
+	if len(values) == 0 {
+		return nil, errors.New("unsupported type: empty array")
+	}
+
+	var ft message.Field_ValueType
+	switch vt := valueType.(type) {
+	case nil, *tengo.Undefined:
+		switch values[0].(type) {
+		case *tengo.Int:
+			ft = message.Field_INTEGER
+		case *tengo.Float:
+			ft = message.Field_DOUBLE
+		case *tengo.Bool:
+			ft = message.Field_BOOL
+		case *tengo.Bytes:
+			ft = message.Field_BYTES
+		default:
+			ft = message.Field_STRING
+		}
+	case *tengo.Int:
+		ft = message.Field_ValueType(vt.Value)
+		if _, ok := message.Field_ValueType_name[int32(ft)]; !ok {
+			return nil, fmt.Errorf("invalid value_type: %d", vt.Value)
+		}
+	default:
+		return nil, fmt.Errorf("value_type must be an int, got %s", vt.TypeName())
+	}
+
+	first := values[0].TypeName()
+	for _, v := range values {
+		if v.TypeName() != first {
+			return nil, errors.New("array has mixed types")
+		}
+		switch v := v.(type) {
+		case *tengo.String:
+			switch ft {
+			case message.Field_STRING:
+				f.ValueString = append(f.ValueString, v.Value)
+			case message.Field_BYTES:
+				f.ValueBytes = append(f.ValueBytes, []byte(v.Value))
+			default:
+				return nil, fmt.Errorf("value_type %s does not accept a string", ft)
+			}
+		case *tengo.Bytes:
+			switch ft {
+			case message.Field_STRING:
+				f.ValueString = append(f.ValueString, string(v.Value))
+			case message.Field_BYTES:
+				f.ValueBytes = append(f.ValueBytes, v.Value)
+			default:
+				return nil, fmt.Errorf("value_type %s does not accept bytes", ft)
+			}
+		case *tengo.Int:
+			switch ft {
+			case message.Field_DOUBLE:
+				f.ValueDouble = append(f.ValueDouble, float64(v.Value))
+			case message.Field_INTEGER:
+				f.ValueInteger = append(f.ValueInteger, v.Value)
+			default:
+				return nil, fmt.Errorf("value_type %s does not accept a number", ft)
+			}
+		case *tengo.Float:
+			switch ft {
+			case message.Field_DOUBLE:
+				f.ValueDouble = append(f.ValueDouble, v.Value)
+			case message.Field_INTEGER:
+				f.ValueInteger = append(f.ValueInteger, int64(v.Value))
+			default:
+				return nil, fmt.Errorf("value_type %s does not accept a number", ft)
+			}
+		case *tengo.Bool:
+			if ft != message.Field_BOOL {
+				return nil, fmt.Errorf("value_type %s does not accept a boolean", ft)
+			}
+			f.ValueBool = append(f.ValueBool, !v.IsFalsy())
+		default:
+			return nil, fmt.Errorf("unsupported type: %s", v.TypeName())
+		}
+	}
+	if ft != message.Field_STRING {
+		f.ValueType = ft.Enum()
+	}
+	return f, nil
+}
+
+// Converts a Heka message into the map form accepted by inject_message.
+func messageToMap(msg *message.Message) *tengo.Map {
+	m := make(map[string]tengo.Object)
+	if msg.Uuid != nil {
+		m["Uuid"] = &tengo.Bytes{Value: msg.Uuid}
+	}
+	if msg.Timestamp != nil {
+		m["Timestamp"] = &tengo.Int{Value: msg.GetTimestamp()}
+	}
+	if msg.Type != nil {
+		m["Type"] = &tengo.String{Value: msg.GetType()}
+	}
+	if msg.Logger != nil {
+		m["Logger"] = &tengo.String{Value: msg.GetLogger()}
+	}
+	if msg.Severity != nil {
+		m["Severity"] = &tengo.Int{Value: int64(msg.GetSeverity())}
+	}
+	if msg.Payload != nil {
+		m["Payload"] = &tengo.String{Value: msg.GetPayload()}
+	}
+	if msg.EnvVersion != nil {
+		m["EnvVersion"] = &tengo.String{Value: msg.GetEnvVersion()}
+	}
+	if msg.Pid != nil {
+		m["Pid"] = &tengo.Int{Value: int64(msg.GetPid())}
+	}
+	if msg.Hostname != nil {
+		m["Hostname"] = &tengo.String{Value: msg.GetHostname()}
+	}
+	if len(msg.Fields) == 0 {
+		return &tengo.Map{Value: m}
+	}
+
+	fields := make([]tengo.Object, 0, len(msg.Fields))
+	for _, f := range msg.Fields {
+		var values []tengo.Object
+		switch f.GetValueType() {
+		case message.Field_STRING:
+			for _, v := range f.ValueString {
+				values = append(values, &tengo.String{Value: v})
+			}
+		case message.Field_BYTES:
+			for _, v := range f.ValueBytes {
+				values = append(values, &tengo.Bytes{Value: v})
+			}
+		case message.Field_INTEGER:
+			for _, v := range f.ValueInteger {
+				values = append(values, &tengo.Int{Value: v})
+			}
+		case message.Field_DOUBLE:
+			for _, v := range f.ValueDouble {
+				values = append(values, &tengo.Float{Value: v})
+			}
+		case message.Field_BOOL:
+			for _, v := range f.ValueBool {
+				if v {
+					values = append(values, tengo.TrueValue)
+				} else {
+					values = append(values, tengo.FalseValue)
+				}
+			}
+		}
+		fm := map[string]tengo.Object{
+			"name":       &tengo.String{Value: f.GetName()},
+			"value_type": &tengo.Int{Value: int64(f.GetValueType())},
+			"value":      &tengo.Array{Value: values},
+		}
+		if f.Representation != nil {
+			fm["representation"] = &tengo.String{Value: f.GetRepresentation()}
+		}
+		fields = append(fields, &tengo.Map{Value: fm})
+	}
+	m["Fields"] = &tengo.Array{Value: fields}
+	return &tengo.Map{Value: m}
+}
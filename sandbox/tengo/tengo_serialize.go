@@ -0,0 +1,310 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012-2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tengo
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/d5/tengo/v2"
+)
+
+// The global a script sets to invalidate previously preserved data, the data
+// file is only restored when the versions match.
+const preservationVersion = "_PRESERVATION_VERSION"
+
+type preservedData struct {
+	Version *int64                     `json:"version,omitempty"`
+	Globals map[string]*preservedValue `json:"globals"`
+}
+
+// A preserved value. Scalars are stored as strings so numbers survive the
+// round trip exactly, containers carry an id so values referenced more than
+// once (including cycles) are restored as shared references.
+type preservedValue struct {
+	Type    string                     `json:"type"`
+	Value   string                     `json:"value,omitempty"`
+	Id      int                        `json:"id,omitempty"`
+	Items   []*preservedValue          `json:"items,omitempty"`
+	Entries map[string]*preservedValue `json:"entries,omitempty"`
+}
+
+type serializer struct {
+	seen map[tengo.Object]int
+}
+
+// Converts a value into its preserved form, returns nil for values that
+// cannot be preserved (functions and other host objects).
+func (s *serializer) serialize(o tengo.Object) *preservedValue {
+	switch v := o.(type) {
+	case *tengo.Undefined:
+		return &preservedValue{Type: "undefined"}
+	case *tengo.Int:
+		return &preservedValue{Type: "int", Value: strconv.FormatInt(v.Value, 10)}
+	case *tengo.Float:
+		return &preservedValue{Type: "float",
+			Value: strconv.FormatFloat(v.Value, 'g', -1, 64)}
+	case *tengo.String:
+		return &preservedValue{Type: "string", Value: v.Value}
+	case *tengo.Bytes:
+		return &preservedValue{Type: "bytes",
+			Value: base64.StdEncoding.EncodeToString(v.Value)}
+	case *tengo.Bool:
+		return &preservedValue{Type: "bool", Value: strconv.FormatBool(!v.IsFalsy())}
+	case *tengo.Char:
+		return &preservedValue{Type: "char", Value: string(v.Value)}
+	case *tengo.Time:
+		return &preservedValue{Type: "time", Value: v.Value.Format(time.RFC3339Nano)}
+	case *tengo.Array, *tengo.ImmutableArray, *tengo.Map, *tengo.ImmutableMap:
+		if id, ok := s.seen[o]; ok {
+			return &preservedValue{Type: "ref", Id: id}
+		}
+		id := len(s.seen) + 1
+		s.seen[o] = id
+		pv := &preservedValue{Type: o.TypeName(), Id: id}
+		if items, ok := arrayValue(o); ok {
+			pv.Items = make([]*preservedValue, len(items))
+			for i, item := range items {
+				if pv.Items[i] = s.serialize(item); pv.Items[i] == nil {
+					pv.Items[i] = &preservedValue{Type: "undefined"}
+				}
+			}
+			return pv
+		}
+		pv.Entries = make(map[string]*preservedValue)
+		entries := mapValue(o)
+		for _, k := range sortedNames(entries) {
+			if ev := s.serialize(entries[k]); ev != nil {
+				pv.Entries[k] = ev
+			}
+		}
+		return pv
+	}
+	return nil
+}
+
+type deserializer struct {
+	refs map[int]tengo.Object
+}
+
+func (d *deserializer) deserialize(pv *preservedValue) (tengo.Object, error) {
+	if pv == nil {
+		return tengo.UndefinedValue, nil
+	}
+	switch pv.Type {
+	case "undefined":
+		return tengo.UndefinedValue, nil
+	case "int":
+		n, err := strconv.ParseInt(pv.Value, 10, 64)
+		return &tengo.Int{Value: n}, err
+	case "float":
+		f, err := strconv.ParseFloat(pv.Value, 64)
+		return &tengo.Float{Value: f}, err
+	case "string":
+		return &tengo.String{Value: pv.Value}, nil
+	case "bytes":
+		b, err := base64.StdEncoding.DecodeString(pv.Value)
+		return &tengo.Bytes{Value: b}, err
+	case "bool":
+		if pv.Value == "true" {
+			return tengo.TrueValue, nil
+		}
+		return tengo.FalseValue, nil
+	case "char":
+		for _, r := range pv.Value {
+			return &tengo.Char{Value: r}, nil
+		}
+		return nil, fmt.Errorf("invalid char value")
+	case "time":
+		t, err := time.Parse(time.RFC3339Nano, pv.Value)
+		return &tengo.Time{Value: t}, err
+	case "ref":
+		if o, ok := d.refs[pv.Id]; ok {
+			return o, nil
+		}
+		return nil, fmt.Errorf("invalid reference %d", pv.Id)
+	}
+
+	var o tengo.Object
+	var items []tengo.Object
+	var entries map[string]tengo.Object
+	switch pv.Type {
+	case "array":
+		items = make([]tengo.Object, len(pv.Items))
+		o = &tengo.Array{Value: items}
+	case "immutable-array":
+		items = make([]tengo.Object, len(pv.Items))
+		o = &tengo.ImmutableArray{Value: items}
+	case "map":
+		entries = make(map[string]tengo.Object, len(pv.Entries))
+		o = &tengo.Map{Value: entries}
+	case "immutable-map":
+		entries = make(map[string]tengo.Object, len(pv.Entries))
+		o = &tengo.ImmutableMap{Value: entries}
+	default:
+		return nil, fmt.Errorf("cannot restore type '%s'", pv.Type)
+	}
+	d.refs[pv.Id] = o
+	var err error
+	for i, item := range pv.Items {
+		if items[i], err = d.deserialize(item); err != nil {
+			return nil, err
+		}
+	}
+	for _, k := range sortedNames(pv.Entries) {
+		if entries[k], err = d.deserialize(pv.Entries[k]); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// Returns the global variables defined by the script, excluding functions
+// and the message API.
+func (this *TengoSandbox) scriptGlobals() map[string]int {
+	globals := make(map[string]int)
+	for _, name := range this.symbols.Names() {
+		symbol, _, ok := this.symbols.Resolve(name, false)
+		if !ok || symbol.Scope != tengo.ScopeGlobal || name == returnSymbol {
+			continue
+		}
+		switch this.vars[symbol.Index].(type) {
+		case *tengo.CompiledFunction, *tengo.UserFunction, *tengo.BuiltinFunction:
+			continue
+		}
+		globals[name] = symbol.Index
+	}
+	return globals
+}
+
+// Globals and map entries are written and read back in name order so a
+// shared reference is always defined before it is used.
+func sortedNames(m interface{}) []string {
+	var names []string
+	switch m := m.(type) {
+	case map[string]int:
+		for name := range m {
+			names = append(names, name)
+		}
+	case map[string]*preservedValue:
+		for name := range m {
+			names = append(names, name)
+		}
+	case map[string]tengo.Object:
+		for name := range m {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (this *TengoSandbox) serializeGlobals() ([]byte, error) {
+	data := preservedData{Globals: make(map[string]*preservedValue)}
+	s := &serializer{seen: make(map[tengo.Object]int)}
+	globals := this.scriptGlobals()
+	for _, name := range sortedNames(globals) {
+		o := this.vars[globals[name]]
+		if o == nil {
+			continue
+		}
+		if name == preservationVersion {
+			if v, ok := o.(*tengo.Int); ok {
+				data.Version = &v.Value
+			}
+		}
+		if pv := s.serialize(o); pv != nil {
+			data.Globals[name] = pv
+		}
+	}
+	return json.Marshal(data)
+}
+
+// Writes the preserved data to a temporary file in the same directory and
+// renames it into place so an interrupted shutdown never leaves a truncated
+// data file behind.
+func (this *TengoSandbox) preserveGlobals(dataFile string) error {
+	data, err := this.serializeGlobals()
+	if err != nil {
+		os.Remove(dataFile)
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dataFile), filepath.Base(dataFile))
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dataFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Restores preserved data into the globals of the freshly run script. The
+// whole file is decoded before any global is assigned so a corrupt file
+// leaves the script's state untouched. Globals the script no longer defines
+// are dropped.
+func (this *TengoSandbox) restoreGlobals(dataFile string) error {
+	b, err := ioutil.ReadFile(dataFile)
+	if err != nil {
+		return err
+	}
+	var data preservedData
+	if err = json.Unmarshal(b, &data); err != nil {
+		return fmt.Errorf("%s: %s", dataFile, err)
+	}
+
+	globals := this.scriptGlobals()
+	if idx, ok := globals[preservationVersion]; ok {
+		if v, ok := this.vars[idx].(*tengo.Int); ok &&
+			(data.Version == nil || *data.Version != v.Value) {
+			return nil
+		}
+	}
+
+	d := &deserializer{refs: make(map[int]tengo.Object)}
+	restored := make(map[int]tengo.Object, len(data.Globals))
+	for _, name := range sortedNames(data.Globals) {
+		o, err := d.deserialize(data.Globals[name])
+		if err != nil {
+			return fmt.Errorf("%s: %s", dataFile, err)
+		}
+		if idx, ok := globals[name]; ok {
+			restored[idx] = o
+		}
+	}
+	for idx, o := range restored {
+		this.vars[idx] = o
+	}
+	if !this.checkMemory() {
+		return errMemoryLimit
+	}
+	return nil
+}